@@ -13,9 +13,12 @@ package adminport
 
 import "bytes"
 import "io/ioutil"
+import "net"
 import "net/http"
 import "strings"
 
+import "github.com/couchbase/indexing/secondary/transport"
+
 // httpClient is a concrete type implementing Client interface.
 type httpClient struct {
 	serverAddr string
@@ -23,15 +26,34 @@ type httpClient struct {
 	httpc      *http.Client
 }
 
-// NewHTTPClient returns a new instance of Client over HTTP.
+// NewHTTPClient returns a new instance of Client over HTTP, or HTTPS if
+// TLS is set up for this process.
 func NewHTTPClient(listenAddr, urlPrefix string) Client {
-	if !strings.HasPrefix(listenAddr, "http://") {
-		listenAddr = "http://" + listenAddr
+	listenAddr = strings.TrimPrefix(listenAddr, "http://")
+	listenAddr = strings.TrimPrefix(listenAddr, "https://")
+
+	ctx := transport.GetTLSContext()
+	if ctx == nil {
+		return &httpClient{
+			serverAddr: "http://" + listenAddr,
+			urlPrefix:  urlPrefix,
+			httpc:      http.DefaultClient,
+		}
+	}
+	// dial with TLS context for every new connection, so that reloaded
+	// certificates are picked up.
+	httpc := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialTLS: func(network, addr string) (net.Conn, error) {
+				return ctx.Dial(addr)
+			},
+		},
 	}
 	return &httpClient{
-		serverAddr: listenAddr,
+		serverAddr: "https://" + listenAddr,
 		urlPrefix:  urlPrefix,
-		httpc:      http.DefaultClient,
+		httpc:      httpc,
 	}
 }
 
@@ -37,6 +37,7 @@ import "sync"
 import "time"
 
 import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/couchbase/indexing/secondary/transport"
 import c "github.com/couchbase/indexing/secondary/common"
 
 // httpServer is a concrete type implementing adminport Server
@@ -184,7 +185,7 @@ func (s *httpServer) Start() (err error) {
 		return ErrorServerStarted
 	}
 
-	if s.lis, err = net.Listen("tcp", s.srv.Addr); err != nil {
+	if s.lis, err = transport.Listen(s.srv.Addr); err != nil {
 		logging.Errorf("%v listen failed %v\n", s.logPrefix, err)
 		return err
 	}
@@ -0,0 +1,814 @@
+package bptree
+
+import "os"
+import "sync"
+import "bytes"
+import "errors"
+import "unsafe"
+import "strconv"
+import "strings"
+import "sync/atomic"
+import "path/filepath"
+
+var ErrCompactionAborted = errors.New("bptree: compaction aborted by rollback")
+
+type KeyCompare func([]byte, []byte) int
+
+// SeqNum identifies a commit. Sequence numbers grow monotonically, a
+// rollback is recorded as a new commit.
+type SeqNum uint64
+
+const (
+	defaultNodeSize   = 8192
+	defaultCacheSize  = 64 * 1024 * 1024
+	nodeCacheOverhead = 128
+)
+
+var memoryInUse int64
+
+// MemoryInUse returns the memory held by node caches of all open databases
+func MemoryInUse() int64 {
+	return atomic.LoadInt64(&memoryInUse)
+}
+
+type Config struct {
+	keyCmp     KeyCompare
+	nodeSize   int
+	cacheSize  int64
+	syncCommit bool
+}
+
+func DefaultConfig() Config {
+	var cfg Config
+	cfg.SetKeyComparator(bytes.Compare)
+	cfg.SetNodeSize(defaultNodeSize)
+	cfg.SetCacheSize(defaultCacheSize)
+	cfg.SetSyncCommit(true)
+	return cfg
+}
+
+func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
+	cfg.keyCmp = cmp
+}
+
+// SetNodeSize sets the encoded size beyond which a node is split
+func (cfg *Config) SetNodeSize(sz int) {
+	cfg.nodeSize = sz
+}
+
+// SetCacheSize sets the memory budget of the cache of persisted nodes
+func (cfg *Config) SetCacheSize(sz int64) {
+	cfg.cacheSize = sz
+}
+
+// SetSyncCommit controls whether a commit is fsync'ed before it returns
+func (cfg *Config) SetSyncCommit(v bool) {
+	cfg.syncCommit = v
+}
+
+// DB is a persistent copy-on-write B+tree store holding one or more named
+// KVStores. Updates are applied by a single writer, reads are served from
+// immutable snapshots. Snapshots of all KVStores are committed atomically.
+type DB struct {
+	Config
+	dir string
+
+	liveSize int64
+	diskSize int64
+
+	// Writer state
+	sync.Mutex
+	gen       uint64
+	mutations uint64
+	committed uint64
+	stores    []*KVStore
+	names     map[string]*KVStore
+	closed    bool
+
+	// Compacted files the writer's tree may still read from
+	stale []*dataFile
+
+	// Commit state
+	commitLock sync.Mutex
+	file       *dataFile
+	commits    []*commitHeader
+	seq        SeqNum
+
+	compactLock sync.Mutex
+	cache       *nodeCache
+}
+
+// KVStore is a sorted key value namespace within a DB
+type KVStore struct {
+	db   *DB
+	name string
+	id   int
+	root child
+}
+
+// Snapshot is an immutable view of all KVStores of a DB. It keeps the
+// data files it reads from open until it is closed.
+type Snapshot struct {
+	db     *DB
+	seq    SeqNum
+	meta   []byte
+	roots  []child
+	files  []*dataFile
+	closed int32
+}
+
+type CommitInfo struct {
+	Seq  SeqNum
+	Meta []byte
+}
+
+type Stats struct {
+	DiskSize    int64
+	DataSize    int64
+	CacheSize   int64
+	CacheHits   int64
+	CacheMisses int64
+	NumCommits  int
+}
+
+// Open opens the store kept in directory dir, creating it if needed. The
+// most recent commit becomes the current state.
+func Open(dir string, cfg Config) (*DB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		Config: cfg,
+		dir:    dir,
+		gen:    1,
+		names:  make(map[string]*KVStore),
+		cache:  newNodeCache(cfg.cacheSize),
+	}
+
+	// Leftovers of an interrupted compaction
+	if tmps, _ := filepath.Glob(filepath.Join(dir, dataFilePrefix+"*.tmp")); len(tmps) > 0 {
+		for _, p := range tmps {
+			os.Remove(p)
+		}
+	}
+
+	versions, err := listDataFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		if db.file, err = createDataFile(dataFileName(dir, 0), 0); err != nil {
+			return nil, err
+		}
+	} else {
+		latest := versions[len(versions)-1]
+		if db.file, err = openDataFile(dataFileName(dir, latest), latest); err != nil {
+			return nil, err
+		}
+
+		// A completed compaction may not have removed its source file
+		for _, v := range versions[:len(versions)-1] {
+			os.Remove(dataFileName(dir, v))
+		}
+
+		if err := db.loadCommits(); err != nil {
+			db.file.close()
+			return nil, err
+		}
+	}
+
+	atomic.StoreInt64(&db.diskSize, db.file.end)
+	return db, nil
+}
+
+func (db *DB) loadCommits() error {
+	h, err := db.file.lastCommit()
+	if err != nil || h == nil {
+		return err
+	}
+
+	db.seq = h.seq
+	atomic.StoreInt64(&db.liveSize, h.liveSize)
+	for {
+		db.commits = append(db.commits, h)
+		if h.prev == 0 {
+			break
+		}
+
+		if h, err = db.file.readCommit(h.prev); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OpenKVStore returns the named KVStore. Its contents are taken from the
+// most recent commit.
+func (db *DB) OpenKVStore(name string) *KVStore {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	db.Lock()
+	defer db.Unlock()
+
+	if s, ok := db.names[name]; ok {
+		return s
+	}
+
+	s := &KVStore{db: db, name: name, id: len(db.stores)}
+	if len(db.commits) > 0 {
+		s.root = db.rootFromCommit(db.commits[0], name)
+	}
+	db.stores = append(db.stores, s)
+	db.names[name] = s
+	return s
+}
+
+func (db *DB) rootFromCommit(h *commitHeader, name string) child {
+	for _, r := range h.roots {
+		if r.name == name && r.off != 0 {
+			return child{count: r.count, loc: location{file: h.loc.file, off: r.off}}
+		}
+	}
+	return child{}
+}
+
+// retainFiles returns the data files the writer's tree may refer to,
+// retained on behalf of a snapshot
+func (db *DB) retainFiles() []*dataFile {
+	files := append([]*dataFile{db.file}, db.stale...)
+	for _, f := range files {
+		f.retain()
+	}
+	return files
+}
+
+func (db *DB) releaseFiles(files []*dataFile) error {
+	var rerr error
+	for _, f := range files {
+		closed, err := f.release()
+		if closed {
+			db.cache.evictFile(f)
+		}
+		if err != nil && rerr == nil {
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+// resetRoots serves the writer's tree from a commit in the current file,
+// compacted files are no longer read by the writer from then on.
+func (db *DB) resetRoots(h *commitHeader) {
+	for _, s := range db.stores {
+		s.root = db.rootFromCommit(h, s.name)
+	}
+	db.committed = db.mutations
+	db.releaseFiles(db.stale)
+	db.stale = nil
+}
+
+func (db *DB) snapshot() *Snapshot {
+	snap := &Snapshot{db: db, roots: make([]child, len(db.stores)), files: db.retainFiles()}
+	for i, s := range db.stores {
+		snap.roots[i] = s.root
+	}
+	// Nodes reachable from the snapshot are now immutable
+	db.gen++
+	return snap
+}
+
+// NewSnapshot returns an in-memory snapshot of the current state
+func (db *DB) NewSnapshot() *Snapshot {
+	db.Lock()
+	defer db.Unlock()
+	return db.snapshot()
+}
+
+// Commit makes the current state durable along with meta and returns a
+// snapshot of what was committed.
+func (db *DB) Commit(meta []byte) (*Snapshot, error) {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+
+	db.Lock()
+	if db.closed {
+		db.Unlock()
+		return nil, ErrClosed
+	}
+	snap := db.snapshot()
+	mutations := db.mutations
+	names := make([]string, len(db.stores))
+	for i, s := range db.stores {
+		names[i] = s.name
+	}
+	db.Unlock()
+
+	p := &persister{db: db, f: db.file, start: db.file.end}
+	h := &commitHeader{seq: db.seq + 1, meta: meta}
+	if len(db.commits) > 0 {
+		h.prev = db.commits[0].loc.off
+	}
+
+	for i := range snap.roots {
+		off, err := p.persist(&snap.roots[i])
+		if err != nil {
+			p.abort()
+			snap.Close()
+			return nil, err
+		}
+		h.roots = append(h.roots, rootRef{name: names[i], off: off, count: snap.roots[i].count})
+	}
+
+	h.liveSize = atomic.LoadInt64(&db.liveSize) + p.written
+	if err := db.writeCommit(h); err != nil {
+		p.abort()
+		snap.Close()
+		return nil, err
+	}
+
+	atomic.AddInt64(&db.liveSize, p.written)
+	snap.seq, snap.meta = h.seq, meta
+
+	// Unless the writer moved on, the in-memory tree can be released and
+	// served from the data file from now on
+	db.Lock()
+	if db.mutations == mutations {
+		db.resetRoots(h)
+	}
+	db.Unlock()
+
+	return snap, nil
+}
+
+func (db *DB) writeCommit(h *commitHeader) error {
+	f := db.file
+	h.loc = f.append(encodeCommit(h))
+	f.appendTrailer(h.loc.off)
+
+	var err error
+	if db.syncCommit {
+		err = f.sync()
+	} else {
+		err = f.flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	db.seq = h.seq
+	db.commits = append([]*commitHeader{h}, db.commits...)
+	atomic.StoreInt64(&db.diskSize, f.end)
+	return nil
+}
+
+func (db *DB) findCommit(seq SeqNum) (int, *commitHeader) {
+	for i, h := range db.commits {
+		if h.seq == seq {
+			return i, h
+		}
+	}
+	return -1, nil
+}
+
+// Commits lists the commits which can be opened or rolled back to, most
+// recent first. Commits recorded by Rollback are not listed, they carry
+// the state of the commit that was rolled back to.
+func (db *DB) Commits() []CommitInfo {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+
+	var infos []CommitInfo
+	for _, h := range db.commits {
+		if !h.rollback {
+			infos = append(infos, CommitInfo{Seq: h.seq, Meta: h.meta})
+		}
+	}
+	return infos
+}
+
+// OpenSnapshot returns a snapshot of the given commit. The snapshot must
+// be closed once it is no longer used.
+func (db *DB) OpenSnapshot(seq SeqNum) (*Snapshot, error) {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+
+	_, h := db.findCommit(seq)
+	if h == nil {
+		return nil, ErrNoCommit
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	snap := &Snapshot{
+		db:    db,
+		seq:   seq,
+		meta:  h.meta,
+		roots: make([]child, len(db.stores)),
+		files: db.retainFiles(),
+	}
+	for i, s := range db.stores {
+		snap.roots[i] = db.rootFromCommit(h, s.name)
+	}
+	return snap, nil
+}
+
+// Rollback discards all changes made after the given commit. The rollback
+// is recorded as a new commit, commits after seq can no longer be opened.
+// Rolling back to zero discards all data.
+func (db *DB) Rollback(seq SeqNum) error {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+
+	h := &commitHeader{seq: db.seq + 1, rollback: true}
+	var chain []*commitHeader
+	if seq != 0 {
+		i, target := db.findCommit(seq)
+		if target == nil {
+			return ErrNoCommit
+		}
+		h.prev = target.loc.off
+		h.roots = target.roots
+		h.meta = target.meta
+		h.liveSize = target.liveSize
+		chain = db.commits[i:]
+	}
+
+	commits := db.commits
+	db.commits = chain
+	if err := db.writeCommit(h); err != nil {
+		db.commits = commits
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+	for _, s := range db.stores {
+		s.root = db.rootFromCommit(h, s.name)
+	}
+	db.gen++
+	db.mutations++
+	db.committed = db.mutations
+	db.releaseFiles(db.stale)
+	db.stale = nil
+	atomic.StoreInt64(&db.liveSize, h.liveSize)
+	return nil
+}
+
+func (db *DB) Stats() Stats {
+	db.commitLock.Lock()
+	ncommits := len(db.commits)
+	db.commitLock.Unlock()
+
+	return Stats{
+		DiskSize:    atomic.LoadInt64(&db.diskSize),
+		DataSize:    atomic.LoadInt64(&db.liveSize),
+		CacheSize:   atomic.LoadInt64(&db.cache.used),
+		CacheHits:   atomic.LoadInt64(&db.cache.hits),
+		CacheMisses: atomic.LoadInt64(&db.cache.misses),
+		NumCommits:  ncommits,
+	}
+}
+
+// Close releases the database. Changes made since the last commit are
+// lost. Data files stay open until the snapshots still reading from them
+// are closed.
+func (db *DB) Close() error {
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	db.stores = nil
+	db.cache.reset()
+	err := db.releaseFiles(append(db.stale, db.file))
+	db.stale = nil
+	return err
+}
+
+// load returns the node a child refers to
+func (db *DB) load(c *child) (*node, error) {
+	if n := c.node(); n != nil {
+		return n, nil
+	}
+	return db.read(c.loc)
+}
+
+func (db *DB) read(loc location) (*node, error) {
+	k := cacheKey{file: loc.file, off: loc.off}
+	if n := db.cache.get(k); n != nil {
+		return n, nil
+	}
+
+	payload, err := loc.file.readRecord(loc.off)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := decodeNode(payload, loc.file)
+	if err != nil {
+		return nil, err
+	}
+
+	n.setLocation(location{file: loc.file, off: loc.off, size: recHdrSize + len(payload)})
+	db.cache.put(k, n, len(payload)+nodeCacheOverhead)
+	return n, nil
+}
+
+// mutable returns a node owned by the writer in place of the child,
+// cloning it if it is shared with a snapshot.
+func (db *DB) mutable(c *child) (*node, error) {
+	n, err := db.load(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.gen == db.gen {
+		return n, nil
+	}
+
+	if loc := n.location(); loc != nil {
+		atomic.AddInt64(&db.liveSize, -int64(loc.size))
+	}
+
+	nn := n.clone(db.gen)
+	c.loc = location{}
+	atomic.StorePointer(&c.ptr, unsafe.Pointer(nn))
+	return nn, nil
+}
+
+// persister writes out the nodes of a snapshot which are not yet part of
+// the current data file
+type persister struct {
+	db      *DB
+	f       *dataFile
+	start   int64
+	written int64
+	nodes   []*node
+	oldLocs []unsafe.Pointer
+}
+
+func (p *persister) persist(c *child) (int64, error) {
+	if n := c.node(); n != nil {
+		return p.persistNode(n)
+	}
+
+	if !c.persisted() {
+		return 0, nil
+	}
+	return p.relocate(c.loc)
+}
+
+func (p *persister) resolve(loc location) (int64, bool) {
+	if loc.file == p.f {
+		return loc.off, true
+	}
+
+	if nloc, ok := loc.resolve(); ok && nloc.file == p.f {
+		return nloc.off, true
+	}
+	return 0, false
+}
+
+// relocate returns the offset of a persisted node in the current file,
+// copying it over if compaction did not carry it forward.
+func (p *persister) relocate(loc location) (int64, error) {
+	if off, ok := p.resolve(loc); ok {
+		return off, nil
+	}
+
+	n, err := p.db.read(loc)
+	if err != nil {
+		return 0, err
+	}
+	return p.write(n)
+}
+
+func (p *persister) persistNode(n *node) (int64, error) {
+	if loc := n.location(); loc != nil {
+		if off, ok := p.resolve(*loc); ok {
+			return off, nil
+		}
+	}
+	return p.write(n)
+}
+
+func (p *persister) write(n *node) (int64, error) {
+	var offs []int64
+	if !n.leaf {
+		offs = make([]int64, len(n.kids))
+		for i := range n.kids {
+			off, err := p.persist(&n.kids[i])
+			if err != nil {
+				return 0, err
+			}
+			offs[i] = off
+		}
+	}
+
+	loc := p.f.append(n.encode(func(i int) int64 { return offs[i] }))
+	p.nodes = append(p.nodes, n)
+	p.oldLocs = append(p.oldLocs, atomic.LoadPointer(&n.loc))
+	n.setLocation(loc)
+	p.written += int64(loc.size)
+
+	if err := p.f.maybeFlush(); err != nil {
+		return 0, err
+	}
+	return loc.off, nil
+}
+
+// abort forgets about a failed commit
+func (p *persister) abort() {
+	for i, n := range p.nodes {
+		atomic.StorePointer(&n.loc, p.oldLocs[i])
+	}
+	p.f.discard()
+	if p.f.end > p.start {
+		p.f.truncate(p.start)
+	}
+}
+
+// Compact rewrites the data file keeping only commits from minSeq onwards
+// along with the most recent one. Commits may proceed concurrently.
+func (db *DB) Compact(minSeq SeqNum) error {
+	db.compactLock.Lock()
+	defer db.compactLock.Unlock()
+
+	db.commitLock.Lock()
+	if db.closed {
+		db.commitLock.Unlock()
+		return ErrClosed
+	}
+	src := db.file
+	var keep []*commitHeader
+	for i, h := range db.commits {
+		if i == 0 || h.seq >= minSeq {
+			keep = append(keep, h)
+		}
+	}
+	db.commitLock.Unlock()
+
+	version := src.version + 1
+	tmpPath := dataFileName(db.dir, version) + ".tmp"
+	dst, err := createDataFile(tmpPath, version)
+	if err != nil {
+		return err
+	}
+
+	c := &compactor{
+		src:   src,
+		dst:   dst,
+		remap: make(map[int64]location),
+		sizes: make(map[int64]int64),
+	}
+
+	cleanup := func(err error) error {
+		dst.close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	for i := len(keep) - 1; i >= 0; i-- {
+		if err := c.copyCommit(keep[i]); err != nil {
+			return cleanup(err)
+		}
+	}
+
+	if err := dst.flush(); err != nil {
+		return cleanup(err)
+	}
+
+	db.commitLock.Lock()
+	defer db.commitLock.Unlock()
+
+	// Catch up with commits made while copying
+	pos, _ := db.findCommit(keep[0].seq)
+	if pos < 0 || db.commits[pos] != keep[0] || db.closed {
+		return cleanup(ErrCompactionAborted)
+	}
+
+	for i := pos - 1; i >= 0; i-- {
+		if err := c.copyCommit(db.commits[i]); err != nil {
+			return cleanup(err)
+		}
+	}
+
+	if err := dst.sync(); err != nil {
+		return cleanup(err)
+	}
+
+	path := dataFileName(db.dir, version)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return cleanup(err)
+	}
+	dst.path = path
+
+	db.commits = c.commits
+	os.Remove(src.path)
+	db.cache.evictFile(src)
+
+	// The writer keeps reading from the old file until its tree is served
+	// from a commit in the new one
+	db.Lock()
+	src.remap = c.remap
+	src.next = dst
+	db.file = dst
+	db.stale = append(db.stale, src)
+	if db.mutations == db.committed {
+		db.resetRoots(c.commits[0])
+	}
+	db.Unlock()
+
+	atomic.StoreInt64(&db.liveSize, c.commits[0].liveSize)
+	atomic.StoreInt64(&db.diskSize, dst.end)
+	return nil
+}
+
+type compactor struct {
+	src, dst *dataFile
+	remap    map[int64]location
+	sizes    map[int64]int64
+	commits  []*commitHeader
+}
+
+func (c *compactor) copyCommit(h *commitHeader) error {
+	nh := &commitHeader{seq: h.seq, rollback: h.rollback, meta: h.meta}
+	if len(c.commits) > 0 {
+		nh.prev = c.commits[0].loc.off
+	}
+
+	for _, r := range h.roots {
+		nr := rootRef{name: r.name, count: r.count}
+		if r.off != 0 {
+			off, sz, err := c.copyTree(r.off)
+			if err != nil {
+				return err
+			}
+			nr.off = off
+			nh.liveSize += sz
+		}
+		nh.roots = append(nh.roots, nr)
+	}
+
+	nh.loc = c.dst.append(encodeCommit(nh))
+	c.dst.appendTrailer(nh.loc.off)
+	c.commits = append([]*commitHeader{nh}, c.commits...)
+	return c.dst.maybeFlush()
+}
+
+// copyTree copies a subtree and returns its new offset and total size
+func (c *compactor) copyTree(off int64) (int64, int64, error) {
+	if loc, ok := c.remap[off]; ok {
+		return loc.off, c.sizes[off], nil
+	}
+
+	payload, err := c.src.readRecord(off)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var loc location
+	var total int64
+	switch payload[0] {
+	case recLeaf:
+		loc = c.dst.append(payload)
+	case recInterior:
+		n, err := decodeNode(payload, c.src)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		offs := make([]int64, len(n.kids))
+		for i := range n.kids {
+			noff, sz, err := c.copyTree(n.kids[i].loc.off)
+			if err != nil {
+				return 0, 0, err
+			}
+			offs[i] = noff
+			total += sz
+		}
+		loc = c.dst.append(n.encode(func(i int) int64 { return offs[i] }))
+	default:
+		return 0, 0, ErrCorrupted
+	}
+
+	total += int64(loc.size)
+	c.remap[off] = loc
+	c.sizes[off] = total
+	return loc.off, total, c.dst.maybeFlush()
+}
+
+func isDataFile(name string) bool {
+	if !strings.HasPrefix(name, dataFilePrefix) {
+		return false
+	}
+	_, err := strconv.Atoi(strings.TrimPrefix(name, dataFilePrefix))
+	return err == nil
+}
@@ -0,0 +1,352 @@
+package bptree
+
+import "fmt"
+import "os"
+import "testing"
+import "sync/atomic"
+import "math/rand"
+import "path/filepath"
+
+var testDir = filepath.Join(os.TempDir(), "bptree_test")
+
+func newTestDB(t *testing.T) *DB {
+	os.RemoveAll(testDir)
+	cfg := DefaultConfig()
+	cfg.SetNodeSize(512)
+	cfg.SetCacheSize(64 * 1024)
+	cfg.SetSyncCommit(false)
+	db, err := Open(testDir, cfg)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return db
+}
+
+func reopen(t *testing.T, db *DB) *DB {
+	cfg := db.Config
+	db.Close()
+	db, err := Open(testDir, cfg)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	return db
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("%010d", i))
+}
+
+func verify(t *testing.T, snap *Snapshot, kvs *KVStore, expected map[int]bool) {
+	if c := snap.Count(kvs); c != int64(len(expected)) {
+		t.Errorf("Expected count %d, got %d", len(expected), c)
+	}
+
+	var prev []byte
+	n := 0
+	itr := snap.NewIterator(kvs)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		var i int
+		fmt.Sscanf(string(itr.Key()), "%d", &i)
+		if !expected[i] {
+			t.Fatalf("Unexpected key %s", itr.Key())
+		}
+		if string(itr.Value()) != fmt.Sprint(i) {
+			t.Fatalf("Unexpected value %s for %s", itr.Value(), itr.Key())
+		}
+		if prev != nil && string(prev) >= string(itr.Key()) {
+			t.Fatalf("Keys out of order %s, %s", prev, itr.Key())
+		}
+		prev = itr.Key()
+		n++
+	}
+
+	if err := itr.Err(); err != nil {
+		t.Fatalf("Iteration failed: %v", err)
+	}
+
+	if n != len(expected) {
+		t.Errorf("Expected %d items, got %d", len(expected), n)
+	}
+}
+
+func TestInsertDelete(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	kvs := db.OpenKVStore("main")
+	expected := make(map[int]bool)
+	for _, i := range rand.Perm(10000) {
+		kvs.Put(key(i), []byte(fmt.Sprint(i)))
+		expected[i] = true
+	}
+
+	snap := db.NewSnapshot()
+	snapExpected := make(map[int]bool)
+	for i := range expected {
+		snapExpected[i] = true
+	}
+
+	for i := 0; i < 10000; i += 3 {
+		if ok, _ := kvs.Delete(key(i)); !ok {
+			t.Errorf("Expected %d to be deleted", i)
+		}
+		delete(expected, i)
+	}
+
+	if ok, _ := kvs.Delete(key(20000)); ok {
+		t.Errorf("Unexpected delete of missing key")
+	}
+
+	verify(t, snap, kvs, snapExpected)
+	verify(t, db.NewSnapshot(), kvs, expected)
+
+	itr := db.NewSnapshot().NewIterator(kvs)
+	itr.Seek(key(3001))
+	if !itr.Valid() || string(itr.Key()) != string(key(3001)) {
+		t.Errorf("Seek to an existing key failed")
+	}
+	itr.Seek(key(3003))
+	if !itr.Valid() || string(itr.Key()) != string(key(3004)) {
+		t.Errorf("Seek to a deleted key failed")
+	}
+}
+
+func TestCommitRecovery(t *testing.T) {
+	db := newTestDB(t)
+
+	main := db.OpenKVStore("main")
+	back := db.OpenKVStore("back")
+	expected := make(map[int]bool)
+	var seqs []SeqNum
+	for c := 0; c < 5; c++ {
+		for i := c * 1000; i < (c+1)*1000; i++ {
+			main.Put(key(i), []byte(fmt.Sprint(i)))
+			back.Put(key(i), []byte(fmt.Sprint(i)))
+			expected[i] = true
+		}
+
+		snap, err := db.Commit([]byte(fmt.Sprint(c)))
+		if err != nil {
+			t.Fatalf("Commit failed: %v", err)
+		}
+		seqs = append(seqs, snap.Seq())
+	}
+
+	// Uncommitted changes are lost
+	main.Put(key(99999), []byte("x"))
+
+	db = reopen(t, db)
+	defer db.Close()
+	main = db.OpenKVStore("main")
+	back = db.OpenKVStore("back")
+
+	commits := db.Commits()
+	if len(commits) != 5 || string(commits[0].Meta) != "4" {
+		t.Fatalf("Unexpected commits %v", commits)
+	}
+
+	snap := db.NewSnapshot()
+	verify(t, snap, main, expected)
+	verify(t, snap, back, expected)
+
+	old, err := db.OpenSnapshot(seqs[1])
+	if err != nil {
+		t.Fatalf("OpenSnapshot failed: %v", err)
+	}
+	if old.Count(main) != 2000 || string(old.Meta()) != "1" {
+		t.Errorf("Unexpected snapshot of commit %d", seqs[1])
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	db := newTestDB(t)
+	kvs := db.OpenKVStore("main")
+	expected := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		kvs.Put(key(i), []byte(fmt.Sprint(i)))
+		expected[i] = true
+	}
+	db.Commit(nil)
+
+	for i := 1000; i < 2000; i++ {
+		kvs.Put(key(i), []byte(fmt.Sprint(i)))
+	}
+	db.Commit(nil)
+	path := db.file.path
+	size := db.file.end
+	db.Close()
+
+	// Cut the last commit header in half
+	os.Truncate(path, size-trailerSize-10)
+
+	db, err := Open(testDir, db.Config)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer db.Close()
+
+	kvs = db.OpenKVStore("main")
+	verify(t, db.NewSnapshot(), kvs, expected)
+}
+
+func TestRollback(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	kvs := db.OpenKVStore("main")
+	expected := make(map[int]bool)
+	var target SeqNum
+	var targetExpected map[int]bool
+	for c := 0; c < 4; c++ {
+		for i := 0; i < 500; i++ {
+			k := rand.Intn(2000)
+			if expected[k] {
+				kvs.Delete(key(k))
+				delete(expected, k)
+			} else {
+				kvs.Put(key(k), []byte(fmt.Sprint(k)))
+				expected[k] = true
+			}
+		}
+
+		snap, _ := db.Commit(nil)
+		if c == 1 {
+			target = snap.Seq()
+			targetExpected = make(map[int]bool)
+			for k := range expected {
+				targetExpected[k] = true
+			}
+		}
+	}
+
+	if err := db.Rollback(target); err != nil {
+		t.Fatalf("Rollback failed: %v", err)
+	}
+
+	verify(t, db.NewSnapshot(), kvs, targetExpected)
+	if commits := db.Commits(); commits[0].Seq != target {
+		t.Errorf("Expected latest commit %d, got %d", target, commits[0].Seq)
+	}
+	if _, err := db.OpenSnapshot(target + 1); err != ErrNoCommit {
+		t.Errorf("Expected commits after rollback point to be discarded")
+	}
+
+	db = reopen(t, db)
+	defer db.Close()
+	kvs = db.OpenKVStore("main")
+	verify(t, db.NewSnapshot(), kvs, targetExpected)
+
+	if err := db.Rollback(0); err != nil {
+		t.Fatalf("Rollback to zero failed: %v", err)
+	}
+	verify(t, db.NewSnapshot(), kvs, nil)
+	if len(db.Commits()) != 0 {
+		t.Errorf("Expected no commits after rollback to zero")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	db := newTestDB(t)
+
+	kvs := db.OpenKVStore("main")
+	expected := make(map[int]bool)
+	var seqs []SeqNum
+	for c := 0; c < 10; c++ {
+		for i := 0; i < 1000; i++ {
+			k := rand.Intn(5000)
+			kvs.Put(key(k), []byte(fmt.Sprint(k)))
+			expected[k] = true
+		}
+		snap, _ := db.Commit(nil)
+		seqs = append(seqs, snap.Seq())
+		snap.Close()
+	}
+
+	before := db.Stats()
+	src := db.file
+	snap := db.NewSnapshot()
+	if err := db.Compact(seqs[8]); err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+	after := db.Stats()
+
+	if after.DiskSize >= before.DiskSize {
+		t.Errorf("Expected compaction to reclaim space (%d => %d)",
+			before.DiskSize, after.DiskSize)
+	}
+
+	if after.NumCommits != 2 {
+		t.Errorf("Expected 2 commits after compaction, got %d", after.NumCommits)
+	}
+
+	// Snapshots taken before compaction remain readable
+	verify(t, snap, kvs, expected)
+
+	// The old file is closed along with the last snapshot reading from it
+	if n := atomic.LoadInt32(&src.refs); n != 1 {
+		t.Errorf("Expected compacted file to be held by the snapshot only, refs %d", n)
+	}
+	snap.Close()
+	if _, err := src.fd.Stat(); err == nil {
+		t.Errorf("Expected compacted file to be closed")
+	}
+
+	// Commits after compaction refer to relocated nodes
+	for i := 5000; i < 5100; i++ {
+		kvs.Put(key(i), []byte(fmt.Sprint(i)))
+		expected[i] = true
+	}
+	db.Commit(nil)
+
+	db = reopen(t, db)
+	defer db.Close()
+	kvs = db.OpenKVStore("main")
+	verify(t, db.NewSnapshot(), kvs, expected)
+
+	if _, err := db.OpenSnapshot(seqs[7]); err != ErrNoCommit {
+		t.Errorf("Expected commit %d to be compacted away", seqs[7])
+	}
+	if _, err := db.OpenSnapshot(seqs[8]); err != nil {
+		t.Errorf("Expected commit %d to be retained", seqs[8])
+	}
+}
+
+func TestConcurrentCompaction(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	kvs := db.OpenKVStore("main")
+	for i := 0; i < 20000; i++ {
+		kvs.Put(key(i), []byte(fmt.Sprint(i)))
+	}
+	db.Commit(nil)
+
+	done := make(chan error)
+	go func() {
+		done <- db.Compact(0)
+	}()
+
+	expected := make(map[int]bool)
+	for i := 0; i < 20000; i++ {
+		expected[i] = true
+	}
+
+	for c := 0; c < 20; c++ {
+		for i := 0; i < 100; i++ {
+			k := 20000 + c*100 + i
+			kvs.Put(key(k), []byte(fmt.Sprint(k)))
+			expected[k] = true
+		}
+		snap, _ := db.Commit(nil)
+		verify(t, snap, kvs, expected)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("Compaction failed: %v", err)
+	}
+
+	db = reopen(t, db)
+	defer db.Close()
+	kvs = db.OpenKVStore("main")
+	verify(t, db.NewSnapshot(), kvs, expected)
+}
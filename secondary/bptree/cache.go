@@ -0,0 +1,125 @@
+package bptree
+
+import "sync"
+import "sync/atomic"
+import "container/list"
+
+const cacheShards = 64
+
+type cacheKey struct {
+	file *dataFile
+	off  int64
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	n    *node
+	size int64
+}
+
+type cacheShard struct {
+	sync.Mutex
+	lru   *list.List
+	items map[cacheKey]*list.Element
+	size  int64
+}
+
+// nodeCache keeps recently read nodes in memory within a byte budget.
+// Nodes which have not been persisted yet are pinned by the tree itself
+// and never go through the cache.
+type nodeCache struct {
+	used   int64
+	hits   int64
+	misses int64
+
+	limit  int64
+	shards [cacheShards]cacheShard
+}
+
+func newNodeCache(limit int64) *nodeCache {
+	c := &nodeCache{limit: limit}
+	for i := range c.shards {
+		c.shards[i].lru = list.New()
+		c.shards[i].items = make(map[cacheKey]*list.Element)
+	}
+	return c
+}
+
+func (c *nodeCache) shard(k cacheKey) *cacheShard {
+	h := uint64(k.off) * 0x9E3779B97F4A7C15
+	return &c.shards[h>>58]
+}
+
+func (c *nodeCache) get(k cacheKey) *node {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	if e, ok := s.items[k]; ok {
+		s.lru.MoveToFront(e)
+		atomic.AddInt64(&c.hits, 1)
+		return e.Value.(*cacheEntry).n
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return nil
+}
+
+func (c *nodeCache) put(k cacheKey, n *node, size int) {
+	s := c.shard(k)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.items[k]; ok {
+		return
+	}
+
+	s.items[k] = s.lru.PushFront(&cacheEntry{key: k, n: n, size: int64(size)})
+	s.size += int64(size)
+	atomic.AddInt64(&c.used, int64(size))
+	atomic.AddInt64(&memoryInUse, int64(size))
+
+	limit := c.limit / cacheShards
+	for s.size > limit && s.lru.Len() > 1 {
+		e := s.lru.Back()
+		ce := e.Value.(*cacheEntry)
+		s.lru.Remove(e)
+		delete(s.items, ce.key)
+		s.size -= ce.size
+		atomic.AddInt64(&c.used, -ce.size)
+		atomic.AddInt64(&memoryInUse, -ce.size)
+	}
+}
+
+// evictFile drops all nodes of a data file that is no longer in use
+func (c *nodeCache) evictFile(f *dataFile) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		for e := s.lru.Front(); e != nil; {
+			next := e.Next()
+			ce := e.Value.(*cacheEntry)
+			if ce.key.file == f {
+				s.lru.Remove(e)
+				delete(s.items, ce.key)
+				s.size -= ce.size
+				atomic.AddInt64(&c.used, -ce.size)
+				atomic.AddInt64(&memoryInUse, -ce.size)
+			}
+			e = next
+		}
+		s.Unlock()
+	}
+}
+
+func (c *nodeCache) reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.lru.Init()
+		s.items = make(map[cacheKey]*list.Element)
+		atomic.AddInt64(&c.used, -s.size)
+		atomic.AddInt64(&memoryInUse, -s.size)
+		s.size = 0
+		s.Unlock()
+	}
+}
@@ -0,0 +1,474 @@
+package bptree
+
+import "os"
+import "fmt"
+import "strconv"
+import "errors"
+import "strings"
+import "sync/atomic"
+import "path/filepath"
+import "hash/crc32"
+import "encoding/binary"
+import "github.com/couchbase/indexing/secondary/natsort"
+
+// On-disk layout
+//
+// A data file is an append-only sequence of records that starts with an
+// 8 byte magic. Every record is framed as
+//
+//   [length uint32][crc32 uint32][payload]
+//
+// and the payload's first byte identifies it as a leaf node, an interior
+// node or a commit header. A commit header is always followed by a 16 byte
+// trailer [header offset uint64][magic uint64] so that the latest commit
+// can be located from the end of the file without scanning it.
+
+const (
+	fileMagic      = uint64(0x4250545245453031) // "BPTREE01"
+	recHdrSize     = 8
+	trailerSize    = 16
+	dataFilePrefix = "data.bpt."
+	writeBufSize   = 1024 * 1024
+)
+
+const (
+	recLeaf     = byte(1)
+	recInterior = byte(2)
+	recCommit   = byte(3)
+)
+
+// Commit header flags
+const (
+	commitRollback = byte(1)
+)
+
+var (
+	ErrCorrupted   = errors.New("bptree: corrupted data file")
+	ErrNotFound    = errors.New("bptree: key not found")
+	ErrNoCommit    = errors.New("bptree: commit not found")
+	ErrClosed      = errors.New("bptree: database is closed")
+	ErrUnknownName = errors.New("bptree: unknown kvstore")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// dataFile is a single version of the append-only file. Older versions are
+// kept open until the writer and all snapshots referring to them have
+// released them, they forward lookups to the next version through remap
+// after a compaction.
+type dataFile struct {
+	// Offset up to which records are readable
+	wbufOff int64
+	refs    int32
+
+	fd      *os.File
+	path    string
+	version int
+	end     int64
+	wbuf    []byte
+
+	// Set once the file has been compacted into next
+	next  *dataFile
+	remap map[int64]location
+}
+
+// location identifies a persisted record
+type location struct {
+	file *dataFile
+	off  int64
+	size int
+}
+
+func dataFileName(dir string, version int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%d", dataFilePrefix, version))
+}
+
+// listDataFiles returns the data file versions found in dir, oldest first
+func listDataFiles(dir string) ([]int, error) {
+	pattern := filepath.Join(dir, dataFilePrefix+"*")
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	natsort.Strings(paths)
+	var versions []int
+	for _, p := range paths {
+		name := filepath.Base(p)
+		if isDataFile(name) {
+			v, _ := strconv.Atoi(strings.TrimPrefix(name, dataFilePrefix))
+			versions = append(versions, v)
+		}
+	}
+	return versions, nil
+}
+
+func createDataFile(path string, version int) (*dataFile, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newDataFile(fd, path, version)
+	var magic [8]byte
+	binary.BigEndian.PutUint64(magic[:], fileMagic)
+	if _, err := fd.WriteAt(magic[:], 0); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	f.end = 8
+	f.wbufOff = 8
+	return f, nil
+}
+
+func openDataFile(path string, version int) (*dataFile, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	var magic [8]byte
+	if _, err := fd.ReadAt(magic[:], 0); err != nil ||
+		binary.BigEndian.Uint64(magic[:]) != fileMagic {
+		fd.Close()
+		return nil, ErrCorrupted
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	f := newDataFile(fd, path, version)
+	f.end = fi.Size()
+	f.wbufOff = f.end
+	return f, nil
+}
+
+func newDataFile(fd *os.File, path string, version int) *dataFile {
+	return &dataFile{fd: fd, path: path, version: version, refs: 1}
+}
+
+func (f *dataFile) close() error {
+	return f.fd.Close()
+}
+
+func (f *dataFile) retain() {
+	atomic.AddInt32(&f.refs, 1)
+}
+
+// release drops a reference and closes the file along with the last one
+func (f *dataFile) release() (bool, error) {
+	if atomic.AddInt32(&f.refs, -1) == 0 {
+		return true, f.fd.Close()
+	}
+	return false, nil
+}
+
+// append buffers a framed record and returns its location
+func (f *dataFile) append(payload []byte) location {
+	var hdr [recHdrSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:8], crc32.Checksum(payload, crcTable))
+
+	off := f.end
+	f.wbuf = append(f.wbuf, hdr[:]...)
+	f.wbuf = append(f.wbuf, payload...)
+	f.end += int64(recHdrSize + len(payload))
+	return location{file: f, off: off, size: recHdrSize + len(payload)}
+}
+
+func (f *dataFile) appendTrailer(hdrOff int64) {
+	var tr [trailerSize]byte
+	binary.BigEndian.PutUint64(tr[0:8], uint64(hdrOff))
+	binary.BigEndian.PutUint64(tr[8:16], fileMagic)
+	f.wbuf = append(f.wbuf, tr[:]...)
+	f.end += trailerSize
+}
+
+// maybeFlush writes out the append buffer once it grows large
+func (f *dataFile) maybeFlush() error {
+	if len(f.wbuf) < writeBufSize {
+		return nil
+	}
+	return f.flush()
+}
+
+func (f *dataFile) flush() error {
+	if len(f.wbuf) == 0 {
+		return nil
+	}
+
+	off := atomic.LoadInt64(&f.wbufOff)
+	if _, err := f.fd.WriteAt(f.wbuf, off); err != nil {
+		return err
+	}
+	atomic.StoreInt64(&f.wbufOff, off+int64(len(f.wbuf)))
+	f.wbuf = f.wbuf[:0]
+	return nil
+}
+
+func (f *dataFile) sync() error {
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.fd.Sync()
+}
+
+// discard drops buffered records that were not written out
+func (f *dataFile) discard() {
+	f.end = atomic.LoadInt64(&f.wbufOff)
+	f.wbuf = f.wbuf[:0]
+}
+
+// readRecord returns the verified payload of the record at off
+func (f *dataFile) readRecord(off int64) ([]byte, error) {
+	var hdr [recHdrSize]byte
+	if _, err := f.fd.ReadAt(hdr[:], off); err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(hdr[0:4])
+	if off+recHdrSize+int64(l) > atomic.LoadInt64(&f.wbufOff) {
+		return nil, ErrCorrupted
+	}
+
+	payload := make([]byte, l)
+	if _, err := f.fd.ReadAt(payload, off+recHdrSize); err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, ErrCorrupted
+	}
+	return payload, nil
+}
+
+// lastCommit locates the most recent commit header. The trailer is tried
+// first, if the tail of the file is torn the file is scanned forward and
+// truncated right after the last complete commit.
+func (f *dataFile) lastCommit() (*commitHeader, error) {
+	if f.end >= 8+recHdrSize+trailerSize {
+		var tr [trailerSize]byte
+		if _, err := f.fd.ReadAt(tr[:], f.end-trailerSize); err == nil &&
+			binary.BigEndian.Uint64(tr[8:16]) == fileMagic {
+			off := int64(binary.BigEndian.Uint64(tr[0:8]))
+			if off >= 8 && off < f.end {
+				if h, err := f.readCommit(off); err == nil &&
+					h.loc.off+int64(h.loc.size)+trailerSize == f.end {
+					return h, nil
+				}
+			}
+		}
+	}
+
+	return f.scanCommits()
+}
+
+func (f *dataFile) scanCommits() (*commitHeader, error) {
+	var last *commitHeader
+	var hdr [recHdrSize]byte
+
+	off := int64(8)
+	for off+recHdrSize <= f.end {
+		if _, err := f.fd.ReadAt(hdr[:], off); err != nil {
+			break
+		}
+
+		l := int64(binary.BigEndian.Uint32(hdr[0:4]))
+		if off+recHdrSize+l > f.end || l == 0 {
+			break
+		}
+
+		payload, err := f.readRecord(off)
+		if err != nil {
+			break
+		}
+
+		next := off + recHdrSize + l
+		if payload[0] == recCommit {
+			if next+trailerSize > f.end {
+				break
+			}
+			h, err := decodeCommit(payload)
+			if err != nil {
+				break
+			}
+			h.loc = location{file: f, off: off, size: int(recHdrSize + l)}
+			last = h
+			next += trailerSize
+		}
+		off = next
+	}
+
+	if last == nil {
+		if f.end > 8 {
+			if err := f.truncate(8); err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	}
+
+	end := last.loc.off + int64(last.loc.size) + trailerSize
+	if end != f.end {
+		if err := f.truncate(end); err != nil {
+			return nil, err
+		}
+	}
+	return last, nil
+}
+
+func (f *dataFile) truncate(sz int64) error {
+	if err := f.fd.Truncate(sz); err != nil {
+		return err
+	}
+	f.end = sz
+	atomic.StoreInt64(&f.wbufOff, sz)
+	return nil
+}
+
+func (f *dataFile) readCommit(off int64) (*commitHeader, error) {
+	payload, err := f.readRecord(off)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := decodeCommit(payload)
+	if err != nil {
+		return nil, err
+	}
+	h.loc = location{file: f, off: off, size: recHdrSize + len(payload)}
+	return h, nil
+}
+
+// resolve follows the compaction chain until the location of a record in
+// the current file is found
+func (loc location) resolve() (location, bool) {
+	for loc.file.next != nil {
+		nloc, ok := loc.file.remap[loc.off]
+		if !ok {
+			return loc, false
+		}
+		loc = nloc
+	}
+	return loc, true
+}
+
+// commitHeader describes one commit point
+type commitHeader struct {
+	seq      SeqNum
+	rollback bool
+	prev     int64
+	liveSize int64
+	roots    []rootRef
+	meta     []byte
+
+	loc location
+}
+
+type rootRef struct {
+	name  string
+	off   int64
+	count int64
+}
+
+func encodeCommit(h *commitHeader) []byte {
+	buf := make([]byte, 0, 64+len(h.meta))
+	buf = append(buf, recCommit)
+	flags := byte(0)
+	if h.rollback {
+		flags |= commitRollback
+	}
+	buf = append(buf, flags)
+	buf = appendUvarint(buf, uint64(h.seq))
+	buf = appendUvarint(buf, uint64(h.prev))
+	buf = appendUvarint(buf, uint64(h.liveSize))
+	buf = appendUvarint(buf, uint64(len(h.roots)))
+	for _, r := range h.roots {
+		buf = appendBytes(buf, []byte(r.name))
+		buf = appendUvarint(buf, uint64(r.off))
+		buf = appendUvarint(buf, uint64(r.count))
+	}
+	buf = appendBytes(buf, h.meta)
+	return buf
+}
+
+func decodeCommit(payload []byte) (*commitHeader, error) {
+	if len(payload) == 0 || payload[0] != recCommit {
+		return nil, ErrCorrupted
+	}
+
+	if len(payload) < 2 {
+		return nil, ErrCorrupted
+	}
+
+	d := decoder{buf: payload[2:]}
+	h := &commitHeader{
+		rollback: payload[1]&commitRollback != 0,
+		seq:      SeqNum(d.uvarint()),
+		prev:     int64(d.uvarint()),
+		liveSize: int64(d.uvarint()),
+	}
+
+	n := int(d.uvarint())
+	for i := 0; i < n && d.err == nil; i++ {
+		var r rootRef
+		r.name = string(d.bytes())
+		r.off = int64(d.uvarint())
+		r.count = int64(d.uvarint())
+		h.roots = append(h.roots, r)
+	}
+
+	if meta := d.bytes(); len(meta) > 0 {
+		h.meta = append([]byte(nil), meta...)
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return h, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendBytes(buf []byte, bs []byte) []byte {
+	buf = appendUvarint(buf, uint64(len(bs)))
+	return append(buf, bs...)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorrupted
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	l := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if uint64(len(d.buf)) < l {
+		d.err = ErrCorrupted
+		return nil
+	}
+	bs := d.buf[:l:l]
+	d.buf = d.buf[l:]
+	return bs
+}
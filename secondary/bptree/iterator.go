@@ -0,0 +1,157 @@
+package bptree
+
+import "sync/atomic"
+
+type iterFrame struct {
+	n *node
+	i int
+}
+
+// Iterator walks the keys of a KVStore snapshot in order
+type Iterator struct {
+	db    *DB
+	root  child
+	stack []iterFrame
+	err   error
+}
+
+func (s *Snapshot) root(kvs *KVStore) *child {
+	if kvs.id < len(s.roots) {
+		return &s.roots[kvs.id]
+	}
+	return &child{}
+}
+
+// Seq returns the commit of the snapshot, it is zero for in-memory
+// snapshots
+func (s *Snapshot) Seq() SeqNum {
+	return s.seq
+}
+
+func (s *Snapshot) Meta() []byte {
+	return s.meta
+}
+
+// Count returns the number of keys of a KVStore in the snapshot
+func (s *Snapshot) Count(kvs *KVStore) int64 {
+	return s.root(kvs).count
+}
+
+func (s *Snapshot) Get(kvs *KVStore, key []byte) ([]byte, error) {
+	return s.db.lookup(s.root(kvs), key)
+}
+
+// Close releases the data files held by the snapshot. Neither the snapshot
+// nor its iterators may be used afterwards.
+func (s *Snapshot) Close() error {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return nil
+	}
+	return s.db.releaseFiles(s.files)
+}
+
+func (s *Snapshot) NewIterator(kvs *KVStore) *Iterator {
+	return &Iterator{
+		db:    s.db,
+		root:  *s.root(kvs),
+		stack: make([]iterFrame, 0, 8),
+	}
+}
+
+func (it *Iterator) SeekFirst() {
+	it.Seek(nil)
+}
+
+// Seek positions the iterator at the first key >= key
+func (it *Iterator) Seek(key []byte) {
+	it.stack = it.stack[:0]
+	it.err = nil
+	if it.root.node() == nil && !it.root.persisted() {
+		return
+	}
+
+	c := &it.root
+	for {
+		n, err := it.db.load(c)
+		if err != nil {
+			it.fail(err)
+			return
+		}
+
+		if n.leaf {
+			i := 0
+			if key != nil {
+				i, _ = n.findItem(key, it.db.keyCmp)
+			}
+			it.stack = append(it.stack, iterFrame{n: n, i: i})
+			break
+		}
+
+		i := 0
+		if key != nil {
+			i = n.findChild(key, it.db.keyCmp)
+		}
+		it.stack = append(it.stack, iterFrame{n: n, i: i})
+		c = &n.kids[i]
+	}
+
+	it.settle()
+}
+
+// settle moves forward until the top of the stack is a valid leaf item
+func (it *Iterator) settle() {
+	for len(it.stack) > 0 {
+		top := &it.stack[len(it.stack)-1]
+		if top.n.leaf {
+			if top.i < len(top.n.items) {
+				return
+			}
+		} else if top.i < len(top.n.kids) {
+			n, err := it.db.load(&top.n.kids[top.i])
+			if err != nil {
+				it.fail(err)
+				return
+			}
+			it.stack = append(it.stack, iterFrame{n: n})
+			continue
+		}
+
+		it.stack = it.stack[:len(it.stack)-1]
+		if len(it.stack) > 0 {
+			it.stack[len(it.stack)-1].i++
+		}
+	}
+}
+
+func (it *Iterator) fail(err error) {
+	it.err = err
+	it.stack = it.stack[:0]
+}
+
+func (it *Iterator) Valid() bool {
+	return len(it.stack) > 0
+}
+
+func (it *Iterator) Next() {
+	it.stack[len(it.stack)-1].i++
+	it.settle()
+}
+
+func (it *Iterator) Key() []byte {
+	top := &it.stack[len(it.stack)-1]
+	return top.n.items[top.i].key
+}
+
+func (it *Iterator) Value() []byte {
+	top := &it.stack[len(it.stack)-1]
+	return top.n.items[top.i].val
+}
+
+// Err returns the error which terminated the iteration, if any
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) Close() {
+	it.stack = nil
+}
@@ -0,0 +1,248 @@
+package bptree
+
+import "unsafe"
+import "sync/atomic"
+
+func (s *KVStore) Name() string {
+	return s.name
+}
+
+// Put inserts or replaces a key
+func (s *KVStore) Put(key, val []byte) error {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	itm := item{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+	}
+
+	inserted, err := db.insert(&s.root, itm)
+	if err != nil {
+		return err
+	}
+
+	if inserted {
+		s.root.count++
+	}
+
+	if rn := s.root.node(); rn.entries() > 1 && rn.size > db.nodeSize {
+		right := rn.split(db.gen)
+		root := newInterior(db.gen)
+		root.kids = []child{
+			{key: rn.firstKey(), count: rn.count(), ptr: unsafe.Pointer(rn)},
+			{key: right.firstKey(), count: right.count(), ptr: unsafe.Pointer(right)},
+		}
+		root.size += childSize(&root.kids[0]) + childSize(&root.kids[1])
+		s.root = child{count: s.root.count, ptr: unsafe.Pointer(root)}
+	}
+
+	db.mutations++
+	return nil
+}
+
+// Get looks up a key in the current state
+func (s *KVStore) Get(key []byte) ([]byte, error) {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return db.lookup(&s.root, key)
+}
+
+// Delete removes a key, it returns false if the key did not exist
+func (s *KVStore) Delete(key []byte) (bool, error) {
+	db := s.db
+	db.Lock()
+	defer db.Unlock()
+
+	if db.closed {
+		return false, ErrClosed
+	}
+
+	// Avoid copying the path down to a missing key
+	if _, err := db.lookup(&s.root, key); err == ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	removed, err := db.remove(&s.root, key)
+	if err != nil || !removed {
+		return removed, err
+	}
+
+	s.root.count--
+	if rn := s.root.node(); rn.entries() == 0 {
+		s.root = child{}
+	} else if !rn.leaf && len(rn.kids) == 1 {
+		s.root = rn.kids[0]
+	}
+
+	db.mutations++
+	return true, nil
+}
+
+// Count returns the number of keys in the current state
+func (s *KVStore) Count() int64 {
+	s.db.Lock()
+	defer s.db.Unlock()
+	return s.root.count
+}
+
+func (db *DB) lookup(c *child, key []byte) ([]byte, error) {
+	if c.node() == nil && !c.persisted() {
+		return nil, ErrNotFound
+	}
+
+	for {
+		n, err := db.load(c)
+		if err != nil {
+			return nil, err
+		}
+
+		if n.leaf {
+			if i, found := n.findItem(key, db.keyCmp); found {
+				return n.items[i].val, nil
+			}
+			return nil, ErrNotFound
+		}
+		c = &n.kids[n.findChild(key, db.keyCmp)]
+	}
+}
+
+func (db *DB) insert(c *child, itm item) (bool, error) {
+	if c.node() == nil && !c.persisted() {
+		n := newLeaf(db.gen)
+		n.items = []item{itm}
+		n.size += itemSize(itm)
+		atomic.StorePointer(&c.ptr, unsafe.Pointer(n))
+		return true, nil
+	}
+
+	n, err := db.mutable(c)
+	if err != nil {
+		return false, err
+	}
+
+	if n.leaf {
+		i, found := n.findItem(itm.key, db.keyCmp)
+		if found {
+			n.size += len(itm.val) - len(n.items[i].val)
+			n.items[i].val = itm.val
+			return false, nil
+		}
+
+		n.items = append(n.items, item{})
+		copy(n.items[i+1:], n.items[i:])
+		n.items[i] = itm
+		n.size += itemSize(itm)
+		return true, nil
+	}
+
+	i := n.findChild(itm.key, db.keyCmp)
+	kc := &n.kids[i]
+	inserted, err := db.insert(kc, itm)
+	if err != nil {
+		return false, err
+	}
+
+	if inserted {
+		kc.count++
+	}
+
+	if kn := kc.node(); kn.entries() > 1 && kn.size > db.nodeSize {
+		right := kn.split(db.gen)
+		rc := child{key: right.firstKey(), count: right.count(), ptr: unsafe.Pointer(right)}
+		kc.count -= rc.count
+
+		n.kids = append(n.kids, child{})
+		copy(n.kids[i+2:], n.kids[i+1:])
+		n.kids[i+1] = rc
+		n.size += childSize(&rc)
+	}
+
+	return inserted, nil
+}
+
+func (db *DB) remove(c *child, key []byte) (bool, error) {
+	n, err := db.mutable(c)
+	if err != nil {
+		return false, err
+	}
+
+	if n.leaf {
+		i, found := n.findItem(key, db.keyCmp)
+		if !found {
+			return false, nil
+		}
+
+		n.size -= itemSize(n.items[i])
+		n.items = append(n.items[:i], n.items[i+1:]...)
+		return true, nil
+	}
+
+	i := n.findChild(key, db.keyCmp)
+	kc := &n.kids[i]
+	removed, err := db.remove(kc, key)
+	if err != nil || !removed {
+		return removed, err
+	}
+
+	kc.count--
+	kn := kc.node()
+	if kn.entries() == 0 {
+		n.removeKid(i)
+	} else if kn.size < db.nodeSize/4 && len(n.kids) > 1 {
+		l := i
+		if l == len(n.kids)-1 {
+			l--
+		}
+		err = db.mergeKids(n, l)
+	}
+
+	return true, err
+}
+
+// mergeKids merges child l+1 into child l if the result fits in a node
+func (db *DB) mergeKids(n *node, l int) error {
+	rn, err := db.load(&n.kids[l+1])
+	if err != nil {
+		return err
+	}
+
+	ln, err := db.load(&n.kids[l])
+	if err != nil {
+		return err
+	}
+
+	if ln.size+rn.size > db.nodeSize {
+		return nil
+	}
+
+	if ln, err = db.mutable(&n.kids[l]); err != nil {
+		return err
+	}
+
+	if loc := rn.location(); loc != nil && rn.gen != db.gen {
+		atomic.AddInt64(&db.liveSize, -int64(loc.size))
+	}
+
+	ln.merge(rn)
+	n.kids[l].count += n.kids[l+1].count
+	n.removeKid(l + 1)
+	return nil
+}
+
+func (n *node) removeKid(i int) {
+	n.size -= childSize(&n.kids[i])
+	n.kids = append(n.kids[:i], n.kids[i+1:]...)
+}
@@ -0,0 +1,241 @@
+package bptree
+
+import "sort"
+import "sync/atomic"
+import "unsafe"
+
+const (
+	itemOverhead  = 4
+	childOverhead = 16
+)
+
+type item struct {
+	key []byte
+	val []byte
+}
+
+// child is a reference from an interior node (or a kvstore root) to a
+// subtree. A persisted child carries its location, a child which has not
+// been written out yet is only reachable through ptr.
+type child struct {
+	key   []byte
+	count int64
+	loc   location
+	ptr   unsafe.Pointer
+}
+
+func (c *child) node() *node {
+	return (*node)(atomic.LoadPointer(&c.ptr))
+}
+
+func (c *child) persisted() bool {
+	return c.loc.file != nil
+}
+
+// node is either a leaf holding items or an interior node holding children.
+// Nodes are never modified once they become visible to a snapshot, the
+// writer owns nodes of its current generation and clones the others.
+type node struct {
+	gen   uint64
+	leaf  bool
+	items []item
+	kids  []child
+	size  int
+
+	// Location once written to a data file
+	loc unsafe.Pointer
+}
+
+func newLeaf(gen uint64) *node {
+	return &node{gen: gen, leaf: true, size: 1}
+}
+
+func newInterior(gen uint64) *node {
+	return &node{gen: gen, size: 1}
+}
+
+func (n *node) location() *location {
+	return (*location)(atomic.LoadPointer(&n.loc))
+}
+
+func (n *node) setLocation(loc location) {
+	atomic.StorePointer(&n.loc, unsafe.Pointer(&loc))
+}
+
+func (n *node) count() int64 {
+	if n.leaf {
+		return int64(len(n.items))
+	}
+
+	var c int64
+	for i := range n.kids {
+		c += n.kids[i].count
+	}
+	return c
+}
+
+func (n *node) clone(gen uint64) *node {
+	nn := &node{gen: gen, leaf: n.leaf, size: n.size}
+	if n.leaf {
+		nn.items = make([]item, len(n.items), len(n.items)+1)
+		copy(nn.items, n.items)
+	} else {
+		nn.kids = make([]child, len(n.kids), len(n.kids)+1)
+		for i := range n.kids {
+			c := &n.kids[i]
+			nn.kids[i] = child{
+				key:   c.key,
+				count: c.count,
+				loc:   c.loc,
+				ptr:   atomic.LoadPointer(&c.ptr),
+			}
+		}
+	}
+	return nn
+}
+
+func (n *node) firstKey() []byte {
+	if n.leaf {
+		if len(n.items) == 0 {
+			return nil
+		}
+		return n.items[0].key
+	}
+	return n.kids[0].key
+}
+
+// findItem returns the position of the first item >= key
+func (n *node) findItem(key []byte, cmp KeyCompare) (int, bool) {
+	i := sort.Search(len(n.items), func(i int) bool {
+		return cmp(n.items[i].key, key) >= 0
+	})
+	return i, i < len(n.items) && cmp(n.items[i].key, key) == 0
+}
+
+// findChild returns the child whose key range covers key
+func (n *node) findChild(key []byte, cmp KeyCompare) int {
+	i := sort.Search(len(n.kids), func(i int) bool {
+		return cmp(n.kids[i].key, key) > 0
+	})
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+// split moves the upper half (by size) of n into a new node. The node
+// must have at least two entries.
+func (n *node) split(gen uint64) *node {
+	right := &node{gen: gen, leaf: n.leaf, size: 1}
+	half := n.size / 2
+	if n.leaf {
+		i, sz := 1, 1+itemSize(n.items[0])
+		for ; i < len(n.items)-1 && sz < half; i++ {
+			sz += itemSize(n.items[i])
+		}
+		right.items = append(right.items, n.items[i:]...)
+		n.items = n.items[:i:i]
+		for _, itm := range right.items {
+			right.size += itemSize(itm)
+		}
+	} else {
+		i, sz := 1, 1+childSize(&n.kids[0])
+		for ; i < len(n.kids)-1 && sz < half; i++ {
+			sz += childSize(&n.kids[i])
+		}
+		right.kids = append(right.kids, n.kids[i:]...)
+		n.kids = n.kids[:i:i]
+		for j := range right.kids {
+			right.size += childSize(&right.kids[j])
+		}
+	}
+	n.size -= right.size - 1
+	return right
+}
+
+func (n *node) entries() int {
+	if n.leaf {
+		return len(n.items)
+	}
+	return len(n.kids)
+}
+
+// merge appends all entries of r to n
+func (n *node) merge(r *node) {
+	if n.leaf {
+		n.items = append(n.items, r.items...)
+	} else {
+		n.kids = append(n.kids, r.kids...)
+	}
+	n.size += r.size - 1
+}
+
+func itemSize(itm item) int {
+	return len(itm.key) + len(itm.val) + itemOverhead
+}
+
+func childSize(c *child) int {
+	return len(c.key) + childOverhead
+}
+
+// encode serializes a node. Children are referred to by the offsets
+// returned by locate.
+func (n *node) encode(locate func(i int) int64) []byte {
+	buf := make([]byte, 0, n.size+16)
+	if n.leaf {
+		buf = append(buf, recLeaf)
+		buf = appendUvarint(buf, uint64(len(n.items)))
+		for _, itm := range n.items {
+			buf = appendBytes(buf, itm.key)
+			buf = appendBytes(buf, itm.val)
+		}
+	} else {
+		buf = append(buf, recInterior)
+		buf = appendUvarint(buf, uint64(len(n.kids)))
+		for i := range n.kids {
+			buf = appendBytes(buf, n.kids[i].key)
+			buf = appendUvarint(buf, uint64(n.kids[i].count))
+			buf = appendUvarint(buf, uint64(locate(i)))
+		}
+	}
+	return buf
+}
+
+// decodeNode rebuilds a node read from file f. Keys and values refer to
+// the payload buffer.
+func decodeNode(payload []byte, f *dataFile) (*node, error) {
+	if len(payload) == 0 {
+		return nil, ErrCorrupted
+	}
+
+	d := decoder{buf: payload[1:]}
+	n := &node{size: 1}
+	switch payload[0] {
+	case recLeaf:
+		n.leaf = true
+		cnt := int(d.uvarint())
+		n.items = make([]item, 0, cnt)
+		for i := 0; i < cnt && d.err == nil; i++ {
+			itm := item{key: d.bytes(), val: d.bytes()}
+			n.items = append(n.items, itm)
+			n.size += itemSize(itm)
+		}
+	case recInterior:
+		cnt := int(d.uvarint())
+		n.kids = make([]child, 0, cnt)
+		for i := 0; i < cnt && d.err == nil; i++ {
+			c := child{key: d.bytes()}
+			c.count = int64(d.uvarint())
+			c.loc = location{file: f, off: int64(d.uvarint())}
+			n.kids = append(n.kids, c)
+			n.size += childSize(&c)
+		}
+	default:
+		return nil, ErrCorrupted
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return n, nil
+}
@@ -85,6 +85,13 @@ func main() {
 	config.SetValue("indexer.diagnostics_dir", *diagDir)
 	config.SetValue("indexer.nodeuuid", *nodeuuid)
 
+	// TLS parameters come from indexing settings in metakv, shared with
+	// the other nodes and GSI clients.
+	if err := common.InitTLS(config); err != nil {
+		logging.Fatalf("Failed to set up TLS: %v", err)
+		common.CrashOnError(err)
+	}
+
 	// Prior to watson (4.5 version) storage_dir parameter was converted
 	// to lower case. Post watson, the plan is to keep the parameter
 	// case-sensitive. Following is the logic:
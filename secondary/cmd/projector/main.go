@@ -96,6 +96,13 @@ func main() {
 		}
 	}
 
+	// TLS parameters come from indexing settings in metakv, shared with
+	// the other nodes and GSI clients.
+	if err := c.InitTLS(config); err != nil {
+		logging.Fatalf("Failed to set up TLS: %v", err)
+		c.CrashOnError(err)
+	}
+
 	epfactory := NewEndpointFactory(cluster, options.numVbuckets)
 	config.SetValue("projector.routerEndpointFactory", epfactory)
 
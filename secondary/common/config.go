@@ -79,6 +79,54 @@ var SystemConfig = Config{
 		true,  // immutable
 		false, // case-insensitive
 	},
+	// security parameters, TLS for dataport, queryport and adminport
+	"security.tls.enabled": ConfigValue{
+		false,
+		"secure dataport, queryport and adminport connections with TLS, " +
+			"read from indexing settings in metakv by indexer, projector " +
+			"and GSI client, takes effect on restart.",
+		false,
+		true,  // immutable
+		false, // case-insensitive
+	},
+	"security.tls.certFile": ConfigValue{
+		"",
+		"PEM encoded certificate chain presented by this node to peers.",
+		"",
+		true, // immutable
+		true, // case-sensitive
+	},
+	"security.tls.keyFile": ConfigValue{
+		"",
+		"PEM encoded private key for security.tls.certFile.",
+		"",
+		true, // immutable
+		true, // case-sensitive
+	},
+	"security.tls.caFile": ConfigValue{
+		"",
+		"PEM encoded CA bundle to verify peer certificates, " +
+			"empty string verifies with system roots.",
+		"",
+		true, // immutable
+		true, // case-sensitive
+	},
+	"security.tls.clientAuth": ConfigValue{
+		false,
+		"mutual TLS, servers require and verify client certificates and " +
+			"clients present security.tls.certFile.",
+		false,
+		true,  // immutable
+		false, // case-insensitive
+	},
+	"security.tls.reloadInterval": ConfigValue{
+		10 * 1000,
+		"interval, in milliseconds, to check certificate, key and CA " +
+			"files for changes and reload them.",
+		10 * 1000, // 10s
+		true,      // immutable
+		false,     // case-insensitive
+	},
 	// projector parameters
 	"projector.name": ConfigValue{
 		"projector",
@@ -149,6 +197,14 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.evaluateIndex.sampleSize": ConfigValue{
+		1000,
+		"Maximum number of documents evaluated for an evaluate index " +
+			"request, larger sets of documents and docids are sampled",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"projector.feedChanSize": ConfigValue{
 		100,
 		"channel size for feed's control path, " +
@@ -262,6 +318,15 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"projector.dcp.includeXATTRs": ConfigValue{
+		false,
+		"negotiate extended attributes and JSON datatype with KV, so " +
+			"that meta().xattrs can be used in index expressions, " +
+			"changing this value does not affect existing feeds.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
 	// projector adminport parameters
 	"projector.adminport.name": ConfigValue{
 		"projector.adminport",
@@ -366,6 +431,57 @@ var SystemConfig = Config{
 		false,         // mutable
 		false,         // case-insensitive
 	},
+	"projector.dataport.compression": ConfigValue{
+		"none",
+		"compression offered to downstream when connecting, " +
+			"`auto` compresses only when the network is the bottleneck, " +
+			"`gzip` always compresses, `none` disables compression, " +
+			"does not affect existing feeds.",
+		"none",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dataport.adaptiveBatching": ConfigValue{
+		false,
+		"adapt bufferSize and bufferTimeout, up to maxBufferSize and " +
+			"maxBufferTimeout, to round trip time and throughput observed " +
+			"with downstream.",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dataport.maxBufferSize": ConfigValue{
+		1000,
+		"upper limit for bufferSize when batching is adaptive.",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dataport.maxBufferTimeout": ConfigValue{
+		200,
+		"upper limit, in milliseconds, for bufferTimeout when batching " +
+			"is adaptive.",
+		200,   // 200ms
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dataport.adaptTick": ConfigValue{
+		1000,
+		"tick, in milliseconds, to measure round trip time with " +
+			"downstream and adapt batching and compression.",
+		1000,  // 1s
+		false, // mutable
+		false, // case-insensitive
+	},
+	"projector.dataport.handshakeTimeout": ConfigValue{
+		5 * 1000,
+		"timeout, in milliseconds, to wait for downstream's reply to " +
+			"handshake, downstream that does not reply is treated as " +
+			"legacy, does not affect existing feeds.",
+		5 * 1000, // 5s
+		false,    // mutable
+		false,    // case-insensitive
+	},
 	"projector.gogc": ConfigValue{
 		100, // 100 percent
 		"set GOGC percent",
@@ -433,6 +549,22 @@ var SystemConfig = Config{
 		false,      // mutable
 		false,      // case-insensitive
 	},
+	"indexer.dataport.compressions": ConfigValue{
+		"gzip",
+		"comma separated list of compressions accepted from routers, " +
+			"empty string disables compression",
+		"gzip",
+		true,  // immutable
+		false, // case-insensitive
+	},
+	"indexer.dataport.recordDir": ConfigValue{
+		"",
+		"directory to record messages received by dataport server, " +
+			"for replaying them later, empty string disables recording",
+		"",
+		true,  // immutable
+		false, // case-insensitive
+	},
 	// indexer queryport configuration
 	"indexer.queryport.maxPayload": ConfigValue{
 		64 * 1024,
@@ -823,6 +955,16 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+
+	//bptree specific config
+	"indexer.storage.bptree.commitPollInterval": ConfigValue{
+		uint64(10),
+		"Time in milliseconds for a slice to poll for " +
+			"any outstanding writes before commit",
+		uint64(10),
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.moi.useMemMgmt": ConfigValue{
 		true,
 		"Use jemalloc based manual memory management",
@@ -837,6 +979,53 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.moi.tiering.enabled": ConfigValue{
+		false,
+		"Evict cold key ranges of memory optimized indexes to disk " +
+			"when they do not fit in the memory quota",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.moi.tiering.memoryFrac": ConfigValue{
+		0.7,
+		"Fraction of memory quota available to memory optimized " +
+			"indexes before cold items are evicted to disk",
+		0.7,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.moi.tiering.pageCacheSize": ConfigValue{
+		uint64(16 * 1024 * 1024),
+		"Size in bytes of the per index cache of evicted pages",
+		uint64(16 * 1024 * 1024),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.moi.tiering.maxEvictPerRound": ConfigValue{
+		uint64(128 * 1024 * 1024),
+		"Maximum bytes evicted or restored per index snapshot",
+		uint64(128 * 1024 * 1024),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.moi.bulkLoad.enabled": ConfigValue{
+		true,
+		"Build memory optimized indexes in INIT_STREAM by sorting " +
+			"buffered mutations instead of inserting them one by one",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.moi.bulkLoad.maxBufferSize": ConfigValue{
+		uint64(1024 * 1024 * 1024),
+		"Maximum memory in bytes used to buffer mutations of an initial " +
+			"build per index. Index is built from mutations buffered so far " +
+			"when the limit is reached",
+		uint64(1024 * 1024 * 1024),
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.useMutationSyncPool": ConfigValue{
 		false,
 		"Use sync pool for mutations",
@@ -863,6 +1052,22 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.mutation_queue.overflow.enabled": ConfigValue{
+		false,
+		"spill mutations to disk instead of blocking the stream " +
+			"if mutation queue is full.",
+		false,
+		true,  // immutable
+		false, // case-insensitive
+	},
+	"indexer.mutation_queue.overflow.segmentSize": ConfigValue{
+		uint64(64 * 1024 * 1024),
+		"size of segment files used for spilling mutations " +
+			"of a vbucket.",
+		uint64(64 * 1024 * 1024),
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.memstatTick": ConfigValue{
 		60, // in second
 		"in second, periodically log runtime memory-stats.",
@@ -1037,6 +1242,75 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.recovery.partial_rollback": ConfigValue{
+		true,
+		"Rollback only the vbuckets past the rollback timestamp when no " +
+			"older disk snapshot is available, instead of rolling back to zero",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.recovery.detect_bucket_flush": ConfigValue{
+		true,
+		"Detect bucket flush from failover logs when all vbuckets are " +
+			"rolled back to zero, and truncate indexes of the bucket instead " +
+			"of rolling back each vbucket",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.recovery.retention.mode": ConfigValue{
+		"count",
+		"Disk snapshot retention policy - count, age or hourly",
+		"count",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.recovery.retention.max_age": ConfigValue{
+		86400,
+		"Age in seconds upto which disk snapshots are kept for age retention policy",
+		86400,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.recovery.retention.hours": ConfigValue{
+		24,
+		"Number of hours for which one disk snapshot per hour is kept for hourly retention policy",
+		24,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.flush.priority": ConfigValue{
+		"",
+		"Flush priority classes as comma separated <bucket>=<class> or " +
+			"<bucket>:<index>=<class> entries. Class is high, normal or low.",
+		"",
+		false, // mutable
+		true,  // case-sensitive
+	},
+	"indexer.settings.flush.weights": ConfigValue{
+		"4,2,1",
+		"Flush scheduling weights of high, normal and low priority classes",
+		"4,2,1",
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.flush.slots": ConfigValue{
+		0,
+		"Number of flusher workers which can flush concurrently when flush " +
+			"priorities are configured, 0 for number of cpus",
+		0,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.flush.maxDeferral": ConfigValue{
+		uint64(1000),
+		"Maximum time in milliseconds a stability timestamp of a bucket is " +
+			"held back for flushes of higher priority buckets",
+		uint64(1000),
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.memory_quota": ConfigValue{
 		uint64(256 * 1024 * 1024),
 		"Maximum memory used by the indexer buffercache",
@@ -1074,6 +1348,23 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.allow_large_keys": ConfigValue{
+		true,
+		"Index secondary keys larger than the key size limits of memdb " +
+			"indexes by storing them out of line, forestdb indexes " +
+			"skip such keys",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.max_large_seckey_size": ConfigValue{
+		61440,
+		"Max size of secondary keys of memdb indexes when allow_large_keys " +
+			"is set, encoded keys are limited to 64KB by scans in any case",
+		61440,
+		false, // mutable
+		false, // case-insensitive
+	},
 
 	"indexer.settings.send_buffer_size": ConfigValue{
 		1024,
@@ -1193,6 +1484,37 @@ var SystemConfig = Config{
 		false, // case-insensitive
 	},
 
+	"indexer.settings.inmemory_snapshot.adaptive.enable": ConfigValue{
+		false,
+		"Adapt InMemory snapshotting interval to mutation rate and scans " +
+			"waiting for snapshots",
+		false,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.inmemory_snapshot.adaptive.min_interval": ConfigValue{
+		uint64(10),
+		"Minimum adaptive InMemory snapshotting interval in milliseconds",
+		uint64(10),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.inmemory_snapshot.adaptive.max_interval": ConfigValue{
+		uint64(1000),
+		"Maximum adaptive InMemory snapshotting interval in milliseconds",
+		uint64(1000),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.inmemory_snapshot.adaptive.low_mutation_rate": ConfigValue{
+		100.0,
+		"Mutations per second below which the adaptive InMemory " +
+			"snapshotting interval is increased",
+		100.0,
+		false, // mutable
+		false, // case-insensitive
+	},
+
 	//fdb specific settings
 	"indexer.settings.persisted_snapshot.fdb.interval": ConfigValue{
 		uint64(5000),
@@ -1239,6 +1561,64 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.flush_trace.sample_rate": ConfigValue{
+		uint64(0),
+		"Trace one in sample_rate mutations through the flush pipeline, " +
+			"0 disables tracing",
+		uint64(0),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.flush_trace.max_traces": ConfigValue{
+		1000,
+		"Number of most recent mutation traces retained",
+		1000,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.doc_errors.max_errors": ConfigValue{
+		100,
+		"Number of most recent documents, which failed to be indexed, " +
+			"retained per index",
+		100,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.doc_errors.max_key_size": ConfigValue{
+		256,
+		"Secondary key of a document which failed to be indexed is " +
+			"truncated to max_key_size bytes",
+		256,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.immutable.fast_path": ConfigValue{
+		false,
+		"Maintain immutable MOI indexes without docid back index. " +
+			"Deletes are not applied and entries are purged after " +
+			"indexer.settings.immutable.ttl, indexes created while " +
+			"the ttl is 0 are maintained with back index",
+		false,
+		true,  // immutable
+		false, // case-insensitive
+	},
+	"indexer.settings.immutable.ttl": ConfigValue{
+		uint64(0),
+		"Time in seconds after which entries of immutable indexes on " +
+			"the fast path are purged, required by the fast path. " +
+			"Setting it to 0 keeps the ttl of existing indexes",
+		uint64(0),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.immutable.update_filter_size": ConfigValue{
+		uint64(1024 * 1024),
+		"Size in bytes of the filter per index used to flag updates of " +
+			"documents in immutable indexes on the fast path, 0 disables it",
+		uint64(1024 * 1024),
+		true,  // immutable
+		false, // case-insensitive
+	},
 	"indexer.settings.moi.persistence_threads": ConfigValue{
 		runtime.NumCPU() * 2,
 		"Number of concurrent threads scanning index for persistence",
@@ -1253,9 +1633,30 @@ var SystemConfig = Config{
 		false, // mutable
 		false, // case-insensitive
 	},
+	"indexer.settings.bptree.node_size": ConfigValue{
+		8192,
+		"Size in bytes beyond which a bptree node is split",
+		8192,
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.bptree.cache_size": ConfigValue{
+		uint64(64 * 1024 * 1024),
+		"Per index cache size in bytes for bptree nodes read from disk",
+		uint64(64 * 1024 * 1024),
+		false, // mutable
+		false, // case-insensitive
+	},
+	"indexer.settings.bptree.sync_commit": ConfigValue{
+		true,
+		"Fsync bptree data files on every persisted snapshot",
+		true,
+		false, // mutable
+		false, // case-insensitive
+	},
 	"indexer.settings.storage_mode": ConfigValue{
 		"",
-		"Storage Type e.g. forestdb, memory_optimized",
+		"Storage Type e.g. forestdb, memory_optimized, bptree",
 		"",
 		false, // mutable
 		false, // case-insensitive
@@ -22,5 +22,22 @@ type Evaluator interface {
 
 	// TransformRoute will transform document consumable by
 	// downstream, returns data to be published to endpoints.
-	TransformRoute(vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, encodeBuf []byte) error
+	// `ctx` is shared by all evaluators transforming the mutation,
+	// it can be nil.
+	TransformRoute(vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, encodeBuf []byte, ctx EvalContext) error
+
+	// GetStatistics returns statistics gathered by the evaluator.
+	GetStatistics() map[string]interface{}
+
+	// Close releases resources shared with other evaluators, called
+	// once the evaluator is removed from its feed.
+	Close()
+}
+
+// EvalContext is shared by evaluators transforming the same mutation,
+// to parse the document once and reuse results of expressions common
+// to several evaluators.
+type EvalContext interface {
+	// Reset the context for mutation `m`.
+	Reset(m *mc.DcpEvent)
 }
@@ -336,11 +336,12 @@ const (
 	ForestDB        = "forestdb"
 	MemDB           = "memdb"
 	MemoryOptimized = "memory_optimized"
+	BPTree          = "bptree"
 )
 
 func IsValidIndexType(t string) bool {
 	switch strings.ToLower(t) {
-	case ForestDB, MemDB, MemoryOptimized:
+	case ForestDB, MemDB, MemoryOptimized, BPTree:
 		return true
 	}
 
@@ -29,6 +29,7 @@ const (
 	StreamBegin                    // control command
 	StreamEnd                      // control command
 	Snapshot                       // control command
+	EvalError                      // data command
 )
 
 // Payload either carries `vbmap` or `vbs`.
@@ -256,6 +257,12 @@ func (kv *KeyVersions) AddUpsertDeletion(uuid uint64, oldkey []byte) {
 	kv.addKey(uuid, UpsertDeletion, nil, oldkey)
 }
 
+// AddEvalError add a keyversion command to report that index expressions
+// could not be evaluated for the document, `errmsg` is sent as key.
+func (kv *KeyVersions) AddEvalError(uuid uint64, errmsg []byte) {
+	kv.addKey(uuid, EvalError, errmsg, nil)
+}
+
 // AddSync add Sync command for vbucket heartbeat.
 func (kv *KeyVersions) AddSync() {
 	kv.addKey(0, Sync, nil, nil)
@@ -0,0 +1,52 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package common
+
+import (
+	"time"
+
+	"github.com/couchbase/indexing/secondary/transport"
+)
+
+// InitTLS sets up TLS for dataport, queryport and adminport connections
+// of this process. `security.tls.` parameters are read from indexing
+// settings in metakv, which is the one source shared by indexer, projector
+// and GSI client, so that all of them agree on it. Parameters are immutable
+// and changes take effect when the process restarts.
+func InitTLS(config Config) error {
+	settings, err := GetSettingsConfig(config)
+	if err != nil {
+		return err
+	}
+	return SetupTLS(settings)
+}
+
+// SetupTLS from `security.tls.` parameters in config. It is a no-op if TLS
+// is disabled or has already been set up.
+func SetupTLS(config Config) error {
+	if !config["security.tls.enabled"].Bool() {
+		return nil
+	} else if transport.GetTLSContext() != nil {
+		return nil
+	}
+
+	interval := time.Duration(config["security.tls.reloadInterval"].Int())
+	ctx, err := transport.NewTLSContext(
+		config["security.tls.certFile"].String(),
+		config["security.tls.keyFile"].String(),
+		config["security.tls.caFile"].String(),
+		config["security.tls.clientAuth"].Bool(),
+		interval*time.Millisecond)
+	if err != nil {
+		return err
+	}
+	transport.SetTLSContext(ctx)
+	return nil
+}
@@ -20,6 +20,7 @@ const (
 	NOT_SET = iota
 	MOI
 	FORESTDB
+	BPTREE
 )
 
 func (s StorageMode) String() string {
@@ -30,6 +31,8 @@ func (s StorageMode) String() string {
 		return "memory_optimized"
 	case FORESTDB:
 		return "forestdb"
+	case BPTREE:
+		return "bptree"
 	default:
 		return "invalid"
 	}
@@ -41,6 +44,7 @@ var smStrMap = map[string]StorageMode{
 	"memdb":            MOI,
 	"memory_optimized": MOI,
 	"forestdb":         FORESTDB,
+	"bptree":           BPTREE,
 }
 
 //Global Storage Mode
@@ -84,6 +88,8 @@ func IndexTypeToStorageMode(t IndexType) StorageMode {
 		return MOI
 	case ForestDB:
 		return FORESTDB
+	case BPTree:
+		return BPTREE
 	default:
 		return NOT_SET
 	}
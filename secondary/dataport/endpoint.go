@@ -15,6 +15,23 @@
 //                            |
 //                            V
 //                          buffers
+//
+// On connecting, endpoint negotiates protocol and compression with the
+// dataport server, refer to handshake.go. With servers that handshake, a
+// routine reads ping replies to measure round trip time.
+//
+// adaptive batching and compression:
+//
+// Every adaptTick endpoint looks at the packets flushed since the last tick.
+// The fraction of time spent writing to the socket tells whether the network
+// is the bottleneck. If so, bufferSize and bufferTimeout are doubled, the
+// latter to at least one round trip, so that fewer and larger packets are
+// sent, and when the network is idle they shrink back to configured values.
+//
+// With `auto` compression, payloads are compressed while the network is the
+// bottleneck. Compression is turned off when the time spent compressing
+// exceeds the time it saves on the wire or when payloads don't compress, and
+// stays off for an increasing number of ticks.
 
 package dataport
 
@@ -23,33 +40,67 @@ import "net"
 import "time"
 import "strconv"
 import "strings"
+import "sync/atomic"
 
 import c "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
 import "github.com/couchbase/indexing/secondary/transport"
 import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/golang/protobuf/proto"
+
+// network is the bottleneck when more than this fraction of time is spent
+// writing to the socket, and idle when less than idleRatio.
+const busyRatio = 0.5
+const idleRatio = 0.1
+
+// payloads that compress to more than this ratio are not worth compressing.
+const compressRatio = 0.9
+
+// maximum number of adaptTick to hold off `auto` compression.
+const maxCompressHold = 64
 
 // RouterEndpoint structure, per topic, to gather key-versions / mutations
 // from one or more vbuckets and push them downstream to a
 // specific node.
 type RouterEndpoint struct {
+	rtt       int64 // average round trip time, updated atomically
 	topic     string
 	timestamp int64  // immutable
 	raddr     string // immutable
 	// config params
-	logPrefix string
-	keyChSize int // channel size for key-versions
+	logPrefix  string
+	keyChSize  int // channel size for key-versions
+	maxPayload int
 	// live update is possible
-	block      bool          // should endpoint block when remote is slow
-	bufferSize int           // size of buffer to wait till flush
-	bufferTm   time.Duration // timeout to flush endpoint-buffer
-	harakiriTm time.Duration // timeout after which endpoint commits harakiri
-	statTick   time.Duration // timeout for logging statistics
+	block       bool          // should endpoint block when remote is slow
+	bufferSize  int           // size of buffer to wait till flush
+	bufferTm    time.Duration // timeout to flush endpoint-buffer
+	harakiriTm  time.Duration // timeout after which endpoint commits harakiri
+	statTick    time.Duration // timeout for logging statistics
+	compression string        // auto, gzip or none
+	adaptive    bool          // adapt bufferSize and bufferTm
+	maxBufSize  int           // upper limit for adaptive bufferSize
+	maxBufTm    time.Duration // upper limit for adaptive bufferTm
+	adaptTick   time.Duration // timeout to adapt batching and compression
 	// gen-server
 	ch    chan []interface{} // carries control commands
 	finch chan bool
 	// downstream
-	pkt  *transport.TransportPacket
-	conn net.Conn
+	pkt      *transport.TransportPacket
+	ctrlPkt  *transport.TransportPacket // pings
+	conn     net.Conn
+	protocol uint32 // negotiated with downstream
+	codec    byte   // compression accepted by downstream
+	// adaptive state
+	curBufSize   int
+	curBufTm     time.Duration
+	compressing  bool
+	compressHold int // adaptTick to wait before compressing again
+	compressWait int // adaptTick left before compressing again
+	throughput   float64
+	linkBusy     float64
+	adaptPkts    transport.PacketStats // as of last adaptTick
+	adaptSince   time.Time
 	// statistics
 	mutCount    int64
 	upsertCount int64
@@ -60,6 +111,7 @@ type RouterEndpoint struct {
 	endCount    int64
 	snapCount   int64
 	flushCount  int64
+	toggleCount int64 // number of times compression was switched
 	prjLatency  *Average
 }
 
@@ -69,41 +121,64 @@ func NewRouterEndpoint(
 	cluster, topic, raddr string, maxvbs int,
 	config c.Config) (*RouterEndpoint, error) {
 
-	conn, err := net.Dial("tcp", raddr)
-	if err != nil {
-		return nil, err
-	}
-
 	endpoint := &RouterEndpoint{
-		topic:      topic,
-		raddr:      raddr,
-		finch:      make(chan bool),
-		timestamp:  time.Now().UnixNano(),
-		keyChSize:  config["keyChanSize"].Int(),
-		block:      config["remoteBlock"].Bool(),
-		bufferSize: config["bufferSize"].Int(),
-		statTick:   time.Duration(config["statTick"].Int()),
-		bufferTm:   time.Duration(config["bufferTimeout"].Int()),
-		harakiriTm: time.Duration(config["harakiriTimeout"].Int()),
-		prjLatency: &Average{},
+		topic:       topic,
+		raddr:       raddr,
+		finch:       make(chan bool),
+		timestamp:   time.Now().UnixNano(),
+		keyChSize:   config["keyChanSize"].Int(),
+		maxPayload:  config["maxPayload"].Int(),
+		block:       config["remoteBlock"].Bool(),
+		bufferSize:  config["bufferSize"].Int(),
+		statTick:    time.Duration(config["statTick"].Int()),
+		bufferTm:    time.Duration(config["bufferTimeout"].Int()),
+		harakiriTm:  time.Duration(config["harakiriTimeout"].Int()),
+		compression: config["compression"].String(),
+		adaptive:    config["adaptiveBatching"].Bool(),
+		maxBufSize:  config["maxBufferSize"].Int(),
+		maxBufTm:    time.Duration(config["maxBufferTimeout"].Int()),
+		adaptTick:   time.Duration(config["adaptTick"].Int()),
+		protocol:    ProtocolLegacy,
+		codec:       transport.CompressionNone,
+		prjLatency:  &Average{},
 	}
 	endpoint.ch = make(chan []interface{}, endpoint.keyChSize)
-	endpoint.conn = conn
-	// TODO: add configuration params for transport flags.
-	flags := transport.TransportFlag(0).SetProtobuf()
-	maxPayload := config["maxPayload"].Int()
-	endpoint.pkt = transport.NewTransportPacket(maxPayload, flags)
-	endpoint.pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
-	endpoint.pkt.SetDecoder(transport.EncodingProtobuf, protobufDecode)
+	endpoint.pkt = newTransportPkt(endpoint.maxPayload)
+	endpoint.ctrlPkt = newTransportPkt(controlPayload)
 
 	endpoint.statTick *= time.Millisecond
 	endpoint.bufferTm *= time.Millisecond
 	endpoint.harakiriTm *= time.Millisecond
+	endpoint.maxBufTm *= time.Millisecond
+	endpoint.adaptTick *= time.Millisecond
+	endpoint.curBufSize, endpoint.curBufTm = endpoint.bufferSize, endpoint.bufferTm
 
 	endpoint.logPrefix = fmt.Sprintf(
 		"ENDP[<-(%v,%4x)<-%v #%v]",
 		endpoint.raddr, uint16(endpoint.timestamp), cluster, topic)
 
+	compressions := []uint32{}
+	if endpoint.compression != "none" {
+		compressions = parseCompressions("gzip")
+	}
+	handshakeTm := time.Duration(config["handshakeTimeout"].Int())
+	conn, hs, rtt, err := dialEndpoint(
+		endpoint.logPrefix, raddr, compressions, handshakeTm*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.conn = conn
+	if hs != nil {
+		endpoint.protocol = hs.GetProtocol()
+		endpoint.codec = negotiatedCompression(hs)
+		endpoint.rtt = int64(rtt)
+		go endpoint.runPong(conn)
+	}
+	fmsg := "%v negotiated protocol:%v compression:%v rtt:%v\n"
+	logging.Infof(
+		fmsg, endpoint.logPrefix, endpoint.protocol,
+		compressionNames[endpoint.codec], rtt)
+
 	go endpoint.run(endpoint.ch)
 	logging.Infof("%v started ...\n", endpoint.logPrefix)
 	return endpoint, nil
@@ -170,8 +245,11 @@ func (endpoint *RouterEndpoint) WaitForExit() error {
 
 // run
 func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
-	flushTick := time.NewTicker(endpoint.bufferTm)
+	flushTick := time.NewTicker(endpoint.curBufTm)
 	harakiri := time.NewTimer(endpoint.harakiriTm)
+	adaptTick := time.NewTicker(endpoint.adaptTick)
+	endpoint.adaptSince = time.Now()
+	endpoint.setCompression(endpoint.compression == "gzip")
 
 	defer func() { // panic safe
 		if r := recover(); r != nil {
@@ -184,6 +262,7 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 		if harakiri != nil {
 			harakiri.Stop()
 		}
+		adaptTick.Stop()
 		// close the connection
 		endpoint.conn.Close()
 		// close this endpoint
@@ -192,9 +271,10 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 	}()
 
 	statSince := time.Now()
-	var stitems [14]string
+	var stitems [24]string
 	logstats := func() {
 		prjLatency := endpoint.prjLatency
+		pstats := endpoint.pkt.Stats()
 		stitems[0] = `"topic":"` + endpoint.topic + `"`
 		stitems[1] = `"raddr":"` + endpoint.raddr + `"`
 		stitems[2] = `"mutCount":` + strconv.Itoa(int(endpoint.mutCount))
@@ -209,6 +289,16 @@ func (endpoint *RouterEndpoint) run(ch chan []interface{}) {
 		stitems[11] = `"latency.min":` + strconv.Itoa(int(prjLatency.Min()))
 		stitems[12] = `"latency.max":` + strconv.Itoa(int(prjLatency.Max()))
 		stitems[13] = `"latency.avg":` + strconv.Itoa(int(prjLatency.Mean()))
+		stitems[14] = `"protocol":` + strconv.Itoa(int(endpoint.protocol))
+		stitems[15] = `"compression":"` + compressionNames[endpoint.codec] + `"`
+		stitems[16] = `"compressing":` + strconv.FormatBool(endpoint.compressing)
+		stitems[17] = `"rtt":` + strconv.Itoa(int(atomic.LoadInt64(&endpoint.rtt)))
+		stitems[18] = `"bufferSize":` + strconv.Itoa(endpoint.curBufSize)
+		stitems[19] = `"bufferTimeout":` + strconv.Itoa(int(endpoint.curBufTm/time.Millisecond))
+		stitems[20] = `"packets":` + strconv.Itoa(int(pstats.Packets))
+		stitems[21] = `"compressedPackets":` + strconv.Itoa(int(pstats.Compressed))
+		stitems[22] = `"rawBytes":` + strconv.Itoa(int(pstats.RawBytes))
+		stitems[23] = `"wireBytes":` + strconv.Itoa(int(pstats.WireBytes))
 		statjson := strings.Join(stitems[:], ",")
 		fmsg := "%v stats {%v}\n"
 		logging.Infof(fmsg, endpoint.logPrefix, statjson)
@@ -260,7 +350,7 @@ loop:
 					kv.Commands, buffers.raddr)
 
 				messageCount++ // count queued up mutations.
-				if messageCount > endpoint.bufferSize {
+				if messageCount > endpoint.curBufSize {
 					if err := flushBuffers(); err != nil {
 						break loop
 					}
@@ -276,6 +366,7 @@ loop:
 				}
 				if cv, ok := config["bufferSize"]; ok {
 					endpoint.bufferSize = cv.Int()
+					endpoint.curBufSize = endpoint.bufferSize
 				}
 				if cv, ok := config["statTick"]; ok {
 					endpoint.statTick = time.Duration(cv.Int())
@@ -284,8 +375,36 @@ loop:
 				if cv, ok := config["bufferTimeout"]; ok {
 					endpoint.bufferTm = time.Duration(cv.Int())
 					endpoint.bufferTm *= time.Millisecond
+					endpoint.curBufTm = endpoint.bufferTm
 					flushTick.Stop()
-					flushTick = time.NewTicker(endpoint.bufferTm)
+					flushTick = time.NewTicker(endpoint.curBufTm)
+				}
+				if cv, ok := config["adaptiveBatching"]; ok {
+					endpoint.adaptive = cv.Bool()
+					if !endpoint.adaptive {
+						endpoint.curBufSize = endpoint.bufferSize
+						endpoint.curBufTm = endpoint.bufferTm
+						flushTick.Stop()
+						flushTick = time.NewTicker(endpoint.curBufTm)
+					}
+				}
+				if cv, ok := config["maxBufferSize"]; ok {
+					endpoint.maxBufSize = cv.Int()
+				}
+				if cv, ok := config["maxBufferTimeout"]; ok {
+					endpoint.maxBufTm = time.Duration(cv.Int())
+					endpoint.maxBufTm *= time.Millisecond
+				}
+				if cv, ok := config["adaptTick"]; ok {
+					endpoint.adaptTick = time.Duration(cv.Int())
+					endpoint.adaptTick *= time.Millisecond
+					adaptTick.Stop()
+					adaptTick = time.NewTicker(endpoint.adaptTick)
+				}
+				if cv, ok := config["compression"]; ok {
+					endpoint.compression = cv.String()
+					endpoint.compressHold, endpoint.compressWait = 0, 0
+					endpoint.setCompression(endpoint.compression == "gzip")
 				}
 				if cv, ok := config["harakiriTimeout"]; ok {
 					endpoint.harakiriTm = time.Duration(cv.Int())
@@ -299,9 +418,42 @@ loop:
 				respch := msg[2].(chan []interface{})
 				respch <- []interface{}{nil}
 
-			case endpCmdGetStatistics: // TODO: this is defunct now.
+			case endpCmdGetStatistics:
 				respch := msg[1].(chan []interface{})
 				stats := endpoint.newStats()
+				stats.Set("raddr", endpoint.raddr)
+				stats.Set("mutCount", float64(endpoint.mutCount))
+				stats.Set("upsertCount", float64(endpoint.upsertCount))
+				stats.Set("deleteCount", float64(endpoint.deleteCount))
+				stats.Set("upsdelCount", float64(endpoint.upsdelCount))
+				stats.Set("syncCount", float64(endpoint.syncCount))
+				stats.Set("beginCount", float64(endpoint.beginCount))
+				stats.Set("endCount", float64(endpoint.endCount))
+				stats.Set("snapCount", float64(endpoint.snapCount))
+				stats.Set("flushCount", float64(endpoint.flushCount))
+				// negotiated with downstream and adaptive batching.
+				pstats := endpoint.pkt.Stats()
+				stats.Set("protocol", float64(endpoint.protocol))
+				stats.Set("compression", compressionNames[endpoint.codec])
+				stats.Set("compressing", endpoint.compressing)
+				stats.Set("compressToggles", float64(endpoint.toggleCount))
+				stats.Set("rtt", float64(atomic.LoadInt64(&endpoint.rtt)))
+				stats.Set("bufferSize", float64(endpoint.curBufSize))
+				stats.Set("bufferTimeout", float64(endpoint.curBufTm/time.Millisecond))
+				stats.Set("throughput", endpoint.throughput)
+				stats.Set("linkBusy", endpoint.linkBusy)
+				stats.Set("packets", float64(pstats.Packets))
+				stats.Set("compressedPackets", float64(pstats.Compressed))
+				stats.Set("rawBytes", float64(pstats.RawBytes))
+				stats.Set("wireBytes", float64(pstats.WireBytes))
+				stats.Set("writeTime", float64(pstats.WriteTime))
+				stats.Set("compressTime", float64(pstats.CompressTime))
+				// queue depth, commands waiting to be handled and
+				// key-versions buffered but not yet flushed downstream.
+				stats.Set("queueLen", float64(len(ch)))
+				stats.Set("queueCap", float64(cap(ch)))
+				stats.Set("bufferedCount", float64(messageCount))
+				stats.Set("lastActive", lastActiveTime.UnixNano())
 				respch <- []interface{}{map[string]interface{}(stats)}
 
 			case endpCmdClose:
@@ -322,6 +474,16 @@ loop:
 			// hence the precaution.
 			lastActiveTime = time.Now()
 
+		case <-adaptTick.C:
+			if endpoint.adapt() {
+				flushTick.Stop()
+				flushTick = time.NewTicker(endpoint.curBufTm)
+			}
+			if err := endpoint.ping(); err != nil {
+				logging.Errorf("%v ping: %v\n", endpoint.logPrefix, err)
+				break loop
+			}
+
 		case <-harakiri.C:
 			if time.Since(lastActiveTime) > endpoint.harakiriTm {
 				logging.Infof("%v committed harakiri\n", endpoint.logPrefix)
@@ -334,6 +496,149 @@ loop:
 	logstats()
 }
 
+// adapt batching and compression to packets flushed since the last call,
+// return true if the flush interval has changed.
+func (endpoint *RouterEndpoint) adapt() bool {
+	pstats, elapsed := endpoint.pkt.Stats(), time.Since(endpoint.adaptSince)
+	prev := endpoint.adaptPkts
+	endpoint.adaptPkts, endpoint.adaptSince = pstats, time.Now()
+
+	packets := pstats.Packets - prev.Packets
+	raw := pstats.RawBytes - prev.RawBytes
+	wire := pstats.WireBytes - prev.WireBytes
+	writeTm := pstats.WriteTime - prev.WriteTime
+	compressTm := pstats.CompressTime - prev.CompressTime
+
+	endpoint.linkBusy = float64(writeTm) / float64(elapsed)
+	endpoint.throughput = float64(wire) / elapsed.Seconds()
+
+	// compression
+	if endpoint.codec != transport.CompressionNone &&
+		endpoint.compression == "auto" && packets > 0 {
+
+		if !endpoint.compressing {
+			if endpoint.compressWait > 0 {
+				endpoint.compressWait--
+			} else if endpoint.linkBusy > busyRatio {
+				endpoint.setCompression(true)
+			}
+
+		} else {
+			ratio := float64(wire) / float64(raw)
+			// time it would have taken to write uncompressed payloads.
+			saved := float64(writeTm) * (1/ratio - 1)
+			if ratio > compressRatio || float64(compressTm) > saved {
+				endpoint.setCompression(false)
+				endpoint.compressHold = endpoint.compressHold*2 + 1
+				if endpoint.compressHold > maxCompressHold {
+					endpoint.compressHold = maxCompressHold
+				}
+				endpoint.compressWait = endpoint.compressHold
+			} else {
+				endpoint.compressHold = 0
+			}
+		}
+	}
+
+	// batching
+	if !endpoint.adaptive {
+		return false
+	}
+	bufSize, bufTm := endpoint.curBufSize, endpoint.curBufTm
+	if endpoint.linkBusy > busyRatio {
+		if raw/(packets+1) < int64(endpoint.maxPayload/2) {
+			bufSize *= 2
+		}
+		bufTm *= 2
+		if rtt := time.Duration(atomic.LoadInt64(&endpoint.rtt)); bufTm < rtt {
+			bufTm = rtt
+		}
+
+	} else if endpoint.linkBusy < idleRatio {
+		bufSize, bufTm = bufSize/2, bufTm/2
+	}
+	endpoint.curBufSize = clampInt(bufSize, endpoint.bufferSize, endpoint.maxBufSize)
+	bufTm = clampDuration(bufTm, endpoint.bufferTm, endpoint.maxBufTm)
+	if bufTm != endpoint.curBufTm {
+		fmsg := "%v flush interval %v, buffer size %v\n"
+		logging.Debugf(fmsg, endpoint.logPrefix, bufTm, endpoint.curBufSize)
+		endpoint.curBufTm = bufTm
+		return true
+	}
+	return false
+}
+
+// setCompression for subsequent packets, if accepted by downstream.
+func (endpoint *RouterEndpoint) setCompression(compress bool) {
+	compress = compress && endpoint.codec != transport.CompressionNone
+	if compress == endpoint.compressing {
+		return
+	}
+	flags := transport.TransportFlag(0).SetProtobuf()
+	if compress {
+		flags = flags | transport.TransportFlag(endpoint.codec)
+	}
+	endpoint.pkt.SetFlags(flags)
+	endpoint.compressing = compress
+	endpoint.toggleCount++
+	fmsg := "%v compression %v turned %v\n"
+	logging.Infof(
+		fmsg, endpoint.logPrefix, compressionNames[endpoint.codec], compress)
+}
+
+// ping downstream to measure round trip time.
+func (endpoint *RouterEndpoint) ping() error {
+	if endpoint.protocol < ProtocolNegotiate {
+		return nil
+	}
+	ping := &protobuf.Ping{Timestamp: proto.Int64(time.Now().UnixNano())}
+	return endpoint.ctrlPkt.Send(endpoint.conn, ping)
+}
+
+// read ping replies from downstream till the connection is closed.
+func (endpoint *RouterEndpoint) runPong(conn net.Conn) {
+	pkt := newTransportPkt(controlPayload)
+	for {
+		payload, err := pkt.Receive(conn)
+		if err != nil {
+			logging.Tracef("%v runPong() exit: %v\n", endpoint.logPrefix, err)
+			return
+		}
+		ping, ok := payload.(*protobuf.Ping)
+		if !ok {
+			fmsg := "%v unexpected payload %T from downstream\n"
+			logging.Warnf(fmsg, endpoint.logPrefix, payload)
+			continue
+		}
+		// exponentially weighted average, this is the only writer.
+		rtt := time.Now().UnixNano() - ping.GetTimestamp()
+		if avg := atomic.LoadInt64(&endpoint.rtt); avg > 0 {
+			rtt = (avg*7 + rtt) / 8
+		}
+		atomic.StoreInt64(&endpoint.rtt, rtt)
+	}
+}
+
+func clampInt(n, min, max int) int {
+	if n > max {
+		n = max
+	}
+	if n < min {
+		n = min
+	}
+	return n
+}
+
+func clampDuration(d, min, max time.Duration) time.Duration {
+	if d > max {
+		d = max
+	}
+	if d < min {
+		d = min
+	}
+	return d
+}
+
 func (endpoint *RouterEndpoint) newStats() c.Statistics {
 	m := map[string]interface{}{}
 	stats, _ := c.NewStatistics(m)
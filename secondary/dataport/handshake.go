@@ -0,0 +1,133 @@
+// Connection handshake between router endpoint and dataport server.
+//
+// Endpoint sends a Handshake as the first message on a new connection,
+// offering the protocol it speaks and the compressions it can apply on
+// payloads. Server replies with its protocol and the compression it accepts,
+// if any, among the offered ones.
+//
+// Server that predates the handshake fails to decode the message and closes
+// the connection, in which case endpoint dials again and falls back to
+// legacy protocol, without compression or pings.
+//
+// After handshake, endpoint periodically sends a Ping that is echoed back by
+// the server, to measure the round trip time of the connection.
+
+package dataport
+
+import "net"
+import "strings"
+import "time"
+
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
+import "github.com/couchbase/indexing/secondary/transport"
+import "github.com/couchbase/indexing/secondary/logging"
+import "github.com/golang/protobuf/proto"
+
+const (
+	// ProtocolLegacy is spoken by peers that don't handshake.
+	ProtocolLegacy uint32 = 1
+	// ProtocolNegotiate adds handshake, compression and ping.
+	ProtocolNegotiate uint32 = 2
+)
+
+// ProtocolVersion spoken by this package.
+const ProtocolVersion = ProtocolNegotiate
+
+// buffer size for handshake and ping packets.
+const controlPayload = 1024
+
+var compressionNames = map[byte]string{
+	transport.CompressionNone:   "none",
+	transport.CompressionSnappy: "snappy",
+	transport.CompressionGzip:   "gzip",
+	transport.CompressionBzip2:  "bzip2",
+}
+
+// compressions supported by transport.
+var supportedCompressions = map[string]byte{
+	"gzip": transport.CompressionGzip,
+}
+
+// parseCompressions from a comma separated list of names, unsupported
+// names are ignored.
+func parseCompressions(names string) []uint32 {
+	compressions := make([]uint32, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if typ, ok := supportedCompressions[name]; ok {
+			compressions = append(compressions, uint32(typ))
+		}
+	}
+	return compressions
+}
+
+// dialEndpoint opens a connection with `raddr` and negotiates protocol and
+// compression. Returned handshake is nil if server speaks legacy protocol.
+func dialEndpoint(
+	prefix, raddr string,
+	compressions []uint32,
+	timeout time.Duration) (net.Conn, *protobuf.Handshake, time.Duration, error) {
+
+	conn, err := transport.Dial(raddr)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	start := time.Now()
+	offer := &protobuf.Handshake{
+		Protocol:     proto.Uint32(ProtocolVersion),
+		Compressions: compressions,
+	}
+	pkt := newTransportPkt(controlPayload)
+	conn.SetDeadline(start.Add(timeout))
+	if err = pkt.Send(conn, offer); err == nil {
+		var payload interface{}
+		if payload, err = pkt.Receive(conn); err == nil {
+			if hs, ok := payload.(*protobuf.Handshake); ok {
+				conn.SetDeadline(time.Time{})
+				return conn, hs, time.Since(start), nil
+			}
+			err = ErrorPayload
+		}
+	}
+	conn.Close()
+
+	fmsg := "%v handshake with %q failed: %v, falling back to legacy\n"
+	logging.Warnf(fmsg, prefix, raddr, err)
+	if conn, err = transport.Dial(raddr); err != nil {
+		return nil, nil, 0, err
+	}
+	return conn, nil, 0, nil
+}
+
+// acceptHandshake replies to router's offer with the first offered
+// compression that is also `accepted` by server.
+func acceptHandshake(
+	offer *protobuf.Handshake, accepted []uint32) *protobuf.Handshake {
+
+	protocol := ProtocolVersion
+	if offer.GetProtocol() < protocol {
+		protocol = offer.GetProtocol()
+	}
+	reply := &protobuf.Handshake{
+		Protocol:     proto.Uint32(protocol),
+		Compressions: make([]uint32, 0, 1),
+	}
+	for _, typ := range offer.GetCompressions() {
+		for _, acc := range accepted {
+			if typ == acc {
+				reply.Compressions = append(reply.Compressions, typ)
+				return reply
+			}
+		}
+	}
+	return reply
+}
+
+// negotiated compression from server's reply, CompressionNone if none.
+func negotiatedCompression(hs *protobuf.Handshake) byte {
+	if compressions := hs.GetCompressions(); len(compressions) > 0 {
+		return byte(compressions[0])
+	}
+	return transport.CompressionNone
+}
@@ -64,6 +64,12 @@ func protobufEncode(payload interface{}) (data []byte, err error) {
 			Vbuuids:  val.Vbuuids,
 			Vbuckets: c.Vbno16to32(val.Vbuckets),
 		}
+
+	case *protobuf.Handshake:
+		pl.Handshake = val
+
+	case *protobuf.Ping:
+		pl.Ping = val
 	}
 
 	if err == nil {
@@ -59,7 +59,7 @@ func TestAddDeletion(t *testing.T) {
 
 func TestAddSync(t *testing.T) {
 	seqno, docid, maxCount := uint64(10), []byte(nil), 1
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddSync()
 	// add it to VbKeyVersions
 	vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -70,7 +70,7 @@ func TestAddSync(t *testing.T) {
 
 func TestAddDropData(t *testing.T) {
 	seqno, docid, maxCount := uint64(10), []byte(nil), 1
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddDropData()
 	// add it to VbKeyVersions
 	vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -81,7 +81,7 @@ func TestAddDropData(t *testing.T) {
 
 func TestNewStreamBegin(t *testing.T) {
 	seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddStreamBegin()
 	// add it to VbKeyVersions
 	vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -92,7 +92,7 @@ func TestNewStreamBegin(t *testing.T) {
 
 func TestNewStreamEnd(t *testing.T) {
 	seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddStreamEnd()
 	// add it to VbKeyVersions
 	vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -189,7 +189,7 @@ func BenchmarkAddUpsertDeletionDecode(b *testing.B) {
 func BenchmarkAddSyncEncode(b *testing.B) {
 	benchmarkMutationEncode(b, func() *common.VbKeyVersions {
 		seqno, docid, maxCount := uint64(10), []byte(nil), 1
-		kv := common.NewKeyVersions(seqno, docid, maxCount)
+		kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 		kv.AddSync()
 		vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
 		vb := common.NewVbKeyVersions("default", vbno, vbuuid, nMuts)
@@ -201,7 +201,7 @@ func BenchmarkAddSyncEncode(b *testing.B) {
 func BenchmarkAddSyncDecode(b *testing.B) {
 	benchmarkMutationDecode(b, func() *common.VbKeyVersions {
 		seqno, docid, maxCount := uint64(10), []byte(nil), 1
-		kv := common.NewKeyVersions(seqno, docid, maxCount)
+		kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 		kv.AddSync()
 		vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
 		vb := common.NewVbKeyVersions("default", vbno, vbuuid, nMuts)
@@ -213,7 +213,7 @@ func BenchmarkAddSyncDecode(b *testing.B) {
 func BenchmarkAddStreamBeginEncode(b *testing.B) {
 	benchmarkMutationEncode(b, func() *common.VbKeyVersions {
 		seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-		kv := common.NewKeyVersions(seqno, docid, maxCount)
+		kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 		kv.AddStreamBegin()
 		// add it to VbKeyVersions
 		vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -226,7 +226,7 @@ func BenchmarkAddStreamBeginEncode(b *testing.B) {
 func BenchmarkAddStreamBeginDecode(b *testing.B) {
 	benchmarkMutationDecode(b, func() *common.VbKeyVersions {
 		seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-		kv := common.NewKeyVersions(seqno, docid, maxCount)
+		kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 		kv.AddStreamBegin()
 		// add it to VbKeyVersions
 		vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -239,7 +239,7 @@ func BenchmarkAddStreamBeginDecode(b *testing.B) {
 func BenchmarkAddStreamEndEncode(b *testing.B) {
 	benchmarkMutationEncode(b, func() *common.VbKeyVersions {
 		seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-		kv := common.NewKeyVersions(seqno, docid, maxCount)
+		kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 		kv.AddStreamEnd()
 		// add it to VbKeyVersions
 		vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -252,7 +252,7 @@ func BenchmarkAddStreamEndEncode(b *testing.B) {
 func BenchmarkAddStreamEndDecode(b *testing.B) {
 	benchmarkMutationDecode(b, func() *common.VbKeyVersions {
 		seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-		kv := common.NewKeyVersions(seqno, docid, maxCount)
+		kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 		kv.AddStreamEnd()
 		// add it to VbKeyVersions
 		vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
@@ -322,7 +322,7 @@ func benchmarkMutationDecode(b *testing.B, fn func() *common.VbKeyVersions) {
 
 func kvUpserts() *common.KeyVersions {
 	seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddUpsert(1, []byte("bangalore"), []byte("varanasi"))
 	kv.AddUpsert(2, []byte("delhi"), []byte("pune"))
 	kv.AddUpsert(3, []byte("jaipur"), []byte("mahe"))
@@ -331,7 +331,7 @@ func kvUpserts() *common.KeyVersions {
 
 func kvUpsertDeletions() *common.KeyVersions {
 	seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddUpsertDeletion(1, []byte("varanasi"))
 	kv.AddUpsertDeletion(2, []byte("pune"))
 	kv.AddUpsertDeletion(3, []byte("mahe"))
@@ -340,7 +340,7 @@ func kvUpsertDeletions() *common.KeyVersions {
 
 func kvDeletions() *common.KeyVersions {
 	seqno, docid, maxCount := uint64(10), []byte("document-name"), 10
-	kv := common.NewKeyVersions(seqno, docid, maxCount)
+	kv := common.NewKeyVersions(seqno, docid, int64(maxCount), 0)
 	kv.AddDeletion(1, []byte("varanasi"))
 	kv.AddDeletion(2, []byte("pune"))
 	kv.AddDeletion(3, []byte("mahe"))
@@ -0,0 +1,278 @@
+// Record and replay of messages delivered by dataport server.
+//
+// In recording mode, dataport server appends every message it passes to
+// the application, []*protobuf.VbKeyVersions and ConnectionError, to a
+// recording file along with the time elapsed since the server started.
+// Replay() reads back a recording and feeds the messages to an
+// application channel, either as fast as the application consumes them
+// or with the recorded spacing.
+//
+// Buffered records are flushed to the file every recordFlushInterval, so
+// that a recording is usable even if the process dies abruptly. A truncated
+// last record, left behind by such a process, is ignored on replay.
+//
+// Record: [len - 4 bytes][kind - 1 byte][elapsed nanoseconds - 8 bytes]
+//         [data - protobuf Payload or json ConnectionError]
+
+package dataport
+
+import "bufio"
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
+import "github.com/golang/protobuf/proto"
+
+// ErrorRecordKind
+var ErrorRecordKind = errors.New("dataport.recordKind")
+
+const (
+	recordVbKeyVersions byte = iota + 1
+	recordConnectionError
+)
+
+const recordHeaderSize = 13
+
+// interval to flush buffered records to the recording file.
+const recordFlushInterval = time.Second
+
+// Recorder writes messages delivered by dataport server to a file.
+type Recorder struct {
+	mu    sync.Mutex
+	fd    *os.File
+	w     *bufio.Writer
+	epoch time.Time
+	buf   []byte
+	finch chan bool
+}
+
+// NewRecorder creates a new recording file under dir, for dataport
+// server listening on laddr.
+func NewRecorder(dir, laddr string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("dataport-%v-%v.rec",
+		strings.Replace(laddr, ":", "_", -1), time.Now().UnixNano())
+	fd, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{
+		fd:    fd,
+		w:     bufio.NewWriter(fd),
+		epoch: time.Now(),
+		finch: make(chan bool),
+	}
+	go r.flusher(recordFlushInterval)
+	return r, nil
+}
+
+// Path of the recording file.
+func (r *Recorder) Path() string {
+	return r.fd.Name()
+}
+
+// Record appends a message to the recording.
+func (r *Recorder) Record(msg interface{}) (err error) {
+	var kind byte
+	var data []byte
+
+	switch val := msg.(type) {
+	case []*protobuf.VbKeyVersions:
+		kind = recordVbKeyVersions
+		pl := protobuf.Payload{
+			Version: proto.Uint32(uint32(ProtobufVersion())),
+			Vbkeys:  val,
+		}
+		data, err = proto.Marshal(&pl)
+
+	case ConnectionError:
+		kind = recordConnectionError
+		data, err = json.Marshal(val)
+
+	default:
+		err = ErrorRecordKind
+	}
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elapsed := time.Since(r.epoch)
+	r.buf = r.buf[:0]
+	r.buf = append(r.buf, make([]byte, recordHeaderSize)...)
+	binary.BigEndian.PutUint32(r.buf[0:4], uint32(len(data)+recordHeaderSize-4))
+	r.buf[4] = kind
+	binary.BigEndian.PutUint64(r.buf[5:13], uint64(elapsed))
+	r.buf = append(r.buf, data...)
+	_, err = r.w.Write(r.buf)
+	return err
+}
+
+// Flush buffered records to the recording file.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.w.Flush()
+}
+
+// flusher periodically flushes buffered records, till recorder is closed.
+func (r *Recorder) flusher(interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			if err := r.Flush(); err != nil {
+				logging.Errorf("dataport recorder %q flush: %v\n", r.Path(), err)
+			}
+		case <-r.finch:
+			return
+		}
+	}
+}
+
+// Close flushes and closes the recording.
+func (r *Recorder) Close() error {
+	close(r.finch)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Flush(); err != nil {
+		r.fd.Close()
+		return err
+	}
+	return r.fd.Close()
+}
+
+// RecordingReader reads back messages of a recording.
+type RecordingReader struct {
+	fd  *os.File
+	r   *bufio.Reader
+	buf []byte
+}
+
+// OpenRecording opens a recording file for reading.
+func OpenRecording(path string) (*RecordingReader, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &RecordingReader{fd: fd, r: bufio.NewReader(fd)}, nil
+}
+
+// Next returns the next message and the time elapsed, since recording
+// started, when it was delivered. Returns io.EOF at the end, including
+// when the last record is truncated.
+func (rr *RecordingReader) Next() (time.Duration, interface{}, error) {
+	var l [4]byte
+	if _, err := io.ReadFull(rr.r, l[:]); err == io.ErrUnexpectedEOF {
+		return 0, nil, rr.truncated()
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	n := int(binary.BigEndian.Uint32(l[:]))
+	if n < recordHeaderSize-4 {
+		return 0, nil, ErrorPayload
+	}
+	if cap(rr.buf) < n {
+		rr.buf = make([]byte, n)
+	}
+	rr.buf = rr.buf[:n]
+	if _, err := io.ReadFull(rr.r, rr.buf); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil, rr.truncated()
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	kind := rr.buf[0]
+	elapsed := time.Duration(binary.BigEndian.Uint64(rr.buf[1:9]))
+	data := rr.buf[9:]
+
+	switch kind {
+	case recordVbKeyVersions:
+		value, err := protobufDecode(data)
+		if err != nil {
+			return 0, nil, err
+		}
+		return elapsed, value, nil
+
+	case recordConnectionError:
+		ce := NewConnectionError()
+		if err := json.Unmarshal(data, &ce); err != nil {
+			return 0, nil, err
+		}
+		return elapsed, ce, nil
+	}
+	return 0, nil, ErrorRecordKind
+}
+
+// truncated record at the end of recording, left behind by a recorder
+// that did not close.
+func (rr *RecordingReader) truncated() error {
+	logging.Warnf("dataport recording %q: ignoring truncated last record\n",
+		rr.fd.Name())
+	return io.EOF
+}
+
+// Close the recording.
+func (rr *RecordingReader) Close() error {
+	return rr.fd.Close()
+}
+
+// Replay feeds messages of a recording to appch, as if they were delivered
+// by dataport server. If realtime is true, messages are delivered with their
+// recorded spacing, else as fast as appch accepts them. Returns the number
+// of messages delivered, when the recording is exhausted or when finch is
+// closed.
+func Replay(
+	path string, appch chan<- interface{}, realtime bool,
+	finch <-chan bool) (int, error) {
+
+	rr, err := OpenRecording(path)
+	if err != nil {
+		return 0, err
+	}
+	defer rr.Close()
+
+	start, count := time.Now(), 0
+	for {
+		elapsed, msg, err := rr.Next()
+		if err == io.EOF {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+
+		if realtime {
+			if d := elapsed - time.Since(start); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-finch:
+					return count, nil
+				}
+			}
+		}
+
+		select {
+		case appch <- msg:
+			count++
+		case <-finch:
+			return count, nil
+		}
+	}
+}
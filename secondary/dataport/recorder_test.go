@@ -0,0 +1,140 @@
+package dataport
+
+import "io/ioutil"
+import "os"
+import "reflect"
+import "testing"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataport-recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(dir, "localhost:8888")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reference messages, as delivered by dataport server.
+	vbno, vbuuid, nMuts := uint16(10), uint64(1000), 10
+	vb := common.NewVbKeyVersions("default", vbno, vbuuid, nMuts)
+	addKeyVersions(vb, []*common.KeyVersions{kvUpserts()}, 1, nMuts)
+	data, err := protobufEncode([]*common.VbKeyVersions{vb})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := protobufDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := NewConnectionError()
+	ce["default"] = []uint16{1, 2, 3}
+	refs := []interface{}{payload, ce, payload}
+
+	for _, msg := range refs {
+		if err := rec.Record(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rec.Record("invalid"); err != ErrorRecordKind {
+		t.Fatalf("expected %v, got %v", ErrorRecordKind, err)
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	appch := make(chan interface{}, len(refs))
+	count, err := Replay(rec.Path(), appch, true /*realtime*/, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if count != len(refs) {
+		t.Fatalf("expected %v messages, got %v", len(refs), count)
+	}
+	for _, ref := range refs {
+		msg := <-appch
+		switch val := msg.(type) {
+		case []*protobuf.VbKeyVersions:
+			ref := ref.([]*protobuf.VbKeyVersions)
+			if len(val) != len(ref) || val[0].String() != ref[0].String() {
+				t.Fatalf("mismatch in VbKeyVersions %v", val)
+			}
+		case ConnectionError:
+			if !reflect.DeepEqual(val, ref) {
+				t.Fatalf("mismatch in ConnectionError %v", val)
+			}
+		default:
+			t.Fatalf("unexpected message %T", msg)
+		}
+	}
+
+	// replay stops when finch is closed.
+	finch := make(chan bool)
+	close(finch)
+	count, err = Replay(rec.Path(), make(chan interface{}), false, finch)
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 0 {
+		t.Fatalf("expected 0 messages, got %v", count)
+	}
+}
+
+func TestRecordTruncated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dataport-recorder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rec, err := NewRecorder(dir, "localhost:8888")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := NewConnectionError()
+	ce["default"] = []uint16{1, 2, 3}
+	if err := rec.Record(ce); err != nil {
+		t.Fatal(err)
+	}
+
+	// buffered records are flushed without closing the recorder.
+	time.Sleep(recordFlushInterval + recordFlushInterval/2)
+	appch := make(chan interface{}, 10)
+	count, err := Replay(rec.Path(), appch, false /*realtime*/, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Fatalf("expected 1 message before close, got %v", count)
+	}
+	if err := rec.Record(ce); err != nil {
+		t.Fatal(err)
+	} else if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// chop the last record, as if the process died while writing it.
+	fi, err := os.Stat(rec.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recsize := fi.Size() / 2 // both records are of same size
+	// partial payload and partial length of last record.
+	for _, size := range []int64{fi.Size() - 3, recsize + 2} {
+		if err := os.Truncate(rec.Path(), size); err != nil {
+			t.Fatal(err)
+		}
+		appch := make(chan interface{}, 10)
+		count, err := Replay(rec.Path(), appch, false /*realtime*/, nil)
+		if err != nil {
+			t.Fatal(err)
+		} else if count != 1 {
+			t.Fatalf("expected 1 message, got %v", count)
+		} else if !reflect.DeepEqual(<-appch, ce) {
+			t.Fatalf("mismatch in ConnectionError")
+		}
+	}
+}
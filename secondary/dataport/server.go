@@ -28,6 +28,9 @@
 //                               *--------------------------------*
 //                                          (control & faults)
 //
+// doReceive() replies to Handshake and Ping messages from router on the
+// same connection, refer to handshake.go.
+//
 // server behavior:
 //
 // 1. can handle more than one connection from same router.
@@ -56,6 +59,7 @@ import "errors"
 import "fmt"
 import "io"
 import "net"
+import "sync/atomic"
 import "time"
 
 import c "github.com/couchbase/indexing/secondary/common"
@@ -120,6 +124,27 @@ type netConn struct {
 	worker chan interface{}
 	active bool
 	tpkt   *transport.TransportPacket
+	rpkt   *transport.TransportPacket // replies to router
+	// negotiated with router, updated atomically.
+	protocol    uint32
+	compression uint32
+}
+
+// statistics for this connection, safe to be called concurrently
+// with doReceive().
+func (nc *netConn) stats() map[string]interface{} {
+	pstats := nc.tpkt.Stats()
+	compression := byte(atomic.LoadUint32(&nc.compression))
+	stats := map[string]interface{}{
+		"protocol":          float64(atomic.LoadUint32(&nc.protocol)),
+		"compression":       compressionNames[compression],
+		"packets":           float64(pstats.Packets),
+		"compressedPackets": float64(pstats.Compressed),
+		"rawBytes":          float64(pstats.RawBytes),
+		"wireBytes":         float64(pstats.WireBytes),
+		"decompressTime":    float64(pstats.CompressTime),
+	}
+	return stats
 }
 
 // Server handles an active dataport server of mutation for all vbuckets.
@@ -139,7 +164,10 @@ type Server struct {
 	genChSize    int           // channel size for genServer routine
 	maxPayload   int           // maximum payload length from router
 	readDeadline time.Duration // timeout, in millisecond, reading from socket
+	compressions []uint32      // compressions accepted from router
 	logPrefix    string
+
+	rec *Recorder // records messages to application, optional
 }
 
 // NewServer creates a new dataport daemon.
@@ -165,10 +193,24 @@ func NewServer(
 		genChSize:    genChSize,
 		maxPayload:   config["maxPayload"].Int(),
 		readDeadline: time.Duration(config["tcpReadDeadline"].Int()),
+		compressions: make([]uint32, 0),
 	}
 	s.logPrefix = fmt.Sprintf("DATP[->dataport %q]", laddr)
-	if s.lis, err = net.Listen("tcp", laddr); err != nil {
+	if cv, ok := config["compressions"]; ok {
+		s.compressions = parseCompressions(cv.String())
+	}
+	if cv, ok := config["recordDir"]; ok && cv.String() != "" {
+		if s.rec, err = NewRecorder(cv.String(), laddr); err != nil {
+			logging.Errorf("%v failed recording ! %v\n", s.logPrefix, err)
+			return nil, err
+		}
+		logging.Infof("%v recording to %q\n", s.logPrefix, s.rec.Path())
+	}
+	if s.lis, err = transport.Listen(laddr); err != nil {
 		logging.Errorf("%v failed starting ! %v\n", s.logPrefix, err)
+		if s.rec != nil {
+			s.rec.Close()
+		}
 		return nil, err
 	}
 	go listener(s.logPrefix, s.lis, s.reqch) // spawn daemon
@@ -211,12 +253,24 @@ func (s *Server) Close() (err error) {
 	return c.OpError(err, resp, 0)
 }
 
+// GetStatistics for each remote connection, synchronous call.
+func (s *Server) GetStatistics() (map[string]interface{}, error) {
+	respch := make(chan []interface{}, 1)
+	cmd := []interface{}{serverMessage{cmd: serverCmdGetStatistics}, respch}
+	resp, err := c.FailsafeOp(s.reqch, respch, cmd, s.finch)
+	if err != nil {
+		return nil, err
+	}
+	return resp[0].(map[string]interface{}), nil
+}
+
 // gen-server commands
 const (
 	serverCmdNewConnection byte = iota + 1
 	serverCmdVbmap
 	serverCmdVbKeyVersions
 	serverCmdError
+	serverCmdGetStatistics
 	serverCmdClose
 )
 
@@ -268,7 +322,7 @@ func (s *Server) genServer(reqch, datach chan []interface{}) {
 						fmsg := "%v StreamEnd without StreamBegin for %v\n"
 						logging.Warnf(fmsg, s.logPrefix, id)
 					}
-				case c.Upsert, c.Deletion, c.UpsertDeletion:
+				case c.Upsert, c.Deletion, c.UpsertDeletion, c.EvalError:
 					if avbok && avb != nil {
 						avb.seqno = kv.GetSeqno()
 						avb.kvers++
@@ -302,7 +356,9 @@ func (s *Server) genServer(reqch, datach chan []interface{}) {
 				worker := make(chan interface{}, s.maxVbuckets)
 				s.conns[raddr] = &netConn{
 					conn: conn, worker: worker,
-					tpkt: newTransportPkt(s.maxPayload),
+					tpkt:     newTransportPkt(s.maxPayload),
+					rpkt:     newTransportPkt(controlPayload),
+					protocol: ProtocolLegacy,
 				}
 				n := len(s.conns)
 				fmsg := "%v new connection %q +%d\n"
@@ -310,6 +366,14 @@ func (s *Server) genServer(reqch, datach chan []interface{}) {
 				s.startWorker(raddr)
 			}
 
+		case serverCmdGetStatistics:
+			respch := cmd[1].(chan []interface{})
+			stats := make(map[string]interface{})
+			for raddr, nc := range s.conns {
+				stats[raddr] = nc.stats()
+			}
+			respch <- []interface{}{stats}
+
 		case serverCmdClose:
 			// before closing the dataport-server log a consolidated
 			// stats on the active-vbuckets.
@@ -321,6 +385,11 @@ func (s *Server) genServer(reqch, datach chan []interface{}) {
 	}
 
 	nicetoapp := func(msg interface{}) {
+		if s.rec != nil {
+			if err := s.rec.Record(msg); err != nil {
+				logging.Errorf("%v recording %T: %v\n", s.logPrefix, msg, err)
+			}
+		}
 		for {
 			select {
 			case <-s.finch:
@@ -384,6 +453,12 @@ func (s *Server) handleClose() {
 		closeConnection(s.logPrefix, raddr, nc)
 	}
 	s.lis, s.conns = nil, nil
+	if s.rec != nil {
+		if err := s.rec.Close(); err != nil {
+			logging.Errorf("%v closing recording: %v\n", s.logPrefix, err)
+		}
+		s.rec = nil
+	}
 	close(s.finch)
 
 	logging.Infof("%v ... stopped\n", s.logPrefix)
@@ -399,7 +474,9 @@ func (s *Server) startWorker(raddr string) {
 		return
 	}
 	logging.Tracef("%v starting worker for connection %q\n", s.logPrefix, raddr)
-	go doReceive(s.logPrefix, nc, s.maxPayload, s.readDeadline, s.datach)
+	go doReceive(
+		s.logPrefix, nc, s.maxPayload, s.readDeadline, s.compressions,
+		s.datach)
 	nc.active = true
 }
 
@@ -492,6 +569,7 @@ func closeConnection(prefix, raddr string, nc *netConn) {
 	close(nc.worker)
 	nc.conn.Close()
 	logging.Infof("%v connection %q closed !\n", prefix, raddr)
+	logging.Infof("%v connection %q stats %v\n", prefix, raddr, nc.stats())
 }
 
 // get all remote connections for `host`
@@ -538,6 +616,7 @@ func doReceive(
 	prefix string,
 	nc *netConn,
 	maxPayload int, readDeadline time.Duration,
+	compressions []uint32,
 	datach chan<- []interface{}) {
 
 	conn, worker := nc.conn, nc.worker
@@ -573,6 +652,30 @@ loop:
 			logging.Tracef(fmsg, prefix, msg.raddr)
 			break loop
 
+		} else if offer, ok := payload.(*protobuf.Handshake); ok {
+			reply := acceptHandshake(offer, compressions)
+			atomic.StoreUint32(&nc.protocol, reply.GetProtocol())
+			typ := negotiatedCompression(reply)
+			atomic.StoreUint32(&nc.compression, uint32(typ))
+			if err := replyRouter(nc, reply, timeoutMs); err != nil {
+				msg.cmd, msg.err = serverCmdError, err
+				datach <- []interface{}{msg}
+				logging.Errorf("%v worker %q exit: %v\n", prefix, msg.raddr, err)
+				break loop
+			}
+			fmsg := "%v handshake with %q protocol:%v compression:%v\n"
+			logging.Infof(
+				fmsg, prefix, msg.raddr, reply.GetProtocol(),
+				compressionNames[typ])
+
+		} else if ping, ok := payload.(*protobuf.Ping); ok {
+			if err := replyRouter(nc, ping, timeoutMs); err != nil {
+				msg.cmd, msg.err = serverCmdError, err
+				datach <- []interface{}{msg}
+				logging.Errorf("%v worker %q exit: %v\n", prefix, msg.raddr, err)
+				break loop
+			}
+
 		} else if vbs, ok := payload.([]*protobuf.VbKeyVersions); ok {
 			msg.cmd, msg.args = serverCmdVbKeyVersions, []interface{}{vbs}
 			if len(datach) == cap(datach) {
@@ -650,6 +753,14 @@ func (ce ConnectionError) Append(hostUuids keeper, raddr string) keeper {
 	return finished
 }
 
+// reply to router on the connection, only doReceive() writes to it.
+func replyRouter(
+	nc *netConn, payload interface{}, timeout time.Duration) error {
+
+	nc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	return nc.rpkt.Send(nc.conn, payload)
+}
+
 func newTransportPkt(maxPayload int) *transport.TransportPacket {
 	flags := transport.TransportFlag(0).SetProtobuf()
 	pkt := transport.NewTransportPacket(maxPayload, flags)
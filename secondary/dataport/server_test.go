@@ -1,12 +1,25 @@
 package dataport
 
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "fmt"
+import "io/ioutil"
+import "math/big"
+import "net"
+import "os"
+import "path/filepath"
 import "testing"
 import "time"
-import "fmt"
 
 import "github.com/couchbase/indexing/secondary/logging"
 import c "github.com/couchbase/indexing/secondary/common"
 import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
+import "github.com/couchbase/indexing/secondary/transport"
+import "github.com/golang/protobuf/proto"
 
 func TestTimeout(t *testing.T) {
 	logging.SetLogLevel(logging.Silent)
@@ -18,13 +31,15 @@ func TestTimeout(t *testing.T) {
 	appch := make(chan interface{}, mutChanSize)
 	prefix := "indexer.dataport."
 	dconfig := c.SystemConfig.SectionConfig(prefix, true /*trim*/)
+	dconfig.SetValue("tcpReadDeadline", 1000)
 	daemon, err := NewServer(raddr, maxvbuckets, dconfig, appch)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// start endpoint
+	// start endpoint, pings would keep the connection alive.
 	config := c.SystemConfig.SectionConfig("projector.dataport.", true /*trim*/)
+	config.SetValue("adaptTick", 60*1000)
 	endp, err := NewRouterEndpoint("clust", "topic", raddr, maxvbuckets, config)
 	if err != nil {
 		t.Fatal(err)
@@ -36,7 +51,7 @@ func TestTimeout(t *testing.T) {
 	for _, vbmap := range vbmaps {
 		for i := 0; i < len(vbmap.Vbuckets); i++ { // for N vbuckets
 			vbno, vbuuid := vbmap.Vbuckets[i], vbmap.Vbuuids[i]
-			kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1)
+			kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1, 0)
 			kv.AddStreamBegin()
 			dkv := &c.DataportKeyVersions{
 				Bucket: vbmap.Bucket, Vbno: vbno, Vbuuid: vbuuid, Kv: kv,
@@ -53,13 +68,13 @@ func TestTimeout(t *testing.T) {
 			idx := i % len(vbmap.Vbuckets)
 			vbno, vbuuid := vbmap.Vbuckets[idx], vbmap.Vbuuids[idx]
 			// send sync messages
-			kv := c.NewKeyVersions(10, nil, 1)
+			kv := c.NewKeyVersions(10, nil, 1, 0)
 			kv.AddSync()
 			dkv := &c.DataportKeyVersions{
 				Bucket: vbmap.Bucket, Vbno: vbno, Vbuuid: vbuuid, Kv: kv,
 			}
-			if endp.Send(dkv); err != nil {
-				t.Fatal(err)
+			if err := endp.Send(dkv); err != nil {
+				return // endpoint closed
 			}
 			<-time.After(
 				time.Duration(dconfig["tcpReadDeadline"].Int()) * time.Millisecond)
@@ -131,7 +146,7 @@ func TestLoopback(t *testing.T) {
 	for _, vbmap := range vbmaps {
 		for i := 0; i < len(vbmap.Vbuckets); i++ { // for N vbuckets
 			vbno, vbuuid := vbmap.Vbuckets[i], vbmap.Vbuuids[i]
-			kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1)
+			kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1, 0)
 			kv.AddStreamBegin()
 			dkv := &c.DataportKeyVersions{
 				Bucket: vbmap.Bucket, Vbno: vbno, Vbuuid: vbuuid, Kv: kv,
@@ -154,31 +169,25 @@ func TestLoopback(t *testing.T) {
 		}
 		seqno += nMuts
 
-		// gather
-		pvbs := make([]*protobuf.VbKeyVersions, 0)
-	loop:
-		for {
+		// gather, endpoint may hold back the tail of a batch till its
+		// buffer timeout.
+		commands := make(map[byte]int)
+		for commands[c.Upsert] < 1600 {
 			select {
 			case msg := <-appch:
-				//t.Logf("%T %v\n", msg, msg)
-				if pvbsSub, ok := msg.([]*protobuf.VbKeyVersions); !ok {
+				pvbs, ok := msg.([]*protobuf.VbKeyVersions)
+				if !ok {
 					t.Fatalf("unexpected type in loopback %T", msg)
-				} else {
-					pvbs = append(pvbs, pvbsSub...)
 				}
-			case <-time.After(10 * time.Millisecond):
-				break loop
-			}
-		}
-		commands := make(map[byte]int)
-		for _, vb := range protobuf2VbKeyVersions(pvbs) {
-			for _, kv := range vb.Kvs {
-				for _, cmd := range kv.Commands {
-					if _, ok := commands[byte(cmd)]; !ok {
-						commands[byte(cmd)] = 0
+				for _, vb := range protobuf2VbKeyVersions(pvbs) {
+					for _, kv := range vb.Kvs {
+						for _, cmd := range kv.Commands {
+							commands[byte(cmd)]++
+						}
 					}
-					commands[byte(cmd)]++
 				}
+			case <-time.After(time.Second):
+				t.Fatalf("unexpected response %v", commands[c.Upsert])
 			}
 		}
 		if StreamBegins, ok := commands[c.StreamBegin]; ok && StreamBegins != 64 {
@@ -193,6 +202,164 @@ func TestLoopback(t *testing.T) {
 	daemon.Close()
 }
 
+func TestNegotiate(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	raddr := "localhost:8888"
+	maxvbuckets, mutChanSize := 8, 100
+
+	// start server
+	appch := make(chan interface{}, mutChanSize)
+	prefix := "indexer.dataport."
+	config := c.SystemConfig.SectionConfig(prefix, true /*trim*/)
+	daemon, err := NewServer(raddr, maxvbuckets, config, appch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// start endpoint, with compression always on
+	config = c.SystemConfig.SectionConfig("projector.dataport.", true /*trim*/)
+	config.SetValue("compression", "gzip")
+	endp, err := NewRouterEndpoint("clust", "topic", raddr, maxvbuckets, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endp.protocol != ProtocolVersion {
+		t.Fatalf("unexpected protocol %v", endp.protocol)
+	} else if endp.codec != transport.CompressionGzip {
+		t.Fatalf("unexpected compression %v", endp.codec)
+	}
+
+	kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1, 0)
+	kv.AddStreamBegin()
+	dkv := &c.DataportKeyVersions{Bucket: "default", Vbno: 0, Vbuuid: 10, Kv: kv}
+	if err := endp.Send(dkv); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-appch:
+		if _, ok := msg.([]*protobuf.VbKeyVersions); !ok {
+			t.Fatalf("unexpected type in negotiate %T", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for mutations")
+	}
+
+	estats := endp.GetStatistics()
+	if estats["compressedPackets"].(float64) == 0 {
+		t.Fatalf("expected compressed packets %v", estats)
+	}
+	dstats, err := daemon.GetStatistics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stats := range dstats {
+		stats := stats.(map[string]interface{})
+		if stats["compression"] != "gzip" {
+			t.Fatalf("unexpected server stats %v", stats)
+		} else if stats["compressedPackets"].(float64) == 0 {
+			t.Fatalf("unexpected server stats %v", stats)
+		}
+	}
+
+	endp.Close()
+	daemon.Close()
+}
+
+func TestTLSFromSettings(t *testing.T) {
+	logging.SetLogLevel(logging.Silent)
+
+	dir, err := ioutil.TempDir("", "dataport-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestCerts(t, dir)
+
+	// indexing settings, as stored in metakv.
+	settings := fmt.Sprintf(`{
+		"security.tls.enabled": true,
+		"security.tls.certFile": %q,
+		"security.tls.keyFile": %q,
+		"security.tls.caFile": %q,
+		"security.tls.clientAuth": true
+	}`, filepath.Join(dir, "node.pem"), filepath.Join(dir, "node.key"),
+		filepath.Join(dir, "ca.pem"))
+	sconfig := c.SystemConfig.Clone()
+	if err := sconfig.Update([]byte(settings)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetupTLS(sconfig); err != nil {
+		t.Fatal(err)
+	}
+	defer transport.SetTLSContext(nil)
+	if transport.GetTLSContext() == nil {
+		t.Fatal("expected TLS context from settings")
+	}
+
+	raddr := "localhost:8888"
+	maxvbuckets, mutChanSize := 8, 100
+
+	// start server
+	appch := make(chan interface{}, mutChanSize)
+	config := sconfig.SectionConfig("indexer.dataport.", true /*trim*/)
+	daemon, err := NewServer(raddr, maxvbuckets, config, appch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// plain TCP peers are not served.
+	conn, err := net.Dial("tcp", raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := newTransportPkt(controlPayload)
+	hs := &protobuf.Handshake{Protocol: proto.Uint32(ProtocolVersion)}
+	pkt.Send(conn, hs)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := pkt.Receive(conn); err == nil {
+		t.Fatal("expected plain TCP handshake to fail")
+	}
+	conn.Close()
+
+	// start endpoint
+	config = sconfig.SectionConfig("projector.dataport.", true /*trim*/)
+	endp, err := NewRouterEndpoint("clust", "topic", raddr, maxvbuckets, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endp.protocol != ProtocolVersion {
+		t.Fatalf("unexpected protocol %v", endp.protocol)
+	}
+
+	kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1, 0)
+	kv.AddStreamBegin()
+	dkv := &c.DataportKeyVersions{Bucket: "default", Vbno: 0, Vbuuid: 10, Kv: kv}
+	if err := endp.Send(dkv); err != nil {
+		t.Fatal(err)
+	}
+	for done := false; !done; {
+		select {
+		case msg := <-appch:
+			switch val := msg.(type) {
+			case []*protobuf.VbKeyVersions:
+				done = true
+			case ConnectionError: // of the plain TCP peer
+				if len(val) > 0 {
+					t.Fatalf("unexpected connection error %v", val)
+				}
+			default:
+				t.Fatalf("unexpected type over TLS %T", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for mutations")
+		}
+	}
+
+	endp.Close()
+	daemon.Close()
+}
+
 func BenchmarkLoopback(b *testing.B) {
 	logging.SetLogLevel(logging.Silent)
 
@@ -221,7 +388,7 @@ func BenchmarkLoopback(b *testing.B) {
 	for _, vbmap := range vbmaps {
 		for i := 0; i < len(vbmap.Vbuckets); i++ { // for N vbuckets
 			vbno, vbuuid := vbmap.Vbuckets[i], vbmap.Vbuuids[i]
-			kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1)
+			kv := c.NewKeyVersions(uint64(0), []byte("Bourne"), 1, 0)
 			kv.AddStreamBegin()
 			dkv := &c.DataportKeyVersions{
 				Bucket: vbmap.Bucket, Vbno: vbno, Vbuuid: vbuuid, Kv: kv,
@@ -280,7 +447,7 @@ func dataKeyVersions(bucket string, seqno, nVbs, nMuts, nIndexes int) []*c.Datap
 	for i := 0; i < nVbs; i++ { // for N vbuckets
 		vbno, vbuuid := uint16(i), uint64(i*10)
 		for j := 0; j < nMuts; j++ {
-			kv := c.NewKeyVersions(uint64(seqno+j), []byte("Bourne"), nIndexes)
+			kv := c.NewKeyVersions(uint64(seqno+j), []byte("Bourne"), int64(nIndexes), 0)
 			for k := 0; k < nIndexes; k++ {
 				key := fmt.Sprintf("bangalore%v", k)
 				oldkey := fmt.Sprintf("varanasi%v", k)
@@ -294,3 +461,61 @@ func dataKeyVersions(bucket string, seqno, nVbs, nMuts, nIndexes int) []*c.Datap
 	}
 	return dkvs
 }
+
+// writeTestCerts writes a CA, ca.pem, and a certificate signed by it for
+// localhost, node.pem and node.key, into dir.
+func writeTestCerts(t *testing.T, dir string) {
+	now := time.Now()
+	cakey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+	cader, err := x509.CreateCertificate(rand.Reader, ca, ca, &cakey.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, node, ca, &key.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"ca.pem":   &pem.Block{Type: "CERTIFICATE", Bytes: cader},
+		"node.pem": &pem.Block{Type: "CERTIFICATE", Bytes: der},
+		"node.key": &pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder},
+	}
+	for name, block := range files {
+		data := pem.EncodeToMemory(block)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import "testing"
 import c "github.com/couchbase/indexing/secondary/common"
 import protobuf "github.com/couchbase/indexing/secondary/protobuf/data"
 import "github.com/couchbase/indexing/secondary/transport"
+import "github.com/golang/protobuf/proto"
 
 func TestPktKeyVersions(t *testing.T) {
 	seqno, nVbs, nMuts, nIndexes := 1, 20, 5, 5
@@ -61,6 +62,86 @@ func TestPktVbmap(t *testing.T) {
 	}
 }
 
+func TestPktCompressed(t *testing.T) {
+	seqno, nVbs, nMuts, nIndexes := 1, 20, 5, 5
+	vbsRef := constructVbKeyVersions("default", seqno, nVbs, nMuts, nIndexes)
+	tc := newTestConnection()
+	tc.reset()
+	flags := transport.TransportFlag(0).SetProtobuf().SetGzip()
+	pkt := transport.NewTransportPacket(1000*1024, flags)
+	pkt.SetEncoder(transport.EncodingProtobuf, protobufEncode)
+	pkt.SetDecoder(transport.EncodingProtobuf, protobufDecode)
+
+	if err := pkt.Send(tc, vbsRef); err != nil {
+		t.Fatal(err)
+	}
+	stats := pkt.Stats()
+	if stats.Packets != 1 || stats.Compressed != 1 {
+		t.Fatalf("unexpected packet stats %+v", stats)
+	} else if stats.WireBytes >= stats.RawBytes {
+		t.Fatalf("payload not compressed %+v", stats)
+	}
+
+	rpkt := newTransportPkt(1000 * 1024)
+	if payload, err := rpkt.Receive(tc); err != nil {
+		t.Fatal(err)
+	} else {
+		vbs := protobuf2VbKeyVersions(payload.([]*protobuf.VbKeyVersions))
+		if len(vbsRef) != len(vbs) {
+			t.Fatal("Mismatch in length")
+		}
+		for i, vb := range vbs {
+			if vb.Equal(vbsRef[i]) == false {
+				t.Fatal("Mismatch in VbKeyVersions")
+			}
+		}
+	}
+	if rstats := rpkt.Stats(); rstats.RawBytes != stats.RawBytes {
+		t.Fatalf("mismatch in received stats %+v %+v", rstats, stats)
+	} else if rstats.WireBytes != stats.WireBytes {
+		t.Fatalf("mismatch in received stats %+v %+v", rstats, stats)
+	}
+}
+
+func TestPktHandshake(t *testing.T) {
+	tc := newTestConnection()
+	tc.reset()
+	pkt := newTransportPkt(controlPayload)
+
+	offer := &protobuf.Handshake{
+		Protocol:     proto.Uint32(ProtocolVersion),
+		Compressions: parseCompressions("snappy, gzip"),
+	}
+	if err := pkt.Send(tc, offer); err != nil {
+		t.Fatal(err)
+	}
+	payload, err := pkt.Receive(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := acceptHandshake(payload.(*protobuf.Handshake), parseCompressions("gzip"))
+	if reply.GetProtocol() != ProtocolVersion {
+		t.Fatalf("unexpected protocol %v", reply.GetProtocol())
+	} else if negotiatedCompression(reply) != transport.CompressionGzip {
+		t.Fatalf("unexpected compression %v", reply.GetCompressions())
+	}
+	reply = acceptHandshake(offer, parseCompressions(""))
+	if negotiatedCompression(reply) != transport.CompressionNone {
+		t.Fatalf("unexpected compression %v", reply.GetCompressions())
+	}
+
+	tc.reset()
+	ping := &protobuf.Ping{Timestamp: proto.Int64(1234)}
+	if err := pkt.Send(tc, ping); err != nil {
+		t.Fatal(err)
+	}
+	if payload, err := pkt.Receive(tc); err != nil {
+		t.Fatal(err)
+	} else if ts := payload.(*protobuf.Ping).GetTimestamp(); ts != 1234 {
+		t.Fatalf("unexpected ping %v", ts)
+	}
+}
+
 func BenchmarkSendVbKeyVersions(b *testing.B) {
 	seqno, nVbs, nMuts, nIndexes := 1, 20, 5, 5
 	vbs := constructVbKeyVersions("default", seqno, nVbs, nMuts, nIndexes)
@@ -140,7 +221,7 @@ func constructVbKeyVersions(bucket string, seqno, nVbs, nMuts, nIndexes int) []*
 		vbno, vbuuid := uint16(i), uint64(i*10)
 		vb := c.NewVbKeyVersions(bucket, vbno, vbuuid, nMuts)
 		for j := 0; j < nMuts; j++ {
-			kv := c.NewKeyVersions(uint64(seqno+j), []byte("Bourne"), nIndexes)
+			kv := c.NewKeyVersions(uint64(seqno+j), []byte("Bourne"), int64(nIndexes), 0)
 			for k := 0; k < nIndexes; k++ {
 				key := fmt.Sprintf("bangalore%v", k)
 				oldkey := fmt.Sprintf("varanasi%v", k)
@@ -4,6 +4,7 @@
 package memcached
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -19,6 +20,7 @@ const bufferAckThreshold = 0.2
 const opaqueOpen = 0xBEAF0001
 const opaqueFailover = 0xDEADBEEF
 const opaqueGetseqno = 0xDEADBEEF
+const opaqueHelo = 0xBEAF0002
 
 // error codes
 var ErrorInvalidLog = errors.New("couchbase.errorInvalidLog")
@@ -36,6 +38,7 @@ type DcpFeed struct {
 	name      string
 	outch     chan<- *DcpEvent      // Exported channel for receiving DCP events
 	vbstreams map[uint16]*DcpStream // vb->stream mapping
+	xattrs    bool                  // request extended attributes
 	// genserver
 	reqch     chan []interface{}
 	finch     chan bool
@@ -64,6 +67,9 @@ func NewDcpFeed(
 		logPrefix:  fmt.Sprintf("DCPT[%s]", name),
 		dcplatency: &Average{},
 	}
+	if val, ok := config["includeXATTRs"]; ok && val != nil {
+		feed.xattrs = val.(bool)
+	}
 
 	mc.Hijack()
 	feed.conn = mc
@@ -472,6 +478,28 @@ func (feed *DcpFeed) doDcpOpen(
 	opaque uint16,
 	rcvch chan []interface{}) error {
 
+	prefix := feed.logPrefix
+
+	flags := transport.DCP_OPEN_PRODUCER // we are consumer
+	// JSON datatype is always negotiated so that documents are flagged as
+	// JSON, xattrs are negotiated along with it only when requested.
+	features := []uint16{transport.FEATURE_JSON}
+	if feed.xattrs {
+		features = append(features, transport.FEATURE_XATTR)
+	}
+	enabled, err := feed.doHelo(name, features, rcvch)
+	if err != nil {
+		return err
+	}
+	if feed.xattrs {
+		if enabled[transport.FEATURE_XATTR] {
+			flags |= transport.DCP_OPEN_INCLUDE_XATTRS
+		} else {
+			fmsg := "%v ##%x xattrs not supported by server"
+			logging.Warnf(fmsg, prefix, opaque)
+		}
+	}
+
 	rq := &transport.MCRequest{
 		Opcode: transport.DCP_OPEN,
 		Key:    []byte(name),
@@ -479,9 +507,8 @@ func (feed *DcpFeed) doDcpOpen(
 	}
 	rq.Extras = make([]byte, 8)
 	binary.BigEndian.PutUint32(rq.Extras[:4], sequence)
-	binary.BigEndian.PutUint32(rq.Extras[4:], 1) // we are consumer
+	binary.BigEndian.PutUint32(rq.Extras[4:], flags)
 
-	prefix := feed.logPrefix
 	if err := feed.conn.Transmit(rq); err != nil {
 		return err
 	}
@@ -556,6 +583,50 @@ func (feed *DcpFeed) doDcpOpen(
 	return nil
 }
 
+// doHelo negotiates `features` with the server, returns the features
+// enabled by the server for this connection. Servers that do not support
+// HELO enable no features.
+func (feed *DcpFeed) doHelo(
+	name string, features []uint16,
+	rcvch chan []interface{}) (map[uint16]bool, error) {
+
+	rq := &transport.MCRequest{
+		Opcode: transport.HELO,
+		Key:    []byte(name),
+		Opaque: opaqueHelo,
+		Body:   make([]byte, 2*len(features)),
+	}
+	for i, feature := range features {
+		binary.BigEndian.PutUint16(rq.Body[2*i:], feature)
+	}
+
+	prefix := feed.logPrefix
+	if err := feed.conn.Transmit(rq); err != nil {
+		fmsg := "%v ##%x doHelo.Transmit(): %v"
+		logging.Errorf(fmsg, prefix, rq.Opaque, err)
+		return nil, err
+	}
+	msg, ok := <-rcvch
+	if !ok {
+		logging.Errorf("%v ##%x doHelo.rcvch closed", prefix, rq.Opaque)
+		return nil, ErrorConnection
+	}
+	pkt := msg[0].(*transport.MCRequest)
+	enabled := make(map[uint16]bool)
+	if pkt.Opcode != transport.HELO {
+		logging.Errorf("%v ##%x HELO != #%v", prefix, rq.Opaque, pkt.Opcode)
+		return nil, ErrorConnection
+	} else if status := transport.Status(pkt.VBucket); status != transport.SUCCESS {
+		fmsg := "%v ##%x doHelo response status %v"
+		logging.Warnf(fmsg, prefix, rq.Opaque, status)
+		return enabled, nil
+	}
+	for i := 0; i+2 <= len(pkt.Body); i += 2 {
+		enabled[binary.BigEndian.Uint16(pkt.Body[i:])] = true
+	}
+	return enabled, nil
+}
+
 func (feed *DcpFeed) doDcpRequestStream(
 	vbno, opaqueMSB uint16, flags uint32,
 	vuuid, startSequence, endSequence, snapStart, snapEnd uint64) error {
@@ -728,6 +799,8 @@ type DcpEvent struct {
 	Key, Value []byte                // Item key/value
 	OldValue   []byte                // TODO: TBD: old document value
 	Cas        uint64                // CAS value of the item
+	Datatype   uint8                 // datatype of the value
+	Xattrs     map[string][]byte     // extended attributes, if negotiated
 	// meta fields
 	Seqno uint64 // seqno. of the mutation, doubles as rollback-seqno
 	// https://issues.couchbase.com/browse/MB-15333,
@@ -749,15 +822,28 @@ type DcpEvent struct {
 
 func newDcpEvent(rq *transport.MCRequest, stream *DcpStream) *DcpEvent {
 	event := &DcpEvent{
-		Opcode:  rq.Opcode,
-		VBucket: stream.Vbucket,
-		VBuuid:  stream.Vbuuid,
-		Ctime:   time.Now().UnixNano(),
+		Opcode:   rq.Opcode,
+		VBucket:  stream.Vbucket,
+		VBuuid:   stream.Vbuuid,
+		Cas:      rq.Cas,
+		Datatype: rq.DataType,
+		Ctime:    time.Now().UnixNano(),
 	}
 	event.Key = make([]byte, len(rq.Key))
 	copy(event.Key, rq.Key)
 	event.Value = make([]byte, len(rq.Body))
 	copy(event.Value, rq.Body)
+	if rq.DataType&transport.DATATYPE_XATTR != 0 {
+		// a value that cannot be separated from its xattrs is not
+		// the document, do not let evaluators index it.
+		xattrs, value, err := parseXattrs(event.Value)
+		if err != nil {
+			logging.Errorf("DcpEvent %q: %v, dropping value", rq.Key, err)
+			event.Value = nil
+		} else {
+			event.Xattrs, event.Value = xattrs, value
+		}
+	}
 
 	// 16 LSBits are used by client library to encode vbucket number.
 	// 16 MSBits are left for application to multiplex on opaque value.
@@ -886,6 +972,39 @@ func parseGetSeqnos(body []byte) (map[uint16]uint64, error) {
 	return seqnos, nil
 }
 
+// parse extended attributes prefixed to the value of a document, returns
+// the attributes and the document value. The xattr section is a 4 byte
+// length followed by key-value pairs, each encoded as a 4 byte length
+// followed by null terminated key and value.
+func parseXattrs(body []byte) (map[string][]byte, []byte, error) {
+	if len(body) < 4 {
+		return nil, nil, fmt.Errorf("invalid body length %v, in xattrs", len(body))
+	}
+	xlen := int(binary.BigEndian.Uint32(body))
+	if xlen > len(body)-4 {
+		return nil, nil, fmt.Errorf("invalid xattrs length %v", xlen)
+	}
+	xattrs := make(map[string][]byte)
+	section := body[4 : 4+xlen]
+	for len(section) > 0 {
+		if len(section) < 4 {
+			return nil, nil, fmt.Errorf("truncated xattr pair")
+		}
+		plen := int(binary.BigEndian.Uint32(section))
+		if plen > len(section)-4 {
+			return nil, nil, fmt.Errorf("invalid xattr pair length %v", plen)
+		}
+		pair := section[4 : 4+plen]
+		k := bytes.IndexByte(pair, 0)
+		if k < 0 || len(pair) == k+1 || pair[len(pair)-1] != 0 {
+			return nil, nil, fmt.Errorf("invalid xattr pair %q", pair)
+		}
+		xattrs[string(pair[:k])] = pair[k+1 : len(pair)-1]
+		section = section[4+plen:]
+	}
+	return xattrs, body[4+xlen:], nil
+}
+
 func computeLatency(stream *DcpStream) int64 {
 	now := time.Now().UnixNano()
 	strm_seqno := stream.Seqno
@@ -0,0 +1,125 @@
+package memcached
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/indexing/secondary/dcp/transport"
+)
+
+func TestNewDcpEventXattrs(t *testing.T) {
+	pairs := []string{"_sync\x00{\"rev\":1}\x00", "meta\x00\"x\"\x00"}
+	section := []byte{}
+	for _, pair := range pairs {
+		plen := make([]byte, 4)
+		binary.BigEndian.PutUint32(plen, uint32(len(pair)))
+		section = append(append(section, plen...), pair...)
+	}
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, uint32(len(section)))
+	body = append(append(body, section...), `{"age":10}`...)
+
+	rq := &transport.MCRequest{
+		Opcode:   transport.DCP_MUTATION,
+		Cas:      0x1234,
+		DataType: transport.DATATYPE_JSON | transport.DATATYPE_XATTR,
+		Key:      []byte("doc"),
+		Body:     body,
+	}
+	event := newDcpEvent(rq, &DcpStream{Vbucket: 1})
+	if event.Cas != 0x1234 {
+		t.Errorf("expected cas %x, got %x", 0x1234, event.Cas)
+	}
+	if event.Datatype != rq.DataType {
+		t.Errorf("expected datatype %v, got %v", rq.DataType, event.Datatype)
+	}
+	if string(event.Value) != `{"age":10}` {
+		t.Errorf("unexpected value %q", event.Value)
+	}
+	ref := map[string][]byte{"_sync": []byte(`{"rev":1}`), "meta": []byte(`"x"`)}
+	if !reflect.DeepEqual(event.Xattrs, ref) {
+		t.Errorf("expected xattrs %q, got %q", ref, event.Xattrs)
+	}
+
+	// without xattrs the value is left as is
+	rq.DataType = transport.DATATYPE_JSON
+	event = newDcpEvent(rq, &DcpStream{Vbucket: 1})
+	if event.Xattrs != nil || len(event.Value) != len(body) {
+		t.Errorf("unexpected xattrs %q", event.Xattrs)
+	}
+
+	// malformed sections
+	for _, bad := range [][]byte{{0, 0}, {0, 0, 0, 9, 0}, {0, 0, 0, 2, 0, 0}} {
+		if _, _, err := parseXattrs(bad); err == nil {
+			t.Errorf("expected error for %v", bad)
+		}
+	}
+
+	// value with a malformed xattr section is dropped
+	rq.DataType = transport.DATATYPE_JSON | transport.DATATYPE_XATTR
+	rq.Body = []byte{0, 0, 0, 9, 0}
+	event = newDcpEvent(rq, &DcpStream{Vbucket: 1})
+	if event.Value != nil || event.Xattrs != nil {
+		t.Errorf("unexpected value %q, xattrs %q", event.Value, event.Xattrs)
+	}
+}
+
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (c *bufferConn) Close() error {
+	return nil
+}
+
+func TestDcpOpenHelo(t *testing.T) {
+	for _, xattrs := range []bool{false, true} {
+		conn := &bufferConn{}
+		mc, _ := Wrap(conn)
+		feed := &DcpFeed{conn: mc, xattrs: xattrs, logPrefix: "test"}
+
+		enabled := make([]byte, 4)
+		binary.BigEndian.PutUint16(enabled, transport.FEATURE_JSON)
+		binary.BigEndian.PutUint16(enabled[2:], transport.FEATURE_XATTR)
+		rcvch := make(chan []interface{}, 2)
+		rcvch <- []interface{}{&transport.MCRequest{
+			Opcode: transport.HELO, Opaque: opaqueHelo, Body: enabled}}
+		rcvch <- []interface{}{&transport.MCRequest{
+			Opcode: transport.DCP_OPEN, Opaque: opaqueOpen}}
+
+		if err := feed.doDcpOpen("test", 0, 0, 0, rcvch); err != nil {
+			t.Fatal(err)
+		}
+
+		hdr := make([]byte, transport.HDR_LEN)
+		helo := &transport.MCRequest{}
+		if _, err := helo.Receive(conn, hdr); err != nil {
+			t.Fatal(err)
+		}
+		features := []uint16{transport.FEATURE_JSON}
+		if xattrs {
+			features = append(features, transport.FEATURE_XATTR)
+		}
+		var got []uint16
+		for i := 0; i+2 <= len(helo.Body); i += 2 {
+			got = append(got, binary.BigEndian.Uint16(helo.Body[i:]))
+		}
+		if helo.Opcode != transport.HELO || !reflect.DeepEqual(got, features) {
+			t.Errorf("xattrs %v: expected HELO with %v, got %v %v",
+				xattrs, features, helo.Opcode, got)
+		}
+
+		open := &transport.MCRequest{}
+		if _, err := open.Receive(conn, hdr); err != nil {
+			t.Fatal(err)
+		}
+		flags := binary.BigEndian.Uint32(open.Extras[4:])
+		if open.Opcode != transport.DCP_OPEN ||
+			(flags&transport.DCP_OPEN_INCLUDE_XATTRS != 0) != xattrs {
+			t.Errorf("xattrs %v: unexpected DCP_OPEN %v flags %x",
+				xattrs, open.Opcode, flags)
+		}
+	}
+}
@@ -55,6 +55,8 @@ const (
 	RDECR      = CommandCode(0x3b)
 	RDECRQ     = CommandCode(0x3c)
 
+	HELO = CommandCode(0x1f) // Negotiate features with the server
+
 	SASL_LIST_MECHS = CommandCode(0x20)
 	SASL_AUTH       = CommandCode(0x21)
 	SASL_STEP       = CommandCode(0x22)
@@ -108,6 +110,25 @@ const (
 	TMPFAIL         = Status(0x86)
 )
 
+// Feature codes negotiated with HELO.
+const (
+	FEATURE_XATTR = uint16(0x06) // Extended attributes
+	FEATURE_JSON  = uint16(0x0b) // JSON datatype
+)
+
+// Datatype bits of a memcached packet.
+const (
+	DATATYPE_JSON   = uint8(0x01)
+	DATATYPE_SNAPPY = uint8(0x02)
+	DATATYPE_XATTR  = uint8(0x04)
+)
+
+// Flags for DCP_OPEN.
+const (
+	DCP_OPEN_PRODUCER       = uint32(0x01)
+	DCP_OPEN_INCLUDE_XATTRS = uint32(0x04)
+)
+
 // MCItem is an internal representation of an item.
 type MCItem struct {
 	Cas               uint64
@@ -180,6 +201,7 @@ func init() {
 	CommandNames[TAP_CHECKPOINT_START] = "TAP_CHECKPOINT_START"
 	CommandNames[TAP_CHECKPOINT_END] = "TAP_CHECKPOINT_END"
 
+	CommandNames[HELO] = "HELO"
 	CommandNames[DCP_OPEN] = "DCP_OPEN"
 	CommandNames[DCP_ADDSTREAM] = "DCP_ADDSTREAM"
 	CommandNames[DCP_CLOSESTREAM] = "DCP_CLOSESTREAM"
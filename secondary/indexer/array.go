@@ -72,6 +72,13 @@ func splitSecondaryArrayKey(key []byte, arrayPos int, tmpBuf []byte) ([][][]byte
 }
 
 func ArrayIndexItems(bs []byte, arrPos int, buf []byte, isDistinct bool) ([][]byte, []int, error) {
+	return arrayIndexItems(bs, arrPos, buf, isDistinct, maxIndexEntrySize, maxArrayIndexEntrySize)
+}
+
+// arrayIndexItems splits an array key into index items, failing if an item
+// is larger than maxItemSize or the items are larger than maxSize in total
+func arrayIndexItems(bs []byte, arrPos int, buf []byte, isDistinct bool,
+	maxItemSize, maxSize int) ([][]byte, []int, error) {
 	var items [][]byte
 	var err error
 
@@ -87,12 +94,12 @@ func ArrayIndexItems(bs []byte, arrPos int, buf []byte, isDistinct bool) ([][]by
 			return nil, nil, err
 		}
 		l := len(buf)
-		if (l - from) > maxIndexEntrySize {
-			logging.Errorf("Encoded array item key too long. Length of key = %v, Limit = %v", buf[from:l], maxIndexEntrySize)
+		if (l - from) > maxItemSize {
+			logging.Errorf("Encoded array item key too long. Length of key = %v, Limit = %v", buf[from:l], maxItemSize)
 			return nil, nil, ErrArrayItemKeyTooLong
 		}
-		if l > maxArrayIndexEntrySize {
-			logging.Errorf("Encoded array key too long. Length of key = %v, Limit = %v", l, maxArrayIndexEntrySize)
+		if l > maxSize {
+			logging.Errorf("Encoded array key too long. Length of key = %v, Limit = %v", l, maxSize)
 			return nil, nil, ErrArrayKeyTooLong
 		}
 		items = append(items, buf[from:l])
@@ -151,3 +158,14 @@ func CompareArrayEntriesWithCount(newKey, oldKey [][]byte, newKeyCount, oldKeyCo
 	}
 	return newKey, oldKey
 }
+
+// isNilEntries returns true if all entries are marked nil by
+// CompareArrayEntriesWithCount
+func isNilEntries(entries [][]byte) bool {
+	for _, e := range entries {
+		if e != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package indexer
+
+import (
+	"fmt"
+	"github.com/couchbase/indexing/secondary/common"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestBPTreeSlice(t *testing.T, path string) *bptreeSlice {
+	stats := &IndexStats{}
+	stats.Init()
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	idxDefn := common.IndexDefn{DefnId: common.IndexDefnId(0)}
+	slice, err := NewBPTreeSlice(path, SliceId(0), idxDefn, common.IndexInstId(0),
+		false, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slice
+}
+
+//closeBPTreeSlice waits for snapshots being destroyed before closing
+//the slice, so that the data files can be reopened
+func closeBPTreeSlice(t *testing.T, b *bptreeSlice) {
+	for i := 0; ; i++ {
+		b.lock.RLock()
+		refCount := b.refCount
+		b.lock.RUnlock()
+		if refCount == 0 {
+			break
+		} else if i == 100 {
+			t.Fatalf("Expected snapshots to be closed, %v still open", refCount)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Close()
+}
+
+func TestBPTreeSlice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bptreeslice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "slice")
+	b := newTestBPTreeSlice(t, path)
+	var slice Slice = b
+
+	insert := func(prefix string, n int, key string) {
+		for i := 0; i < n; i++ {
+			meta := NewMutationMeta()
+			docid := []byte(fmt.Sprintf("%v-%d", prefix, i))
+			err := slice.Insert([]byte(fmt.Sprintf("[\"%v-%d\"]", key, i)), docid, meta)
+			meta.Free()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	del := func(docid string) {
+		meta := NewMutationMeta()
+		defer meta.Free()
+		if err := slice.Delete([]byte(docid), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	docids := func(info SnapshotInfo) map[string]bool {
+		snap, err := slice.OpenSnapshot(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		ids := make(map[string]bool)
+		err = snap.All(func(entry []byte) error {
+			ids[string(docIdFromEntryBytes(entry))] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := snap.CountTotal(nil)
+		if err != nil || count != uint64(len(ids)) {
+			t.Errorf("Expected count %v, got %v (%v)", len(ids), count, err)
+		}
+		return ids
+	}
+
+	expectDocids := func(info SnapshotInfo, expected ...string) {
+		got := docids(info)
+		if len(got) != len(expected) {
+			t.Errorf("Expected %v entries, got %v", len(expected), len(got))
+		}
+		for _, docid := range expected {
+			if !got[docid] {
+				t.Errorf("Expected entry %v", docid)
+			}
+		}
+	}
+
+	//persist a snapshot after updates and deletes
+	insert("docid", 4, "key")
+	insert("docid", 2, "newkey")
+	del("docid-3")
+
+	ts := common.NewTsVbuuid("default", 4)
+	ts.Seqnos[0], ts.Vbuuids[0] = 10, 1
+	info, err := slice.NewSnapshot(ts, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDocids(info, "docid-0", "docid-1", "docid-2")
+	if n := slice.GetCommittedCount(); n != 3 {
+		t.Errorf("Expected 3 committed items, got %v", n)
+	}
+
+	//in-memory snapshots see writes since the persisted snapshot
+	insert("newdoc", 2, "key")
+	info, err = slice.NewSnapshot(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDocids(info, "docid-0", "docid-1", "docid-2", "newdoc-0", "newdoc-1")
+
+	//rollback drops them
+	infos, err := slice.GetSnapshots()
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("Expected a disk snapshot, got %v (%v)", len(infos), err)
+	}
+	if err := slice.Rollback(infos[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectDocids(infos[0], "docid-0", "docid-1", "docid-2")
+	if n := slice.GetCommittedCount(); n != 3 {
+		t.Errorf("Expected 3 committed items after rollback, got %v", n)
+	}
+
+	//persisted snapshots are recovered along with their timestamp
+	closeBPTreeSlice(t, b)
+	b = newTestBPTreeSlice(t, path)
+	slice = b
+	defer func() { closeBPTreeSlice(t, b) }()
+
+	infos, err = slice.GetSnapshots()
+	if err != nil || len(infos) != 1 {
+		t.Fatalf("Expected a recovered disk snapshot, got %v (%v)", len(infos), err)
+	}
+	if rts := infos[0].Timestamp(); rts == nil || rts.Seqnos[0] != 10 || rts.Vbuuids[0] != 1 {
+		t.Errorf("Unexpected recovered timestamp %v", rts)
+	}
+	expectDocids(infos[0], "docid-0", "docid-1", "docid-2")
+
+	//the back index is recovered as well, updates replace old entries
+	insert("docid", 1, "otherkey")
+	del("docid-2")
+	info, err = slice.NewSnapshot(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDocids(info, "docid-0", "docid-1")
+
+	if err := slice.RollbackToZero(); err != nil {
+		t.Fatal(err)
+	}
+	info, err = slice.NewSnapshot(nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectDocids(info)
+}
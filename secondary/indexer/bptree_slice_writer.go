@@ -0,0 +1,1052 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/indexing/secondary/bptree"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/common/queryutil"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/platform"
+	"os"
+	"sync"
+	"time"
+)
+
+//NewBPTreeSlice initializes a new slice with the bptree storage engine.
+//Main and back index are kept as separate kvstores of a single database
+//so that a persisted snapshot commits both atomically.
+//Slice methods are not thread-safe and application needs to
+//handle the synchronization. The only exception being Insert and
+//Delete can be called concurrently.
+//Returns error in case slice cannot be initialized.
+func NewBPTreeSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
+	idxInstId common.IndexInstId, isPrimary bool,
+	sysconf common.Config, idxStats *IndexStats) (*bptreeSlice, error) {
+
+	slice := &bptreeSlice{}
+	slice.idxStats = idxStats
+
+	slice.get_bytes = platform.NewAlignedInt64(0)
+	slice.insert_bytes = platform.NewAlignedInt64(0)
+	slice.delete_bytes = platform.NewAlignedInt64(0)
+	slice.flushedCount = platform.NewAlignedUint64(0)
+	slice.committedCount = platform.NewAlignedUint64(0)
+
+	config := bptree.DefaultConfig()
+	config.SetNodeSize(sysconf["settings.bptree.node_size"].Int())
+	config.SetCacheSize(int64(sysconf["settings.bptree.cache_size"].Uint64()))
+	config.SetSyncCommit(sysconf["settings.bptree.sync_commit"].Bool())
+
+	var err error
+	if slice.db, err = bptree.Open(path, config); err != nil {
+		logging.Errorf("BPTreeSlice::NewBPTreeSlice Error Opening Slice %v. Error %v", path, err)
+		return nil, err
+	}
+
+	slice.main = slice.db.OpenKVStore("main")
+
+	//create a separate back-index for non-primary indexes
+	if !isPrimary {
+		slice.back = slice.db.OpenKVStore("back")
+	}
+
+	slice.sysconf = sysconf
+	slice.path = path
+	slice.idxInstId = idxInstId
+	slice.idxDefnId = idxDefn.DefnId
+	slice.idxDefn = idxDefn
+	slice.id = sliceId
+	slice.isPrimary = isPrimary
+
+	// Array related initialization
+	_, slice.isArrayDistinct, slice.arrayExprPosition, err = queryutil.GetArrayExpressionPosition(idxDefn.SecExprs)
+	if err != nil {
+		return nil, err
+	}
+
+	sliceBufSize := sysconf["settings.sliceBufSize"].Uint64()
+	slice.cmdCh = make(chan interface{}, sliceBufSize)
+	slice.workerDone = make(chan bool)
+	slice.stopCh = make(DoneChannel)
+
+	go slice.handleCommandsWorker()
+
+	logging.Infof("BPTreeSlice:NewBPTreeSlice Created New Slice Id %v IndexInstId %v",
+		sliceId, idxInstId)
+
+	slice.setCommittedCount(slice.main.Count())
+
+	return slice, nil
+}
+
+//bptreeSlice represents a slice backed by the bptree storage engine
+type bptreeSlice struct {
+	get_bytes, insert_bytes, delete_bytes platform.AlignedInt64
+	//flushed count
+	flushedCount platform.AlignedUint64
+	// persisted items count
+	committedCount platform.AlignedUint64
+
+	path string
+	id   SliceId
+
+	refCount int
+	lock     sync.RWMutex
+
+	db   *bptree.DB
+	main *bptree.KVStore // handle for forward index
+	back *bptree.KVStore // handle for reverse index
+
+	idxDefn   common.IndexDefn
+	idxDefnId common.IndexDefnId
+	idxInstId common.IndexInstId
+
+	status        SliceStatus
+	isActive      bool
+	isDirty       bool
+	isPrimary     bool
+	isSoftDeleted bool
+	isSoftClosed  bool
+
+	cmdCh      chan interface{} //internal channel to buffer commands
+	stopCh     DoneChannel      //internal channel to signal shutdown
+	workerDone chan bool        //worker status check channel
+
+	fatalDbErr error //store any fatal DB error
+
+	totalFlushTime  time.Duration
+	totalCommitTime time.Duration
+
+	idxStats *IndexStats
+	sysconf  common.Config
+	confLock sync.RWMutex
+
+	// Array processing
+	arrayExprPosition int
+	isArrayDistinct   bool
+}
+
+func (b *bptreeSlice) IncrRef() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refCount++
+}
+
+func (b *bptreeSlice) DecrRef() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.refCount--
+	if b.refCount == 0 {
+		if b.isSoftClosed {
+			tryCloseBPTreeSlice(b)
+		}
+		if b.isSoftDeleted {
+			tryDeleteBPTreeSlice(b)
+		}
+	}
+}
+
+//Insert will insert the given key/value pair from slice.
+//Internally the request is buffered and executed async.
+//If the slice has encountered any fatal error condition,
+//it will be returned as error.
+func (b *bptreeSlice) Insert(rawKey []byte, docid []byte, meta *MutationMeta) error {
+	key, err := GetIndexEntryBytes(rawKey, docid, b.idxDefn.IsPrimary, b.idxDefn.IsArrayIndex, 1)
+	if err != nil {
+		return err
+	}
+
+	b.idxStats.numDocsFlushQueued.Add(1)
+	b.cmdCh <- &indexItem{key: key, rawKey: rawKey, docid: docid, pos: newDocPos(meta)}
+	return b.fatalDbErr
+}
+
+//Delete will delete the given document from slice.
+//Internally the request is buffered and executed async.
+//If the slice has encountered any fatal error condition,
+//it will be returned as error.
+func (b *bptreeSlice) Delete(docid []byte, meta *MutationMeta) error {
+	b.idxStats.numDocsFlushQueued.Add(1)
+	b.cmdCh <- docid
+	return b.fatalDbErr
+}
+
+//handleCommandsWorker keeps listening to any buffered
+//write requests for the slice and processes those.
+//bptree supports a single writer.
+func (b *bptreeSlice) handleCommandsWorker() {
+
+	var start time.Time
+	var c interface{}
+
+loop:
+	for {
+		var nmut int
+		select {
+		case c = <-b.cmdCh:
+			switch cmd := c.(type) {
+			case *indexItem:
+				start = time.Now()
+				nmut = b.insert(cmd.key, cmd.rawKey, cmd.docid, cmd.pos)
+				b.totalFlushTime += time.Since(start)
+
+			case []byte:
+				start = time.Now()
+				nmut = b.delete(cmd)
+				b.totalFlushTime += time.Since(start)
+
+			default:
+				logging.Errorf("BPTreeSlice::handleCommandsWorker \n\tSliceId %v IndexInstId %v Received "+
+					"Unknown Command %v", b.id, b.idxInstId, c)
+			}
+
+			b.idxStats.numItemsFlushed.Add(int64(nmut))
+			b.idxStats.numDocsIndexed.Add(1)
+
+		case <-b.stopCh:
+			b.stopCh <- true
+			break loop
+
+			//worker gets a status check message on this channel, it responds
+			//when its not processing any mutation
+		case <-b.workerDone:
+			b.workerDone <- true
+		}
+	}
+}
+
+func (b *bptreeSlice) insert(key []byte, rawKey []byte, docid []byte, pos docPos) int {
+	var nmut int
+
+	if b.isPrimary {
+		nmut = b.insertPrimaryIndex(key, docid)
+	} else if !b.idxDefn.IsArrayIndex {
+		nmut = b.insertSecIndex(key, docid)
+	} else {
+		nmut = b.insertSecArrayIndex(key, rawKey, docid, pos)
+	}
+
+	b.logWriterStat()
+	return nmut
+}
+
+func (b *bptreeSlice) insertPrimaryIndex(key []byte, docid []byte) int {
+	t0 := time.Now()
+	_, err := b.main.Get(key)
+	b.idxStats.Timings.stKVGet.Put(time.Now().Sub(t0))
+
+	if err == nil {
+		logging.Tracef("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Key %v Already Exists. "+
+			"Primary Index Update Skipped.", b.id, b.idxInstId, string(docid))
+	} else if err != bptree.ErrNotFound {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error locating "+
+			"mainindex entry %v", b.id, b.idxInstId, err)
+	} else {
+		t0 := time.Now()
+		if err = b.main.Put(key, nil); err != nil {
+			b.checkFatalDbError(err)
+			logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error in Main Index Set. "+
+				"Skipped Key %s. Error %v", b.id, b.idxInstId, string(docid), err)
+		}
+		b.idxStats.Timings.stKVSet.Put(time.Now().Sub(t0))
+		platform.AddInt64(&b.insert_bytes, int64(len(key)))
+		b.isDirty = true
+	}
+
+	return 1
+}
+
+func (b *bptreeSlice) insertSecIndex(key []byte, docid []byte) (nmut int) {
+	var err error
+	var oldkey []byte
+
+	//check if the docid exists in the back index
+	if oldkey, err = b.getBackIndexEntry(docid); err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error locating "+
+			"backindex entry %v", b.id, b.idxInstId, err)
+		return
+	} else if oldkey != nil {
+		//If old-key from backindex matches with the new-key
+		//in mutation, skip it.
+		if bytes.Equal(oldkey, key) {
+			logging.Tracef("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Received Unchanged Key for "+
+				"Doc Id %v. Key %v. Skipped.", b.id, b.idxInstId, string(docid), key)
+			b.idxStats.numWritesSkipped.Add(1)
+			return
+		}
+
+		//there is already an entry in main index for this docid
+		//delete from main index
+		if err = b.deleteKV(b.main, oldkey); err != nil {
+			return
+		}
+
+		// If a field value changed from "existing" to "missing" (ie, key = nil),
+		// we need to remove back index entry corresponding to the previous "existing" value.
+		if key == nil {
+			if err = b.deleteKV(b.back, docid); err != nil {
+				return
+			}
+		}
+		b.isDirty = true
+	}
+
+	if key == nil {
+		logging.Tracef("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Received NIL Key for "+
+			"Doc Id %s. Skipped.", b.id, b.idxInstId, docid)
+		return
+	}
+
+	//set the back index entry <docid, encodedkey>
+	if err = b.setKV(b.back, docid, key); err != nil {
+		return
+	}
+
+	//set in main index
+	if err = b.setKV(b.main, key, nil); err != nil {
+		return
+	}
+	b.isDirty = true
+
+	nmut = 1
+	return
+}
+
+func (b *bptreeSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte, pos docPos) (nmut int) {
+	var err error
+	var oldkey []byte
+
+	//check if the docid exists in the back index and Get old key from back index
+	if oldkey, err = b.getBackIndexEntry(docid); err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error locating "+
+			"backindex entry %v", b.id, b.idxInstId, err)
+		return
+	}
+
+	var oldEntriesBytes, newEntriesBytes [][]byte
+	var oldKeyCount, newKeyCount []int
+	if oldkey != nil {
+		if bytes.Equal(oldkey, key) {
+			logging.Tracef("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Received Unchanged Key for "+
+				"Doc Id %v. Key %v. Skipped.", b.id, b.idxInstId, string(docid), key)
+			b.idxStats.numWritesSkipped.Add(1)
+			return
+		}
+
+		tmpBufPtr := arrayEncBufPool.Get()
+		defer arrayEncBufPool.Put(tmpBufPtr)
+		if oldEntriesBytes, oldKeyCount, err = ArrayIndexItems(oldkey, b.arrayExprPosition,
+			(*tmpBufPtr)[:0], b.isArrayDistinct); err != nil {
+			b.checkFatalDbError(err)
+			logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error in retrieving "+
+				"compostite old secondary keys %v", b.id, b.idxInstId, err)
+			return
+		}
+	}
+
+	if key != nil {
+		tmpBufPtr := arrayEncBufPool.Get()
+		defer arrayEncBufPool.Put(tmpBufPtr)
+		newEntriesBytes, newKeyCount, err = ArrayIndexItems(key, b.arrayExprPosition,
+			(*tmpBufPtr)[:0], b.isArrayDistinct)
+		if err == ErrArrayItemKeyTooLong {
+			logging.Errorf("BPTreeSlice::insert Error indexing docid: %s in Slice: %v. Error: Encoded array item too long (> %v). Skipped.",
+				docid, b.id, maxIndexEntrySize)
+			logging.Verbosef("BPTreeSlice::insert Skipped docid: %s Key: %s", docid, string(key))
+			b.idxStats.addDocError(docErrorClass(err), docid, rawKey, pos, err.Error())
+			b.deleteSecArrayIndex(docid)
+			return
+		} else if err == ErrArrayKeyTooLong {
+			logging.Errorf("BPTreeSlice::insert Error indexing docid: %s in Slice: %v. Error: Encoded array key too long (> %v). Skipped.",
+				docid, b.id, maxArrayIndexEntrySize)
+			logging.Verbosef("BPTreeSlice::insert Skipped docid: %s Key: %s", docid, string(key))
+			b.idxStats.addDocError(docErrorClass(err), docid, rawKey, pos, err.Error())
+			b.deleteSecArrayIndex(docid)
+			return
+		} else if err != nil {
+			b.checkFatalDbError(err)
+			logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error in creating "+
+				"compostite new secondary keys %v", b.id, b.idxInstId, err)
+			return
+		}
+	}
+
+	var indexEntriesToBeAdded, indexEntriesToBeDeleted [][]byte
+	if len(oldEntriesBytes) == 0 { // It is a new key. Nothing to delete
+		indexEntriesToBeAdded = newEntriesBytes
+	} else if len(newEntriesBytes) == 0 { // New key is nil. Nothing to add
+		indexEntriesToBeDeleted = oldEntriesBytes
+	} else {
+		indexEntriesToBeAdded, indexEntriesToBeDeleted = CompareArrayEntriesWithCount(newEntriesBytes, oldEntriesBytes, newKeyCount, oldKeyCount)
+	}
+
+	tmpBufPtr := encBufPool.Get()
+	defer encBufPool.Put(tmpBufPtr)
+
+	// Delete each of indexEntriesToBeDeleted from main index
+	for i, item := range indexEntriesToBeDeleted {
+		if item != nil { // nil item indicates it should not be deleted
+			var keyToBeDeleted []byte
+			if keyToBeDeleted, err = GetIndexEntryBytes2(item, docid, false, false, oldKeyCount[i], (*tmpBufPtr)[:0]); err != nil {
+				b.checkFatalDbError(err)
+				logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error from GetIndexEntryBytes2 "+
+					"for entry to be deleted from main index %v", b.id, b.idxInstId, err)
+				return
+			}
+			if err = b.deleteKV(b.main, keyToBeDeleted); err != nil {
+				return
+			}
+			nmut++
+		}
+	}
+
+	// Insert each of indexEntriesToBeAdded into main index
+	for i, item := range indexEntriesToBeAdded {
+		if item != nil { // nil item indicates it should not be added
+			var keyToBeAdded []byte
+			if keyToBeAdded, err = GetIndexEntryBytes2(item, docid, false, false, newKeyCount[i], (*tmpBufPtr)[:0]); err != nil {
+				b.checkFatalDbError(err)
+				logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error from GetIndexEntryBytes2 "+
+					"for entry to be added to main index %v", b.id, b.idxInstId, err)
+				return
+			}
+			if err = b.setKV(b.main, keyToBeAdded, nil); err != nil {
+				return
+			}
+			nmut++
+		}
+	}
+
+	// If a field value changed from "existing" to "missing" (ie, key = nil),
+	// we need to remove back index entry corresponding to the previous "existing" value.
+	if key == nil {
+		if err = b.deleteKV(b.back, docid); err != nil {
+			return
+		}
+	} else { //set the back index entry <docid, encodedkey>
+		if err = b.setKV(b.back, docid, key); err != nil {
+			return
+		}
+	}
+
+	b.isDirty = true
+	return nmut
+}
+
+func (b *bptreeSlice) delete(docid []byte) int {
+	var nmut int
+
+	if b.isPrimary {
+		nmut = b.deletePrimaryIndex(docid)
+	} else if !b.idxDefn.IsArrayIndex {
+		nmut = b.deleteSecIndex(docid)
+	} else {
+		nmut = b.deleteSecArrayIndex(docid)
+	}
+
+	b.logWriterStat()
+	return nmut
+}
+
+func (b *bptreeSlice) deletePrimaryIndex(docid []byte) (nmut int) {
+	if docid == nil {
+		common.CrashOnError(errors.New("Nil Primary Key"))
+		return
+	}
+
+	//docid -> key format
+	entry, err := NewPrimaryIndexEntry(docid)
+	common.CrashOnError(err)
+
+	//delete from main index
+	if err := b.deleteKV(b.main, entry.Bytes()); err != nil {
+		return
+	}
+	b.isDirty = true
+
+	return 1
+}
+
+func (b *bptreeSlice) deleteSecIndex(docid []byte) (nmut int) {
+	olditm, err := b.getBackIndexEntry(docid)
+	if err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v. Error locating "+
+			"backindex entry for Doc %s. Error %v", b.id, b.idxInstId, docid, err)
+		return
+	}
+
+	//if the oldkey is nil, nothing needs to be done. This is the case of deletes
+	//which happened before index was created.
+	if olditm == nil {
+		logging.Tracef("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v Received NIL Key for "+
+			"Doc Id %v. Skipped.", b.id, b.idxInstId, docid)
+		return
+	}
+
+	//delete from main index
+	if err = b.deleteKV(b.main, olditm); err != nil {
+		return
+	}
+
+	//delete from the back index
+	if err = b.deleteKV(b.back, docid); err != nil {
+		return
+	}
+	b.isDirty = true
+	return 1
+}
+
+func (b *bptreeSlice) deleteSecArrayIndex(docid []byte) (nmut int) {
+	olditm, err := b.getBackIndexEntry(docid)
+	if err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v. Error locating "+
+			"backindex entry for Doc %s. Error %v", b.id, b.idxInstId, docid, err)
+		return
+	}
+
+	if olditm == nil {
+		logging.Tracef("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v Received NIL Key for "+
+			"Doc Id %v. Skipped.", b.id, b.idxInstId, docid)
+		return
+	}
+
+	tmpBufPtr := arrayEncBufPool.Get()
+	defer arrayEncBufPool.Put(tmpBufPtr)
+	indexEntriesToBeDeleted, keyCount, err := ArrayIndexItems(olditm, b.arrayExprPosition,
+		(*tmpBufPtr)[:0], b.isArrayDistinct)
+	if err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v Error in retrieving "+
+			"compostite old secondary keys %v", b.id, b.idxInstId, err)
+		return
+	}
+
+	keyBufPtr := encBufPool.Get()
+	defer encBufPool.Put(keyBufPtr)
+
+	// Delete each of indexEntriesToBeDeleted from main index
+	for i, item := range indexEntriesToBeDeleted {
+		var keyToBeDeleted []byte
+		if keyToBeDeleted, err = GetIndexEntryBytes2(item, docid, false, false, keyCount[i], (*keyBufPtr)[:0]); err != nil {
+			b.checkFatalDbError(err)
+			logging.Errorf("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v Error from GetIndexEntryBytes2 "+
+				"for entry to be deleted from main index %v", b.id, b.idxInstId, err)
+			return
+		}
+		if err = b.deleteKV(b.main, keyToBeDeleted); err != nil {
+			return
+		}
+	}
+
+	//delete from the back index
+	if err = b.deleteKV(b.back, docid); err != nil {
+		return
+	}
+	b.isDirty = true
+	return len(indexEntriesToBeDeleted)
+}
+
+func (b *bptreeSlice) setKV(kvs *bptree.KVStore, key, val []byte) error {
+	t0 := time.Now()
+	if err := kvs.Put(key, val); err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::insert \n\tSliceId %v IndexInstId %v Error in %v Index Set. "+
+			"Skipped Key %v. Error %v", b.id, b.idxInstId, kvs.Name(), key, err)
+		return err
+	}
+	b.idxStats.Timings.stKVSet.Put(time.Now().Sub(t0))
+	platform.AddInt64(&b.insert_bytes, int64(len(key)+len(val)))
+	return nil
+}
+
+func (b *bptreeSlice) deleteKV(kvs *bptree.KVStore, key []byte) error {
+	t0 := time.Now()
+	if _, err := kvs.Delete(key); err != nil {
+		b.checkFatalDbError(err)
+		logging.Errorf("BPTreeSlice::delete \n\tSliceId %v IndexInstId %v Error deleting "+
+			"entry from %v index %v", b.id, b.idxInstId, kvs.Name(), err)
+		return err
+	}
+	b.idxStats.Timings.stKVDelete.Put(time.Now().Sub(t0))
+	platform.AddInt64(&b.delete_bytes, int64(len(key)))
+	return nil
+}
+
+//getBackIndexEntry returns an existing back index entry
+//given the docid
+func (b *bptreeSlice) getBackIndexEntry(docid []byte) ([]byte, error) {
+	t0 := time.Now()
+	kbytes, err := b.back.Get(docid)
+	b.idxStats.Timings.stKVGet.Put(time.Now().Sub(t0))
+	platform.AddInt64(&b.get_bytes, int64(len(kbytes)))
+
+	if err == bptree.ErrNotFound {
+		return nil, nil
+	}
+
+	return kbytes, err
+}
+
+//checkFatalDbError checks if the error returned from DB
+//is fatal and stores it. This error will be returned
+//to caller on next DB operation
+func (b *bptreeSlice) checkFatalDbError(err error) {
+
+	//panic on all DB errors and recover rather than risk
+	//inconsistent db state
+	common.CrashOnError(err)
+
+	switch err {
+	case bptree.ErrCorrupted, bptree.ErrClosed:
+		b.fatalDbErr = err
+	}
+}
+
+// Creates an open snapshot handle from snapshot info
+// Snapshot info is obtained from NewSnapshot() or GetSnapshots() API
+// Returns error if snapshot handle cannot be created.
+//An in-memory snapshot is handed over to the first snapshot handle
+//opened from its info, it is closed along with the handle.
+func (b *bptreeSlice) OpenSnapshot(info SnapshotInfo) (Snapshot, error) {
+	snapInfo := info.(*bptreeSnapshotInfo)
+
+	s := &bptreeSnapshot{
+		slice:     b,
+		idxDefnId: b.idxDefnId,
+		idxInstId: b.idxInstId,
+		ts:        snapInfo.Timestamp(),
+		seq:       snapInfo.Seq,
+		committed: info.IsCommitted(),
+		snap:      snapInfo.snap,
+	}
+	snapInfo.snap = nil
+
+	logging.Infof("BPTreeSlice::OpenSnapshot SliceId %v IndexInstId %v Creating New "+
+		"Snapshot %v", b.id, b.idxInstId, snapInfo)
+	err := s.Create()
+
+	return s, err
+}
+
+func (b *bptreeSlice) setCommittedCount(count int64) {
+	platform.StoreUint64(&b.committedCount, uint64(count))
+}
+
+func (b *bptreeSlice) GetCommittedCount() uint64 {
+	return platform.LoadUint64(&b.committedCount)
+}
+
+//Rollback slice to given snapshot. Return error if
+//not possible
+func (b *bptreeSlice) Rollback(info SnapshotInfo) error {
+
+	//before rollback make sure there are no mutations
+	//in the slice buffer. Timekeeper will make sure there
+	//are no flush workers before calling rollback.
+	b.waitPersist()
+
+	snapInfo := info.(*bptreeSnapshotInfo)
+	if err := b.db.Rollback(snapInfo.Seq); err != nil {
+		logging.Errorf("BPTreeSlice::Rollback \n\tSliceId %v IndexInstId %v. Error Rollback "+
+			"to Snapshot %v. Error %v", b.id, b.idxInstId, info, err)
+		return err
+	}
+
+	b.setCommittedCount(b.main.Count())
+	return nil
+}
+
+//RollbackToZero rollbacks the slice to initial state. Return error if
+//not possible
+func (b *bptreeSlice) RollbackToZero() error {
+
+	b.waitPersist()
+
+	if err := b.db.Rollback(0); err != nil {
+		logging.Errorf("BPTreeSlice::Rollback SliceId %v IndexInstId %v. Error Rollback "+
+			"to Zero. Error %v", b.id, b.idxInstId, err)
+		return err
+	}
+
+	b.setCommittedCount(b.main.Count())
+	return nil
+}
+
+//slice insert/delete methods are async. There
+//can be outstanding mutations in internal queue to flush even
+//after insert/delete have return success to caller.
+//This method provides a mechanism to wait till internal
+//queue is empty.
+func (b *bptreeSlice) waitPersist() {
+
+	if !b.checkAllWorkersDone() {
+		//every SLICE_COMMIT_POLL_INTERVAL milliseconds,
+		//check for outstanding mutations. If there are
+		//none, proceed with the commit.
+		b.confLock.RLock()
+		commitPollInterval := b.sysconf["storage.bptree.commitPollInterval"].Uint64()
+		b.confLock.RUnlock()
+		ticker := time.NewTicker(time.Millisecond * time.Duration(commitPollInterval))
+		defer ticker.Stop()
+
+		for _ = range ticker.C {
+			if b.checkAllWorkersDone() {
+				break
+			}
+		}
+	}
+}
+
+//NewSnapshot creates a snapshot of the outstanding writes. A persisted
+//snapshot commits the data file along with the snapshot info. If it
+//returns error, slice should be rolled back to previous snapshot.
+func (b *bptreeSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotInfo, error) {
+
+	flushStart := time.Now()
+	b.waitPersist()
+	flushTime := time.Since(flushStart)
+
+	b.isDirty = false
+
+	newSnapshotInfo := &bptreeSnapshotInfo{
+		Ts:        ts,
+		Committed: commit,
+		CreatedAt: time.Now(),
+	}
+
+	if !commit {
+		newSnapshotInfo.snap = b.db.NewSnapshot()
+		return newSnapshotInfo, nil
+	}
+
+	// Snapshot info is stored along with the commit, its seqnum is
+	// assigned by the commit itself
+	newSnapshotInfo.ItemsCount = b.main.Count()
+	newSnapshotInfo.DataSize = b.db.Stats().DataSize
+	meta, err := json.Marshal(newSnapshotInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	snap, err := b.db.Commit(meta)
+	elapsed := time.Since(start)
+	b.idxStats.Timings.stCommit.Put(elapsed)
+
+	b.totalCommitTime += elapsed
+	logging.Infof("BPTreeSlice::Commit SliceId %v IndexInstId %v FlushTime %v CommitTime %v TotalFlushTime %v "+
+		"TotalCommitTime %v", b.id, b.idxInstId, flushTime, elapsed, b.totalFlushTime, b.totalCommitTime)
+
+	if err != nil {
+		logging.Errorf("BPTreeSlice::Commit \n\tSliceId %v IndexInstId %v Error in "+
+			"Index Commit %v", b.id, b.idxInstId, err)
+		return nil, err
+	}
+
+	newSnapshotInfo.Seq = snap.Seq()
+	newSnapshotInfo.snap = snap
+	b.setCommittedCount(snap.Count(b.main))
+
+	return newSnapshotInfo, nil
+}
+
+//checkAllWorkersDone return true if all workers have
+//finished processing
+func (b *bptreeSlice) checkAllWorkersDone() bool {
+
+	//if there are mutations in the cmdCh, workers are
+	//not yet done
+	if len(b.cmdCh) > 0 {
+		return false
+	}
+
+	//worker queue is empty, make sure the worker is done
+	//processing the last mutation
+	b.workerDone <- true
+	<-b.workerDone
+	return true
+}
+
+func (b *bptreeSlice) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	logging.Infof("BPTreeSlice::Close Closing Slice Id %v, IndexInstId %v, "+
+		"IndexDefnId %v", b.id, b.idxInstId, b.idxDefnId)
+
+	//signal shutdown for command handler routine
+	b.stopCh <- true
+	<-b.stopCh
+
+	if b.refCount > 0 {
+		b.isSoftClosed = true
+	} else {
+		tryCloseBPTreeSlice(b)
+	}
+}
+
+//Destroy removes the database file from disk.
+//Slice is not recoverable after this.
+func (b *bptreeSlice) Destroy() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.refCount > 0 {
+		logging.Infof("BPTreeSlice::Destroy Softdeleted Slice Id %v, IndexInstId %v, "+
+			"IndexDefnId %v", b.id, b.idxInstId, b.idxDefnId)
+		b.isSoftDeleted = true
+	} else {
+		tryDeleteBPTreeSlice(b)
+	}
+}
+
+//Id returns the Id for this Slice
+func (b *bptreeSlice) Id() SliceId {
+	return b.id
+}
+
+// FilePath returns the filepath for this Slice
+func (b *bptreeSlice) Path() string {
+	return b.path
+}
+
+//IsActive returns if the slice is active
+func (b *bptreeSlice) IsActive() bool {
+	return b.isActive
+}
+
+//SetActive sets the active state of this slice
+func (b *bptreeSlice) SetActive(isActive bool) {
+	b.isActive = isActive
+}
+
+//Status returns the status for this slice
+func (b *bptreeSlice) Status() SliceStatus {
+	return b.status
+}
+
+//SetStatus set new status for this slice
+func (b *bptreeSlice) SetStatus(status SliceStatus) {
+	b.status = status
+}
+
+//IndexInstId returns the Index InstanceId this
+//slice is associated with
+func (b *bptreeSlice) IndexInstId() common.IndexInstId {
+	return b.idxInstId
+}
+
+//IndexDefnId returns the Index DefnId this slice
+//is associated with
+func (b *bptreeSlice) IndexDefnId() common.IndexDefnId {
+	return b.idxDefnId
+}
+
+// Returns snapshot info list, most recent first
+func (b *bptreeSlice) GetSnapshots() ([]SnapshotInfo, error) {
+	b.confLock.RLock()
+	maxRollbacks := b.sysconf["settings.recovery.max_rollbacks"].Int()
+	policy := retentionPolicyFromConfig(b.sysconf)
+	b.confLock.RUnlock()
+
+	var infos []SnapshotInfo
+	for _, c := range b.db.Commits() {
+		if len(infos) == maxRollbacks {
+			break
+		}
+
+		info := &bptreeSnapshotInfo{}
+		if err := json.Unmarshal(c.Meta, info); err != nil {
+			return nil, errors.New("Failed to retrieve snapshots list -" + err.Error())
+		}
+		info.Seq = c.Seq
+		infos = append(infos, info)
+	}
+
+	return retainBPTreeSnapshots(infos, policy), nil
+}
+
+//retainBPTreeSnapshots applies the retention policy to a snapshot list
+//ordered most recent first. Commits dropped by the policy are reclaimed
+//by the next compaction.
+func retainBPTreeSnapshots(infos []SnapshotInfo, policy RetentionPolicy) []SnapshotInfo {
+	n := len(infos)
+	created := make([]time.Time, n)
+	pinned := make([]bool, n)
+	for i, info := range infos {
+		created[n-1-i] = info.(*bptreeSnapshotInfo).CreatedAt
+		pinned[n-1-i] = created[n-1-i].IsZero()
+	}
+
+	var retained []SnapshotInfo
+	keep := policy.Retain(created, pinned, time.Now())
+	for i, info := range infos {
+		if keep[n-1-i] {
+			retained = append(retained, info)
+		}
+	}
+
+	return retained
+}
+
+var errBPTreeSnapshotRetention = errors.New("Per index snapshot retention is not supported by bptree storage")
+
+func (b *bptreeSlice) RetentionPolicy() RetentionPolicy {
+	b.confLock.RLock()
+	defer b.confLock.RUnlock()
+
+	return retentionPolicyFromConfig(b.sysconf)
+}
+
+func (b *bptreeSlice) SetRetentionPolicy(policy *RetentionPolicy) error {
+	return errBPTreeSnapshotRetention
+}
+
+func (b *bptreeSlice) PinSnapshot(id string, pin bool) error {
+	return errBPTreeSnapshotRetention
+}
+
+// Returns retained rollback points, most recent first. Snapshots share
+// the data file and are identified by commit seqno.
+func (b *bptreeSlice) DiskSnapshots() ([]DiskSnapshot, error) {
+	infos, err := b.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []DiskSnapshot
+	for _, info := range infos {
+		bi := info.(*bptreeSnapshotInfo)
+		snaps = append(snaps, DiskSnapshot{
+			Id:      fmt.Sprintf("%d", bi.Seq),
+			Created: bi.CreatedAt,
+			Size:    bi.DataSize,
+			Items:   bi.ItemsCount,
+			Ts:      summarizeTs(bi.Ts),
+		})
+	}
+
+	return snaps, nil
+}
+
+// IsDirty returns true if there has been any change in
+// in the slice storage after last in-mem/persistent snapshot
+func (b *bptreeSlice) IsDirty() bool {
+	b.waitPersist()
+	return b.isDirty
+}
+
+//Compact rewrites the data file retaining the snapshots which can
+//still be rolled back to. Writes and commits continue while the
+//file is being copied.
+func (b *bptreeSlice) Compact(abortTime time.Time) error {
+	b.IncrRef()
+	defer b.DecrRef()
+
+	b.confLock.RLock()
+	canRun := canRunCompaction(b.sysconf, abortTime)
+	b.confLock.RUnlock()
+
+	if !canRun {
+		logging.Infof("BPTreeSlice::Skip Compaction outside of compaction interval."+
+			"Slice Id %v, IndexInstId %v, IndexDefnId %v", b.id, b.idxInstId, b.idxDefnId)
+		return nil
+	}
+
+	infos, err := b.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	osnap := NewSnapshotInfoContainer(infos).GetOldest()
+	if osnap == nil {
+		logging.Infof("BPTreeSlice::Compact No Snapshot Found. Skipped Compaction."+
+			"Slice Id %v, IndexInstId %v, IndexDefnId %v", b.id, b.idxInstId, b.idxDefnId)
+		return nil
+	}
+
+	seq := osnap.(*bptreeSnapshotInfo).Seq
+	logging.Infof("BPTreeSlice::Compact Compacting upto SeqNum %v. "+
+		"Slice Id %v, IndexInstId %v, IndexDefnId %v", seq, b.id,
+		b.idxInstId, b.idxDefnId)
+
+	return b.db.Compact(seq)
+}
+
+func (b *bptreeSlice) Statistics() (StorageStatistics, error) {
+	var sts StorageStatistics
+
+	dbStats := b.db.Stats()
+	sts.DataSize = dbStats.DataSize
+	sts.DiskSize = dbStats.DiskSize
+
+	sts.GetBytes = platform.LoadInt64(&b.get_bytes)
+	sts.InsertBytes = platform.LoadInt64(&b.insert_bytes)
+	sts.DeleteBytes = platform.LoadInt64(&b.delete_bytes)
+
+	return sts, nil
+}
+
+func (b *bptreeSlice) UpdateConfig(cfg common.Config) {
+	b.confLock.Lock()
+	defer b.confLock.Unlock()
+
+	b.sysconf = cfg
+}
+
+func (b *bptreeSlice) String() string {
+
+	str := fmt.Sprintf("SliceId: %v ", b.id)
+	str += fmt.Sprintf("File: %v ", b.path)
+	str += fmt.Sprintf("Index: %v ", b.idxInstId)
+
+	return str
+}
+
+func (b *bptreeSlice) logWriterStat() {
+	count := platform.AddUint64(&b.flushedCount, 1)
+	if (count%10000 == 0) || count == 1 {
+		logging.Infof("logWriterStat:: %v "+
+			"FlushedCount %v QueuedCount %v", b.idxInstId,
+			count, len(b.cmdCh))
+	}
+}
+
+func tryDeleteBPTreeSlice(b *bptreeSlice) {
+	logging.Infof("BPTreeSlice::Destroy Destroying Slice Id %v, IndexInstId %v, "+
+		"IndexDefnId %v", b.id, b.idxInstId, b.idxDefnId)
+
+	b.db.Close()
+
+	//cleanup the disk directory
+	if err := os.RemoveAll(b.path); err != nil {
+		logging.Errorf("BPTreeSlice::Destroy Error Cleaning Up Slice Id %v, "+
+			"IndexInstId %v, IndexDefnId %v. Error %v", b.id, b.idxInstId, b.idxDefnId, err)
+	}
+}
+
+func tryCloseBPTreeSlice(b *bptreeSlice) {
+	if err := b.db.Close(); err != nil {
+		logging.Errorf("BPTreeSlice::Close Error Closing Slice Id %v, "+
+			"IndexInstId %v, IndexDefnId %v. Error %v", b.id, b.idxInstId, b.idxDefnId, err)
+	}
+}
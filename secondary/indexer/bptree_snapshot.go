@@ -0,0 +1,163 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbase/indexing/secondary/bptree"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/platform"
+	"time"
+)
+
+type bptreeSnapshotInfo struct {
+	Ts        *common.TsVbuuid
+	Seq       bptree.SeqNum `json:"-"`
+	Committed bool
+	CreatedAt time.Time
+
+	// Entries in the main index and live data size when the snapshot
+	// was committed
+	ItemsCount int64 `json:",omitempty"`
+	DataSize   int64 `json:",omitempty"`
+
+	snap *bptree.Snapshot
+}
+
+func (info *bptreeSnapshotInfo) Timestamp() *common.TsVbuuid {
+	return info.Ts
+}
+
+func (info *bptreeSnapshotInfo) IsCommitted() bool {
+	return info.Committed
+}
+
+func (info *bptreeSnapshotInfo) String() string {
+	return fmt.Sprintf("SnapshotInfo: seqno: %v committed:%v", info.Seq, info.Committed)
+}
+
+type bptreeSnapshot struct {
+	slice *bptreeSlice
+
+	snap *bptree.Snapshot
+	seq  bptree.SeqNum
+
+	idxDefnId common.IndexDefnId //index definition id
+	idxInstId common.IndexInstId //index instance id
+	ts        *common.TsVbuuid   //timestamp
+	committed bool
+
+	refCount int32 //Reader count for this snapshot
+}
+
+func (s *bptreeSnapshot) Create() error {
+
+	t0 := time.Now()
+	if s.snap == nil {
+		var err error
+		if s.snap, err = s.slice.db.OpenSnapshot(s.seq); err != nil {
+			logging.Errorf("BPTreeSnapshot::Open \n\tUnexpected Error "+
+				"Opening DB Snapshot (%v) SeqNum %v %v", s.slice.Path(), s.seq, err)
+			return err
+		}
+	}
+
+	if s.committed {
+		s.slice.idxStats.Timings.stPersistSnapshotCreate.Put(time.Now().Sub(t0))
+	} else {
+		s.slice.idxStats.Timings.stSnapshotCreate.Put(time.Now().Sub(t0))
+	}
+
+	s.slice.IncrRef()
+	platform.StoreInt32(&s.refCount, 1)
+
+	return nil
+}
+
+func (s *bptreeSnapshot) Open() error {
+	platform.AddInt32(&s.refCount, int32(1))
+
+	return nil
+}
+
+func (s *bptreeSnapshot) IsOpen() bool {
+
+	count := platform.LoadInt32(&s.refCount)
+	return count > 0
+}
+
+func (s *bptreeSnapshot) Id() SliceId {
+	return s.slice.Id()
+}
+
+func (s *bptreeSnapshot) IndexInstId() common.IndexInstId {
+	return s.idxInstId
+}
+
+func (s *bptreeSnapshot) IndexDefnId() common.IndexDefnId {
+	return s.idxDefnId
+}
+
+func (s *bptreeSnapshot) Timestamp() *common.TsVbuuid {
+	return s.ts
+}
+
+//Close the snapshot
+func (s *bptreeSnapshot) Close() error {
+
+	count := platform.AddInt32(&s.refCount, int32(-1))
+
+	if count < 0 {
+		logging.Errorf("BPTreeSnapshot::Close Close operation requested " +
+			"on already closed snapshot")
+		return errors.New("Snapshot Already Closed")
+
+	} else if count == 0 {
+		go s.Destroy()
+	}
+
+	return nil
+}
+
+//Destroy releases the snapshot along with the data files only it
+//was reading from
+func (s *bptreeSnapshot) Destroy() {
+
+	defer s.slice.DecrRef()
+
+	t0 := time.Now()
+	if err := s.snap.Close(); err != nil {
+		logging.Errorf("BPTreeSnapshot::Destroy Error closing snapshot %v: %v", s, err)
+	}
+	s.snap = nil
+
+	if !s.committed {
+		s.slice.idxStats.Timings.stSnapshotClose.Put(time.Now().Sub(t0))
+	}
+}
+
+func (s *bptreeSnapshot) String() string {
+
+	str := fmt.Sprintf("Index: %v ", s.idxInstId)
+	str += fmt.Sprintf("SliceId: %v ", s.slice.Id())
+	str += fmt.Sprintf("SeqNum: %v ", s.seq)
+	str += fmt.Sprintf("TS: %v ", s.ts)
+	return str
+}
+
+func (s *bptreeSnapshot) Info() SnapshotInfo {
+	return &bptreeSnapshotInfo{
+		Seq:       s.seq,
+		Committed: s.committed,
+		Ts:        s.ts,
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2016 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+// This file implements IndexReader interface
+import (
+	"github.com/couchbase/indexing/secondary/bptree"
+	"github.com/couchbase/indexing/secondary/common"
+	"time"
+)
+
+// Items count of the snapshot
+func (s *bptreeSnapshot) StatCountTotal() (uint64, error) {
+	return uint64(s.snap.Count(s.slice.main)), nil
+}
+
+func (s *bptreeSnapshot) CountTotal(stopch StopChannel) (uint64, error) {
+	return s.CountRange(MinIndexKey, MaxIndexKey, Both, stopch)
+}
+
+func (s *bptreeSnapshot) CountRange(low, high IndexKey, inclusion Inclusion,
+	stopch StopChannel) (uint64, error) {
+
+	var count uint64
+	callb := func([]byte) error {
+		select {
+		case <-stopch:
+			return common.ErrClientCancel
+		default:
+			count++
+		}
+
+		return nil
+	}
+
+	err := s.Range(low, high, inclusion, callb)
+	return count, err
+}
+
+func (s *bptreeSnapshot) CountLookup(keys []IndexKey, stopch StopChannel) (uint64, error) {
+	var err error
+	var count uint64
+
+	callb := func([]byte) error {
+		select {
+		case <-stopch:
+			return common.ErrClientCancel
+		default:
+			count++
+		}
+
+		return nil
+	}
+
+	for _, k := range keys {
+		if err = s.Lookup(k, callb); err != nil {
+			break
+		}
+	}
+
+	return count, err
+}
+
+func (s *bptreeSnapshot) Exists(key IndexKey, stopch StopChannel) (bool, error) {
+	var count uint64
+	callb := func([]byte) error {
+		select {
+		case <-stopch:
+			return common.ErrClientCancel
+		default:
+			count++
+		}
+
+		return nil
+	}
+
+	err := s.Lookup(key, callb)
+	return count != 0, err
+}
+
+func (s *bptreeSnapshot) Lookup(key IndexKey, callb EntryCallback) error {
+	return s.Iterate(key, key, Both, compareExact, callb)
+}
+
+func (s *bptreeSnapshot) Range(low, high IndexKey, inclusion Inclusion,
+	callb EntryCallback) error {
+
+	var cmpFn CmpEntry
+	if s.slice.isPrimary {
+		cmpFn = compareExact
+	} else {
+		cmpFn = comparePrefix
+	}
+
+	return s.Iterate(low, high, inclusion, cmpFn, callb)
+}
+
+func (s *bptreeSnapshot) All(callb EntryCallback) error {
+	return s.Range(MinIndexKey, MaxIndexKey, Both, callb)
+}
+
+func (s *bptreeSnapshot) Iterate(low, high IndexKey, inclusion Inclusion,
+	cmpFn CmpEntry, callback EntryCallback) error {
+
+	ttime := time.Now()
+
+	var entry IndexEntry
+	it := s.snap.NewIterator(s.slice.main)
+	defer it.Close()
+
+	defer func() {
+		s.slice.idxStats.Timings.stScanPipelineIterate.Put(time.Now().Sub(ttime))
+	}()
+
+	if low.Bytes() == nil {
+		it.SeekFirst()
+	} else {
+		it.Seek(low.Bytes())
+
+		// Discard equal keys if low inclusion is requested
+		if inclusion == Neither || inclusion == High {
+			if err := s.iterEqualKeys(low, it, cmpFn, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+loop:
+	for ; it.Valid(); it.Next() {
+		entry = s.newIndexEntry(it.Key())
+
+		// Iterator has reached past the high key, no need to scan further
+		if cmpFn(high, entry) <= 0 {
+			break loop
+		}
+
+		if err := callback(it.Key()); err != nil {
+			return err
+		}
+	}
+
+	// Include equal keys if high inclusion is requested
+	if inclusion == Both || inclusion == High {
+		if err := s.iterEqualKeys(high, it, cmpFn, callback); err != nil {
+			return err
+		}
+	}
+
+	return it.Err()
+}
+
+func (s *bptreeSnapshot) newIndexEntry(b []byte) IndexEntry {
+	var entry IndexEntry
+	var err error
+
+	if s.slice.isPrimary {
+		entry, err = BytesToPrimaryIndexEntry(b)
+	} else {
+		entry, err = BytesToSecondaryIndexEntry(b)
+	}
+	common.CrashOnError(err)
+	return entry
+}
+
+func (s *bptreeSnapshot) iterEqualKeys(k IndexKey, it *bptree.Iterator,
+	cmpFn CmpEntry, callback func([]byte) error) error {
+	var err error
+
+	var entry IndexEntry
+	for ; it.Valid(); it.Next() {
+		entry = s.newIndexEntry(it.Key())
+		if cmpFn(k, entry) == 0 {
+			if callback != nil {
+				err = callback(it.Key())
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			break
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/logging"
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+)
+
+//Bucket Flush
+//
+//A bucket flush keeps the bucket UUID but resets every vbucket to seqno 0
+//with a new vbuuid. Stream requests then get rolled back to zero for all
+//vbuckets and the vbuuids the indexer has seen are gone from the failover
+//logs. With settings.recovery.detect_bucket_flush, KVSender checks the
+//failover logs on a rollback and flags the rollback as a bucket flush.
+//
+//During recovery, storage manager truncates all indexes of the bucket in
+//the stream to empty instead of looking for a snapshot to rollback to, and
+//the stream restarts from zero. Index definitions, instance state and
+//topology are left as is, so the indexes rebuild from the flushed bucket
+//without being dropped and recreated.
+
+//isBucketFlushed returns true if all vbuckets of restartTs with a non-zero
+//seqno are rolled back to zero and none of their vbuuids are present in
+//the failover logs.
+func isBucketFlushed(restartTs, rollbackTs *protobuf.TsVbuuid,
+	flogs *protobuf.FailoverLogResponse) bool {
+
+	if restartTs == nil || rollbackTs == nil || flogs == nil {
+		return false
+	}
+
+	vbuuids := make(map[uint32]uint64)
+	restartVbuuids := restartTs.GetVbuuids()
+	for i, seqno := range restartTs.GetSeqnos() {
+		if seqno != 0 {
+			vbuuids[restartTs.GetVbnos()[i]] = restartVbuuids[i]
+		}
+	}
+	if len(vbuuids) == 0 {
+		return false
+	}
+
+	rolledBack := make(map[uint32]bool)
+	rollbackSeqnos := rollbackTs.GetSeqnos()
+	for i, vbno := range rollbackTs.GetVbnos() {
+		if rollbackSeqnos[i] == 0 {
+			rolledBack[vbno] = true
+		}
+	}
+
+	checked := 0
+	for _, flog := range flogs.GetLogs() {
+		vbuuid, ok := vbuuids[flog.GetVbno()]
+		if !ok {
+			continue
+		}
+		for _, fvbuuid := range flog.GetVbuuids() {
+			if fvbuuid == vbuuid {
+				return false
+			}
+		}
+		checked++
+	}
+
+	for vbno := range vbuuids {
+		if !rolledBack[vbno] {
+			return false
+		}
+	}
+
+	//all vbuckets need a failover log to rule out a regular rollback
+	return checked == len(vbuuids)
+}
+
+//checkBucketFlush fetches the failover logs of the vbuckets in restartTs
+//and returns true if the rollback is due to a bucket flush.
+func (k *kvSender) checkBucketFlush(bucket string,
+	restartTs, rollbackTs *protobuf.TsVbuuid) bool {
+
+	if !k.config["settings.recovery.detect_bucket_flush"].Bool() ||
+		restartTs == nil || rollbackTs == nil {
+		return false
+	}
+
+	flogs, err := k.getFailoverLogs(bucket, restartTs.GetVbnos())
+	if err != nil {
+		logging.Errorf("KVSender::checkBucketFlush %v Error Fetching Failover "+
+			"Logs %v. Treating as rollback.", bucket, err)
+		return false
+	}
+
+	if isBucketFlushed(restartTs, rollbackTs, flogs) {
+		logging.Infof("KVSender::checkBucketFlush Bucket %v Flush Detected", bucket)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package indexer
+
+import (
+	protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
+	"testing"
+)
+
+func TestIsBucketFlushed(t *testing.T) {
+	failoverLogs := func(vbuuids ...[]uint64) *protobuf.FailoverLogResponse {
+		res := &protobuf.FailoverLogResponse{}
+		for i, uuids := range vbuuids {
+			vbno := uint32(i)
+			res.Logs = append(res.Logs, &protobuf.FailoverLog{
+				Vbno:    &vbno,
+				Vbuuids: uuids,
+				Seqnos:  make([]uint64, len(uuids)),
+			})
+		}
+		return res
+	}
+
+	restartTs := protobuf.NewTsVbuuid("default", "default", 3)
+	restartTs.Append(0, 100, 11, 100, 100)
+	restartTs.Append(1, 200, 21, 200, 200)
+	restartTs.Append(2, 0, 31, 0, 0)
+
+	rollbackTs := protobuf.NewTsVbuuid("default", "default", 3)
+	rollbackTs.Append(0, 0, 12, 0, 0)
+	rollbackTs.Append(1, 0, 22, 0, 0)
+
+	flushed := failoverLogs([]uint64{12}, []uint64{22}, []uint64{32})
+	if !isBucketFlushed(restartTs, rollbackTs, flushed) {
+		t.Errorf("Expected bucket flush to be detected")
+	}
+
+	//history of a vbucket is still there, regular rollback
+	failover := failoverLogs([]uint64{12}, []uint64{22, 21}, []uint64{32})
+	if isBucketFlushed(restartTs, rollbackTs, failover) {
+		t.Errorf("Unexpected bucket flush with vbuuid in failover log")
+	}
+
+	//not all vbuckets rolled back to zero
+	partialTs := protobuf.NewTsVbuuid("default", "default", 3)
+	partialTs.Append(0, 0, 12, 0, 0)
+	if isBucketFlushed(restartTs, partialTs, flushed) {
+		t.Errorf("Unexpected bucket flush with partial rollback")
+	}
+
+	//missing failover log
+	if isBucketFlushed(restartTs, rollbackTs, failoverLogs([]uint64{12})) {
+		t.Errorf("Unexpected bucket flush with missing failover log")
+	}
+
+	//stream starting from zero
+	zeroTs := protobuf.NewTsVbuuid("default", "default", 3)
+	zeroTs.Append(0, 0, 11, 0, 0)
+	if isBucketFlushed(zeroTs, rollbackTs, flushed) {
+		t.Errorf("Unexpected bucket flush for stream starting from zero")
+	}
+}
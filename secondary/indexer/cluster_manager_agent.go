@@ -511,6 +511,66 @@ func (meta *metaNotifier) OnIndexDelete(defnId common.IndexDefnId, bucket string
 	return nil
 }
 
+func (meta *metaNotifier) OnIndexPause(defnId common.IndexDefnId, bucket string) error {
+
+	logging.Infof("clustMgrAgent::OnIndexPause Notification "+
+		"Received for Pause IndexId %v", defnId)
+
+	return meta.sendIndexMaintenance(INDEXER_PAUSE_INDEX, defnId, bucket)
+}
+
+func (meta *metaNotifier) OnIndexResume(defnId common.IndexDefnId, bucket string) error {
+
+	logging.Infof("clustMgrAgent::OnIndexResume Notification "+
+		"Received for Resume IndexId %v", defnId)
+
+	return meta.sendIndexMaintenance(INDEXER_RESUME_INDEX, defnId, bucket)
+}
+
+func (meta *metaNotifier) sendIndexMaintenance(mType MsgType,
+	defnId common.IndexDefnId, bucket string) error {
+
+	respCh := make(MsgChannel)
+
+	//Treat DefnId as InstId for now
+	meta.adminCh <- &MsgIndexMaintenance{mType: mType,
+		instId: common.IndexInstId(defnId),
+		bucket: bucket,
+		respCh: respCh}
+
+	//wait for response
+	if res, ok := <-respCh; ok {
+
+		switch res.GetMsgType() {
+
+		case MSG_SUCCESS:
+			logging.Infof("clustMgrAgent::sendIndexMaintenance Success "+
+				"for %v IndexId %v", mType, defnId)
+			return nil
+
+		case MSG_ERROR:
+			logging.Errorf("clustMgrAgent::sendIndexMaintenance Error "+
+				"for %v IndexId %v. Error %v", mType, defnId, res)
+			err := res.(*MsgError).GetError()
+			return err.cause
+
+		default:
+			logging.Fatalf("clustMgrAgent::sendIndexMaintenance Unknown Response "+
+				"Received for %v IndexId %v. Response %v", mType, defnId, res)
+			common.CrashOnError(errors.New("Unknown Response"))
+
+		}
+
+	} else {
+		logging.Fatalf("clustMgrAgent::sendIndexMaintenance Unexpected Channel Close "+
+			"for %v IndexId %v", mType, defnId)
+		common.CrashOnError(errors.New("Unknown Response"))
+
+	}
+
+	return nil
+}
+
 func (meta *metaNotifier) makeDefaultPartitionContainer() common.PartitionContainer {
 
 	pc := common.NewKeyPartitionContainer()
@@ -222,7 +222,8 @@ loop:
 		case _, ok := <-cd.timer.C:
 
 			conf := cd.config.Load()
-			if common.GetStorageMode() == common.FORESTDB {
+			if common.GetStorageMode() == common.FORESTDB ||
+				common.GetStorageMode() == common.BPTREE {
 
 				if ok {
 					replych := make(chan []IndexStorageStats)
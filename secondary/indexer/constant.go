@@ -57,10 +57,17 @@ const MAX_DOCID_LEN = 256
 //Buffer Length for encoded Sec Key
 const MAX_SEC_KEY_BUFFER_LEN = MAX_SEC_KEY_LEN * 3
 
+//Max Length of encoded Secondary Key of memdb indexes when large
+//keys are allowed. Scans pass an entry as a single item of a pipeline
+//block, which is limited to 64KB including headers.
+const MAX_LARGE_SEC_KEY_BUFFER_LEN = 1<<16 - 1 - 10 - MAX_DOCID_LEN
+
 const INDEXER_ID_KEY = "IndexerId"
 
 const INDEXER_STATE_KEY = "IndexerState"
 
+const INDEXER_PAUSED_INDEXES_KEY = "IndexerPausedIndexes"
+
 const INDEXER_NODE_UUID = "IndexerNodeUUID"
 
 const MAX_KVWARMUP_RETRIES = 120
@@ -0,0 +1,171 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/common"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Document Error Reporting
+//
+//Documents which cannot be indexed are skipped by the index, either because
+//projector failed to evaluate the index expressions for the document or
+//because the key produced is too long to be stored. Each index keeps a
+//ring of the last settings.doc_errors.max_errors such documents, with the
+//docid, vbucket, seqno, class of the error and a key truncated to
+//settings.doc_errors.max_key_size bytes. Both settings can be changed at
+//runtime. Rings are served at /stats/errors and the number of evaluation
+//and key size failures is reported in index stats.
+//
+//The key is the secondary key as seen by the slice, which depending on
+//the storage may be json or collatejson encoded. It is served as base64
+//of the raw bytes, so a truncated key is not mangled into a json string.
+
+//classes of document errors
+const (
+	docErrEval          = "eval_error"
+	docErrKeyTooLong    = "key_too_long"
+	docErrArrayTooLong  = "array_key_too_long"
+	docErrArrayItemLong = "array_item_too_long"
+	docErrDocIdTooLong  = "docid_too_long"
+	docErrOther         = "other"
+)
+
+var docErrorConfig struct {
+	maxErrors  int64
+	maxKeySize int64
+}
+
+func updateDocErrorConfig(config common.Config) {
+	atomic.StoreInt64(&docErrorConfig.maxErrors,
+		int64(config["settings.doc_errors.max_errors"].Int()))
+	atomic.StoreInt64(&docErrorConfig.maxKeySize,
+		int64(config["settings.doc_errors.max_key_size"].Int()))
+}
+
+//docErrorClass classifies the error returned for a document by the
+//slice writers
+func docErrorClass(err error) string {
+	switch err {
+	case ErrSecKeyTooLong, ErrLargeSecKeyTooLong:
+		return docErrKeyTooLong
+	case ErrArrayKeyTooLong:
+		return docErrArrayTooLong
+	case ErrArrayItemKeyTooLong:
+		return docErrArrayItemLong
+	case ErrDocIdTooLong:
+		return docErrDocIdTooLong
+	}
+	return docErrOther
+}
+
+//docPos is the position of a mutation in the stream of its vbucket
+type docPos struct {
+	vbucket Vbucket
+	seqno   Seqno
+}
+
+func newDocPos(meta *MutationMeta) docPos {
+	return docPos{vbucket: meta.vbucket, seqno: meta.seqno}
+}
+
+//DocError describes a document skipped by an index
+type DocError struct {
+	Time    int64   `json:"time"`
+	Docid   string  `json:"docid"`
+	Vbucket Vbucket `json:"vbucket"`
+	Seqno   Seqno   `json:"seqno"`
+	Class   string  `json:"class"`
+	Key     []byte  `json:"key,omitempty"` //raw key, base64 in json
+	Error   string  `json:"error,omitempty"`
+}
+
+type docErrorLog struct {
+	mu     sync.Mutex
+	errors []*DocError //ring of the most recent errors
+	next   int
+}
+
+func (l *docErrorLog) add(e *DocError) {
+	maxErrors := int(atomic.LoadInt64(&docErrorConfig.maxErrors))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if maxErrors <= 0 {
+		l.errors, l.next = nil, 0
+		return
+	} else if len(l.errors) > maxErrors { //ring was shrunk
+		errors := l.ordered()
+		l.errors, l.next = errors[len(errors)-maxErrors:], 0
+	}
+
+	if len(l.errors) < maxErrors {
+		l.errors = append(l.errors, e)
+		return
+	}
+	l.errors[l.next] = e
+	l.next = (l.next + 1) % len(l.errors)
+}
+
+//ordered returns recorded errors, oldest first, caller is expected to
+//hold the lock
+func (l *docErrorLog) ordered() []*DocError {
+	errors := make([]*DocError, 0, len(l.errors))
+	errors = append(errors, l.errors[l.next:]...)
+	errors = append(errors, l.errors[:l.next]...)
+	return errors
+}
+
+//Get returns recorded errors, oldest first
+func (l *docErrorLog) Get() []*DocError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ordered()
+}
+
+func truncateDocErrorKey(key []byte) []byte {
+	maxKeySize := int(atomic.LoadInt64(&docErrorConfig.maxKeySize))
+	if len(key) > maxKeySize {
+		key = key[:maxKeySize]
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	//key buffers are reused by slice writers
+	return append([]byte(nil), key...)
+}
+
+//addDocError records a document skipped by the index and counts it by class
+func (s *IndexStats) addDocError(class string, docid, key []byte,
+	pos docPos, errmsg string) {
+
+	s.numDocErrors.Add(1)
+	switch class {
+	case docErrEval:
+		s.numEvalErrors.Add(1)
+	case docErrKeyTooLong, docErrArrayTooLong, docErrArrayItemLong, docErrDocIdTooLong:
+		s.numKeySizeErrors.Add(1)
+	}
+
+	e := &DocError{
+		Time:    time.Now().UnixNano(),
+		Docid:   string(docid),
+		Vbucket: pos.vbucket,
+		Seqno:   pos.seqno,
+		Class:   class,
+		Key:     truncateDocErrorKey(key),
+		Error:   errmsg,
+	}
+	s.docErrors.add(e)
+}
@@ -0,0 +1,87 @@
+package indexer
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+func TestDocErrorLog(t *testing.T) {
+	docErrorConfig.maxErrors, docErrorConfig.maxKeySize = 3, 4
+	defer func() {
+		docErrorConfig.maxErrors, docErrorConfig.maxKeySize = 0, 0
+	}()
+
+	s := &IndexStats{}
+	s.Init()
+	for i := 0; i < 5; i++ {
+		docid := []byte(fmt.Sprintf("docid-%d", i))
+		s.addDocError(docErrKeyTooLong, docid, []byte(`["key"]`),
+			docPos{vbucket: Vbucket(i), seqno: Seqno(i)}, ErrSecKeyTooLong.Error())
+	}
+	s.addDocError(docErrEval, []byte("docid-5"), nil, docPos{}, "eval failed")
+
+	errors := s.docErrors.Get()
+	if len(errors) != 3 {
+		t.Fatalf("Expected 3 errors, got %v", len(errors))
+	}
+	//oldest first
+	for i, docid := range []string{"docid-3", "docid-4", "docid-5"} {
+		if errors[i].Docid != docid {
+			t.Errorf("Expected %v at %v, got %v", docid, i, errors[i].Docid)
+		}
+	}
+	if string(errors[0].Key) != `["ke` || errors[0].Seqno != 3 {
+		t.Errorf("Unexpected error %+v", errors[0])
+	}
+	if errors[2].Class != docErrEval || errors[2].Error != "eval failed" ||
+		errors[2].Key != nil {
+		t.Errorf("Unexpected error %+v", errors[2])
+	}
+
+	if n := s.numDocErrors.Value(); n != 6 {
+		t.Errorf("Expected 6 doc errors, got %v", n)
+	}
+	if n := s.numKeySizeErrors.Value(); n != 5 {
+		t.Errorf("Expected 5 key size errors, got %v", n)
+	}
+	if n := s.numEvalErrors.Value(); n != 1 {
+		t.Errorf("Expected 1 eval error, got %v", n)
+	}
+
+	//shrinking the ring keeps the most recent errors
+	docErrorConfig.maxErrors = 1
+	s.addDocError(docErrorClass(ErrArrayKeyTooLong), []byte("docid-6"), nil,
+		docPos{}, ErrArrayKeyTooLong.Error())
+	errors = s.docErrors.Get()
+	if len(errors) != 1 || errors[0].Docid != "docid-6" ||
+		errors[0].Class != docErrArrayTooLong {
+		t.Errorf("Unexpected errors after shrink %+v", errors)
+	}
+}
+
+func TestDocErrorKeyJSON(t *testing.T) {
+	docErrorConfig.maxErrors, docErrorConfig.maxKeySize = 1, 3
+	defer func() {
+		docErrorConfig.maxErrors, docErrorConfig.maxKeySize = 0, 0
+	}()
+
+	//collatejson encoded keys are not valid utf8
+	s := &IndexStats{}
+	s.Init()
+	key := []byte{0x0a, 0xff, 0x00, 0x01}
+	s.addDocError(docErrKeyTooLong, []byte("docid"), key, docPos{}, "")
+	key[0] = 0
+
+	bytes, err := json.Marshal(s.docErrors.Get())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var errors []map[string]interface{}
+	if err := json.Unmarshal(bytes, &errors); err != nil {
+		t.Fatal(err)
+	}
+	if len(errors) != 1 || errors[0]["key"] != "Cv8A" {
+		t.Errorf("Expected base64 of truncated key, got %s", bytes)
+	}
+}
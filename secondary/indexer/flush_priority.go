@@ -0,0 +1,361 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Flush QoS
+//
+//Buckets and indexes can be assigned a priority class using
+//settings.flush.priority, a comma separated list of <bucket>=<class>
+//and <bucket>:<index>=<class> entries. The class of an index is its
+//own class if configured, else the class of its bucket, normal if none
+//is configured.
+//
+//Flusher workers of all buckets share a fixed number of flush slots.
+//A worker holds a slot of the class of the index it is updating for a
+//batch of mutations and waiting workers are granted slots by weighted
+//round robin between classes, so that updates of an index of a higher
+//class get a larger share of flush throughput when indexes compete.
+//A worker holds at most one slot. It gives up its slot when it moves to
+//an index of another class or has to wait for mutations.
+//
+//Mutations of INIT_STREAM and CATCHUP_STREAM are flushed one class
+//below the configured class, low being the lowest, so that initial
+//builds of indexes do not delay maintenance of indexes of the same class.
+//
+//Snapshots are per stream and bucket, so for timekeeper the class of a
+//bucket is the highest class of the bucket or any of its indexes, lowered
+//for INIT_STREAM and CATCHUP_STREAM in the same way. Timekeeper holds back
+//stability timestamps of a stream/bucket while a stream/bucket of a higher
+//class is being flushed.
+
+type flushPriority int
+
+const (
+	FLUSH_PRIORITY_LOW flushPriority = iota
+	FLUSH_PRIORITY_NORMAL
+	FLUSH_PRIORITY_HIGH
+	numFlushPriorities
+)
+
+//number of mutations flushed by a worker per scheduler slot
+const flushSchedBatchSize = 256
+
+func (p flushPriority) String() string {
+	switch p {
+	case FLUSH_PRIORITY_LOW:
+		return "low"
+	case FLUSH_PRIORITY_NORMAL:
+		return "normal"
+	case FLUSH_PRIORITY_HIGH:
+		return "high"
+	default:
+		return "invalid"
+	}
+}
+
+func parseFlushPriority(s string) (flushPriority, bool) {
+	for p := FLUSH_PRIORITY_LOW; p < numFlushPriorities; p++ {
+		if strings.EqualFold(s, p.String()) {
+			return p, true
+		}
+	}
+	return FLUSH_PRIORITY_NORMAL, false
+}
+
+type flushPriorities struct {
+	buckets map[string]flushPriority
+	indexes map[string]flushPriority //bucket:index
+}
+
+func newFlushPriorities(config common.Config) *flushPriorities {
+	fp := &flushPriorities{
+		buckets: make(map[string]flushPriority),
+		indexes: make(map[string]flushPriority),
+	}
+
+	setting := config["settings.flush.priority"].String()
+	for _, entry := range strings.Split(setting, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		kv := strings.SplitN(entry, "=", 2)
+		var p flushPriority
+		var ok bool
+		if len(kv) == 2 {
+			p, ok = parseFlushPriority(strings.TrimSpace(kv[1]))
+		}
+
+		if !ok {
+			logging.Warnf("Indexer::FlushPriority Ignoring invalid entry %v", entry)
+			continue
+		}
+
+		name := strings.TrimSpace(kv[0])
+		if strings.Contains(name, ":") {
+			fp.indexes[name] = p
+		} else {
+			fp.buckets[name] = p
+		}
+	}
+
+	return fp
+}
+
+func (fp *flushPriorities) isEmpty() bool {
+	return len(fp.buckets) == 0 && len(fp.indexes) == 0
+}
+
+//streamPriority lowers the class for the streams of initial index builds
+func streamPriority(streamId common.StreamId, p flushPriority) flushPriority {
+	switch streamId {
+	case common.INIT_STREAM, common.CATCHUP_STREAM:
+		if p > FLUSH_PRIORITY_LOW {
+			return p - 1
+		}
+	}
+	return p
+}
+
+//bucketPriority returns the flush class of a stream/bucket
+func (fp *flushPriorities) bucketPriority(streamId common.StreamId, bucket string,
+	indexInstMap common.IndexInstMap) flushPriority {
+
+	p, found := fp.buckets[bucket]
+	for _, inst := range indexInstMap {
+		if inst.Defn.Bucket != bucket {
+			continue
+		}
+
+		if ip, ok := fp.indexes[bucket+":"+inst.Defn.Name]; ok {
+			if !found || ip > p {
+				p = ip
+			}
+			found = true
+		}
+	}
+
+	if !found {
+		p = FLUSH_PRIORITY_NORMAL
+	}
+	return streamPriority(streamId, p)
+}
+
+//indexPriority returns the flush class of an index
+func (fp *flushPriorities) indexPriority(inst common.IndexInst) flushPriority {
+	if p, ok := fp.indexes[inst.Defn.Bucket+":"+inst.Defn.Name]; ok {
+		return p
+	}
+	if p, ok := fp.buckets[inst.Defn.Bucket]; ok {
+		return p
+	}
+	return FLUSH_PRIORITY_NORMAL
+}
+
+//indexPriorities returns the flush class of each index of the bucket
+//when flushed by the stream
+func (fp *flushPriorities) indexPriorities(streamId common.StreamId, bucket string,
+	indexInstMap common.IndexInstMap) map[common.IndexInstId]flushPriority {
+
+	priorities := make(map[common.IndexInstId]flushPriority)
+	for instId, inst := range indexInstMap {
+		if inst.Defn.Bucket == bucket {
+			priorities[instId] = streamPriority(streamId, fp.indexPriority(inst))
+		}
+	}
+	return priorities
+}
+
+//flushScheduler is created once by mutation manager and updated in
+//place on config change, so that slots held by flusher workers started
+//with an earlier config are returned to the same scheduler.
+type flushScheduler struct {
+	mu      sync.Mutex
+	total   int //configured slots
+	slots   int //free slots, negative while the number of slots is reduced
+	weights [numFlushPriorities]int
+	credit  [numFlushPriorities]int
+	waiters [numFlushPriorities][]chan struct{}
+}
+
+func newFlushScheduler(config common.Config) *flushScheduler {
+	s := &flushScheduler{}
+	s.update(config)
+	return s
+}
+
+//update applies the slots and weights settings. Slots added are handed
+//to waiting workers, slots removed are taken back as they are released.
+func (s *flushScheduler) update(config common.Config) {
+	total := config["settings.flush.slots"].Int()
+	if total <= 0 {
+		total = runtime.NumCPU()
+	}
+
+	//weights are listed from high to low
+	weights := [numFlushPriorities]int{1, 1, 1}
+	for i, w := range strings.Split(config["settings.flush.weights"].String(), ",") {
+		p := FLUSH_PRIORITY_HIGH - flushPriority(i)
+		if p < FLUSH_PRIORITY_LOW {
+			break
+		}
+
+		if n, err := strconv.Atoi(strings.TrimSpace(w)); err == nil && n > 0 {
+			weights[p] = n
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if total == s.total && weights == s.weights {
+		return
+	}
+
+	logging.Infof("Indexer::FlushScheduler Slots %v Weights %v", total, weights)
+
+	s.slots += total - s.total
+	s.total = total
+	s.weights = weights
+	s.credit = [numFlushPriorities]int{}
+
+	for s.slots > 0 && s.handover() {
+		s.slots--
+	}
+}
+
+//acquire waits for a flush slot
+func (s *flushScheduler) acquire(p flushPriority) {
+	s.mu.Lock()
+	if s.slots > 0 && !s.hasWaiters() {
+		s.slots--
+		s.mu.Unlock()
+		return
+	}
+
+	ch := make(chan struct{})
+	s.waiters[p] = append(s.waiters[p], ch)
+	s.mu.Unlock()
+	<-ch
+}
+
+//release hands over the slot to a waiting worker
+func (s *flushScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.slots >= 0 && s.handover() {
+		return
+	}
+
+	s.slots++
+}
+
+//handover grants a slot to the next waiting worker, if any
+func (s *flushScheduler) handover() bool {
+	p, ok := s.next()
+	if !ok {
+		return false
+	}
+
+	ch := s.waiters[p][0]
+	s.waiters[p] = s.waiters[p][1:]
+	close(ch)
+	return true
+}
+
+func (s *flushScheduler) hasWaiters() bool {
+	for _, w := range s.waiters {
+		if len(w) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+//next picks the class of the next waiter by smooth weighted round robin
+func (s *flushScheduler) next() (flushPriority, bool) {
+	best := flushPriority(-1)
+	total := 0
+	for p := FLUSH_PRIORITY_LOW; p < numFlushPriorities; p++ {
+		if len(s.waiters[p]) == 0 {
+			continue
+		}
+
+		s.credit[p] += s.weights[p]
+		total += s.weights[p]
+		if best < 0 || s.credit[p] > s.credit[best] {
+			best = p
+		}
+	}
+
+	if best < 0 {
+		return best, false
+	}
+
+	s.credit[best] -= total
+	return best, true
+}
+
+//flushTurn tracks the scheduler slot held by a flusher worker
+type flushTurn struct {
+	sched    *flushScheduler
+	held     bool
+	priority flushPriority //class of the slot held
+	n        int           //mutations flushed with the slot held
+}
+
+//begin is called before updating an index of class p. A slot of
+//another class is released first, so a worker never waits for a slot
+//while holding one.
+func (t *flushTurn) begin(p flushPriority) {
+	if t.sched == nil {
+		return
+	}
+
+	if t.held && t.priority != p {
+		t.release()
+	}
+
+	if !t.held {
+		t.sched.acquire(p)
+		t.held, t.priority = true, p
+	}
+}
+
+//end is called after flushing a mutation
+func (t *flushTurn) end() {
+	if !t.held {
+		return
+	}
+
+	if t.n++; t.n >= flushSchedBatchSize {
+		t.release()
+	}
+}
+
+//release gives up the slot before the worker waits for mutations
+//or exits
+func (t *flushTurn) release() {
+	if t.held {
+		t.sched.release()
+		t.held, t.n = false, 0
+	}
+}
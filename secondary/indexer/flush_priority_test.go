@@ -0,0 +1,218 @@
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/common"
+	"testing"
+	"time"
+)
+
+func newFlushTestConfig(priority, weights string, slots int) common.Config {
+	config := common.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	config.SetValue("settings.flush.priority", priority)
+	config.SetValue("settings.flush.weights", weights)
+	config.SetValue("settings.flush.slots", slots)
+	return config
+}
+
+func TestFlushPriorities(t *testing.T) {
+
+	config := newFlushTestConfig(
+		"default=high, default:idx1=low, b2=LOW, invalid, b3=urgent, b3:idx2=high",
+		"4,2,1", 1)
+	fp := newFlushPriorities(config)
+
+	inst := func(instId common.IndexInstId, bucket, name string) common.IndexInst {
+		return common.IndexInst{InstId: instId,
+			Defn: common.IndexDefn{Bucket: bucket, Name: name}}
+	}
+	indexInstMap := common.IndexInstMap{
+		1: inst(1, "default", "idx1"),
+		2: inst(2, "default", "idx2"),
+		3: inst(3, "b2", "idx1"),
+		4: inst(4, "b3", "idx1"),
+		5: inst(5, "b3", "idx2"),
+		6: inst(6, "b4", "idx1"),
+	}
+
+	expected := map[common.IndexInstId]flushPriority{
+		1: FLUSH_PRIORITY_LOW,
+		2: FLUSH_PRIORITY_HIGH,
+		3: FLUSH_PRIORITY_LOW,
+		4: FLUSH_PRIORITY_NORMAL,
+		5: FLUSH_PRIORITY_HIGH,
+		6: FLUSH_PRIORITY_NORMAL,
+	}
+	for instId, p := range expected {
+		if ip := fp.indexPriority(indexInstMap[instId]); ip != p {
+			t.Errorf("index %v: expected %v, got %v", instId, p, ip)
+		}
+	}
+
+	if ps := fp.indexPriorities(common.MAINT_STREAM, "b3", indexInstMap); len(ps) != 2 ||
+		ps[4] != FLUSH_PRIORITY_NORMAL || ps[5] != FLUSH_PRIORITY_HIGH {
+		t.Errorf("unexpected index priorities of b3 %v", ps)
+	}
+
+	//initial builds are flushed one class lower
+	for _, streamId := range []common.StreamId{common.INIT_STREAM, common.CATCHUP_STREAM} {
+		if ps := fp.indexPriorities(streamId, "b3", indexInstMap); len(ps) != 2 ||
+			ps[4] != FLUSH_PRIORITY_LOW || ps[5] != FLUSH_PRIORITY_NORMAL {
+			t.Errorf("unexpected %v index priorities of b3 %v", streamId, ps)
+		}
+	}
+	if ps := fp.indexPriorities(common.INIT_STREAM, "b2", indexInstMap); ps[3] != FLUSH_PRIORITY_LOW {
+		t.Errorf("expected low to stay low, got %v", ps[3])
+	}
+
+	//bucket class is the highest of the bucket and its indexes
+	buckets := map[string]flushPriority{
+		"default": FLUSH_PRIORITY_HIGH,
+		"b2":      FLUSH_PRIORITY_LOW,
+		"b3":      FLUSH_PRIORITY_HIGH,
+		"b4":      FLUSH_PRIORITY_NORMAL,
+	}
+	for bucket, p := range buckets {
+		if bp := fp.bucketPriority(common.MAINT_STREAM, bucket, indexInstMap); bp != p {
+			t.Errorf("bucket %v: expected %v, got %v", bucket, p, bp)
+		}
+	}
+
+	//INIT_STREAM of a high bucket yields to MAINT_STREAM of the same bucket
+	if bp := fp.bucketPriority(common.INIT_STREAM, "default", indexInstMap); bp != FLUSH_PRIORITY_NORMAL {
+		t.Errorf("expected INIT_STREAM of default to be normal, got %v", bp)
+	}
+	if bp := fp.bucketPriority(common.INIT_STREAM, "b2", indexInstMap); bp != FLUSH_PRIORITY_LOW {
+		t.Errorf("expected INIT_STREAM of b2 to be low, got %v", bp)
+	}
+
+	if !newFlushPriorities(newFlushTestConfig("", "4,2,1", 1)).isEmpty() {
+		t.Errorf("expected no flush priorities")
+	}
+}
+
+func TestFlushSchedulerWRR(t *testing.T) {
+
+	s := newFlushScheduler(newFlushTestConfig("default=high", "4,2,1", 1))
+
+	for p := FLUSH_PRIORITY_LOW; p < numFlushPriorities; p++ {
+		for i := 0; i < 100; i++ {
+			s.waiters[p] = append(s.waiters[p], make(chan struct{}))
+		}
+	}
+
+	var counts [numFlushPriorities]int
+	for i := 0; i < 70; i++ {
+		if !s.handover() {
+			t.Fatalf("expected a waiter")
+		}
+	}
+	for p := FLUSH_PRIORITY_LOW; p < numFlushPriorities; p++ {
+		counts[p] = 100 - len(s.waiters[p])
+	}
+
+	if counts != [numFlushPriorities]int{10, 20, 40} {
+		t.Errorf("expected slots granted in ratio of weights, got %v", counts)
+	}
+
+	//classes without waiters don't accumulate credit
+	s = newFlushScheduler(newFlushTestConfig("default=high", "4,2,1", 1))
+	s.waiters[FLUSH_PRIORITY_LOW] = []chan struct{}{make(chan struct{}), make(chan struct{})}
+	for i := 0; i < 2; i++ {
+		if p, ok := s.next(); !ok || p != FLUSH_PRIORITY_LOW {
+			t.Errorf("expected low priority waiter, got %v %v", p, ok)
+		}
+	}
+}
+
+func TestFlushSchedulerSlots(t *testing.T) {
+
+	config := newFlushTestConfig("default=high", "4,2,1", 2)
+	s := newFlushScheduler(config)
+	s.acquire(FLUSH_PRIORITY_NORMAL)
+	s.acquire(FLUSH_PRIORITY_NORMAL)
+
+	acquired := make(chan bool)
+	go func() {
+		s.acquire(FLUSH_PRIORITY_LOW)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("expected acquire to wait for a slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//added slot is handed to the waiting worker
+	config.SetValue("settings.flush.slots", 3)
+	s.update(config)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatalf("expected waiting worker to get the added slot")
+	}
+
+	//slots removed are taken back as they are released
+	config.SetValue("settings.flush.slots", 1)
+	s.update(config)
+	s.release()
+	s.release()
+	if s.slots != 0 {
+		t.Errorf("expected no free slots, got %v", s.slots)
+	}
+	s.release()
+	if s.slots != 1 || s.total != 1 {
+		t.Errorf("expected 1 free slot of 1, got %v of %v", s.slots, s.total)
+	}
+
+	//update with unchanged settings keeps the state
+	s.acquire(FLUSH_PRIORITY_HIGH)
+	s.update(config)
+	if s.slots != 0 {
+		t.Errorf("expected no free slots, got %v", s.slots)
+	}
+}
+
+func TestFlushTurn(t *testing.T) {
+
+	s := newFlushScheduler(newFlushTestConfig("default=high", "4,2,1", 1))
+	turn := &flushTurn{sched: s}
+
+	turn.begin(FLUSH_PRIORITY_HIGH)
+	turn.end()
+	turn.begin(FLUSH_PRIORITY_HIGH)
+	if !turn.held || turn.n != 1 || s.slots != 0 {
+		t.Errorf("expected slot to be held, got %v %v %v", turn.held, turn.n, s.slots)
+	}
+
+	//moving to an index of another class waits for a slot of that class
+	turn.begin(FLUSH_PRIORITY_LOW)
+	if !turn.held || turn.priority != FLUSH_PRIORITY_LOW || turn.n != 0 || s.slots != 0 {
+		t.Errorf("expected low priority slot, got %v %v %v %v",
+			turn.held, turn.priority, turn.n, s.slots)
+	}
+
+	//slot is released after a batch
+	for i := 0; i < flushSchedBatchSize; i++ {
+		turn.end()
+	}
+	if turn.held || s.slots != 1 {
+		t.Errorf("expected slot to be released after batch, got %v %v", turn.held, s.slots)
+	}
+
+	turn.begin(FLUSH_PRIORITY_NORMAL)
+	turn.release()
+	turn.release()
+	if turn.held || s.slots != 1 {
+		t.Errorf("expected slot to be released once, got %v %v", turn.held, s.slots)
+	}
+
+	//no scheduler, no slots
+	turn = &flushTurn{}
+	turn.begin(FLUSH_PRIORITY_HIGH)
+	turn.end()
+	turn.release()
+	if turn.held {
+		t.Errorf("expected no slot without scheduler")
+	}
+}
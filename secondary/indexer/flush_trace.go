@@ -0,0 +1,210 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"fmt"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/stats"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Flush Pipeline Tracing
+//
+//Mutations are timed at each stage of the path from dataport to snapshot:
+//
+//  worker_queue    - from mutation stream reader till picked by stream worker
+//  mutation_queue  - dwell in mutation queue till dequeued by flusher
+//  flush_apply     - flusher handing the mutation to the slices of an index
+//  snapshot_create - in-memory snapshot creation of an index
+//  slice_commit    - persisted snapshot creation of an index, which commits
+//                    its slices to disk
+//  snapshot        - from flush done till snapshots of all indexes of the
+//                    bucket are created
+//
+//Latency histograms of the stages are reported in bucket and index stats.
+//Additionally, one in settings.flush_trace.sample_rate mutations carries a
+//trace with the time of each stage. Once the snapshot containing a sampled
+//mutation is created, the trace is moved to a ring of the last
+//settings.flush_trace.max_traces traces which is served at /stats/traces.
+//Mutations spilled to disk by the mutation queue keep their timestamps and
+//trace.
+
+//latency histogram boundaries in microseconds
+var latencyHistBuckets = []int64{100, 500, 1000, 5000, 10000, 50000,
+	100000, 500000, 1000000, 5000000, 10000000}
+
+func initLatencyHistogram(h *stats.Histogram) {
+	h.Init(latencyHistBuckets, humanizeLatency)
+}
+
+func humanizeLatency(us int64) string {
+	if us == math.MinInt64 {
+		return "0"
+	} else if us == math.MaxInt64 {
+		return "inf"
+	}
+	return fmt.Sprint(time.Duration(us) * time.Microsecond)
+}
+
+func addLatency(h *stats.Histogram, d time.Duration) {
+	h.Add(int64(d / time.Microsecond))
+}
+
+//addLatencySince adds the time elapsed since a unix nano timestamp,
+//if the timestamp is set
+func addLatencySince(h *stats.Histogram, since int64, now time.Time) {
+	if since != 0 {
+		addLatency(h, now.Sub(time.Unix(0, since)))
+	}
+}
+
+//MutationTrace has the time, in unix nanoseconds, a sampled mutation
+//reached each stage of the flush pipeline
+type MutationTrace struct {
+	Bucket  string  `json:"bucket"`
+	Stream  string  `json:"stream"`
+	Docid   string  `json:"docid"`
+	Vbucket Vbucket `json:"vbucket"`
+	Seqno   Seqno   `json:"seqno"`
+
+	Received  int64 `json:"received"`
+	Processed int64 `json:"processed"`
+	Queued    int64 `json:"queued"`
+	Dequeued  int64 `json:"dequeued"`
+	Applied   int64 `json:"applied"`
+	Snapshot  int64 `json:"snapshot"`
+}
+
+type mutationTracer struct {
+	sampleRate uint64
+	counter    uint64
+
+	mu        sync.Mutex
+	pending   map[string][]*MutationTrace //stream:bucket -> traces
+	traces    []*MutationTrace            //ring of completed traces
+	next      int
+	maxTraces int
+}
+
+var mTracer = newMutationTracer()
+
+func newMutationTracer() *mutationTracer {
+	return &mutationTracer{
+		pending: make(map[string][]*MutationTrace),
+	}
+}
+
+func (t *mutationTracer) UpdateConfig(config common.Config) {
+	atomic.StoreUint64(&t.sampleRate, config["settings.flush_trace.sample_rate"].Uint64())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	maxTraces := config["settings.flush_trace.max_traces"].Int()
+	if maxTraces != t.maxTraces {
+		t.maxTraces = maxTraces
+		t.traces, t.next = nil, 0
+	}
+}
+
+//newTrace returns a trace if the mutation is to be sampled, else nil
+func (t *mutationTracer) newTrace(streamId common.StreamId, meta *MutationMeta,
+	docid []byte, received int64) *MutationTrace {
+
+	rate := atomic.LoadUint64(&t.sampleRate)
+	if rate == 0 || atomic.AddUint64(&t.counter, 1)%rate != 0 {
+		return nil
+	}
+
+	return &MutationTrace{
+		Bucket:    meta.bucket,
+		Stream:    streamId.String(),
+		Docid:     string(docid),
+		Vbucket:   meta.vbucket,
+		Seqno:     meta.seqno,
+		Received:  received,
+		Processed: time.Now().UnixNano(),
+	}
+}
+
+//applied records a trace of a mutation applied by flusher, to be completed
+//once the snapshot is created
+func (t *mutationTracer) applied(streamId common.StreamId, trace *MutationTrace) {
+	trace.Applied = time.Now().UnixNano()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.maxTraces <= 0 {
+		return
+	}
+
+	key := fmt.Sprintf("%v:%v", streamId, trace.Bucket)
+	if len(t.pending[key]) < t.maxTraces {
+		t.pending[key] = append(t.pending[key], trace)
+	}
+}
+
+//snapshotDone completes pending traces of mutations which are part of
+//the snapshot created for the stream/bucket at ts
+func (t *mutationTracer) snapshotDone(streamId common.StreamId, bucket string,
+	ts *common.TsVbuuid) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := fmt.Sprintf("%v:%v", streamId, bucket)
+	pending := t.pending[key]
+	if len(pending) == 0 {
+		return
+	}
+
+	now := time.Now().UnixNano()
+	remaining := pending[:0]
+	for _, trace := range pending {
+		if int(trace.Vbucket) < len(ts.Seqnos) &&
+			uint64(trace.Seqno) <= ts.Seqnos[trace.Vbucket] {
+			trace.Snapshot = now
+			t.addTrace(trace)
+		} else {
+			remaining = append(remaining, trace)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(t.pending, key)
+	} else {
+		t.pending[key] = remaining
+	}
+}
+
+func (t *mutationTracer) addTrace(trace *MutationTrace) {
+	if len(t.traces) < t.maxTraces {
+		t.traces = append(t.traces, trace)
+		return
+	}
+	t.traces[t.next] = trace
+	t.next = (t.next + 1) % t.maxTraces
+}
+
+//Traces returns completed traces, oldest first
+func (t *mutationTracer) Traces() []*MutationTrace {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	traces := make([]*MutationTrace, 0, len(t.traces))
+	traces = append(traces, t.traces[t.next:]...)
+	traces = append(traces, t.traces[:t.next]...)
+	return traces
+}
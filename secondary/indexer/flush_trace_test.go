@@ -0,0 +1,177 @@
+package indexer
+
+import (
+	"encoding/json"
+	"github.com/couchbase/indexing/secondary/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestTracer(sampleRate uint64, maxTraces int) *mutationTracer {
+	config := common.SystemConfig.SectionConfig("indexer.", true)
+	config.SetValue("settings.flush_trace.sample_rate", sampleRate)
+	config.SetValue("settings.flush_trace.max_traces", maxTraces)
+
+	t := newMutationTracer()
+	t.UpdateConfig(config)
+	return t
+}
+
+//traceMutation samples a mutation of vbucket 0 and applies it if sampled
+func traceMutation(t *mutationTracer, seqno Seqno) *MutationTrace {
+	meta := &MutationMeta{bucket: "default", vbucket: 0, seqno: seqno}
+	trace := t.newTrace(common.MAINT_STREAM, meta, []byte("docid"), 1)
+	if trace != nil {
+		t.applied(common.MAINT_STREAM, trace)
+	}
+	return trace
+}
+
+func snapshotTs(seqno uint64) *common.TsVbuuid {
+	ts := common.NewTsVbuuid("default", 1)
+	ts.Seqnos[0] = seqno
+	return ts
+}
+
+func TestMutationTracerSampling(t *testing.T) {
+	tracer := newTestTracer(0, 10)
+	for i := 1; i <= 10; i++ {
+		if traceMutation(tracer, Seqno(i)) != nil {
+			t.Fatalf("Expected no trace with sampling disabled")
+		}
+	}
+
+	tracer = newTestTracer(3, 10)
+	var sampled []Seqno
+	for i := 1; i <= 10; i++ {
+		if trace := traceMutation(tracer, Seqno(i)); trace != nil {
+			if trace.Bucket != "default" || trace.Stream != common.MAINT_STREAM.String() ||
+				trace.Docid != "docid" || trace.Received != 1 ||
+				trace.Processed == 0 || trace.Applied == 0 {
+				t.Errorf("Unexpected trace %+v", trace)
+			}
+			sampled = append(sampled, trace.Seqno)
+		}
+	}
+	if len(sampled) != 3 || sampled[0] != 3 || sampled[1] != 6 || sampled[2] != 9 {
+		t.Errorf("Expected mutations 3, 6 and 9 to be sampled, got %v", sampled)
+	}
+}
+
+func TestMutationTracerSnapshotDone(t *testing.T) {
+	tracer := newTestTracer(1, 10)
+	for i := 1; i <= 4; i++ {
+		traceMutation(tracer, Seqno(i))
+	}
+
+	//other streams and buckets do not complete the traces
+	tracer.snapshotDone(common.INIT_STREAM, "default", snapshotTs(4))
+	tracer.snapshotDone(common.MAINT_STREAM, "other", snapshotTs(4))
+	if n := len(tracer.Traces()); n != 0 {
+		t.Fatalf("Expected no completed traces, got %v", n)
+	}
+
+	tracer.snapshotDone(common.MAINT_STREAM, "default", snapshotTs(2))
+	traces := tracer.Traces()
+	if len(traces) != 2 || traces[0].Seqno != 1 || traces[1].Seqno != 2 {
+		t.Fatalf("Expected traces of seqno 1 and 2, got %v", traces)
+	}
+	for _, trace := range traces {
+		if trace.Snapshot < trace.Applied {
+			t.Errorf("Expected snapshot time to be set, got %+v", trace)
+		}
+	}
+	key := common.MAINT_STREAM.String() + ":default"
+	if n := len(tracer.pending[key]); n != 2 {
+		t.Errorf("Expected 2 pending traces, got %v", n)
+	}
+
+	tracer.snapshotDone(common.MAINT_STREAM, "default", snapshotTs(4))
+	if n := len(tracer.Traces()); n != 4 {
+		t.Errorf("Expected 4 completed traces, got %v", n)
+	}
+	if _, ok := tracer.pending[key]; ok {
+		t.Errorf("Expected no pending traces")
+	}
+}
+
+func TestMutationTracerRing(t *testing.T) {
+	tracer := newTestTracer(1, 3)
+	for i := 1; i <= 7; i++ {
+		traceMutation(tracer, Seqno(i))
+		tracer.snapshotDone(common.MAINT_STREAM, "default", snapshotTs(uint64(i)))
+	}
+
+	traces := tracer.Traces()
+	if len(traces) != 3 {
+		t.Fatalf("Expected 3 traces, got %v", len(traces))
+	}
+	for i, trace := range traces {
+		if trace.Seqno != Seqno(5+i) {
+			t.Errorf("Expected oldest first traces 5, 6 and 7, got %v at %v", trace.Seqno, i)
+		}
+	}
+
+	//pending traces are bounded as well
+	for i := 8; i <= 12; i++ {
+		traceMutation(tracer, Seqno(i))
+	}
+	if n := len(tracer.pending[common.MAINT_STREAM.String()+":default"]); n != 3 {
+		t.Errorf("Expected 3 pending traces, got %v", n)
+	}
+}
+
+func TestHandleTracesReq(t *testing.T) {
+	//cluster manager accepting any credentials
+	ns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ns.Close()
+
+	config := common.SystemConfig.SectionConfig("indexer.", true)
+	config.SetValue("clusterAddr", strings.TrimPrefix(ns.URL, "http://"))
+	s := &statsManager{}
+	s.config.Store(config)
+
+	saved := mTracer
+	defer func() { mTracer = saved }()
+	mTracer = newTestTracer(1, 10)
+	traceMutation(mTracer, 1)
+	traceMutation(mTracer, 2)
+	mTracer.snapshotDone(common.MAINT_STREAM, "default", snapshotTs(1))
+
+	request := func(method string, auth bool) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, "http://localhost/stats/traces", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth {
+			r.SetBasicAuth("Administrator", "password")
+		}
+		w := httptest.NewRecorder()
+		s.handleTracesReq(w, r)
+		return w
+	}
+
+	if w := request("GET", false); w.Code != 401 {
+		t.Errorf("Expected 401 without credentials, got %v", w.Code)
+	}
+	if w := request("DELETE", true); w.Code != 400 {
+		t.Errorf("Expected 400 for unsupported method, got %v", w.Code)
+	}
+
+	w := request("GET", true)
+	if w.Code != 200 {
+		t.Fatalf("Expected 200, got %v", w.Code)
+	}
+	var traces []*MutationTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &traces); err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || traces[0].Seqno != 1 || traces[0].Bucket != "default" ||
+		traces[0].Snapshot == 0 {
+		t.Errorf("Expected the completed trace of seqno 1, got %v", traces)
+	}
+}
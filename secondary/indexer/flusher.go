@@ -14,6 +14,7 @@ import (
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	"sync"
+	"time"
 )
 
 //Flusher is the only component which does read/dequeue from a MutationQueue.
@@ -73,6 +74,10 @@ type flusher struct {
 	indexPartnMap IndexPartnMap
 	config        common.Config
 	stats         *IndexerStats
+
+	//flush QoS, sched is nil if not enabled
+	sched      *flushScheduler
+	priorities map[common.IndexInstId]flushPriority
 }
 
 //NewFlusher returns new instance of flusher
@@ -257,9 +262,17 @@ func (f *flusher) flushSingleVbucket(q MutationQueue, streamId common.StreamId,
 	ok := true
 	var mut *MutationKeys
 
+	turn := &flushTurn{sched: f.sched}
+	defer turn.release()
+
 	bucketStats := f.stats.buckets[mut.meta.bucket]
 	//Process till supervisor asks to stop on the channel
 	for ok {
+		//don't hold a flush slot while waiting for mutations
+		if len(mutch) == 0 {
+			turn.release()
+		}
+
 		select {
 		case mut, ok = <-mutch:
 			if ok {
@@ -267,7 +280,11 @@ func (f *flusher) flushSingleVbucket(q MutationQueue, streamId common.StreamId,
 					//No persistence is required. Just skip this mutation.
 					continue
 				}
-				f.flushSingleMutation(mut, streamId)
+				if bucketStats != nil {
+					f.recordDequeue(mut, bucketStats)
+				}
+				f.flushSingleMutation(mut, streamId, turn)
+				turn.end()
 				if bucketStats != nil {
 					bucketStats.mutationQueueSize.Add(-1)
 				}
@@ -301,9 +318,17 @@ func (f *flusher) flushSingleVbucketUptoSeqno(q MutationQueue, streamId common.S
 	var mut *MutationKeys
 	bucketStats := f.stats.buckets[bucket]
 
+	turn := &flushTurn{sched: f.sched}
+	defer turn.release()
+
 	//Read till the channel is closed by queue indicating it has sent all the
 	//sequence numbers requested
 	for ok {
+		//don't hold a flush slot while waiting for mutations
+		if len(mutch) == 0 {
+			turn.release()
+		}
+
 		select {
 		case mut, ok = <-mutch:
 			if ok {
@@ -311,7 +336,11 @@ func (f *flusher) flushSingleVbucketUptoSeqno(q MutationQueue, streamId common.S
 					//No persistence is required. Just skip this mutation.
 					continue
 				}
-				f.flushSingleMutation(mut, streamId)
+				if bucketStats != nil {
+					f.recordDequeue(mut, bucketStats)
+				}
+				f.flushSingleMutation(mut, streamId, turn)
+				turn.end()
 				mut.Free()
 				if bucketStats != nil {
 					bucketStats.mutationQueueSize.Add(-1)
@@ -327,19 +356,29 @@ func (f *flusher) flushSingleVbucketUptoSeqno(q MutationQueue, streamId common.S
 
 //flushSingleMutation talks to persistence layer to store the mutations
 //Any error from persistence layer is sent back on workerMsgCh
-func (f *flusher) flushSingleMutation(mut *MutationKeys, streamId common.StreamId) {
+func (f *flusher) flushSingleMutation(mut *MutationKeys, streamId common.StreamId,
+	turn *flushTurn) {
 
 	switch streamId {
 
 	case common.MAINT_STREAM, common.INIT_STREAM, common.CATCHUP_STREAM:
-		f.flush(mut, streamId)
+		f.flush(mut, streamId, turn)
 
 	default:
 		logging.Errorf("Flusher::flushSingleMutation Invalid StreamId: %v", streamId)
 	}
 }
 
-func (f *flusher) flush(mutk *MutationKeys, streamId common.StreamId) {
+//recordDequeue records the time the mutation spent in mutation queue
+func (f *flusher) recordDequeue(mutk *MutationKeys, bucketStats *BucketStats) {
+	now := time.Now()
+	addLatencySince(&bucketStats.mutationQueueLatency, mutk.meta.queueTime, now)
+	if mutk.meta.trace != nil {
+		mutk.meta.trace.Dequeued = now.UnixNano()
+	}
+}
+
+func (f *flusher) flush(mutk *MutationKeys, streamId common.StreamId, turn *flushTurn) {
 
 	logging.LazyTrace(func() string {
 		return fmt.Sprintf("Flusher::flush Flushing Stream %v Mutations %v", streamId, mutk)
@@ -378,6 +417,8 @@ func (f *flusher) flush(mutk *MutationKeys, streamId common.StreamId) {
 			continue
 		}
 
+		turn.begin(f.indexPriority(mut.uuid))
+
 		switch mut.command {
 
 		case common.Upsert:
@@ -410,15 +451,39 @@ func (f *flusher) flush(mutk *MutationKeys, streamId common.StreamId) {
 				f.processDelete(mut, mutk.docid, mutk.meta)
 			}
 
+		case common.EvalError:
+			f.processEvalError(mut, mutk.docid, mutk.meta)
+
 		default:
 			logging.Errorf("Flusher::flush Unknown mutation type received. Skipped %v",
 				mut.key)
 		}
 	}
+
+	if mutk.meta.trace != nil {
+		mTracer.applied(streamId, mutk.meta.trace)
+	}
+}
+
+//indexPriority returns the flush class of an index of the bucket
+func (f *flusher) indexPriority(instId common.IndexInstId) flushPriority {
+	if p, ok := f.priorities[instId]; ok {
+		return p
+	}
+	return FLUSH_PRIORITY_NORMAL
+}
+
+//recordApply records the time taken to hand a mutation to the index slice
+func (f *flusher) recordApply(instId common.IndexInstId, start time.Time) {
+	if idxStats, ok := f.stats.indexes[instId]; ok {
+		addLatency(&idxStats.flushApplyLatency, time.Since(start))
+	}
 }
 
 func (f *flusher) processUpsert(mut *Mutation, docid []byte, meta *MutationMeta) {
 
+	defer f.recordApply(mut.uuid, time.Now())
+
 	idxInst, _ := f.indexInstMap[mut.uuid]
 
 	partnId := idxInst.Pc.GetPartitionIdByPartitionKey(mut.partnkey)
@@ -438,6 +503,11 @@ func (f *flusher) processUpsert(mut *Mutation, docid []byte, meta *MutationMeta)
 				"docid: %s in Slice: %v. Error: %v. Skipped.",
 				mut.key, docid, slice.Id(), err)
 
+			if idxStats, ok := f.stats.indexes[mut.uuid]; ok {
+				idxStats.addDocError(docErrorClass(err), docid, mut.key,
+					newDocPos(meta), err.Error())
+			}
+
 			if err2 := slice.Delete(docid, meta); err2 != nil {
 				logging.Errorf("Flusher::processUpsert Error removing entry due to error %v Key: %s "+
 					"docid: %s in Slice: %v. Error: %v", err, mut.key, docid, slice.Id(), err2)
@@ -450,8 +520,23 @@ func (f *flusher) processUpsert(mut *Mutation, docid []byte, meta *MutationMeta)
 
 }
 
+//processEvalError records a document for which projector failed to
+//evaluate the index expressions. The error message is sent as key.
+func (f *flusher) processEvalError(mut *Mutation, docid []byte, meta *MutationMeta) {
+
+	logging.Debugf("Flusher::processEvalError Index Instance %v docid: %s "+
+		"failed evaluation. Error: %s. Skipped.", mut.uuid, docid, mut.key)
+
+	if idxStats, ok := f.stats.indexes[mut.uuid]; ok {
+		idxStats.addDocError(docErrEval, docid, nil, newDocPos(meta),
+			string(mut.key))
+	}
+}
+
 func (f *flusher) processDelete(mut *Mutation, docid []byte, meta *MutationMeta) {
 
+	defer f.recordApply(mut.uuid, time.Now())
+
 	idxInst, _ := f.indexInstMap[mut.uuid]
 
 	partnId := idxInst.Pc.GetPartitionIdByPartitionKey(mut.partnkey)
@@ -484,7 +569,7 @@ func (f *flusher) IsQueueLWTLowerThanTimestamp(q MutationQueue, ts Timestamp) bo
 	//each individual vbucket seqno should be lower than or equal to timestamp seqno
 	for i, t := range ts {
 		mut := q.PeekHead(Vbucket(i))
-		if mut.meta.seqno > t {
+		if mut != nil && mut.meta != nil && mut.meta.seqno > t {
 			return false
 		}
 	}
@@ -498,7 +583,7 @@ func (f *flusher) GetQueueLWT(q MutationQueue) Timestamp {
 	ts := NewTimestamp(int(q.GetNumVbuckets()))
 	var i uint16
 	for i = 0; i < q.GetNumVbuckets(); i++ {
-		if mut := q.PeekHead(Vbucket(i)); mut != nil {
+		if mut := q.PeekHead(Vbucket(i)); mut != nil && mut.meta != nil {
 			ts[i] = mut.meta.seqno
 		} else {
 			ts[i] = 0
@@ -0,0 +1,79 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/fdb"
+	"strings"
+)
+
+//Forestdb usage outside of the forestdb slice is kept to this file so
+//that the other storage modes do not depend on it directly. Local
+//metadata of the cluster manager is still stored in forestdb.
+
+//isKeyNotFound returns true if a local metadata lookup failed because
+//the key was never stored. Errors from the cluster manager agent only
+//carry the forestdb error text.
+func isKeyNotFound(err error) bool {
+	return strings.Contains(err.Error(), forestdb.FDB_RESULT_KEY_NOT_FOUND.Error())
+}
+
+//forestdbMemoryUsed returns the memory held by the forestdb buffer cache
+func forestdbMemoryUsed() uint64 {
+	return forestdb.BufferCacheUsed()
+}
+
+//localMetaStore persists the index instance map when the cluster
+//manager is not enabled
+type localMetaStore struct {
+	dbfile *forestdb.File
+	meta   *forestdb.KVStore
+}
+
+func openLocalMetaStore() (*localMetaStore, error) {
+	var err error
+	m := &localMetaStore{}
+
+	if m.dbfile, err = forestdb.Open("meta", forestdb.DefaultConfig()); err != nil {
+		return nil, err
+	}
+
+	// Make use of default kvstore provided by forestdb
+	if m.meta, err = m.dbfile.OpenKVStore("default", forestdb.DefaultKVStoreConfig()); err != nil {
+		m.dbfile.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+//get returns nil if the key does not exist
+func (m *localMetaStore) get(key string) ([]byte, error) {
+	val, err := m.meta.GetKV([]byte(key))
+
+	//forestdb reports get in a non-existent key as an
+	//error, skip that
+	if err == forestdb.FDB_RESULT_KEY_NOT_FOUND {
+		return nil, nil
+	}
+	return val, err
+}
+
+func (m *localMetaStore) set(key string, val []byte) error {
+	if err := m.meta.SetKV([]byte(key), val); err != nil {
+		return err
+	}
+	return m.dbfile.Commit(forestdb.COMMIT_MANUAL_WAL_FLUSH)
+}
+
+func (m *localMetaStore) close() {
+	m.meta.Close()
+	m.dbfile.Close()
+}
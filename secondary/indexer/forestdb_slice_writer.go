@@ -171,6 +171,7 @@ type indexItem struct {
 	key    []byte
 	rawKey []byte
 	docid  []byte
+	pos    docPos
 }
 
 //fdbSlice represents a forestdb slice
@@ -276,7 +277,7 @@ func (fdb *fdbSlice) Insert(rawKey []byte, docid []byte, meta *MutationMeta) err
 	}
 
 	fdb.idxStats.numDocsFlushQueued.Add(1)
-	fdb.cmdCh <- &indexItem{key: key, rawKey: rawKey, docid: docid}
+	fdb.cmdCh <- &indexItem{key: key, rawKey: rawKey, docid: docid, pos: newDocPos(meta)}
 	return fdb.fatalDbErr
 }
 
@@ -311,7 +312,7 @@ loop:
 			case *indexItem:
 				icmd = c.(*indexItem)
 				start = time.Now()
-				nmut = fdb.insert((*icmd).key, (*icmd).rawKey, (*icmd).docid, workerId)
+				nmut = fdb.insert((*icmd).key, (*icmd).rawKey, (*icmd).docid, (*icmd).pos, workerId)
 				elapsed = time.Since(start)
 				fdb.totalFlushTime += elapsed
 
@@ -344,7 +345,7 @@ loop:
 }
 
 //insert does the actual insert in forestdb
-func (fdb *fdbSlice) insert(key []byte, rawKey []byte, docid []byte, workerId int) int {
+func (fdb *fdbSlice) insert(key []byte, rawKey []byte, docid []byte, pos docPos, workerId int) int {
 	var nmut int
 
 	if fdb.isPrimary {
@@ -352,7 +353,7 @@ func (fdb *fdbSlice) insert(key []byte, rawKey []byte, docid []byte, workerId in
 	} else if !fdb.idxDefn.IsArrayIndex {
 		nmut = fdb.insertSecIndex(key, docid, workerId)
 	} else {
-		nmut = fdb.insertSecArrayIndex(key, rawKey, docid, workerId)
+		nmut = fdb.insertSecArrayIndex(key, rawKey, docid, pos, workerId)
 	}
 
 	fdb.logWriterStat()
@@ -410,6 +411,7 @@ func (fdb *fdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) (nmu
 		if bytes.Equal(oldkey, key) {
 			logging.Tracef("ForestDBSlice::insert \n\tSliceId %v IndexInstId %v Received Unchanged Key for "+
 				"Doc Id %v. Key %v. Skipped.", fdb.id, fdb.idxInstId, string(docid), key)
+			fdb.idxStats.numWritesSkipped.Add(1)
 			return
 		}
 
@@ -475,7 +477,7 @@ func (fdb *fdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) (nmu
 	return
 }
 
-func (fdb *fdbSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte, workerId int) (nmut int) {
+func (fdb *fdbSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte, pos docPos, workerId int) (nmut int) {
 	var err error
 	var oldkey []byte
 
@@ -493,6 +495,7 @@ func (fdb *fdbSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte
 		if bytes.Equal(oldkey, key) {
 			logging.Tracef("ForestDBSlice::insert \n\tSliceId %v IndexInstId %v Received Unchanged Key for "+
 				"Doc Id %v. Key %v. Skipped.", fdb.id, fdb.idxInstId, string(docid), key)
+			fdb.idxStats.numWritesSkipped.Add(1)
 			return
 		}
 
@@ -515,12 +518,14 @@ func (fdb *fdbSlice) insertSecArrayIndex(key []byte, rawKey []byte, docid []byte
 			logging.Errorf("ForestDBSlice::insert Error indexing docid: %s in Slice: %v. Error: Encoded array item too long (> %v). Skipped.",
 				docid, fdb.id, maxIndexEntrySize)
 			logging.Verbosef("ForestDBSlice::insert Skipped docid: %s Key: %s", docid, string(key))
+			fdb.idxStats.addDocError(docErrorClass(err), docid, rawKey, pos, err.Error())
 			fdb.deleteSecArrayIndex(docid, workerId)
 			return
 		} else if err == ErrArrayKeyTooLong {
 			logging.Errorf("ForestDBSlice::insert Error indexing docid: %s in Slice: %v. Error: Encoded array key too long (> %v). Skipped.",
 				docid, fdb.id, maxArrayIndexEntrySize)
 			logging.Verbosef("ForestDBSlice::insert Skipped docid: %s Key: %s", docid, string(key))
+			fdb.idxStats.addDocError(docErrorClass(err), docid, rawKey, pos, err.Error())
 			fdb.deleteSecArrayIndex(docid, workerId)
 			return
 		} else if err != nil {
@@ -1028,6 +1033,7 @@ func (fdb *fdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotInfo
 		Ts:        ts,
 		MainSeq:   mainDbInfo.LastSeqNum(),
 		Committed: commit,
+		CreatedAt: time.Now(),
 	}
 
 	//for non-primary index add info for back-index
@@ -1051,6 +1057,11 @@ func (fdb *fdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotInfo
 
 		//the next meta seqno after this update
 		newSnapshotInfo.MetaSeq = metaDbInfo.LastSeqNum() + 1
+		newSnapshotInfo.ItemsCount = int64(mainDbInfo.DocCount())
+		fdb.statFdLock.Lock()
+		newSnapshotInfo.DataSize = int64(fdb.statFd.EstimateSpaceUsed())
+		fdb.statFdLock.Unlock()
+
 		infos, err := fdb.getSnapshotsMeta()
 		if err != nil {
 			return nil, err
@@ -1060,15 +1071,20 @@ func (fdb *fdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotInfo
 
 		fdb.confLock.RLock()
 		maxRollbacks := fdb.sysconf["settings.recovery.max_rollbacks"].Int()
+		policy := retentionPolicyFromConfig(fdb.sysconf)
 		fdb.confLock.RUnlock()
 
 		if sic.Len() > maxRollbacks {
 			sic.RemoveOldest()
 		}
 
+		// Forestdb keeps only max_rollbacks commit headers. Retention policy
+		// can only drop rollback points within that limit.
+		snapList := retainFdbSnapshots(sic.List(), policy)
+
 		// Meta update should be done before commit
 		// Otherwise, metadata will not be atomically updated along with disk commit.
-		err = fdb.updateSnapshotsMeta(sic.List())
+		err = fdb.updateSnapshotsMeta(snapList)
 		if err != nil {
 			return nil, err
 		}
@@ -1200,6 +1216,47 @@ func (fdb *fdbSlice) GetSnapshots() ([]SnapshotInfo, error) {
 	return infos, err
 }
 
+var errFdbSnapshotRetention = errors.New("Per index snapshot retention is not supported by forestdb storage")
+
+func (fdb *fdbSlice) RetentionPolicy() RetentionPolicy {
+	fdb.confLock.RLock()
+	defer fdb.confLock.RUnlock()
+
+	return retentionPolicyFromConfig(fdb.sysconf)
+}
+
+func (fdb *fdbSlice) SetRetentionPolicy(policy *RetentionPolicy) error {
+	return errFdbSnapshotRetention
+}
+
+func (fdb *fdbSlice) PinSnapshot(id string, pin bool) error {
+	return errFdbSnapshotRetention
+}
+
+// Returns retained rollback points, most recent first. Snapshots share
+// the index file and are identified by meta seqno. Size is the space used
+// by the file when the snapshot was committed.
+func (fdb *fdbSlice) DiskSnapshots() ([]DiskSnapshot, error) {
+	infos, err := fdb.getSnapshotsMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	var snaps []DiskSnapshot
+	for _, info := range infos {
+		fi := info.(*fdbSnapshotInfo)
+		snaps = append(snaps, DiskSnapshot{
+			Id:      fmt.Sprintf("%d", fi.MetaSeq),
+			Created: fi.CreatedAt,
+			Size:    fi.DataSize,
+			Items:   fi.ItemsCount,
+			Ts:      summarizeTs(fi.Ts),
+		})
+	}
+
+	return snaps, nil
+}
+
 // IsDirty returns true if there has been any change in
 // in the slice storage after last in-mem/persistent snapshot
 func (fdb *fdbSlice) IsDirty() bool {
@@ -1538,10 +1595,17 @@ func (fdb *fdbSlice) canRunCompaction(abortTime time.Time) bool {
 	fdb.confLock.RLock()
 	defer fdb.confLock.RUnlock()
 
+	return canRunCompaction(fdb.sysconf, abortTime)
+}
+
+//canRunCompaction checks the compaction settings to find out if
+//compaction can run at this time
+func canRunCompaction(sysconf common.Config, abortTime time.Time) bool {
+
 	// Once compaction starts, only need to find out if it past the end date.
-	mode := strings.ToLower(fdb.sysconf["settings.compaction.compaction_mode"].String())
-	abort := fdb.sysconf["settings.compaction.abort_exceed_interval"].Bool()
-	interval := fdb.sysconf["settings.compaction.interval"].String()
+	mode := strings.ToLower(sysconf["settings.compaction.compaction_mode"].String())
+	abort := sysconf["settings.compaction.abort_exceed_interval"].Bool()
+	interval := sysconf["settings.compaction.interval"].String()
 
 	// No need to stop running compaction if in full compaction mode
 	if mode == "full" {
@@ -1582,7 +1646,7 @@ func (fdb *fdbSlice) canRunCompaction(abortTime time.Time) bool {
 
 		} else {
 			// if there is no end time, then allow compaction to continue.
-			logging.Errorf("ForestDBSlice::canRunCompaction.  Compaction setting misconfigured.  Allowing compaction to continue without abort.")
+			logging.Errorf("canRunCompaction.  Compaction setting misconfigured.  Allowing compaction to continue without abort.")
 		}
 	}
 
@@ -28,6 +28,12 @@ type fdbSnapshotInfo struct {
 	BackSeq   forestdb.SeqNum
 	MetaSeq   forestdb.SeqNum
 	Committed bool
+	CreatedAt time.Time
+
+	// Entries in the main index and space used by the index file
+	// when the snapshot was committed
+	ItemsCount int64 `json:",omitempty"`
+	DataSize   int64 `json:",omitempty"`
 }
 
 func (info *fdbSnapshotInfo) Timestamp() *common.TsVbuuid {
@@ -38,6 +44,29 @@ func (info *fdbSnapshotInfo) IsCommitted() bool {
 	return info.Committed
 }
 
+//retainFdbSnapshots applies the retention policy to a snapshot list
+//ordered most recent first. Snapshots of older versions do not carry
+//the creation time and are left to the max_rollbacks limit.
+func retainFdbSnapshots(infos []SnapshotInfo, policy RetentionPolicy) []SnapshotInfo {
+	n := len(infos)
+	created := make([]time.Time, n)
+	pinned := make([]bool, n)
+	for i, info := range infos {
+		created[n-1-i] = info.(*fdbSnapshotInfo).CreatedAt
+		pinned[n-1-i] = created[n-1-i].IsZero()
+	}
+
+	var retained []SnapshotInfo
+	keep := policy.Retain(created, pinned, time.Now())
+	for i, info := range infos {
+		if keep[n-1-i] {
+			retained = append(retained, info)
+		}
+	}
+
+	return retained
+}
+
 func (info *fdbSnapshotInfo) String() string {
 	return fmt.Sprintf("SnapshotInfo: seqnos: %v, %v, %v committed:%v", info.MainSeq,
 		info.BackSeq, info.MetaSeq, info.Committed)
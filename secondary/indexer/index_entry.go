@@ -7,12 +7,16 @@ import (
 	"fmt"
 	"github.com/couchbase/indexing/secondary/collatejson"
 	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"sync/atomic"
 )
 
 var (
 	ErrSecKeyNil     = errors.New("Secondary key array is empty")
 	ErrSecKeyTooLong = errors.New(fmt.Sprintf("Secondary key is too long (> %d)", MAX_SEC_KEY_LEN))
 	ErrDocIdTooLong  = errors.New(fmt.Sprintf("DocID is too long (>%d)", MAX_DOCID_LEN))
+
+	ErrLargeSecKeyTooLong = errors.New("Secondary key is too long (> max_large_seckey_size)")
 )
 
 // Special index keys
@@ -36,11 +40,45 @@ var (
 	maxArrayKeyLength       = common.SystemConfig["indexer.settings.max_array_seckey_size"].Int()
 	maxArrayKeyBufferLength = maxArrayKeyLength * 3
 	maxArrayIndexEntrySize  = maxArrayKeyBufferLength + MAX_DOCID_LEN + 2
+
+	// Large key settings are updated while slice writers are running,
+	// access them atomically
+	allowLargeKeys    int32
+	maxLargeKeyLength int64
 )
 
 func init() {
 	jsonEncoder = collatejson.NewCodec(16)
 	encBufPool = common.NewByteBufferPool(maxIndexEntrySize)
+	setLargeKeySettings(common.SystemConfig)
+}
+
+// setLargeKeySettings applies settings of keys beyond the key size limits,
+// which are indexed by memdb slices only. Keys are limited to
+// max_large_seckey_size and to MAX_LARGE_SEC_KEY_BUFFER_LEN once encoded.
+func setLargeKeySettings(config common.Config) {
+	var allow int32
+	if config["indexer.settings.allow_large_keys"].Bool() {
+		allow = 1
+	}
+
+	maxLen := config["indexer.settings.max_large_seckey_size"].Int()
+	if maxLen > MAX_LARGE_SEC_KEY_BUFFER_LEN {
+		logging.Warnf("max_large_seckey_size %v is beyond the limit of encoded keys, using %v",
+			maxLen, MAX_LARGE_SEC_KEY_BUFFER_LEN)
+		maxLen = MAX_LARGE_SEC_KEY_BUFFER_LEN
+	}
+
+	atomic.StoreInt64(&maxLargeKeyLength, int64(maxLen))
+	atomic.StoreInt32(&allowLargeKeys, allow)
+}
+
+func largeKeysAllowed() bool {
+	return atomic.LoadInt32(&allowLargeKeys) == 1
+}
+
+func maxLargeKeyLen() int {
+	return int(atomic.LoadInt64(&maxLargeKeyLength))
 }
 
 // Generic index entry abstraction (primary or secondary)
@@ -105,9 +143,19 @@ func (e *primaryIndexEntry) String() string {
 // Format:
 // [collate_json_encoded_sec_key][raw_docid_bytes][optional_count_2_bytes][len_of_docid_2_bytes]
 // The MSB of right byte of docid length indicates whether count is encoded or not
+// The next bit indicates a large key stored out of line. The encoded key is then
+// replaced by [prefix_of_encoded_key][slot_of_key_8_bytes] (see memdb_largekeys.go)
 type secondaryIndexEntry []byte
 
 func NewSecondaryIndexEntry(key []byte, docid []byte, isArray bool, count int, buf []byte) (secondaryIndexEntry, error) {
+	return newSecondaryIndexEntry(key, docid, isArray, count, buf, nil)
+}
+
+// newSecondaryIndexEntry builds the entry of a slice which keeps keys beyond
+// the key size limits in large key store lks. Key size limits are checked
+// if lks is nil.
+func newSecondaryIndexEntry(key []byte, docid []byte, isArray bool, count int,
+	buf []byte, lks *largeKeyStore) (secondaryIndexEntry, error) {
 	var err error
 	var offset int
 
@@ -116,7 +164,14 @@ func NewSecondaryIndexEntry(key []byte, docid []byte, isArray bool, count int, b
 	}
 
 	if key[0] == '[' { // JSON
-		if isArray {
+		if lks != nil {
+			if len(key) > maxLargeKeyLen() {
+				return nil, ErrLargeSecKeyTooLong
+			}
+			if cap(buf) < 3*len(key) {
+				buf = make([]byte, 0, 3*len(key))
+			}
+		} else if isArray {
 			if isArraySecKeyLarge(key) {
 				return nil, errors.New(fmt.Sprintf("Secondary array key is too long (> %d)", maxArrayKeyLength))
 			}
@@ -127,7 +182,11 @@ func NewSecondaryIndexEntry(key []byte, docid []byte, isArray bool, count int, b
 			return nil, err
 		}
 	} else { // Encoded
-		if isArray {
+		if lks != nil {
+			if len(key) > MAX_LARGE_SEC_KEY_BUFFER_LEN {
+				return nil, ErrLargeSecKeyTooLong
+			}
+		} else if isArray {
 			if len(key) > maxArrayIndexEntrySize {
 				return nil, errors.New(fmt.Sprintf("Encoded secondary array key is too long (> %d)", maxArrayIndexEntrySize))
 			}
@@ -137,20 +196,35 @@ func NewSecondaryIndexEntry(key []byte, docid []byte, isArray bool, count int, b
 		buf = append(buf, key...)
 	}
 
+	// JSON keys may grow when encoded
+	if lks != nil && len(buf) > MAX_LARGE_SEC_KEY_BUFFER_LEN {
+		return nil, ErrLargeSecKeyTooLong
+	}
+
+	isLargeKey := lks != nil && len(buf) > largeKeyPrefixLen
+	if isLargeKey {
+		var slot [largeKeySlotLen]byte
+		binary.BigEndian.PutUint64(slot[:], lks.add(buf))
+		buf = append(buf[:largeKeyPrefixLen], slot[:]...)
+	}
+
 	buf = append(buf, docid...)
 
 	if count > 1 {
-		buf = buf[:len(buf)+2]
+		buf = append(buf, 0, 0)
 		offset = len(buf) - 2
 		binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(count))
 	}
 
-	buf = buf[:len(buf)+2]
+	buf = append(buf, 0, 0)
 	offset = len(buf) - 2
 	binary.LittleEndian.PutUint16(buf[offset:offset+2], uint16(len(docid)))
 	if count > 1 {
 		buf[offset+1] = byte(uint8(1) << 7)
 	}
+	if isLargeKey {
+		buf[offset+1] |= byte(uint8(1) << 6)
+	}
 
 	e := secondaryIndexEntry(buf)
 	return e, nil
@@ -165,7 +239,7 @@ func (e *secondaryIndexEntry) lenDocId() int {
 	rbuf := []byte(*e)
 	offset := len(rbuf) - 2
 	l := binary.LittleEndian.Uint16(rbuf[offset : offset+2])
-	len := l & 0x7fff // Length & 0111111 11111111 (as MSB of length is used to indicate presence of count)
+	len := l & 0x3fff // Length & 0011111 11111111 (as two MSBs of length are used to indicate count and large key)
 	return int(len)
 }
 
@@ -182,6 +256,12 @@ func (e *secondaryIndexEntry) isCountEncoded() bool {
 	return (rbuf[offset] & 0x80) == 0x80
 }
 
+func (e *secondaryIndexEntry) isLargeKey() bool {
+	rbuf := []byte(*e)
+	offset := len(rbuf) - 1 // Decode length byte to see if key is stored out of line
+	return (rbuf[offset] & 0x40) == 0x40
+}
+
 func (e secondaryIndexEntry) ReadDocId(buf []byte) ([]byte, error) {
 	docidlen := e.lenDocId()
 	var offset int
@@ -290,7 +370,10 @@ func NewSecondaryKey(key []byte, buf []byte) (IndexKey, error) {
 	}
 
 	if isSecKeyLarge(key) {
-		return nil, ErrSecKeyTooLong
+		if !largeKeysAllowed() || len(key) > maxLargeKeyLen() {
+			return nil, ErrSecKeyTooLong
+		}
+		buf = make([]byte, 0, 3*len(key))
 	}
 
 	var err error
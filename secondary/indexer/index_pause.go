@@ -0,0 +1,469 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"time"
+)
+
+//Index Maintenance Pause/Resume
+//
+//Maintenance of an ACTIVE index can be paused without dropping the index.
+//A paused index is removed from MAINT_STREAM, but its slice and last
+//snapshot are kept and the index stays ACTIVE for scans. A paused index
+//has no stream (NIL_STREAM) in the indexer. Index metadata is not updated,
+//the list of paused indexes is kept in local metadata instead. As its
+//snapshot does not advance, scan coordinator rejects scans of a paused
+//index with session or query consistency (ErrIndexPaused).
+//
+//On resume, the index catches up in CATCHUP_STREAM from the timestamp of
+//its last persisted snapshot, the same way a stream restarts in recovery.
+//The index is also added back to MAINT_STREAM, so that mutations for it
+//get queued there, and timekeeper merges CATCHUP_STREAM to MAINT_STREAM
+//once it has flushed past MAINT_STREAM. If no other index of the bucket
+//is in MAINT_STREAM, MAINT_STREAM is restarted for the bucket from the
+//snapshot timestamp of the index instead.
+
+var (
+	ErrIndexCatchupInProgress = errors.New("Index Catchup In Progress")
+	ErrIndexNotActive         = errors.New("Index Not Active")
+	ErrIndexBuildInProgress   = errors.New("Index Build In Progress For Bucket")
+	ErrIndexPauseInProgress   = errors.New("Index Drop Or Pause In Progress For Bucket")
+)
+
+func isIndexPaused(inst common.IndexInst) bool {
+	return inst.State == common.INDEX_STATE_ACTIVE && inst.Stream == common.NIL_STREAM
+}
+
+func (idx *indexer) handleIndexMaintenance(msg Message) {
+
+	instId := msg.(*MsgIndexMaintenance).GetIndexInstId()
+	respCh := msg.(*MsgIndexMaintenance).GetResponseChannel()
+
+	logging.Infof("Indexer::handleIndexMaintenance %v IndexInstId %v", msg.GetMsgType(), instId)
+
+	indexInst, ok := idx.checkIndexMaintenanceRequest(instId, respCh)
+	if !ok {
+		return
+	}
+
+	switch msg.GetMsgType() {
+
+	case INDEXER_PAUSE_INDEX:
+		idx.pauseIndex(indexInst, respCh)
+
+	case INDEXER_RESUME_INDEX:
+		idx.resumeIndex(indexInst, respCh)
+	}
+}
+
+func (idx *indexer) checkIndexMaintenanceRequest(instId common.IndexInstId,
+	respCh MsgChannel) (common.IndexInst, bool) {
+
+	sendError := func(code errCode, cause error) {
+		logging.Errorf("Indexer::checkIndexMaintenanceRequest IndexInstId %v. Error %v",
+			instId, cause)
+		respCh <- &MsgError{
+			err: Error{code: code,
+				severity: FATAL,
+				cause:    cause,
+				category: INDEXER}}
+	}
+
+	if is := idx.getIndexerState(); is != common.INDEXER_ACTIVE {
+		sendError(ERROR_INDEXER_NOT_ACTIVE, ErrIndexerNotActive)
+		return common.IndexInst{}, false
+	}
+
+	indexInst, ok := idx.indexInstMap[instId]
+	if !ok {
+		sendError(ERROR_INDEXER_UNKNOWN_INDEX, common.ErrIndexNotFound)
+		return indexInst, false
+	}
+
+	if indexInst.State != common.INDEX_STATE_ACTIVE {
+		sendError(ERROR_INDEXER_NOT_ACTIVE, ErrIndexNotActive)
+		return indexInst, false
+	}
+
+	bucket := indexInst.Defn.Bucket
+	for _, streamId := range []common.StreamId{common.MAINT_STREAM, common.CATCHUP_STREAM} {
+		state := idx.getStreamBucketState(streamId, bucket)
+		if state == STREAM_RECOVERY || state == STREAM_PREPARE_RECOVERY {
+			sendError(ERROR_INDEXER_IN_RECOVERY, ErrIndexerInRecovery)
+			return indexInst, false
+		}
+	}
+
+	return indexInst, true
+}
+
+func (idx *indexer) pauseIndex(indexInst common.IndexInst, respCh MsgChannel) {
+
+	sendError := func(code errCode, cause error) {
+		logging.Errorf("Indexer::pauseIndex IndexInstId %v. Error %v", indexInst.InstId, cause)
+		respCh <- &MsgError{
+			err: Error{code: code,
+				severity: FATAL,
+				cause:    cause,
+				category: INDEXER}}
+	}
+
+	switch indexInst.Stream {
+
+	case common.NIL_STREAM:
+		logging.Infof("Indexer::pauseIndex IndexInstId %v Already Paused", indexInst.InstId)
+		respCh <- &MsgSuccess{}
+		return
+
+	case common.CATCHUP_STREAM:
+		sendError(ERROR_INDEX_BUILD_IN_PROGRESS, ErrIndexCatchupInProgress)
+		return
+	}
+
+	bucket := indexInst.Defn.Bucket
+
+	//MAINT_STREAM is required to merge indexes being built or caught up.
+	//The last index of the bucket in MAINT_STREAM cannot be paused till then.
+	if idx.isLastIndexInMaintStream(indexInst) &&
+		(idx.checkBucketExistsInStream(bucket, common.INIT_STREAM, false) ||
+			idx.checkBucketExistsInStream(bucket, common.CATCHUP_STREAM, false)) {
+		sendError(ERROR_INDEX_BUILD_IN_PROGRESS, ErrIndexBuildInProgress)
+		return
+	}
+
+	if obs, ok := idx.streamBucketObserveFlushDone[common.MAINT_STREAM][bucket]; ok && obs != nil {
+		sendError(ERROR_INDEX_DROP_IN_PROGRESS, ErrIndexPauseInProgress)
+		return
+	}
+
+	paused := indexInst
+	paused.Stream = common.NIL_STREAM
+	idx.indexInstMap[paused.InstId] = paused
+
+	msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+	if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, nil); err != nil {
+		sendError(ERROR_INDEXER_INTERNAL_ERROR, err)
+		common.CrashOnError(err)
+	}
+
+	idx.persistPausedIndexes()
+
+	logging.Infof("Indexer::pauseIndex Paused Maintenance of Index %v %v:%v",
+		paused.InstId, bucket, paused.Defn.Name)
+
+	//removing an index from a stream is the same as for drop, wait for
+	//the flush in progress to finish before that.
+	if ok, _ := idx.streamBucketFlushInProgress[common.MAINT_STREAM][bucket]; ok {
+		notifyCh := make(MsgChannel)
+		idx.streamBucketObserveFlushDone[common.MAINT_STREAM][bucket] = notifyCh
+		go idx.processPauseAfterFlushDone(indexInst, notifyCh, respCh)
+	} else {
+		idx.sendStreamUpdateForDropIndex(indexInst, respCh)
+		respCh <- &MsgSuccess{}
+	}
+}
+
+func (idx *indexer) processPauseAfterFlushDone(indexInst common.IndexInst,
+	notifyCh MsgChannel, respCh MsgChannel) {
+
+	select {
+	case <-notifyCh:
+		idx.sendStreamUpdateForDropIndex(indexInst, respCh)
+		respCh <- &MsgSuccess{}
+	}
+
+	//indicate done, observer is cleared by notifyFlushObserver
+	close(notifyCh)
+}
+
+func (idx *indexer) resumeIndex(indexInst common.IndexInst, respCh MsgChannel) {
+
+	sendError := func(code errCode, cause error) {
+		logging.Errorf("Indexer::resumeIndex IndexInstId %v. Error %v", indexInst.InstId, cause)
+		respCh <- &MsgError{
+			err: Error{code: code,
+				severity: FATAL,
+				cause:    cause,
+				category: INDEXER}}
+	}
+
+	if !isIndexPaused(indexInst) {
+		logging.Infof("Indexer::resumeIndex IndexInstId %v Not Paused. Stream %v",
+			indexInst.InstId, indexInst.Stream)
+		respCh <- &MsgSuccess{}
+		return
+	}
+
+	bucket := indexInst.Defn.Bucket
+
+	//a pause waiting for the flush in progress still has to remove the
+	//index from MAINT_STREAM, resuming now would lose it after merge
+	if obs, ok := idx.streamBucketObserveFlushDone[common.MAINT_STREAM][bucket]; ok && obs != nil {
+		sendError(ERROR_INDEX_DROP_IN_PROGRESS, ErrIndexPauseInProgress)
+		return
+	}
+
+	maintRunning := idx.checkBucketExistsInStream(bucket, common.MAINT_STREAM, false)
+
+	//only one catchup at a time per bucket
+	if maintRunning &&
+		idx.getStreamBucketState(common.CATCHUP_STREAM, bucket) != STREAM_INACTIVE {
+		sendError(ERROR_INDEX_BUILD_IN_PROGRESS, ErrIndexCatchupInProgress)
+		return
+	}
+
+	restartTs, err := idx.getIndexRestartTs(indexInst.InstId)
+	if err != nil {
+		sendError(ERROR_INDEXER_INTERNAL_ERROR, err)
+		return
+	}
+
+	buildStream := common.CATCHUP_STREAM
+	if !maintRunning {
+		buildStream = common.MAINT_STREAM
+	}
+
+	indexInst.Stream = buildStream
+	idx.indexInstMap[indexInst.InstId] = indexInst
+
+	msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
+	if err := idx.distributeIndexMapsToWorkers(msgUpdateIndexInstMap, nil); err != nil {
+		sendError(ERROR_INDEXER_INTERNAL_ERROR, err)
+		common.CrashOnError(err)
+	}
+
+	idx.persistPausedIndexes()
+
+	logging.Infof("Indexer::resumeIndex Resuming Maintenance of Index %v %v:%v "+
+		"in Stream %v. RestartTs %v", indexInst.InstId, bucket, indexInst.Defn.Name,
+		buildStream, restartTs)
+
+	if buildStream == common.CATCHUP_STREAM {
+		idx.sendStreamUpdateForResumeIndex(indexInst)
+	}
+
+	idx.stateLock.Lock()
+	if _, ok := idx.streamBucketStatus[buildStream]; !ok {
+		idx.streamBucketStatus[buildStream] = make(BucketStatus)
+	}
+	idx.stateLock.Unlock()
+
+	idx.startBucketStream(buildStream, bucket, restartTs)
+	idx.setStreamBucketState(buildStream, bucket, STREAM_ACTIVE)
+
+	respCh <- &MsgSuccess{}
+}
+
+//sendStreamUpdateForResumeIndex adds an index being caught up to
+//MAINT_STREAM, so mutations for this index are already in queue to
+//allow convergence with CATCHUP_STREAM. The timestamp at which projector
+//has added the index to MAINT_STREAM is the minimum merge timestamp.
+func (idx *indexer) sendStreamUpdateForResumeIndex(indexInst common.IndexInst) {
+
+	bucket := indexInst.Defn.Bucket
+	respCh := make(MsgChannel)
+	stopCh := make(StopChannel)
+
+	cmd := &MsgStreamUpdate{mType: ADD_INDEX_LIST_TO_STREAM,
+		streamId:  common.MAINT_STREAM,
+		bucket:    bucket,
+		indexList: []common.IndexInst{indexInst},
+		respCh:    respCh,
+		stopCh:    stopCh}
+
+	//send stream update to timekeeper
+	if resp := idx.sendStreamUpdateToWorker(cmd, idx.tkCmdCh, "Timekeeper"); resp.GetMsgType() != MSG_SUCCESS {
+		respErr := resp.(*MsgError).GetError()
+		common.CrashOnError(respErr.cause)
+	}
+
+	//send stream update to mutation manager
+	if resp := idx.sendStreamUpdateToWorker(cmd, idx.mutMgrCmdCh, "MutationMgr"); resp.GetMsgType() != MSG_SUCCESS {
+		respErr := resp.(*MsgError).GetError()
+		common.CrashOnError(respErr.cause)
+	}
+
+	clustAddr := idx.config["clusterAddr"].String()
+
+	reqLock := idx.acquireStreamRequestLock(bucket, common.MAINT_STREAM)
+	go func(reqLock *kvRequest) {
+		defer idx.releaseStreamRequestLock(reqLock)
+		idx.waitStreamRequestLock(reqLock)
+	retryloop:
+		for {
+			if !ValidateBucket(clustAddr, bucket, []string{indexInst.Defn.BucketUUID}) {
+				logging.Errorf("Indexer::sendStreamUpdateForResumeIndex \n\tBucket Not Found "+
+					"For Stream %v Bucket %v", common.MAINT_STREAM, bucket)
+				break retryloop
+			}
+			idx.sendMsgToKVSender(cmd)
+
+			if resp, ok := <-respCh; ok {
+
+				switch resp.GetMsgType() {
+
+				case MSG_SUCCESS:
+					logging.Infof("Indexer::sendStreamUpdateForResumeIndex Success Stream %v Bucket %v ",
+						common.MAINT_STREAM, bucket)
+
+					idx.internalRecvCh <- &MsgTKInitBuildDone{
+						mType:    TK_INIT_BUILD_DONE_ACK,
+						streamId: common.CATCHUP_STREAM,
+						bucket:   bucket,
+						mergeTs:  resp.(*MsgStreamUpdate).GetRestartTs()}
+					break retryloop
+
+				default:
+					//log and retry for all other responses
+					respErr := resp.(*MsgError).GetError()
+					logging.Errorf("Indexer::sendStreamUpdateForResumeIndex Stream %v Bucket %v "+
+						"Error from Projector %v. Retrying.", common.MAINT_STREAM, bucket, respErr.cause)
+					time.Sleep(KV_RETRY_INTERVAL * time.Millisecond)
+				}
+			}
+		}
+	}(reqLock)
+}
+
+func (idx *indexer) isLastIndexInMaintStream(indexInst common.IndexInst) bool {
+
+	for _, inst := range idx.indexInstMap {
+		if inst.InstId != indexInst.InstId &&
+			inst.Defn.Bucket == indexInst.Defn.Bucket &&
+			inst.Stream == common.MAINT_STREAM &&
+			inst.State != common.INDEX_STATE_DELETED {
+			return false
+		}
+	}
+	return true
+}
+
+//getIndexRestartTs returns the timestamp of the last persisted snapshot
+//of the index, nil if there is none.
+func (idx *indexer) getIndexRestartTs(instId common.IndexInstId) (*common.TsVbuuid, error) {
+
+	partnMap, ok := idx.indexPartnMap[instId]
+	if !ok {
+		return nil, common.ErrIndexNotFound
+	}
+
+	//there is only one partition and one slice for now
+	slice := partnMap[0].Sc.GetSliceById(0)
+
+	infos, err := slice.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	if latest := NewSnapshotInfoContainer(infos).GetLatest(); latest != nil {
+		return latest.Timestamp(), nil
+	}
+	return nil, nil
+}
+
+//persistPausedIndexes stores the list of paused indexes in local metadata
+func (idx *indexer) persistPausedIndexes() {
+
+	if !idx.enableManager {
+		return
+	}
+
+	instIds := make([]common.IndexInstId, 0)
+	for instId, inst := range idx.indexInstMap {
+		if isIndexPaused(inst) {
+			instIds = append(instIds, instId)
+		}
+	}
+
+	val, err := json.Marshal(instIds)
+	common.CrashOnError(err)
+
+	idx.clustMgrAgentCmdCh <- &MsgClustMgrLocal{
+		mType: CLUST_MGR_SET_LOCAL,
+		key:   INDEXER_PAUSED_INDEXES_KEY,
+		value: string(val),
+	}
+
+	respMsg := <-idx.clustMgrAgentCmdCh
+	resp := respMsg.(*MsgClustMgrLocal)
+
+	if errMsg := resp.GetError(); errMsg != nil {
+		logging.Fatalf("Indexer::persistPausedIndexes Unable to set PausedIndexes In Local"+
+			"Meta Storage. Err %v", errMsg)
+		common.CrashOnError(errMsg)
+	}
+}
+
+//recoverPausedIndexes marks indexes paused before restart. Indexes found in
+//CATCHUP_STREAM were being resumed, these are maintained in MAINT_STREAM.
+func (idx *indexer) recoverPausedIndexes() {
+
+	for instId, inst := range idx.indexInstMap {
+		if inst.Stream == common.CATCHUP_STREAM {
+			inst.Stream = common.MAINT_STREAM
+			idx.indexInstMap[instId] = inst
+		}
+	}
+
+	if !idx.enableManager {
+		return
+	}
+
+	idx.clustMgrAgentCmdCh <- &MsgClustMgrLocal{
+		mType: CLUST_MGR_GET_LOCAL,
+		key:   INDEXER_PAUSED_INDEXES_KEY,
+	}
+
+	respMsg := <-idx.clustMgrAgentCmdCh
+	resp := respMsg.(*MsgClustMgrLocal)
+
+	val := resp.GetValue()
+	err := resp.GetError()
+
+	if err != nil {
+		if !isKeyNotFound(err) {
+			logging.Fatalf("Indexer::recoverPausedIndexes Error Fetching PausedIndexes From Local"+
+				"Meta Storage. Err %v", err)
+			common.CrashOnError(err)
+		}
+		return
+	}
+
+	var instIds []common.IndexInstId
+	if err := json.Unmarshal([]byte(val), &instIds); err != nil {
+		logging.Errorf("Indexer::recoverPausedIndexes Invalid PausedIndexes %v. Err %v", val, err)
+		return
+	}
+
+	for _, instId := range instIds {
+		inst, ok := idx.indexInstMap[instId]
+		if !ok || inst.State != common.INDEX_STATE_ACTIVE || inst.Stream != common.MAINT_STREAM {
+			continue
+		}
+
+		if idx.isLastIndexInMaintStream(inst) &&
+			idx.checkBucketExistsInStream(inst.Defn.Bucket, common.INIT_STREAM, false) {
+			logging.Warnf("Indexer::recoverPausedIndexes Index %v Required In MAINT_STREAM "+
+				"For Bucket %v. Resuming Maintenance.", instId, inst.Defn.Bucket)
+			continue
+		}
+
+		inst.Stream = common.NIL_STREAM
+		idx.indexInstMap[instId] = inst
+		logging.Infof("Indexer::recoverPausedIndexes Index %v Maintenance Paused", instId)
+	}
+
+	idx.persistPausedIndexes()
+}
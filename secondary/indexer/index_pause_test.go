@@ -0,0 +1,255 @@
+package indexer
+
+import (
+	"encoding/json"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/fdb"
+	"reflect"
+	"testing"
+)
+
+//newPauseTestIndexer returns an indexer with workers which accept any
+//command and a cluster manager agent which keeps local metadata in memory
+func newPauseTestIndexer(insts ...common.IndexInst) (*indexer, map[string]string) {
+
+	idx := &indexer{
+		state:                        common.INDEXER_ACTIVE,
+		indexInstMap:                 make(common.IndexInstMap),
+		streamBucketStatus:           make(map[common.StreamId]BucketStatus),
+		streamBucketFlushInProgress:  make(map[common.StreamId]BucketFlushInProgressMap),
+		streamBucketObserveFlushDone: make(map[common.StreamId]BucketObserveFlushDoneMap),
+		mutMgrCmdCh:                  make(MsgChannel),
+		storageMgrCmdCh:              make(MsgChannel),
+		tkCmdCh:                      make(MsgChannel),
+		scanCoordCmdCh:               make(MsgChannel),
+		statsMgrCmdCh:                make(MsgChannel),
+		clustMgrAgentCmdCh:           make(MsgChannel),
+		stats:                        NewIndexerStats(),
+		enableManager:                true,
+	}
+	idx.initStreamFlushMap()
+	for _, inst := range insts {
+		idx.indexInstMap[inst.InstId] = inst
+	}
+
+	for _, ch := range []MsgChannel{idx.mutMgrCmdCh, idx.storageMgrCmdCh,
+		idx.tkCmdCh, idx.scanCoordCmdCh, idx.statsMgrCmdCh} {
+		go func(ch MsgChannel) {
+			for range ch {
+				ch <- &MsgSuccess{}
+			}
+		}(ch)
+	}
+
+	local := make(map[string]string)
+	go func() {
+		for msg := range idx.clustMgrAgentCmdCh {
+			req := msg.(*MsgClustMgrLocal)
+			resp := &MsgClustMgrLocal{mType: req.mType, key: req.key}
+			if req.mType == CLUST_MGR_SET_LOCAL {
+				local[req.key] = req.value
+			} else if val, ok := local[req.key]; ok {
+				resp.value = val
+			} else {
+				resp.err = forestdb.FDB_RESULT_KEY_NOT_FOUND
+			}
+			idx.clustMgrAgentCmdCh <- resp
+		}
+	}()
+
+	return idx, local
+}
+
+func newPauseTestInst(instId common.IndexInstId, stream common.StreamId) common.IndexInst {
+	return common.IndexInst{
+		InstId: instId,
+		Defn:   common.IndexDefn{DefnId: common.IndexDefnId(instId), Bucket: "default"},
+		State:  common.INDEX_STATE_ACTIVE,
+		Stream: stream,
+	}
+}
+
+func pausedIndexes(t *testing.T, local map[string]string) []common.IndexInstId {
+	var instIds []common.IndexInstId
+	if err := json.Unmarshal([]byte(local[INDEXER_PAUSED_INDEXES_KEY]), &instIds); err != nil {
+		t.Fatal(err)
+	}
+	return instIds
+}
+
+func sendIndexMaintenance(idx *indexer, mType MsgType,
+	instId common.IndexInstId) Message {
+
+	respCh := make(MsgChannel, 1)
+	idx.handleIndexMaintenance(&MsgIndexMaintenance{mType: mType,
+		instId: instId, respCh: respCh})
+	return <-respCh
+}
+
+func TestPauseIndex(t *testing.T) {
+
+	catchup := newPauseTestInst(3, common.CATCHUP_STREAM)
+	catchup.Defn.Bucket = "other"
+	idx, local := newPauseTestIndexer(
+		newPauseTestInst(1, common.MAINT_STREAM),
+		newPauseTestInst(2, common.MAINT_STREAM),
+		catchup)
+	defer close(idx.clustMgrAgentCmdCh)
+
+	//removal from MAINT_STREAM waits for the flush in progress
+	idx.streamBucketFlushInProgress[common.MAINT_STREAM]["default"] = true
+	respCh := make(MsgChannel, 1)
+	idx.handleIndexMaintenance(&MsgIndexMaintenance{mType: INDEXER_PAUSE_INDEX,
+		instId: 1, respCh: respCh})
+
+	if inst := idx.indexInstMap[1]; !isIndexPaused(inst) {
+		t.Errorf("expected index to be paused, stream %v", inst.Stream)
+	}
+	if obs := idx.streamBucketObserveFlushDone[common.MAINT_STREAM]["default"]; obs == nil {
+		t.Errorf("expected flush done observer for pause")
+	}
+	if ids := pausedIndexes(t, local); !reflect.DeepEqual(ids, []common.IndexInstId{1}) {
+		t.Errorf("expected paused indexes [1], got %v", ids)
+	}
+
+	//only one pause or drop at a time per bucket
+	if resp := sendIndexMaintenance(idx, INDEXER_PAUSE_INDEX, 2); resp.GetMsgType() != MSG_ERROR {
+		t.Errorf("expected pause in progress error, got %v", resp)
+	}
+
+	//pause is idempotent
+	if resp := sendIndexMaintenance(idx, INDEXER_PAUSE_INDEX, 1); resp.GetMsgType() != MSG_SUCCESS {
+		t.Errorf("expected success for paused index, got %v", resp)
+	}
+
+	//index being caught up cannot be paused
+	if resp := sendIndexMaintenance(idx, INDEXER_PAUSE_INDEX, 3); resp.GetMsgType() != MSG_ERROR {
+		t.Errorf("expected catchup in progress error, got %v", resp)
+	}
+
+	//unknown index
+	if resp := sendIndexMaintenance(idx, INDEXER_PAUSE_INDEX, 4); resp.GetMsgType() != MSG_ERROR {
+		t.Errorf("expected unknown index error, got %v", resp)
+	}
+
+	//resume of an index which is not paused is a no-op
+	if resp := sendIndexMaintenance(idx, INDEXER_RESUME_INDEX, 2); resp.GetMsgType() != MSG_SUCCESS {
+		t.Errorf("expected success for active index, got %v", resp)
+	}
+
+	//no requests while indexer is not active
+	idx.setIndexerState(common.INDEXER_PAUSED)
+	if resp := sendIndexMaintenance(idx, INDEXER_RESUME_INDEX, 1); resp.GetMsgType() != MSG_ERROR {
+		t.Errorf("expected indexer not active error, got %v", resp)
+	}
+}
+
+func TestResumeDuringPauseFlush(t *testing.T) {
+
+	idx, _ := newPauseTestIndexer(
+		newPauseTestInst(1, common.MAINT_STREAM),
+		newPauseTestInst(2, common.MAINT_STREAM))
+	defer close(idx.clustMgrAgentCmdCh)
+
+	idx.streamBucketFlushInProgress[common.MAINT_STREAM]["default"] = true
+	pauseCh := make(MsgChannel, 1)
+	idx.handleIndexMaintenance(&MsgIndexMaintenance{mType: INDEXER_PAUSE_INDEX,
+		instId: 1, respCh: pauseCh})
+
+	//the index is still to be removed from MAINT_STREAM
+	if resp := sendIndexMaintenance(idx, INDEXER_RESUME_INDEX, 1); resp.GetMsgType() != MSG_ERROR {
+		t.Errorf("expected pause in progress error, got %v", resp)
+	}
+	if inst := idx.indexInstMap[1]; !isIndexPaused(inst) {
+		t.Errorf("expected index to stay paused, stream %v", inst.Stream)
+	}
+
+	//flush done completes the pause
+	notifyCh := idx.streamBucketObserveFlushDone[common.MAINT_STREAM]["default"]
+	idx.notifyFlushObserver(&MsgMutMgrFlushDone{mType: MUT_MGR_FLUSH_DONE,
+		streamId: common.MAINT_STREAM, bucket: "default"})
+	if resp := <-pauseCh; resp.GetMsgType() != MSG_SUCCESS {
+		t.Errorf("expected pause to complete, got %v", resp)
+	}
+	if _, ok := <-notifyCh; ok {
+		t.Errorf("expected flush done observer to be closed")
+	}
+	if obs := idx.streamBucketObserveFlushDone[common.MAINT_STREAM]["default"]; obs != nil {
+		t.Errorf("expected flush done observer to be cleared")
+	}
+}
+
+func TestPauseIndexLastInMaintStream(t *testing.T) {
+
+	building := newPauseTestInst(2, common.INIT_STREAM)
+	building.State = common.INDEX_STATE_INITIAL
+	idx, _ := newPauseTestIndexer(newPauseTestInst(1, common.MAINT_STREAM), building)
+	defer close(idx.clustMgrAgentCmdCh)
+
+	//MAINT_STREAM is needed to merge the index being built
+	if resp := sendIndexMaintenance(idx, INDEXER_PAUSE_INDEX, 1); resp.GetMsgType() != MSG_ERROR {
+		t.Errorf("expected build in progress error, got %v", resp)
+	}
+	if inst := idx.indexInstMap[1]; inst.Stream != common.MAINT_STREAM {
+		t.Errorf("expected index in MAINT_STREAM, got %v", inst.Stream)
+	}
+}
+
+func TestPauseFlushObserverCleared(t *testing.T) {
+
+	idx, _ := newPauseTestIndexer()
+	defer close(idx.clustMgrAgentCmdCh)
+
+	notifyCh := make(MsgChannel)
+	idx.streamBucketObserveFlushDone[common.MAINT_STREAM]["default"] = notifyCh
+	go func() {
+		<-notifyCh
+		close(notifyCh)
+	}()
+
+	idx.notifyFlushObserver(&MsgMutMgrFlushDone{mType: MUT_MGR_FLUSH_DONE,
+		streamId: common.MAINT_STREAM, bucket: "default"})
+
+	if obs := idx.streamBucketObserveFlushDone[common.MAINT_STREAM]["default"]; obs != nil {
+		t.Errorf("expected flush done observer to be cleared")
+	}
+}
+
+func TestRecoverPausedIndexes(t *testing.T) {
+
+	idx, local := newPauseTestIndexer(
+		newPauseTestInst(1, common.MAINT_STREAM),
+		newPauseTestInst(2, common.MAINT_STREAM),
+		newPauseTestInst(3, common.CATCHUP_STREAM))
+	defer close(idx.clustMgrAgentCmdCh)
+
+	//nothing persisted yet
+	idx.recoverPausedIndexes()
+	for instId, inst := range idx.indexInstMap {
+		if inst.Stream != common.MAINT_STREAM {
+			t.Errorf("expected index %v in MAINT_STREAM, got %v", instId, inst.Stream)
+		}
+	}
+	if val, ok := local[INDEXER_PAUSED_INDEXES_KEY]; ok {
+		t.Errorf("expected no paused indexes, got %v", val)
+	}
+
+	//index 3 was paused and is being resumed at restart, index 4 is dropped
+	local[INDEXER_PAUSED_INDEXES_KEY] = "[1,4]"
+	idx.indexInstMap[3] = newPauseTestInst(3, common.CATCHUP_STREAM)
+	idx.recoverPausedIndexes()
+
+	expected := map[common.IndexInstId]common.StreamId{
+		1: common.NIL_STREAM,
+		2: common.MAINT_STREAM,
+		3: common.MAINT_STREAM,
+	}
+	for instId, stream := range expected {
+		if inst := idx.indexInstMap[instId]; inst.Stream != stream {
+			t.Errorf("expected index %v in %v, got %v", instId, stream, inst.Stream)
+		}
+	}
+	if ids := pausedIndexes(t, local); !reflect.DeepEqual(ids, []common.IndexInstId{1}) {
+		t.Errorf("expected paused indexes [1], got %v", ids)
+	}
+}
@@ -14,8 +14,8 @@ import (
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"github.com/couchbase/indexing/secondary/bptree"
 	"github.com/couchbase/indexing/secondary/common"
-	"github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/memdb"
 	"github.com/couchbase/indexing/secondary/memdb/mm"
@@ -84,6 +84,7 @@ type indexer struct {
 
 	streamBucketRequestStopCh map[common.StreamId]BucketRequestStopCh
 	streamBucketRollbackTs    map[common.StreamId]BucketRollbackTs
+	streamBucketFlushed       map[common.StreamId]map[string]bool
 	streamBucketRequestQueue  map[common.StreamId]map[string]chan *kvRequest
 	streamBucketRequestLock   map[common.StreamId]map[string]chan *sync.Mutex
 
@@ -176,6 +177,7 @@ func NewIndexer(config common.Config) (Indexer, Message) {
 		streamBucketObserveFlushDone: make(map[common.StreamId]BucketObserveFlushDoneMap),
 		streamBucketRequestStopCh:    make(map[common.StreamId]BucketRequestStopCh),
 		streamBucketRollbackTs:       make(map[common.StreamId]BucketRollbackTs),
+		streamBucketFlushed:          make(map[common.StreamId]map[string]bool),
 		streamBucketRequestQueue:     make(map[common.StreamId]map[string]chan *kvRequest),
 		streamBucketRequestLock:      make(map[common.StreamId]map[string]chan *sync.Mutex),
 		bucketBuildTs:                make(map[string]Timestamp),
@@ -200,6 +202,7 @@ func NewIndexer(config common.Config) (Indexer, Message) {
 	// Read memquota setting
 	idx.stats.memoryQuota.Set(int64(idx.config["settings.memory_quota"].Uint64()))
 	memdb.Debug(idx.config["settings.moi.debug"].Bool())
+	setTieringBudget(idx.config)
 	logging.Infof("Indexer::NewIndexer Starting with Vbuckets %v", idx.config["numVbuckets"].Int())
 
 	idx.initStreamAddressMap()
@@ -559,6 +562,10 @@ func (idx *indexer) getBucketForAdminMsg(msg Message) []string {
 		dropMsg := msg.(*MsgDropIndex)
 		return []string{dropMsg.GetBucket()}
 
+	case INDEXER_PAUSE_INDEX, INDEXER_RESUME_INDEX:
+		maintMsg := msg.(*MsgIndexMaintenance)
+		return []string{maintMsg.GetBucket()}
+
 	default:
 		return nil
 	}
@@ -704,7 +711,8 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 
 	case STORAGE_INDEX_SNAP_REQUEST,
 		STORAGE_INDEX_STORAGE_STATS,
-		STORAGE_INDEX_COMPACT:
+		STORAGE_INDEX_COMPACT,
+		STORAGE_INDEX_DISK_SNAPSHOTS:
 		idx.storageMgrCmdCh <- msg
 		<-idx.storageMgrCmdCh
 
@@ -761,6 +769,10 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 	case INDEXER_STATS:
 		idx.handleStats(msg)
 
+	case DATAPORT_STATS:
+		idx.mutMgrCmdCh <- msg
+		<-idx.mutMgrCmdCh
+
 	case MSG_ERROR,
 		STREAM_READER_ERROR:
 		//crash for all errors by default
@@ -777,6 +789,13 @@ func (idx *indexer) handleWorkerMsgs(msg Message) {
 	case INDEXER_RESUME:
 		idx.handleIndexerResume(msg)
 
+	case INDEXER_PAUSE_INDEX,
+		INDEXER_RESUME_INDEX:
+		idx.handleIndexMaintenance(msg)
+
+	case INDEXER_REPLAY_STREAM:
+		idx.handleReplayStream(msg)
+
 	default:
 		logging.Fatalf("Indexer::handleWorkerMsgs Unknown Message %+v", msg)
 		common.CrashOnError(errors.New("Unknown Msg On Worker Channel"))
@@ -840,6 +859,7 @@ func (idx *indexer) handleConfigUpdate(msg Message) {
 	}
 
 	memdb.Debug(idx.config["settings.moi.debug"].Bool())
+	setTieringBudget(newConfig)
 	idx.setProfilerOptions(newConfig)
 	idx.config = newConfig
 	idx.compactMgrCmdCh <- msg
@@ -875,6 +895,11 @@ func (idx *indexer) handleAdminMsgs(msg Message) {
 
 		idx.handleDropIndex(msg)
 
+	case INDEXER_PAUSE_INDEX,
+		INDEXER_RESUME_INDEX:
+
+		idx.handleIndexMaintenance(msg)
+
 	case MSG_ERROR:
 
 		logging.Fatalf("Indexer::handleAdminMsgs Fatal Error On Admin Channel %+v", msg)
@@ -1151,6 +1176,10 @@ func (idx *indexer) handleBuildIndex(msg Message) {
 
 		idx.bulkUpdateState(instIdList, buildState)
 
+		if buildStream == common.INIT_STREAM {
+			idx.beginBulkLoad(instIdList)
+		}
+
 		logging.Infof("Indexer::handleBuildIndex \n\tAdded Index: %v to Stream: %v State: %v",
 			instIdList, buildStream, buildState)
 
@@ -1260,6 +1289,16 @@ func (idx *indexer) handleDropIndex(msg Message) {
 		return
 	}
 
+	//paused index is not in any stream, only data cleanup is required
+	if isIndexPaused(indexInst) {
+		idx.cleanupIndexData(indexInst, clientCh)
+		idx.persistPausedIndexes()
+		logging.Infof("Indexer::handleDropIndex Cleanup Successful for "+
+			"Paused Index Data %v", indexInst)
+		clientCh <- &MsgSuccess{}
+		return
+	}
+
 	//Drop is a two step process. First set the index state as DELETED.
 	//Then all the workers are notified about this state change. If this
 	//step is successful, no mutation/scan request for the index will be processed.
@@ -1362,6 +1401,15 @@ func (idx *indexer) handleInitPrepRecovery(msg Message) {
 		}
 	}
 
+	//bucket flush is recorded till recovery is done, as there can be
+	//more rollbacks before the stream gets restarted
+	if msg.(*MsgRecovery).IsBucketFlush() {
+		if _, ok := idx.streamBucketFlushed[streamId]; !ok {
+			idx.streamBucketFlushed[streamId] = make(map[string]bool)
+		}
+		idx.streamBucketFlushed[streamId][bucket] = true
+	}
+
 	idx.setStreamBucketState(streamId, bucket, STREAM_PREPARE_RECOVERY)
 
 	logging.Infof("Indexer::handleInitPrepRecovery StreamId %v Bucket %v %v",
@@ -1416,9 +1464,13 @@ func (idx *indexer) handleInitRecovery(msg Message) {
 	logging.Infof("Indexer::handleInitRecovery StreamId %v Bucket %v %v",
 		streamId, bucket, STREAM_RECOVERY)
 
-	//if there is a rollbackTs, process rollback
-	if ts, ok := idx.streamBucketRollbackTs[streamId][bucket]; ok && ts != nil {
-		restartTs, err := idx.processRollback(streamId, bucket, ts)
+	//if the bucket got flushed, truncate the indexes and restart from zero
+	if idx.streamBucketFlushed[streamId][bucket] {
+		idx.processBucketFlush(streamId, bucket)
+		idx.startBucketStream(streamId, bucket, nil)
+	} else if ts, ok := idx.streamBucketRollbackTs[streamId][bucket]; ok && ts != nil {
+		//if there is a rollbackTs, process rollback
+		restartTs, err := idx.processRollback(streamId, bucket, ts, false)
 		if err != nil {
 			common.CrashOnError(err)
 		}
@@ -1444,6 +1496,7 @@ func (idx *indexer) handleRecoveryDone(msg Message) {
 
 	delete(idx.streamBucketRequestStopCh[streamId], bucket)
 	delete(idx.streamBucketRollbackTs[streamId], bucket)
+	delete(idx.streamBucketFlushed[streamId], bucket)
 
 	idx.bucketBuildTs[bucket] = buildTs
 
@@ -1522,7 +1575,7 @@ func (idx *indexer) handleInitBuildDoneAck(msg Message) {
 
 	switch streamId {
 
-	case common.INIT_STREAM:
+	case common.INIT_STREAM, common.CATCHUP_STREAM:
 
 		//send the ack to timekeeper
 		idx.tkCmdCh <- msg
@@ -1547,7 +1600,7 @@ func (idx *indexer) handleMergeStreamAck(msg Message) {
 
 	switch streamId {
 
-	case common.INIT_STREAM:
+	case common.INIT_STREAM, common.CATCHUP_STREAM:
 		delete(idx.streamBucketRequestStopCh[streamId], bucket)
 
 		state := idx.getStreamBucketState(streamId, bucket)
@@ -1573,6 +1626,11 @@ func (idx *indexer) handleMergeStreamAck(msg Message) {
 		idx.tkCmdCh <- msg
 		<-idx.tkCmdCh
 
+		//index resumed from pause is already active in metadata
+		if streamId == common.CATCHUP_STREAM {
+			return
+		}
+
 		//for cbq bridge, return response after merge is done and
 		//index is ready to query
 		if !idx.enableManager {
@@ -1964,6 +2022,11 @@ func (idx *indexer) sendStreamUpdateForDropIndex(indexInst common.IndexInst,
 			indexStreamIds = append(indexStreamIds, common.MAINT_STREAM)
 		}
 
+	//index resumed from pause is in MAINT_STREAM as well
+	case common.CATCHUP_STREAM:
+		indexStreamIds = append(indexStreamIds, common.CATCHUP_STREAM)
+		indexStreamIds = append(indexStreamIds, common.MAINT_STREAM)
+
 	default:
 		logging.Fatalf("Indexer::sendStreamUpdateForDropIndex \n\t Unsupported StreamId %v", indexInst.Stream)
 		common.CrashOnError(ErrInvalidStream)
@@ -2338,6 +2401,10 @@ func (idx *indexer) handleInitialBuildDone(msg Message) {
 		idx.indexInstMap[index.InstId] = index
 	}
 
+	if streamId == common.INIT_STREAM {
+		idx.endBulkLoad(instIdList)
+	}
+
 	//send updated maps to all workers
 	msgUpdateIndexInstMap := idx.newIndexInstMsg(idx.indexInstMap)
 
@@ -2472,11 +2539,11 @@ func (idx *indexer) handleMergeStream(msg Message) {
 
 	switch streamId {
 
-	case common.INIT_STREAM:
+	case common.INIT_STREAM, common.CATCHUP_STREAM:
 		idx.handleMergeInitStream(msg)
 
 	default:
-		logging.Fatalf("Indexer::handleMergeStream \n\tOnly INIT_STREAM can be merged "+
+		logging.Fatalf("Indexer::handleMergeStream \n\tOnly INIT_STREAM/CATCHUP_STREAM can be merged "+
 			"to MAINT_STREAM. Found Stream: %v.", streamId)
 		common.CrashOnError(ErrInvalidStream)
 	}
@@ -2491,12 +2558,14 @@ func (idx *indexer) handleMergeInitStream(msg Message) {
 
 	logging.Infof("Indexer::handleMergeInitStream Bucket: %v Stream: %v", bucket, streamId)
 
-	//get the list of indexes for this bucket in CATCHUP state
+	//get the list of indexes for this bucket in CATCHUP state. Indexes in
+	//CATCHUP_STREAM are resumed from pause and already ACTIVE.
 	var indexList []common.IndexInst
 	var bucketUUIDList []string
 	for _, index := range idx.indexInstMap {
 		if index.Defn.Bucket == bucket && index.Stream == streamId &&
-			index.State == common.INDEX_STATE_CATCHUP {
+			(index.State == common.INDEX_STATE_CATCHUP ||
+				streamId == common.CATCHUP_STREAM) {
 
 			index.State = common.INDEX_STATE_ACTIVE
 			index.Stream = common.MAINT_STREAM
@@ -2748,7 +2817,9 @@ func (idx *indexer) startBucketStream(streamId common.StreamId, bucket string,
 				switch indexInst.State {
 				case common.INDEX_STATE_ACTIVE,
 					common.INDEX_STATE_INITIAL:
-					if indexInst.Stream == streamId {
+					//index resumed from pause is in MAINT_STREAM as well
+					if indexInst.Stream == streamId ||
+						indexInst.Stream == common.CATCHUP_STREAM {
 						indexList = append(indexList, indexInst)
 						bucketUUIDList = append(bucketUUIDList, indexInst.Defn.BucketUUID)
 					}
@@ -2773,6 +2844,17 @@ func (idx *indexer) startBucketStream(streamId common.StreamId, bucket string,
 			}
 		}
 
+	case common.CATCHUP_STREAM:
+
+		for _, indexInst := range idx.indexInstMap {
+			if indexInst.Defn.Bucket == bucket &&
+				indexInst.Stream == streamId &&
+				indexInst.State == common.INDEX_STATE_ACTIVE {
+				indexList = append(indexList, indexInst)
+				bucketUUIDList = append(bucketUUIDList, indexInst.Defn.BucketUUID)
+			}
+		}
+
 	default:
 		logging.Fatalf("Indexer::startBucketStream \n\t Unsupported StreamId %v", streamId)
 		common.CrashOnError(ErrInvalidStream)
@@ -2867,9 +2949,10 @@ func (idx *indexer) startBucketStream(streamId common.StreamId, bucket string,
 						"Projector For Stream %v Bucket %v", streamId, bucket)
 					rollbackTs := resp.(*MsgRollback).GetRollbackTs()
 					idx.internalRecvCh <- &MsgRecovery{mType: INDEXER_INIT_PREP_RECOVERY,
-						streamId:  streamId,
-						bucket:    bucket,
-						restartTs: rollbackTs}
+						streamId:    streamId,
+						bucket:      bucket,
+						restartTs:   rollbackTs,
+						bucketFlush: resp.(*MsgRollback).IsBucketFlush()}
 					break retryloop
 
 				default:
@@ -2897,12 +2980,14 @@ func (idx *indexer) startBucketStream(streamId common.StreamId, bucket string,
 }
 
 func (idx *indexer) processRollback(streamId common.StreamId,
-	bucket string, rollbackTs *common.TsVbuuid) (*common.TsVbuuid, error) {
+	bucket string, rollbackTs *common.TsVbuuid,
+	bucketFlush bool) (*common.TsVbuuid, error) {
 
 	//send to storage manager to rollback
 	msg := &MsgRollback{streamId: streamId,
-		bucket:     bucket,
-		rollbackTs: rollbackTs}
+		bucket:      bucket,
+		rollbackTs:  rollbackTs,
+		bucketFlush: bucketFlush}
 
 	idx.storageMgrCmdCh <- msg
 	res := <-idx.storageMgrCmdCh
@@ -2918,6 +3003,23 @@ func (idx *indexer) processRollback(streamId common.StreamId,
 
 }
 
+//processBucketFlush truncates all indexes of the bucket in the stream.
+//Index definitions and topology are retained and the indexes get rebuilt
+//once the stream restarts from zero.
+func (idx *indexer) processBucketFlush(streamId common.StreamId, bucket string) {
+
+	logging.Infof("Indexer::processBucketFlush StreamId %v Bucket %v. Bucket "+
+		"Flush Detected. Truncating Indexes.", streamId, bucket)
+
+	if _, err := idx.processRollback(streamId, bucket, nil, true); err != nil {
+		common.CrashOnError(err)
+	}
+
+	if bStats, ok := idx.stats.buckets[bucket]; ok {
+		bStats.numBucketFlushes.Add(1)
+	}
+}
+
 //helper function to init streamFlush map for all streams
 func (idx *indexer) initStreamFlushMap() {
 
@@ -2939,6 +3041,8 @@ func (idx *indexer) notifyFlushObserver(msg Message) {
 			//wait for a sync response that cleanup is done.
 			//notification is sent one by one as there is no lock
 			<-notifyCh
+			//observer is done, the map is only updated by the indexer loop
+			idx.streamBucketObserveFlushDone[streamId][bucket] = nil
 		}
 	}
 	return
@@ -2952,11 +3056,7 @@ func (idx *indexer) processDropAfterFlushDone(indexInst common.IndexInst,
 		idx.cleanupIndex(indexInst, clientCh)
 	}
 
-	streamId := indexInst.Stream
-	bucket := indexInst.Defn.Bucket
-	idx.streamBucketObserveFlushDone[streamId][bucket] = nil
-
-	//indicate done
+	//indicate done, observer is cleared by notifyFlushObserver
 	close(notifyCh)
 }
 
@@ -3037,7 +3137,7 @@ func (idx *indexer) bootstrap(snapshotNotifych chan IndexSnapshot) error {
 			}
 			logging.Infof("Indexer::bootstrap Recovered Indexer State %v", val)
 
-		} else if strings.Contains(err.Error(), forestdb.FDB_RESULT_KEY_NOT_FOUND.Error()) {
+		} else if isKeyNotFound(err) {
 			//if there is no IndexerState, nothing to do
 			logging.Infof("Indexer::bootstrap No Previous Indexer State Recovered")
 
@@ -3093,7 +3193,7 @@ func (idx *indexer) genIndexerId() {
 
 		if err == nil {
 			idx.id = val
-		} else if strings.Contains(err.Error(), forestdb.FDB_RESULT_KEY_NOT_FOUND.Error()) {
+		} else if isKeyNotFound(err) {
 			//if there is no IndexerId, generate and store in manager
 
 			id, err := common.NewUUID()
@@ -3144,6 +3244,7 @@ func (idx *indexer) initFromPersistedState() error {
 	logging.Infof("Indexer::initFromPersistedState Recovered IndexInstMap %v", idx.indexInstMap)
 
 	idx.validateIndexInstMap()
+	idx.recoverPausedIndexes()
 
 	for _, inst := range idx.indexInstMap {
 		if inst.State != common.INDEX_STATE_DELETED {
@@ -3211,33 +3312,16 @@ func (idx *indexer) recoverInstMapFromManager() error {
 
 func (idx *indexer) recoverInstMapFromFile() error {
 
-	var dbfile *forestdb.File
-	var meta *forestdb.KVStore
-	var err error
-
 	//read indexer state and local state context
-	config := forestdb.DefaultConfig()
-
-	if dbfile, err = forestdb.Open("meta", config); err != nil {
-		return err
-	}
-	defer dbfile.Close()
-
-	kvconfig := forestdb.DefaultKVStoreConfig()
-	// Make use of default kvstore provided by forestdb
-	if meta, err = dbfile.OpenKVStore("default", kvconfig); err != nil {
+	meta, err := openLocalMetaStore()
+	if err != nil {
 		return err
 	}
-
-	defer meta.Close()
+	defer meta.close()
 
 	//read the instance map
-	var instBytes []byte
-	instBytes, err = meta.GetKV([]byte(INST_MAP_KEY_NAME))
-
-	//forestdb reports get in a non-existent key as an
-	//error, skip that
-	if err != nil && err != forestdb.FDB_RESULT_KEY_NOT_FOUND {
+	instBytes, err := meta.get(INST_MAP_KEY_NAME)
+	if err != nil {
 		return err
 	}
 
@@ -3515,9 +3599,9 @@ func (idx *indexer) closeAllStreams() {
 
 	for i := 0; i < int(common.ALL_STREAMS); i++ {
 
-		//skip for nil and catchup stream
-		if i == int(common.NIL_STREAM) ||
-			i == int(common.CATCHUP_STREAM) {
+		//skip for nil stream. catchup stream may have been
+		//left open by an index resumed from pause.
+		if i == int(common.NIL_STREAM) {
 			continue
 		}
 
@@ -3817,7 +3901,8 @@ func (idx *indexer) handleResetStats() {
 }
 
 func (idx *indexer) memoryUsedStorage() int64 {
-	mem_used := int64(forestdb.BufferCacheUsed()) + int64(memdb.MemoryInUse()) + int64(nodetable.MemoryInUse())
+	mem_used := int64(forestdbMemoryUsed()) + int64(memdb.MemoryInUse()) + int64(nodetable.MemoryInUse()) +
+		int64(bptree.MemoryInUse())
 	return mem_used
 }
 
@@ -3834,6 +3919,8 @@ func NewSlice(id SliceId, indInst *common.IndexInst,
 	if indInst.Defn.Using == common.MemDB ||
 		indInst.Defn.Using == common.MemoryOptimized {
 		slice, err = NewMemDBSlice(path, id, indInst.Defn, indInst.InstId, indInst.Defn.IsPrimary, conf, stats.indexes[indInst.InstId])
+	} else if indInst.Defn.Using == common.BPTree {
+		slice, err = NewBPTreeSlice(path, id, indInst.Defn, indInst.InstId, indInst.Defn.IsPrimary, conf, stats.indexes[indInst.InstId])
 	} else {
 		slice, err = NewForestDBSlice(path, id, indInst.Defn, indInst.InstId, indInst.Defn.IsPrimary, conf, stats.indexes[indInst.InstId])
 	}
@@ -4078,7 +4165,8 @@ func (idx *indexer) monitorMemUsage() {
 					canResume = false
 				}
 			}
-		} else if common.GetStorageMode() == common.FORESTDB {
+		} else if common.GetStorageMode() == common.FORESTDB ||
+			common.GetStorageMode() == common.BPTREE {
 
 			if idx.needsGCFdb() {
 				start := time.Now()
@@ -4095,6 +4183,15 @@ func (idx *indexer) monitorMemUsage() {
 
 }
 
+func (idx *indexer) handleReplayStream(msg Message) {
+
+	logging.Infof("Indexer::handleReplayStream %v", msg)
+
+	idx.mutMgrCmdCh <- msg
+	resp := <-idx.mutMgrCmdCh
+	msg.(*MsgReplayStream).GetResponseChannel() <- resp
+}
+
 func (idx *indexer) handleIndexerPause(msg Message) {
 
 	logging.Infof("Indexer::handleIndexerPause")
@@ -4271,7 +4368,7 @@ func (idx *indexer) memoryUsed(forceRefresh bool) uint64 {
 		gMemstatCacheLastUpdated = time.Now()
 	}
 
-	mem_used := ms.HeapInuse + ms.GCSys + forestdb.BufferCacheUsed()
+	mem_used := ms.HeapInuse + ms.GCSys + forestdbMemoryUsed()
 	if common.GetStorageMode() == common.MOI {
 		mem_used += mm.Size()
 	}
@@ -4398,3 +4495,44 @@ func (idx *indexer) canSetStorageMode(sm string) bool {
 
 	return true
 }
+
+//setTieringBudget limits the memory of tiered memory optimized indexes
+//to a fraction of the memory quota
+func setTieringBudget(cfg common.Config) {
+	if !cfg["moi.tiering.enabled"].Bool() {
+		memdb.SetTieringBudget(0)
+		return
+	}
+
+	quota := float64(cfg["settings.memory_quota"].Uint64())
+	frac := cfg["moi.tiering.memoryFrac"].Float64()
+	memdb.SetTieringBudget(int64(quota * frac))
+}
+
+//beginBulkLoad switches slices of the indexes to buffer the
+//mutations of initial build
+func (idx *indexer) beginBulkLoad(instIdList []common.IndexInstId) {
+	for _, instId := range instIdList {
+		for _, partnInst := range idx.indexPartnMap[instId] {
+			for _, slice := range partnInst.Sc.GetAllSlices() {
+				if bl, ok := slice.(BulkLoader); ok {
+					bl.BeginBulkLoad()
+				}
+			}
+		}
+	}
+}
+
+//endBulkLoad builds the indexes from buffered mutations of
+//initial build
+func (idx *indexer) endBulkLoad(instIdList []common.IndexInstId) {
+	for _, instId := range instIdList {
+		for _, partnInst := range idx.indexPartnMap[instId] {
+			for _, slice := range partnInst.Sc.GetAllSlices() {
+				if bl, ok := slice.(BulkLoader); ok {
+					bl.EndBulkLoad()
+				}
+			}
+		}
+	}
+}
@@ -342,8 +342,9 @@ func (k *kvSender) openMutationStream(streamId c.StreamId, indexInstList []c.Ind
 		}
 
 		respCh <- &MsgRollback{streamId: streamId,
-			bucket:     bucket,
-			rollbackTs: nativeTs}
+			bucket:      bucket,
+			rollbackTs:  nativeTs,
+			bucketFlush: k.checkBucketFlush(bucket, restartTsList, rollbackTs)}
 	} else if err != nil {
 		logging.Errorf("KVSender::openMutationStream %v %v Error Received %v",
 			streamId, bucket, err)
@@ -422,7 +423,8 @@ func (k *kvSender) restartVbuckets(streamId c.StreamId, restartTs *c.TsVbuuid,
 		nativeTs := rollbackTs.ToTsVbuuid(numVbuckets)
 
 		respCh <- &MsgRollback{streamId: streamId,
-			rollbackTs: nativeTs}
+			rollbackTs:  nativeTs,
+			bucketFlush: k.checkBucketFlush(restartTs.Bucket, protoRestartTs, rollbackTs)}
 	} else if err != nil {
 		//if there is a topicMissing/genServer.Closed error, a fresh
 		//MutationTopicRequest is required.
@@ -0,0 +1,270 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The docid back index of a memdb slice is persisted along with each disk
+// snapshot as one file per slice writer. A record carries crc32 hash of the
+// docid and the data file position of the item. During recovery, loaded
+// nodes are located by position and the back index tables are built in
+// parallel without hashing docids or routing items to writers.
+//
+// Record: [hash - 4 bytes][shard - 2 bytes][pos - 4 bytes]
+
+const (
+	backIndexDirName  = "backindex"
+	backIndexMetaFile = "meta.json"
+	backIndexRecSize  = 10
+)
+
+var errBackIndexMismatch = errors.New("Back index does not match snapshot")
+
+type backIndexMeta struct {
+	NumWriters  int      `json:"numWriters"`
+	NumVbuckets int      `json:"numVbuckets"`
+	NumShards   int      `json:"numShards"`
+	Counts      []int    `json:"counts"`
+	Checksums   []uint32 `json:"checksums"`
+}
+
+func backIndexFile(dir string, id int) string {
+	return filepath.Join(dir, backIndexDirName, fmt.Sprintf("shard-%d", id))
+}
+
+type backIndexPart struct {
+	sync.Mutex
+	fd    *os.File
+	w     *bufio.Writer
+	crc   hash.Hash32
+	count int
+}
+
+type backIndexWriter struct {
+	dir       string
+	meta      backIndexMeta
+	numShards int32
+	parts     []backIndexPart
+
+	errLock sync.Mutex
+	err     error
+}
+
+func newBackIndexWriter(dir string, numWriters, numVbuckets int) (*backIndexWriter, error) {
+	biw := &backIndexWriter{
+		dir:   dir,
+		parts: make([]backIndexPart, numWriters),
+		meta: backIndexMeta{
+			NumWriters:  numWriters,
+			NumVbuckets: numVbuckets,
+		},
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, backIndexDirName), 0755); err != nil {
+		return nil, err
+	}
+
+	for i := range biw.parts {
+		fd, err := os.OpenFile(backIndexFile(dir, i), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			biw.abort()
+			return nil, err
+		}
+
+		p := &biw.parts[i]
+		p.fd = fd
+		p.crc = crc32.NewIEEE()
+		p.w = bufio.NewWriter(io.MultiWriter(fd, p.crc))
+	}
+
+	return biw, nil
+}
+
+// Add is called concurrently for items written to snapshot data files
+func (biw *backIndexWriter) Add(e *memdb.ItemEntry) {
+	var rec [backIndexRecSize]byte
+
+	shard, pos := e.Position()
+	for {
+		n := atomic.LoadInt32(&biw.numShards)
+		if int32(shard) < n || atomic.CompareAndSwapInt32(&biw.numShards, n, int32(shard+1)) {
+			break
+		}
+	}
+
+	entry := e.Item().Bytes()
+	binary.BigEndian.PutUint32(rec[0:4], hashDocId(entry))
+	binary.BigEndian.PutUint16(rec[4:6], uint16(shard))
+	binary.BigEndian.PutUint32(rec[6:10], uint32(pos))
+
+	p := &biw.parts[vbucketFromEntryBytes(entry, biw.meta.NumVbuckets)%len(biw.parts)]
+	p.Lock()
+	_, err := p.w.Write(rec[:])
+	p.count++
+	p.Unlock()
+
+	if err != nil {
+		biw.setError(err)
+	}
+}
+
+func (biw *backIndexWriter) setError(err error) {
+	biw.errLock.Lock()
+	defer biw.errLock.Unlock()
+
+	if biw.err == nil {
+		biw.err = err
+	}
+}
+
+// Close flushes back index files and writes the metadata, which marks
+// the back index as valid
+func (biw *backIndexWriter) Close() error {
+	biw.meta.NumShards = int(atomic.LoadInt32(&biw.numShards))
+	for i := range biw.parts {
+		p := &biw.parts[i]
+		if err := p.w.Flush(); err != nil {
+			biw.setError(err)
+		}
+
+		if err := p.fd.Close(); err != nil {
+			biw.setError(err)
+		}
+
+		biw.meta.Counts = append(biw.meta.Counts, p.count)
+		biw.meta.Checksums = append(biw.meta.Checksums, p.crc.Sum32())
+	}
+
+	if biw.err != nil {
+		os.RemoveAll(filepath.Join(biw.dir, backIndexDirName))
+		return biw.err
+	}
+
+	bs, _ := json.Marshal(biw.meta)
+	metafile := filepath.Join(biw.dir, backIndexDirName, backIndexMetaFile)
+	return ioutil.WriteFile(metafile, bs, 0644)
+}
+
+func (biw *backIndexWriter) abort() {
+	for i := range biw.parts {
+		if fd := biw.parts[i].fd; fd != nil {
+			fd.Close()
+		}
+	}
+	os.RemoveAll(filepath.Join(biw.dir, backIndexDirName))
+}
+
+// backIndexLoader collects nodes loaded from snapshot data files by
+// their position and builds back index tables from persisted records
+type backIndexLoader struct {
+	dir     string
+	meta    backIndexMeta
+	nodes   [][]unsafe.Pointer
+	invalid int32
+}
+
+func openBackIndex(dir string, numWriters, numVbuckets int) (*backIndexLoader, error) {
+	bil := &backIndexLoader{dir: dir}
+	bs, err := ioutil.ReadFile(filepath.Join(dir, backIndexDirName, backIndexMetaFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, &bil.meta); err != nil {
+		return nil, err
+	}
+
+	m := &bil.meta
+	if m.NumWriters != numWriters || m.NumVbuckets != numVbuckets ||
+		len(m.Counts) != numWriters || len(m.Checksums) != numWriters {
+		return nil, errBackIndexMismatch
+	}
+
+	bil.nodes = make([][]unsafe.Pointer, m.NumShards)
+	return bil, nil
+}
+
+// AddNode is called concurrently for nodes loaded from snapshot data files.
+// A shard is loaded by a single worker in the order of positions.
+func (bil *backIndexLoader) AddNode(shard, pos int, n *skiplist.Node) {
+	if shard >= len(bil.nodes) || pos != len(bil.nodes[shard]) {
+		atomic.StoreInt32(&bil.invalid, 1)
+		return
+	}
+
+	bil.nodes[shard] = append(bil.nodes[shard], unsafe.Pointer(n))
+}
+
+func (bil *backIndexLoader) validate() error {
+	var total, expected int
+	for _, nodes := range bil.nodes {
+		total += len(nodes)
+	}
+
+	for _, count := range bil.meta.Counts {
+		expected += count
+	}
+
+	if atomic.LoadInt32(&bil.invalid) != 0 || total != expected {
+		return errBackIndexMismatch
+	}
+
+	return nil
+}
+
+// Build reads the back index records of a slice writer and updates the
+// writer's back index table
+func (bil *backIndexLoader) Build(id int, update func(uint32, *skiplist.Node)) error {
+	fd, err := os.Open(backIndexFile(bil.dir, id))
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var rec [backIndexRecSize]byte
+	crc := crc32.NewIEEE()
+	r := bufio.NewReader(io.TeeReader(fd, crc))
+	for i := 0; i < bil.meta.Counts[id]; i++ {
+		if _, err := io.ReadFull(r, rec[:]); err != nil {
+			return err
+		}
+
+		shard := int(binary.BigEndian.Uint16(rec[4:6]))
+		pos := int(binary.BigEndian.Uint32(rec[6:10]))
+		if shard >= len(bil.nodes) || pos >= len(bil.nodes[shard]) {
+			return errBackIndexMismatch
+		}
+
+		update(binary.BigEndian.Uint32(rec[0:4]), (*skiplist.Node)(bil.nodes[shard][pos]))
+	}
+
+	if crc.Sum32() != bil.meta.Checksums[id] {
+		return errBackIndexMismatch
+	}
+
+	return nil
+}
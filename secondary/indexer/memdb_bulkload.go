@@ -0,0 +1,381 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bytes"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"github.com/couchbase/indexing/secondary/platform"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Initial build of an empty memdb slice can be done as a bulk load. Slice
+// writers buffer mutations into per writer runs instead of applying them.
+// When the initial build is done, each writer sorts its run and keeps the
+// last mutation of every docid. Index entries of all runs are then merged
+// into the main store in parallel using the skiplist builder and the back
+// index is built from the new nodes. Writers resume incremental maintenance
+// once the store is assembled.
+//
+// Begin, end and abort of bulk load are passed to the writers through their
+// command channels, so that every writer switches exactly at the same point
+// of its mutation stream.
+
+const (
+	bulkArenaSize     = 1024 * 1024
+	bulkMutationSize  = 64 // Approximate buffer overhead of a mutation
+	bulkSamplesPerRun = 1024
+)
+
+type bulkRun struct {
+	muts    []indexMutation
+	size    int64
+	entries [][]byte
+	arena   []byte
+}
+
+// copyEntry copies an index entry into the arena of the run
+func (run *bulkRun) copyEntry(e []byte) []byte {
+	if len(run.arena)+len(e) > cap(run.arena) {
+		sz := bulkArenaSize
+		if len(e) > sz {
+			sz = len(e)
+		}
+		run.arena = make([]byte, 0, sz)
+	}
+
+	off := len(run.arena)
+	run.arena = append(run.arena, e...)
+	return run.arena[off:len(run.arena):len(run.arena)]
+}
+
+type memdbBulkLoad struct {
+	runs       []bulkRun
+	maxRunSize int64
+	ending     bool
+	sealed     sync.WaitGroup
+	done       chan bool
+}
+
+type mutationsByDocId []indexMutation
+
+func (m mutationsByDocId) Len() int {
+	return len(m)
+}
+
+func (m mutationsByDocId) Less(i, j int) bool {
+	return bytes.Compare(m[i].docid, m[j].docid) < 0
+}
+
+func (m mutationsByDocId) Swap(i, j int) {
+	m[i], m[j] = m[j], m[i]
+}
+
+//BeginBulkLoad switches an empty slice to buffer mutations of the
+//initial build. Returns false if bulk load is not enabled or possible.
+func (mdb *memdbSlice) BeginBulkLoad() bool {
+	mdb.confLock.RLock()
+	enabled := mdb.sysconf["moi.bulkLoad.enabled"].Bool()
+	maxSize := int64(mdb.sysconf["moi.bulkLoad.maxBufferSize"].Uint64())
+	mdb.confLock.RUnlock()
+
+	if !enabled {
+		return false
+	}
+
+	mdb.waitPersist()
+
+	mdb.bulkLock.Lock()
+	if mdb.bulk != nil {
+		mdb.bulkLock.Unlock()
+		return true
+	}
+
+	if mdb.mainstore.ItemsCount() != 0 || mdb.GetCommittedCount() != 0 || mdb.isDirty {
+		mdb.bulkLock.Unlock()
+		logging.Infof("MemDBSlice::BeginBulkLoad Slice Id %v, IndexInstId %v "+
+			"is not empty. Skipping bulk load.", mdb.id, mdb.idxInstId)
+		return false
+	}
+
+	mdb.bulk = &memdbBulkLoad{
+		runs:       make([]bulkRun, mdb.numWriters),
+		maxRunSize: maxSize / int64(mdb.numWriters),
+		done:       make(chan bool),
+	}
+	mdb.bulkLock.Unlock()
+
+	for i := 0; i < mdb.numWriters; i++ {
+		mdb.cmdCh[i] <- indexMutation{op: opBulkLoadBegin}
+	}
+
+	logging.Infof("MemDBSlice::BeginBulkLoad Slice Id %v, IndexInstId %v "+
+		"started bulk load", mdb.id, mdb.idxInstId)
+	return true
+}
+
+//EndBulkLoad builds the index from buffered mutations in the background
+//and switches the slice to incremental maintenance
+func (mdb *memdbSlice) EndBulkLoad() {
+	mdb.bulkLock.Lock()
+	defer mdb.bulkLock.Unlock()
+
+	bulk := mdb.bulk
+	if bulk == nil || bulk.ending {
+		return
+	}
+
+	bulk.ending = true
+	bulk.sealed.Add(mdb.numWriters)
+	go mdb.doBulkLoad(bulk)
+}
+
+func (mdb *memdbSlice) getBulkLoad() *memdbBulkLoad {
+	mdb.bulkLock.Lock()
+	defer mdb.bulkLock.Unlock()
+	return mdb.bulk
+}
+
+//abortBulkLoad discards buffered mutations. Slice workers should be idle.
+func (mdb *memdbSlice) abortBulkLoad() {
+	mdb.bulkLock.Lock()
+	bulk := mdb.bulk
+	if bulk != nil && !bulk.ending {
+		mdb.bulk = nil
+	}
+	mdb.bulkLock.Unlock()
+
+	if bulk == nil {
+		return
+	}
+
+	if bulk.ending {
+		<-bulk.done
+		return
+	}
+
+	for i := 0; i < mdb.numWriters; i++ {
+		mdb.cmdCh[i] <- indexMutation{op: opBulkLoadAbort}
+	}
+	mdb.waitPersist()
+
+	logging.Infof("MemDBSlice::abortBulkLoad Slice Id %v, IndexInstId %v "+
+		"discarded buffered mutations", mdb.id, mdb.idxInstId)
+}
+
+func (mdb *memdbSlice) bufferMutation(bulk *memdbBulkLoad, mut indexMutation, workerId int) int {
+	run := &bulk.runs[workerId]
+	prevSize := run.size
+	run.muts = append(run.muts, mut)
+	run.size += int64(len(mut.key) + len(mut.docid) + bulkMutationSize)
+	platform.AddInt64(&mdb.insert_bytes, int64(len(mut.key)+len(mut.docid)))
+
+	// Build with what has been buffered so far if the run is too large
+	if run.size > bulk.maxRunSize && prevSize <= bulk.maxRunSize {
+		logging.Infof("MemDBSlice::bufferMutation Slice Id %v, IndexInstId %v "+
+			"reached bulk load buffer limit", mdb.id, mdb.idxInstId)
+		mdb.EndBulkLoad()
+	}
+
+	mdb.isDirty = true
+	return 1
+}
+
+//sealBulkRun converts the run of a writer into sorted index entries and
+//waits until the store has been assembled
+func (mdb *memdbSlice) sealBulkRun(bulk *memdbBulkLoad, workerId int) {
+	run := &bulk.runs[workerId]
+
+	sort.Stable(mutationsByDocId(run.muts))
+	for i, mut := range run.muts {
+		// Only the last mutation of a docid is relevant
+		if i+1 < len(run.muts) && bytes.Equal(mut.docid, run.muts[i+1].docid) {
+			continue
+		}
+
+		if mut.op == opUpdate && (mdb.isPrimary || len(mut.key) != 0) {
+			mdb.appendBulkEntries(run, mut.key, mut.docid, mut.pos, workerId)
+		}
+	}
+
+	run.muts = nil
+	sort.Sort(common.ByteSlices(run.entries))
+
+	bulk.sealed.Done()
+	<-bulk.done
+}
+
+func (mdb *memdbSlice) appendBulkEntries(run *bulkRun, key, docid []byte,
+	pos docPos, workerId int) {
+
+	if mdb.isPrimary {
+		entry, err := NewPrimaryIndexEntry(docid)
+		common.CrashOnError(err)
+		run.entries = append(run.entries, run.copyEntry(entry))
+		return
+	}
+
+	if !mdb.idxDefn.IsArrayIndex {
+		entry, err := newSecondaryIndexEntry(key, docid, false, 1, mdb.encodeBuf[workerId][:0],
+			mdb.largeKeysForWrite())
+		if err != nil {
+			logging.Errorf("MemDBSlice::appendBulkEntries Slice Id %v IndexInstId %v "+
+				"Skipping docid:%s (%v)", mdb.id, mdb.idxInstId, docid, err)
+			mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
+			return
+		}
+
+		run.entries = append(run.entries, run.copyEntry(entry))
+		return
+	}
+
+	if !largeKeysAllowed() && len(key) > maxArrayIndexEntrySize {
+		logging.Errorf("MemDBSlice::appendBulkEntries Error indexing docid: %s in Slice: %v. Error: Encoded array key (size %v) too long (> %v). Skipped.",
+			docid, mdb.id, len(key), maxArrayIndexEntrySize)
+		mdb.idxStats.addDocError(docErrArrayTooLong, docid, key, pos, ErrArrayKeyTooLong.Error())
+		return
+	}
+
+	items, counts, err := mdb.arrayIndexItems(key, workerId)
+	if err != nil {
+		logging.Errorf("MemDBSlice::appendBulkEntries Error indexing docid: %s in Slice: %v. Error: %v. Skipped.",
+			docid, mdb.id, err)
+		mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
+		return
+	}
+
+	n := len(run.entries)
+	for i, item := range items {
+		entry, err := newSecondaryIndexEntry(item, docid, true, counts[i], mdb.encodeBuf[workerId][:0],
+			mdb.largeKeysForWrite())
+		if err != nil {
+			logging.Errorf("MemDBSlice::appendBulkEntries Slice Id %v IndexInstId %v "+
+				"Skipping docid:%s (%v)", mdb.id, mdb.idxInstId, docid, err)
+			mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
+			run.entries = run.entries[:n]
+			return
+		}
+
+		run.entries = append(run.entries, run.copyEntry(entry))
+	}
+}
+
+//doBulkLoad waits for all writers to seal their runs and assembles the
+//main store and back index from the index entries
+func (mdb *memdbSlice) doBulkLoad(bulk *memdbBulkLoad) {
+	for i := 0; i < mdb.numWriters; i++ {
+		mdb.cmdCh[i] <- indexMutation{op: opBulkLoadEnd}
+	}
+	bulk.sealed.Wait()
+
+	t0 := time.Now()
+	mdb.confLock.RLock()
+	numVbuckets := mdb.sysconf["numVbuckets"].Int()
+	mdb.confLock.RUnlock()
+
+	var callb memdb.ItemCallback
+	var waitBuild func()
+	if !mdb.isPrimary {
+		var addNode func(*skiplist.Node)
+		addNode, waitBuild = mdb.newNodeTracker(numVbuckets)
+		callb = func(e *memdb.ItemEntry) {
+			addNode(e.Node())
+		}
+	}
+
+	runs := make([][][]byte, len(bulk.runs))
+	for i := range bulk.runs {
+		runs[i] = bulk.runs[i].entries
+	}
+
+	err := mdb.mainstore.BulkLoad(newBulkSources(runs, mdb.numWriters), callb)
+	if waitBuild != nil {
+		waitBuild()
+	}
+
+	if err != nil {
+		logging.Fatalf("MemDBSlice::doBulkLoad Slice Id %v, IndexInstId %v "+
+			"failed to bulk load (%v)", mdb.id, mdb.idxInstId, err)
+		common.CrashOnError(err)
+	}
+
+	logging.Infof("MemDBSlice::doBulkLoad Slice Id %v, IndexInstId %v "+
+		"loaded %v items. Took %v", mdb.id, mdb.idxInstId,
+		mdb.mainstore.ItemsCount(), time.Since(t0))
+
+	mdb.bulkLock.Lock()
+	mdb.bulk = nil
+	mdb.bulkLock.Unlock()
+	close(bulk.done)
+}
+
+//newBulkSources splits sorted runs into key ranges of about the same size
+//and returns a source per range which merges the runs in sorted order
+func newBulkSources(runs [][][]byte, parts int) []memdb.ItemSource {
+	var samples [][]byte
+	for _, run := range runs {
+		step := len(run)/bulkSamplesPerRun + 1
+		for i := 0; i < len(run); i += step {
+			samples = append(samples, run[i])
+		}
+	}
+	sort.Sort(common.ByteSlices(samples))
+
+	var pivots [][]byte
+	for p := 1; p < parts && len(samples) > 0; p++ {
+		pivots = append(pivots, samples[p*len(samples)/parts])
+	}
+
+	var sources []memdb.ItemSource
+	start := make([]int, len(runs))
+	for p := 0; p <= len(pivots); p++ {
+		heads := make([][][]byte, len(runs))
+		for r, run := range runs {
+			end := len(run)
+			if p < len(pivots) {
+				pivot := pivots[p]
+				end = sort.Search(len(run), func(i int) bool {
+					return bytes.Compare(run[i], pivot) >= 0
+				})
+			}
+
+			heads[r] = run[start[r]:end]
+			start[r] = end
+		}
+
+		sources = append(sources, newMergeSource(heads))
+	}
+
+	return sources
+}
+
+func newMergeSource(heads [][][]byte) memdb.ItemSource {
+	return func() []byte {
+		min := -1
+		for i, h := range heads {
+			if len(h) > 0 && (min < 0 || bytes.Compare(h[0], heads[min][0]) < 0) {
+				min = i
+			}
+		}
+
+		if min < 0 {
+			return nil
+		}
+
+		itm := heads[min][0]
+		heads[min] = heads[min][1:]
+		return itm
+	}
+}
@@ -0,0 +1,541 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"github.com/couchbase/indexing/secondary/platform"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Immutable secondary indexes of a memdb slice, with
+// settings.immutable.fast_path enabled, are maintained without the docid
+// back index. Entries are inserted into the main store without looking up
+// a previous version of the document, and deletions are not applied.
+// Instead, each slice writer keeps a log of the nodes it inserted in
+// chunks ordered by insert time, and entries older than
+// settings.immutable.ttl seconds are purged a chunk at a time. The log
+// costs a pointer per entry as opposed to a back index entry per document.
+// The fast path is not used without a ttl, as entries would never go away.
+// Purges are queued to the writers once a snapshot is created and run along
+// with mutations.
+//
+// Insert times are persisted along with each disk snapshot, so that entries
+// keep their age across recovery. A record carries the hash of an entry and
+// the insert time of its chunk. Records are sorted by hash. Entries without
+// a record are purged first.
+// Record: [hash - 8 bytes][insert time - 8 bytes]
+//
+// As there is no back index, updates of an already indexed document can
+// not be applied. A fixed size docid filter per writer flags documents
+// which are likely to have been indexed before in num_immutable_updates.
+// The filter is not persisted and may report false positives.
+
+const (
+	immutableChunkSize = 1024
+	immutableChunkSpan = time.Second
+
+	//minimum interval between purges of expired entries
+	immutablePurgeInterval = time.Second
+
+	immutableLogFile    = "immutablelog"
+	immutableLogRecSize = 16
+)
+
+type immutableChunk struct {
+	oldest time.Time
+	newest time.Time
+	nodes  []unsafe.Pointer
+}
+
+//immutableLog is the insert time ordered log of the nodes of a slice
+//writer. It is updated by the owning writer and read by the snapshot
+//persistor.
+type immutableLog struct {
+	sync.Mutex
+	chunks []*immutableChunk
+	frozen bool //no purge while nodes are read by the persistor
+}
+
+func (l *immutableLog) add(node *skiplist.Node, now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	n := len(l.chunks)
+	if n == 0 || len(l.chunks[n-1].nodes) == immutableChunkSize ||
+		now.Sub(l.chunks[n-1].oldest) > immutableChunkSpan {
+
+		l.chunks = append(l.chunks, &immutableChunk{
+			oldest: now,
+			nodes:  make([]unsafe.Pointer, 0, immutableChunkSize),
+		})
+		n++
+	}
+
+	chunk := l.chunks[n-1]
+	chunk.nodes = append(chunk.nodes, unsafe.Pointer(node))
+	chunk.newest = now
+}
+
+//purge deletes nodes of all chunks with entries inserted before cutoff
+//and returns the number of nodes deleted.
+func (l *immutableLog) purge(cutoff time.Time, w *memdb.Writer) int {
+	var expired []*immutableChunk
+	l.Lock()
+	for !l.frozen && len(l.chunks) > 0 && l.chunks[0].newest.Before(cutoff) {
+		expired = append(expired, l.chunks[0])
+		l.chunks[0] = nil
+		l.chunks = l.chunks[1:]
+	}
+	l.Unlock()
+
+	var n int
+	for _, chunk := range expired {
+		for _, ptr := range chunk.nodes {
+			w.DeleteNode((*skiplist.Node)(ptr))
+			n++
+		}
+	}
+	return n
+}
+
+//remove drops the given nodes from the log. Writer should be idle.
+func (l *immutableLog) remove(nodes map[unsafe.Pointer]bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	chunks := l.chunks[:0]
+	for _, chunk := range l.chunks {
+		live := chunk.nodes[:0]
+		for _, ptr := range chunk.nodes {
+			if !nodes[ptr] {
+				live = append(live, ptr)
+			}
+		}
+
+		if chunk.nodes = live; len(live) > 0 {
+			chunks = append(chunks, chunk)
+		}
+	}
+	l.chunks = chunks
+}
+
+//freeze returns a copy of the chunks of the log, whose nodes are not
+//purged until the log is thawed
+func (l *immutableLog) freeze() []immutableChunk {
+	l.Lock()
+	defer l.Unlock()
+
+	l.frozen = true
+	chunks := make([]immutableChunk, len(l.chunks))
+	for i, chunk := range l.chunks {
+		chunks[i] = *chunk
+	}
+	return chunks
+}
+
+func (l *immutableLog) thaw() {
+	l.Lock()
+	defer l.Unlock()
+	l.frozen = false
+}
+
+type immutableLogRec struct {
+	hash uint64
+	t    int64
+}
+
+type immutableLogRecs []immutableLogRec
+
+func (r immutableLogRecs) Len() int           { return len(r) }
+func (r immutableLogRecs) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r immutableLogRecs) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+//insertTime returns the insert time of an entry, the zero time if it has
+//no record
+func (r immutableLogRecs) insertTime(entry []byte) time.Time {
+	h := hashImmutableEntry(entry)
+	i := sort.Search(len(r), func(i int) bool { return r[i].hash >= h })
+	if i < len(r) && r[i].hash == h {
+		return time.Unix(0, r[i].t)
+	}
+	return time.Time{}
+}
+
+func hashImmutableEntry(entry []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(entry)
+	return h.Sum64()
+}
+
+//storeImmutableLog writes insert times of the logged entries to dir
+func (mdb *memdbSlice) storeImmutableLog(dir string) error {
+	var recs immutableLogRecs
+	var err error
+loop:
+	for _, l := range mdb.ilog {
+		for _, chunk := range l.freeze() {
+			t := chunk.newest.UnixNano()
+			for _, ptr := range chunk.nodes {
+				var entry []byte
+				if entry, err = (*memdb.Item)((*skiplist.Node)(ptr).Item()).LoadBytes(); err != nil {
+					break loop
+				}
+				recs = append(recs, immutableLogRec{hash: hashImmutableEntry(entry), t: t})
+			}
+		}
+	}
+	for _, l := range mdb.ilog {
+		l.thaw()
+	}
+	if err != nil {
+		return err
+	}
+	sort.Sort(recs)
+
+	f, err := os.Create(filepath.Join(dir, immutableLogFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var rec [immutableLogRecSize]byte
+	w := bufio.NewWriter(f)
+	for _, r := range recs {
+		binary.BigEndian.PutUint64(rec[0:8], r.hash)
+		binary.BigEndian.PutUint64(rec[8:16], uint64(r.t))
+		if _, err = w.Write(rec[:]); err != nil {
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+//loadImmutableLog reads insert times persisted along with a snapshot, nil
+//if the snapshot has none
+func loadImmutableLog(dir string) (immutableLogRecs, error) {
+	f, err := os.Open(filepath.Join(dir, immutableLogFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	recs := immutableLogRecs{}
+	var rec [immutableLogRecSize]byte
+	r := bufio.NewReader(f)
+	for {
+		if _, err = io.ReadFull(r, rec[:]); err == io.EOF {
+			return recs, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		recs = append(recs, immutableLogRec{
+			hash: binary.BigEndian.Uint64(rec[0:8]),
+			t:    int64(binary.BigEndian.Uint64(rec[8:16])),
+		})
+	}
+}
+
+//docidFilter is a bloom filter of indexed docids.
+type docidFilter struct {
+	bits []uint64
+}
+
+const docidFilterHashes = 3
+
+func newDocidFilter(size uint64) *docidFilter {
+	if size < 8 {
+		return nil
+	}
+	return &docidFilter{bits: make([]uint64, size/8)}
+}
+
+//testAndSet adds docid to the filter and returns true if it was
+//probably present already.
+func (f *docidFilter) testAndSet(docid []byte) bool {
+	if f == nil {
+		return false
+	}
+
+	h1 := crc32.ChecksumIEEE(docid)
+	h := fnv.New32a()
+	h.Write(docid)
+	h2 := h.Sum32() | 1
+
+	nbits := uint32(len(f.bits) * 64)
+	present := true
+	for i := uint32(0); i < docidFilterHashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if f.bits[word]&mask == 0 {
+			present = false
+			f.bits[word] |= mask
+		}
+	}
+	return present
+}
+
+func (mdb *memdbSlice) hasBackIndex() bool {
+	return !mdb.isPrimary && !mdb.isImmutable
+}
+
+func (mdb *memdbSlice) initImmutableStores() {
+	filterSize := mdb.sysconf["settings.immutable.update_filter_size"].Uint64()
+	mdb.ilog = make([]*immutableLog, mdb.numWriters)
+	mdb.ifilter = make([]*docidFilter, mdb.numWriters)
+	for i := 0; i < mdb.numWriters; i++ {
+		mdb.ilog[i] = &immutableLog{}
+		mdb.ifilter[i] = newDocidFilter(filterSize / uint64(mdb.numWriters))
+	}
+}
+
+func (mdb *memdbSlice) insertImmutable(key []byte, docid []byte, pos docPos, workerId int) int {
+	//document does not qualify for the index anymore
+	if len(key) == 0 {
+		mdb.idxStats.numDeletesSkipped.Add(1)
+		return 0
+	}
+
+	var entries [][]byte
+	if !mdb.idxDefn.IsArrayIndex {
+		entry, err := newSecondaryIndexEntry(key, docid, false, 1, mdb.encodeBuf[workerId],
+			mdb.largeKeysForWrite())
+		if err != nil {
+			logging.Errorf("MemDBSlice::insertImmutable Slice Id %v IndexInstId %v "+
+				"Skipping docid:%s (%v)", mdb.id, mdb.idxInstId, docid, err)
+			mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
+			return 0
+		}
+		entries = [][]byte{entry}
+	} else {
+		if !largeKeysAllowed() && len(key) > maxArrayIndexEntrySize {
+			logging.Errorf("MemDBSlice::insertImmutable Error indexing docid: %s in Slice: %v. "+
+				"Error: Encoded array key (size %v) too long (> %v). Skipped.",
+				docid, mdb.id, len(key), maxArrayIndexEntrySize)
+			mdb.idxStats.addDocError(docErrArrayTooLong, docid, key, pos, ErrArrayKeyTooLong.Error())
+			return 0
+		}
+
+		items, counts, err := mdb.arrayIndexItems(key, workerId)
+		if err != nil {
+			logging.Errorf("MemDBSlice::insertImmutable Error indexing docid: %s in Slice: %v. "+
+				"Error: %v. Skipped.", docid, mdb.id, err)
+			mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
+			return 0
+		}
+
+		for i, item := range items {
+			entry, err := newSecondaryIndexEntry(item, docid, true, counts[i], nil,
+				mdb.largeKeysForWrite())
+			if err != nil {
+				logging.Errorf("MemDBSlice::insertImmutable Slice Id %v IndexInstId %v "+
+					"Skipping docid:%s (%v)", mdb.id, mdb.idxInstId, docid, err)
+				mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
+				return 0
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	var nmut int
+	t0 := time.Now()
+	for _, entry := range entries {
+		//insert fails if the same entry exists
+		if node := mdb.main[workerId].Put2(entry); node != nil {
+			mdb.ilog[workerId].add(node, t0)
+			platform.AddInt64(&mdb.insert_bytes, int64(len(entry)))
+			nmut++
+		}
+	}
+	mdb.idxStats.Timings.stKVSet.Put(time.Since(t0))
+
+	if nmut == 0 {
+		mdb.idxStats.numWritesSkipped.Add(1)
+		return 0
+	}
+
+	if mdb.ifilter[workerId].testAndSet(docid) {
+		mdb.idxStats.numImmutableUpdates.Add(1)
+		logging.Tracef("MemDBSlice::insertImmutable Slice Id %v IndexInstId %v "+
+			"docid %s may have been indexed before", mdb.id, mdb.idxInstId, docid)
+	}
+
+	mdb.isDirty = true
+	return nmut
+}
+
+//purgeImmutable removes entries of the writer older than the ttl
+func (mdb *memdbSlice) purgeImmutable(workerId int) {
+	ttl := mdb.immutableTTL()
+	cutoff := time.Now().Add(-time.Duration(ttl) * time.Second)
+	if n := mdb.ilog[workerId].purge(cutoff, mdb.main[workerId]); n > 0 {
+		mdb.idxStats.numItemsPurged.Add(int64(n))
+		mdb.isDirty = true
+	}
+}
+
+//immutableTTL returns the ttl of entries. Fast path needs purging, the ttl
+//at slice creation is used if it has been set to 0 since.
+func (mdb *memdbSlice) immutableTTL() uint64 {
+	mdb.confLock.RLock()
+	ttl := mdb.sysconf["settings.immutable.ttl"].Uint64()
+	mdb.confLock.RUnlock()
+
+	if ttl == 0 {
+		return mdb.createTTL
+	}
+	return ttl
+}
+
+//triggerImmutablePurge queues a purge of expired entries to the slice
+//writers without waiting for it. Purged entries are part of the next
+//snapshot.
+func (mdb *memdbSlice) triggerImmutablePurge() {
+	if time.Since(mdb.lastPurge) < immutablePurgeInterval {
+		return
+	}
+
+	mdb.lastPurge = time.Now()
+	for i := 0; i < mdb.numWriters; i++ {
+		select {
+		case mdb.cmdCh[i] <- indexMutation{op: opPurge}:
+		default:
+			//writer is busy, it purges on the next trigger
+		}
+	}
+}
+
+type loggedNode struct {
+	t    time.Time
+	node *skiplist.Node
+}
+
+type loggedNodes []loggedNode
+
+func (n loggedNodes) Len() int           { return len(n) }
+func (n loggedNodes) Less(i, j int) bool { return n[i].t.Before(n[j].t) }
+func (n loggedNodes) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+//newImmutableLogBuilder returns a function which adds nodes to the logs
+//of slice writers and a function which waits for them to finish. Nodes
+//are logged by their insert time in recs, or are considered inserted at
+//the time they are added if recs is nil.
+func (mdb *memdbSlice) newImmutableLogBuilder(numVbuckets int,
+	recs immutableLogRecs) (func(*skiplist.Node), func()) {
+
+	var wg sync.WaitGroup
+	partShardCh := make([]chan *skiplist.Node, mdb.numWriters)
+
+	for wId := 0; wId < mdb.numWriters; wId++ {
+		wg.Add(1)
+		partShardCh[wId] = make(chan *skiplist.Node, 1000)
+		go func(i int, wg *sync.WaitGroup) {
+			defer wg.Done()
+			if recs == nil {
+				for node := range partShardCh[i] {
+					mdb.ilog[i].add(node, time.Now())
+				}
+				return
+			}
+
+			var nodes loggedNodes
+			for node := range partShardCh[i] {
+				entry := mdb.itemBytes(node)
+				nodes = append(nodes, loggedNode{t: recs.insertTime(entry), node: node})
+			}
+
+			sort.Stable(nodes)
+			for _, n := range nodes {
+				mdb.ilog[i].add(n.node, n.t)
+			}
+		}(wId, &wg)
+	}
+
+	addNode := func(n *skiplist.Node) {
+		wId := vbucketFromEntryBytes(mdb.itemBytes(n), numVbuckets) % mdb.numWriters
+		partShardCh[wId] <- n
+	}
+
+	wait := func() {
+		for wId := 0; wId < mdb.numWriters; wId++ {
+			close(partShardCh[wId])
+		}
+		wg.Wait()
+	}
+
+	return addNode, wait
+}
+
+//newNodeTracker returns a builder for the back index or, for immutable
+//indexes, the insert log of the slice writers
+func (mdb *memdbSlice) newNodeTracker(numVbuckets int) (func(*skiplist.Node), func()) {
+	if mdb.isImmutable {
+		return mdb.newImmutableLogBuilder(numVbuckets, nil)
+	}
+	return mdb.newBackIndexBuilder(numVbuckets)
+}
+
+//rollbackImmutableVbuckets removes all entries of the given vbuckets.
+//Remaining entries keep their insert time. Slice writers should be idle.
+func (mdb *memdbSlice) rollbackImmutableVbuckets(rollback []bool) (int, error) {
+	numVbuckets := len(rollback)
+
+	snap, err := mdb.mainstore.NewSnapshot()
+	if err != nil {
+		return 0, err
+	}
+
+	var nitems int
+	removed := make(map[unsafe.Pointer]bool)
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		entry := itr.Get()
+		if entry == nil {
+			break
+		}
+		if vb := vbucketFromEntryBytes(entry, numVbuckets); rollback[vb] {
+			removed[unsafe.Pointer(itr.GetNode())] = true
+			mdb.main[vb%mdb.numWriters].Delete(append([]byte(nil), entry...))
+			nitems++
+		}
+	}
+	err = itr.Err()
+	itr.Close()
+	snap.Close()
+
+	for i := 0; i < mdb.numWriters; i++ {
+		mdb.ilog[i].remove(removed)
+	}
+
+	if err != nil {
+		mdb.setTierError(err)
+	}
+	return nitems, err
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"unsafe"
+)
+
+// Secondary keys of a memdb slice which are longer than the key size limits
+// are kept out of line in a large key store owned by the slice. The index
+// entry of such a key carries the first largeKeyPrefixLen bytes of the
+// encoded key followed by the slot of the full key in the store. Slots are
+// derived from the hash of the encoded key.
+//
+// Keys stored out of line are still limited to max_large_seckey_size and to
+// MAX_LARGE_SEC_KEY_BUFFER_LEN once encoded. Slices of other storage modes
+// skip keys beyond the key size limits.
+//
+// Collatejson encoding preserves ordering on prefixes, so entries are placed
+// correctly by the bytes comparator of the store except among entries which
+// share the prefix. Such entries are adjacent in the store and iterators
+// expand them to full keys and sort them before returning them.
+//
+// Keys which are no longer referenced are reclaimed by mark and sweep. Slots
+// are tagged with the snapshot epoch in which they were last written. Once
+// the store has grown enough, slots referenced by a snapshot are marked in
+// the background. Unmarked slots not written since the snapshot are removed
+// once all older snapshots have been released.
+//
+// The store is persisted along with each disk snapshot.
+// Record: [slot - 8 bytes][len - 4 bytes][encoded key]
+
+const (
+	largeKeyPrefixLen = MAX_SEC_KEY_BUFFER_LEN
+	largeKeySlotLen   = 8
+	largeKeyFile      = "largekeys"
+
+	// Minimum number of keys in the store before a mark is started
+	largeKeyMinSweep = 1024
+)
+
+var errLargeKeyNotFound = errors.New("Large key not found in store")
+
+type largeKey struct {
+	key  []byte
+	used uint64 // epoch of the last write
+}
+
+type largeKeyStore struct {
+	sync.RWMutex
+	keys  map[uint64]*largeKey
+	size  int64
+	epoch uint64
+
+	// Result of the last mark
+	marking   bool
+	marked    map[uint64]bool
+	markSnap  *memdb.Snapshot
+	markEpoch uint64
+	lastSweep int
+}
+
+func newLargeKeyStore() *largeKeyStore {
+	return &largeKeyStore{keys: make(map[uint64]*largeKey)}
+}
+
+// add returns the slot of an encoded key, adding it to the store if needed
+func (s *largeKeyStore) add(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	slot := h.Sum64()
+
+	s.Lock()
+	defer s.Unlock()
+
+	for ; ; slot++ {
+		lk, ok := s.keys[slot]
+		if !ok {
+			s.keys[slot] = &largeKey{key: append([]byte(nil), key...), used: s.epoch}
+			s.size += int64(len(key))
+			return slot
+		}
+
+		if bytes.Equal(lk.key, key) {
+			lk.used = s.epoch
+			return slot
+		}
+	}
+}
+
+func (s *largeKeyStore) get(slot uint64) ([]byte, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if lk, ok := s.keys[slot]; ok {
+		return lk.key, nil
+	}
+
+	return nil, errLargeKeyNotFound
+}
+
+// Count returns the number of keys and their total size
+func (s *largeKeyStore) Count() (int, int64) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.keys), s.size
+}
+
+func largeKeySlot(e secondaryIndexEntry) uint64 {
+	return binary.BigEndian.Uint64(e[largeKeyPrefixLen : largeKeyPrefixLen+largeKeySlotLen])
+}
+
+// hasLargeKeyPrefix returns true if the key of an entry extends beyond the
+// prefix kept in entries of large keys. Entries persisted by older versions
+// may carry such keys inline.
+func hasLargeKeyPrefix(b []byte) bool {
+	e := secondaryIndexEntry(b)
+	return e.isLargeKey() || e.lenKey() > largeKeyPrefixLen
+}
+
+// entryKey returns the full encoded key of an entry
+func (s *largeKeyStore) entryKey(b []byte) []byte {
+	e := secondaryIndexEntry(b)
+	if !e.isLargeKey() {
+		return b[:e.lenKey()]
+	}
+
+	key, err := s.get(largeKeySlot(e))
+	common.CrashOnError(err)
+	return key
+}
+
+// expandEntry returns an entry carrying the full key in place of the
+// prefix and slot of the key
+func (s *largeKeyStore) expandEntry(b []byte) []byte {
+	e := secondaryIndexEntry(b)
+	if !e.isLargeKey() {
+		return b
+	}
+
+	key := s.entryKey(b)
+	rest := b[largeKeyPrefixLen+largeKeySlotLen:]
+	entry := make([]byte, 0, len(key)+len(rest))
+	entry = append(entry, key...)
+	entry = append(entry, rest...)
+	entry[len(entry)-1] &^= byte(uint8(1) << 6)
+	return entry
+}
+
+// newSnapshot starts a new write epoch once a snapshot of the slice has
+// been created. Slice writers are expected to be idle. Unreferenced keys
+// are reclaimed if allowed and a mark is started over snap if the store
+// has grown.
+func (s *largeKeyStore) newSnapshot(mainstore *memdb.MemDB, snap *memdb.Snapshot,
+	reclaim bool) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	epoch := s.epoch
+	s.epoch++
+
+	if s.marked != nil && reclaim && !s.hasOlderSnapshots(mainstore) {
+		var n int
+		for slot, lk := range s.keys {
+			if !s.marked[slot] && lk.used <= s.markEpoch {
+				s.size -= int64(len(lk.key))
+				delete(s.keys, slot)
+				n++
+			}
+		}
+
+		logging.Infof("LargeKeyStore::newSnapshot Reclaimed %v keys, %v keys in use", n, len(s.keys))
+		s.marked, s.markSnap = nil, nil
+		s.lastSweep = len(s.keys)
+	}
+
+	threshold := 2 * s.lastSweep
+	if threshold < largeKeyMinSweep {
+		threshold = largeKeyMinSweep
+	}
+
+	if !s.marking && s.marked == nil && len(s.keys) > threshold && snap.Open() {
+		s.marking = true
+		go s.mark(snap, epoch)
+	}
+}
+
+// hasOlderSnapshots returns true if snapshots as old as the marked one are
+// alive, caller is expected to hold the lock
+func (s *largeKeyStore) hasOlderSnapshots(mainstore *memdb.MemDB) bool {
+	for _, snap := range mainstore.GetSnapshots() {
+		if memdb.CompareSnapshot(unsafe.Pointer(snap), unsafe.Pointer(s.markSnap)) <= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *largeKeyStore) mark(snap *memdb.Snapshot, epoch uint64) {
+	marked := make(map[uint64]bool)
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if e := secondaryIndexEntry(itr.Get()); e != nil && e.isLargeKey() {
+			marked[largeKeySlot(e)] = true
+		}
+	}
+	err := itr.Err()
+	itr.Close()
+	snap.Close()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.marking = false
+	if err != nil {
+		// Keys of unread entries would be reclaimed
+		logging.Errorf("LargeKeyStore::mark Unable to mark keys in use (%v)", err)
+		return
+	}
+	s.marked, s.markSnap, s.markEpoch = marked, snap, epoch
+}
+
+func (s *largeKeyStore) StoreToDisk(dir string) error {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.keys) == 0 {
+		return nil
+	}
+
+	f, err := os.Create(filepath.Join(dir, largeKeyFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var hdr [largeKeySlotLen + 4]byte
+	w := bufio.NewWriter(f)
+	for slot, lk := range s.keys {
+		binary.BigEndian.PutUint64(hdr[:largeKeySlotLen], slot)
+		binary.BigEndian.PutUint32(hdr[largeKeySlotLen:], uint32(len(lk.key)))
+		if _, err = w.Write(hdr[:]); err != nil {
+			return err
+		}
+		if _, err = w.Write(lk.key); err != nil {
+			return err
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (s *largeKeyStore) LoadFromDisk(dir string) error {
+	f, err := os.Open(filepath.Join(dir, largeKeyFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s.Lock()
+	defer s.Unlock()
+
+	var hdr [largeKeySlotLen + 4]byte
+	r := bufio.NewReader(f)
+	for {
+		if _, err = io.ReadFull(r, hdr[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		slot := binary.BigEndian.Uint64(hdr[:largeKeySlotLen])
+		key := make([]byte, binary.BigEndian.Uint32(hdr[largeKeySlotLen:]))
+		if _, err = io.ReadFull(r, key); err != nil {
+			return err
+		}
+
+		if lk, ok := s.keys[slot]; ok {
+			s.size -= int64(len(lk.key))
+		}
+		s.keys[slot] = &largeKey{key: key, used: s.epoch}
+		s.size += int64(len(key))
+	}
+}
+
+// Iterator over the entries of a snapshot which returns entries of large
+// keys expanded, in the order of full keys
+type largeKeyIterator struct {
+	*memdb.Iterator
+	store *largeKeyStore
+	block [][]byte
+	pos   int
+}
+
+func (s *largeKeyStore) NewIterator(snap *memdb.Snapshot) *largeKeyIterator {
+	return &largeKeyIterator{Iterator: snap.NewIterator(), store: s}
+}
+
+func (it *largeKeyIterator) SeekFirst() {
+	it.Iterator.SeekFirst()
+	it.load()
+}
+
+func (it *largeKeyIterator) Seek(key []byte) {
+	if len(key) <= largeKeyPrefixLen {
+		it.Iterator.Seek(key)
+		it.load()
+		return
+	}
+
+	it.Iterator.Seek(key[:largeKeyPrefixLen])
+	for it.load(); it.Valid() && bytes.Compare(it.Get(), key) < 0; it.Next() {
+	}
+}
+
+func (it *largeKeyIterator) Valid() bool {
+	return it.pos < len(it.block)
+}
+
+func (it *largeKeyIterator) Get() []byte {
+	return it.block[it.pos]
+}
+
+func (it *largeKeyIterator) Next() {
+	it.pos++
+	if it.pos == len(it.block) {
+		it.load()
+	}
+}
+
+// load reads the next entry of the snapshot or all entries sharing the
+// prefix of a large key
+func (it *largeKeyIterator) load() {
+	it.block, it.pos = it.block[:0], 0
+	if !it.Iterator.Valid() {
+		return
+	}
+
+	itm := it.Iterator.Get()
+	if itm == nil {
+		return
+	}
+	it.Iterator.Next()
+	it.block = append(it.block, it.store.expandEntry(itm))
+	if !hasLargeKeyPrefix(itm) {
+		return
+	}
+
+	prefix := itm[:largeKeyPrefixLen]
+	for ; it.Iterator.Valid(); it.Iterator.Next() {
+		itm = it.Iterator.Get()
+		if itm == nil || !hasLargeKeyPrefix(itm) || !bytes.Equal(itm[:largeKeyPrefixLen], prefix) {
+			break
+		}
+		it.block = append(it.block, it.store.expandEntry(itm))
+	}
+
+	if len(it.block) > 1 {
+		sort.Sort(common.ByteSlices(it.block))
+	}
+}
@@ -38,22 +38,32 @@ import (
 const (
 	opUpdate = iota
 	opDelete
+	opBulkLoadBegin
+	opBulkLoadEnd
+	opBulkLoadAbort
+	opPurge
 )
 
 const tmpDirName = ".tmp"
 
+const (
+	snapshotPinFile     = "pinned"
+	retentionPolicyFile = "retention.json"
+)
+
 type indexMutation struct {
 	op    int
 	key   []byte
 	docid []byte
+	pos   docPos
 }
 
 func docIdFromEntryBytes(e []byte) []byte {
 	offset := len(e) - 2
 	l := binary.LittleEndian.Uint16(e[offset : offset+2])
-	// Length & 0111111 00000000
-	// as MSB of length is used to indicate presence of count
-	docidlen := int(l & 0x7fff)
+	// Length & 0011111 11111111
+	// as two MSBs of length are used to indicate count and large key
+	docidlen := int(l & 0x3fff)
 	offset = len(e) - 1
 	if (e[offset] & 0x80) == 0x80 { // if count is encoded
 		offset = len(e) - docidlen - 4
@@ -72,7 +82,10 @@ func entryBytesFromDocId(docid []byte) []byte {
 }
 
 func vbucketFromEntryBytes(e []byte, numVbuckets int) int {
-	docid := docIdFromEntryBytes(e)
+	return vbucketFromDocId(docIdFromEntryBytes(e), numVbuckets)
+}
+
+func vbucketFromDocId(docid []byte, numVbuckets int) int {
 	hash := crc32.ChecksumIEEE(docid)
 	return int((hash >> 16) & uint32(numVbuckets-1))
 }
@@ -85,7 +98,12 @@ func nodeEquality(p unsafe.Pointer, entry []byte) bool {
 	node := (*skiplist.Node)(p)
 	docid1 := docIdFromEntryBytes(entry)
 	itm := (*memdb.Item)(node.Item())
-	docid2 := docIdFromEntryBytes(itm.Bytes())
+	// A failed read is reported by the tier error check of the writer
+	bs, err := itm.LoadBytes()
+	if err != nil {
+		return false
+	}
+	docid2 := docIdFromEntryBytes(bs)
 	return bytes.Equal(docid1, docid2)
 }
 
@@ -131,10 +149,17 @@ type memdbSlice struct {
 
 	workerDone []chan bool
 
-	fatalDbErr error
+	fatalDbErr  error
+	tierErrLock sync.Mutex
+
+	// Writers hold it shared while they apply a mutation, balancing
+	// memory of a tiered store needs them idle
+	balanceLock sync.RWMutex
 
 	numWriters   int
-	maxRollbacks int
+	// Per index disk snapshot retention policy
+	retention  *RetentionPolicy
+	retainLock sync.Mutex
 
 	totalFlushTime  time.Duration
 	totalCommitTime time.Duration
@@ -145,12 +170,26 @@ type memdbSlice struct {
 
 	isPersistorActive int32
 
+	// Initial build from buffered mutations
+	bulk     *memdbBulkLoad
+	bulkLock sync.Mutex
+
+	// Immutable index maintained without back index
+	isImmutable bool
+	ilog        []*immutableLog
+	ifilter     []*docidFilter
+	lastPurge   time.Time
+	createTTL   uint64
+
 	// Array processing
 	arrayExprPosition int
 	isArrayDistinct   bool
 
 	encodeBuf [][]byte
 	arrayBuf  [][]byte
+
+	// Keys beyond the key size limits
+	largeKeys *largeKeyStore
 }
 
 func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
@@ -162,6 +201,12 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 		os.Mkdir(path, 0777)
 	}
 
+	// Evicted pages of a previous run are not recoverable
+	staleTiers, _ := filepath.Glob(filepath.Join(path, "tier-*"))
+	for _, dir := range staleTiers {
+		os.RemoveAll(dir)
+	}
+
 	slice := &memdbSlice{}
 	slice.idxStats = idxStats
 
@@ -177,7 +222,7 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 	slice.idxDefn = idxDefn
 	slice.id = sliceId
 	slice.numWriters = sysconf["numSliceWriters"].Int()
-	slice.maxRollbacks = sysconf["settings.recovery.max_rollbacks"].Int()
+	slice.retention = loadRetentionPolicy(path)
 
 	sliceBufSize := sysconf["settings.sliceBufSize"].Uint64()
 	if sliceBufSize < uint64(slice.numWriters) {
@@ -197,6 +242,16 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 	slice.stopCh = make([]DoneChannel, slice.numWriters)
 
 	slice.isPrimary = isPrimary
+	slice.isImmutable = !isPrimary && idxDefn.Immutable &&
+		sysconf["settings.immutable.fast_path"].Bool()
+	if slice.isImmutable {
+		if slice.createTTL = sysconf["settings.immutable.ttl"].Uint64(); slice.createTTL == 0 {
+			logging.Warnf("MemDBSlice:NewMemDBSlice Slice Id %v IndexInstId %v "+
+				"settings.immutable.ttl is not set, not using immutable fast path",
+				sliceId, idxInstId)
+			slice.isImmutable = false
+		}
+	}
 	slice.initStores()
 
 	// Array related initialization
@@ -206,7 +261,7 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 	}
 
 	logging.Infof("MemDBSlice:NewMemDBSlice Created New Slice Id %v IndexInstId %v "+
-		"WriterThreads %v", sliceId, idxInstId, slice.numWriters)
+		"WriterThreads %v Immutable %v", sliceId, idxInstId, slice.numWriters, slice.isImmutable)
 
 	for i := 0; i < slice.numWriters; i++ {
 		slice.stopCh[i] = make(DoneChannel)
@@ -220,7 +275,15 @@ func NewMemDBSlice(path string, sliceId SliceId, idxDefn common.IndexDefn,
 
 func (slice *memdbSlice) initStores() {
 	cfg := memdb.DefaultConfig()
-	if slice.sysconf["moi.useMemMgmt"].Bool() {
+	if slice.sysconf["moi.tiering.enabled"].Bool() {
+		// Evicted pages are reclaimed by the garbage collector
+		if slice.sysconf["moi.useMemMgmt"].Bool() {
+			logging.Warnf("MemDBSlice::initStores SliceId %v IndexInstId %v "+
+				"moi.useMemMgmt is ignored as tiering is enabled", slice.id, slice.idxInstId)
+		}
+		cacheSize := int64(slice.sysconf["moi.tiering.pageCacheSize"].Uint64())
+		cfg.UseTiering(slice.path, cacheSize)
+	} else if slice.sysconf["moi.useMemMgmt"].Bool() {
 		cfg.UseMemoryMgmt(mm.Malloc, mm.Free)
 	}
 
@@ -230,12 +293,22 @@ func (slice *memdbSlice) initStores() {
 
 	cfg.SetKeyComparator(byteItemCompare)
 	slice.mainstore = memdb.NewWithConfig(cfg)
+	if err := slice.mainstore.TierError(); err != nil {
+		logging.Errorf("MemDBSlice::initStores SliceId %v IndexInstId %v "+
+			"Tiering disabled (%v)", slice.id, slice.idxInstId, err)
+	}
 	slice.main = make([]*memdb.Writer, slice.numWriters)
 	for i := 0; i < slice.numWriters; i++ {
 		slice.main[i] = slice.mainstore.NewWriter()
 	}
 
 	if !slice.isPrimary {
+		slice.largeKeys = newLargeKeyStore()
+	}
+
+	if slice.isImmutable {
+		slice.initImmutableStores()
+	} else if !slice.isPrimary {
 		slice.back = make([]*nodetable.NodeTable, slice.numWriters)
 		for i := 0; i < slice.numWriters; i++ {
 			slice.back[i] = nodetable.New(hashDocId, nodeEquality)
@@ -243,6 +316,27 @@ func (slice *memdbSlice) initStores() {
 	}
 }
 
+// largeKeysForWrite returns the large key store of the slice if keys beyond
+// the key size limits are to be indexed
+func (mdb *memdbSlice) largeKeysForWrite() *largeKeyStore {
+	if largeKeysAllowed() {
+		return mdb.largeKeys
+	}
+	return nil
+}
+
+// arrayIndexItems splits an array key into index items, keys beyond the key
+// size limits are left to the large key store
+func (mdb *memdbSlice) arrayIndexItems(keys []byte, workerId int) ([][]byte, []int, error) {
+	if largeKeysAllowed() {
+		return arrayIndexItems(keys, mdb.arrayExprPosition, mdb.arrayBuf[workerId],
+			mdb.isArrayDistinct, MAX_LARGE_SEC_KEY_BUFFER_LEN, math.MaxInt32)
+	}
+
+	return ArrayIndexItems(keys, mdb.arrayExprPosition, mdb.arrayBuf[workerId],
+		mdb.isArrayDistinct)
+}
+
 func (mdb *memdbSlice) IncrRef() {
 	mdb.lock.Lock()
 	defer mdb.lock.Unlock()
@@ -270,6 +364,7 @@ func (mdb *memdbSlice) Insert(key []byte, docid []byte, meta *MutationMeta) erro
 		op:    opUpdate,
 		key:   key,
 		docid: docid,
+		pos:   newDocPos(meta),
 	}
 	mdb.cmdCh[int(meta.vbucket)%mdb.numWriters] <- mut
 	mdb.idxStats.numDocsFlushQueued.Add(1)
@@ -286,6 +381,7 @@ func (mdb *memdbSlice) handleCommandsWorker(workerId int) {
 	var start time.Time
 	var elapsed time.Duration
 	var icmd indexMutation
+	var bulk *memdbBulkLoad
 
 loop:
 	for {
@@ -293,17 +389,43 @@ loop:
 		select {
 		case icmd = <-mdb.cmdCh[workerId]:
 			switch icmd.op {
-			case opUpdate:
+			case opUpdate, opDelete:
 				start = time.Now()
-				nmut = mdb.insert(icmd.key, icmd.docid, workerId)
+				mdb.balanceLock.RLock()
+				if bulk != nil {
+					nmut = mdb.bufferMutation(bulk, icmd, workerId)
+				} else if icmd.op == opUpdate {
+					nmut = mdb.insert(icmd.key, icmd.docid, icmd.pos, workerId)
+				} else {
+					nmut = mdb.delete(icmd.docid, workerId)
+				}
+				mdb.balanceLock.RUnlock()
+				// Comparisons with evicted items which could not be read
+				// may have misplaced the mutation
+				mdb.setTierError(mdb.mainstore.TierError())
 				elapsed = time.Since(start)
 				mdb.totalFlushTime += elapsed
 
-			case opDelete:
-				start = time.Now()
-				nmut = mdb.delete(icmd.docid, workerId)
-				elapsed = time.Since(start)
-				mdb.totalFlushTime += elapsed
+			case opBulkLoadBegin:
+				bulk = mdb.getBulkLoad()
+				continue loop
+
+			case opBulkLoadEnd:
+				if bulk != nil {
+					mdb.sealBulkRun(bulk, workerId)
+					bulk = nil
+				}
+				continue loop
+
+			case opBulkLoadAbort:
+				bulk = nil
+				continue loop
+
+			case opPurge:
+				mdb.balanceLock.RLock()
+				mdb.purgeImmutable(workerId)
+				mdb.balanceLock.RUnlock()
+				continue loop
 
 			default:
 				logging.Errorf("MemDBSlice::handleCommandsWorker \n\tSliceId %v IndexInstId %v Received "+
@@ -324,18 +446,20 @@ loop:
 	}
 }
 
-func (mdb *memdbSlice) insert(key []byte, docid []byte, workerId int) int {
+func (mdb *memdbSlice) insert(key []byte, docid []byte, pos docPos, workerId int) int {
 	var nmut int
 
 	if mdb.isPrimary {
 		nmut = mdb.insertPrimaryIndex(key, docid, workerId)
+	} else if mdb.isImmutable {
+		nmut = mdb.insertImmutable(key, docid, pos, workerId)
 	} else if len(key) == 0 {
 		nmut = mdb.delete(docid, workerId)
 	} else {
 		if mdb.idxDefn.IsArrayIndex {
-			nmut = mdb.insertSecArrayIndex(key, docid, workerId)
+			nmut = mdb.insertSecArrayIndex(key, docid, pos, workerId)
 		} else {
-			nmut = mdb.insertSecIndex(key, docid, workerId)
+			nmut = mdb.insertSecIndex(key, docid, pos, workerId)
 		}
 	}
 
@@ -356,20 +480,30 @@ func (mdb *memdbSlice) insertPrimaryIndex(key []byte, docid []byte, workerId int
 	return 1
 }
 
-func (mdb *memdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) int {
+func (mdb *memdbSlice) insertSecIndex(key []byte, docid []byte, pos docPos, workerId int) int {
 	// 1. Insert entry into main index
 	// 2. Upsert into backindex with docid, mainnode pointer
 	// 3. Delete old entry from main index if back index had
 	// a previous mainnode pointer entry
 	t0 := time.Now()
-	entry, err := NewSecondaryIndexEntry(key, docid, mdb.idxDefn.IsArrayIndex,
-		1, mdb.encodeBuf[workerId])
+	entry, err := newSecondaryIndexEntry(key, docid, mdb.idxDefn.IsArrayIndex,
+		1, mdb.encodeBuf[workerId], mdb.largeKeysForWrite())
 	if err != nil {
 		logging.Errorf("MemDBSlice::insertSecIndex Slice Id %v IndexInstId %v "+
 			"Skipping docid:%s (%v)", mdb.Id, mdb.idxInstId, docid, err)
+		mdb.idxStats.addDocError(docErrorClass(err), docid, key, pos, err.Error())
 		return mdb.deleteSecIndex(docid, workerId)
 	}
 
+	// Skip the write if the document's key is unchanged
+	if ptr := mdb.back[workerId].Get(entry); ptr != nil {
+		itm := (*memdb.Item)((*skiplist.Node)(ptr).Item())
+		if bs, err := itm.LoadBytes(); err == nil && bytes.Equal(bs, entry) {
+			mdb.idxStats.numWritesSkipped.Add(1)
+			return 0
+		}
+	}
+
 	newNode := mdb.main[workerId].Put2(entry)
 	mdb.idxStats.Timings.stKVSet.Put(time.Now().Sub(t0))
 	platform.AddInt64(&mdb.insert_bytes, int64(len(docid)+len(entry)))
@@ -388,26 +522,28 @@ func (mdb *memdbSlice) insertSecIndex(key []byte, docid []byte, workerId int) in
 	return 1
 }
 
-func (mdb *memdbSlice) insertSecArrayIndex(keys []byte, docid []byte, workerId int) int {
-	if len(keys) > maxArrayIndexEntrySize {
+func (mdb *memdbSlice) insertSecArrayIndex(keys []byte, docid []byte, pos docPos, workerId int) int {
+	if !largeKeysAllowed() && len(keys) > maxArrayIndexEntrySize {
 		logging.Errorf("MemDBSlice::insertSecArrayIndex Error indexing docid: %s in Slice: %v. Error: Encoded array key (size %v) too long (> %v). Skipped.",
 			docid, mdb.id, len(keys), maxArrayIndexEntrySize)
 		logging.Verbosef("MemDBSlice::insertSecArrayIndex Skipped docid: %s Key: %s", docid, string(keys))
+		mdb.idxStats.addDocError(docErrArrayTooLong, docid, keys, pos, ErrArrayKeyTooLong.Error())
 		return mdb.deleteSecArrayIndex(docid, workerId)
 	}
 
 	var nmut int
-	newEntriesBytes, newKeyCount, err := ArrayIndexItems(keys, mdb.arrayExprPosition,
-		mdb.arrayBuf[workerId], mdb.isArrayDistinct)
+	newEntriesBytes, newKeyCount, err := mdb.arrayIndexItems(keys, workerId)
 	if err == ErrArrayItemKeyTooLong {
 		logging.Errorf("MemDBSlice::insertSecArrayIndex Error indexing docid: %s in Slice: %v. Error: Encoded array item too long (> %v). Skipped.",
 			docid, mdb.id, maxIndexEntrySize)
 		logging.Verbosef("MemDBSlice::insertSecArrayIndex Skipped docid: %s Key: %s", docid, string(keys))
+		mdb.idxStats.addDocError(docErrorClass(err), docid, keys, pos, err.Error())
 		return mdb.deleteSecArrayIndex(docid, workerId)
 	} else if err == ErrArrayKeyTooLong {
 		logging.Errorf("MemDBSlice::insertSecArrayIndex Error indexing docid: %s in Slice: %v. Error: Encoded array key too long (> %v). Skipped.",
 			docid, mdb.id, maxArrayIndexEntrySize)
 		logging.Verbosef("MemDBSlice::insertSecArrayIndex Skipped docid: %s Key: %s", docid, string(keys))
+		mdb.idxStats.addDocError(docErrorClass(err), docid, keys, pos, err.Error())
 		return mdb.deleteSecArrayIndex(docid, workerId)
 	}
 	common.CrashOnError(err)
@@ -421,24 +557,34 @@ func (mdb *memdbSlice) insertSecArrayIndex(keys []byte, docid []byte, workerId i
 	_, ptr := mdb.back[workerId].Remove(lookupentry)
 
 	list := memdb.NewNodeList((*skiplist.Node)(ptr))
-	oldEntriesBytes := list.Keys()
-	oldKeyCount := make([]int, len(oldEntriesBytes))
-	for i, _ := range oldEntriesBytes {
-		e := secondaryIndexEntry(oldEntriesBytes[i])
+	oldEntries, err := list.LoadKeys()
+	if err != nil {
+		// Keep the old entries, the slice is errored anyway
+		mdb.back[workerId].Update(lookupentry, ptr)
+		mdb.setTierError(err)
+		return 0
+	}
+	oldEntriesBytes := make([][]byte, len(oldEntries))
+	oldKeyCount := make([]int, len(oldEntries))
+	for i, _ := range oldEntries {
+		e := secondaryIndexEntry(oldEntries[i])
 		oldKeyCount[i] = e.Count()
-		oldEntriesBytes[i] = oldEntriesBytes[i][:e.lenKey()]
+		oldEntriesBytes[i] = mdb.largeKeys.entryKey(oldEntries[i])
 	}
 
 	entryBytesToBeAdded, entryBytesToDeleted := CompareArrayEntriesWithCount(newEntriesBytes, oldEntriesBytes, newKeyCount, oldKeyCount)
 	nmut = 0
 
+	if ptr != nil && isNilEntries(entryBytesToBeAdded) && isNilEntries(entryBytesToDeleted) {
+		mdb.back[workerId].Update(lookupentry, ptr)
+		mdb.idxStats.numWritesSkipped.Add(1)
+		return 0
+	}
+
 	// Delete each entry in entryBytesToDeleted
 	for i, item := range entryBytesToDeleted {
 		if item != nil { // nil item indicates it should not be deleted
-			entry, err := NewSecondaryIndexEntry(item, docid, mdb.idxDefn.IsArrayIndex,
-				oldKeyCount[i], mdb.encodeBuf[workerId][:0])
-			common.CrashOnError(err)
-			node := list.Remove(entry)
+			node := list.Remove(oldEntries[i])
 			mdb.main[workerId].DeleteNode(node)
 			nmut++
 		}
@@ -448,11 +594,12 @@ func (mdb *memdbSlice) insertSecArrayIndex(keys []byte, docid []byte, workerId i
 	for i, key := range entryBytesToBeAdded {
 		if key != nil { // nil item indicates it should not be added
 			t0 := time.Now()
-			entry, err := NewSecondaryIndexEntry(key, docid, mdb.idxDefn.IsArrayIndex,
-				newKeyCount[i], mdb.encodeBuf[workerId][:0])
+			entry, err := newSecondaryIndexEntry(key, docid, mdb.idxDefn.IsArrayIndex,
+				newKeyCount[i], mdb.encodeBuf[workerId][:0], mdb.largeKeysForWrite())
 			if err != nil {
 				logging.Errorf("MemDBSlice::insertSecArrayIndex Slice Id %v IndexInstId %v "+
 					"Skipping docid:%s (%v)", mdb.Id, mdb.idxInstId, docid, err)
+				mdb.idxStats.addDocError(docErrorClass(err), docid, keys, pos, err.Error())
 				return mdb.deleteSecArrayIndex(docid, workerId)
 			}
 			newNode := mdb.main[workerId].Put2(entry)
@@ -476,6 +623,9 @@ func (mdb *memdbSlice) delete(docid []byte, workerId int) int {
 
 	if mdb.isPrimary {
 		nmut = mdb.deletePrimaryIndex(docid, workerId)
+	} else if mdb.isImmutable {
+		//entries are removed by ttl based purge
+		mdb.idxStats.numDeletesSkipped.Add(1)
 	} else if !mdb.idxDefn.IsArrayIndex {
 		nmut = mdb.deleteSecIndex(docid, workerId)
 	} else {
@@ -532,7 +682,11 @@ func (mdb *memdbSlice) deleteSecArrayIndex(docid []byte, workerId int) (nmut int
 		return
 	}
 	list := memdb.NewNodeList(ptr)
-	oldEntriesBytes := list.Keys()
+	oldEntriesBytes, err := list.LoadKeys()
+	if err != nil {
+		mdb.setTierError(err)
+		return
+	}
 
 	t0 := time.Now()
 	mdb.back[workerId].Remove(lookupentry)
@@ -571,11 +725,14 @@ func (mdb *memdbSlice) checkFatalDbError(err error) {
 }
 
 type memdbSnapshotInfo struct {
-	Ts       *common.TsVbuuid
-	MainSnap *memdb.Snapshot `json:"-"`
+	Ts         *common.TsVbuuid
+	CreatedAt  time.Time
+	ItemsCount int64
+	MainSnap   *memdb.Snapshot `json:"-"`
 
 	Committed bool `json:"-"`
 	dataPath  string
+	largeKeys *largeKeyStore
 }
 
 type memdbSnapshot struct {
@@ -640,12 +797,50 @@ func (mdb *memdbSlice) doPersistSnapshot(s *memdbSnapshot) {
 			concurrency = int(math.Ceil(float64(maxThreads) * float64(indexCount) / float64(total)))
 		}
 
+		numVbuckets := mdb.sysconf["numVbuckets"].Int()
 		mdb.confLock.RUnlock()
-		err := mdb.mainstore.StoreToDisk(tmpdir, s.info.MainSnap, concurrency, nil)
+
+		var biw *backIndexWriter
+		var itmCallback memdb.ItemCallback
+		if mdb.hasBackIndex() {
+			var err error
+			if biw, err = newBackIndexWriter(tmpdir, mdb.numWriters, numVbuckets); err == nil {
+				itmCallback = biw.Add
+			} else {
+				logging.Warnf("MemDBSlice Slice Id %v, IndexInstId %v unable to persist"+
+					" back index (error=%v)", mdb.id, mdb.idxInstId, err)
+			}
+		}
+
+		var err error
+		if mdb.isImmutable {
+			// Snapshot is closed once stored
+			err = mdb.storeImmutableLog(tmpdir)
+		}
+		if err == nil {
+			err = mdb.mainstore.StoreToDisk(tmpdir, s.info.MainSnap, concurrency, itmCallback)
+		} else {
+			s.info.MainSnap.Close()
+		}
+		if err == nil && s.info.largeKeys != nil {
+			err = s.info.largeKeys.StoreToDisk(tmpdir)
+		}
+		if biw != nil {
+			if err != nil {
+				biw.abort()
+			} else if berr := biw.Close(); berr != nil {
+				logging.Warnf("MemDBSlice Slice Id %v, IndexInstId %v unable to persist"+
+					" back index (error=%v)", mdb.id, mdb.idxInstId, berr)
+			}
+		}
+
 		if err == nil {
 			var fd *os.File
 			var bs []byte
-			bs, err = json.Marshal(s.info)
+			info := *s.info
+			info.CreatedAt = t0
+			info.ItemsCount = s.info.MainSnap.Count()
+			bs, err = json.Marshal(&info)
 			if err == nil {
 				fd, err = os.OpenFile(manifest, os.O_WRONLY|os.O_CREATE, 0755)
 				_, err = fd.Write(bs)
@@ -657,7 +852,7 @@ func (mdb *memdbSlice) doPersistSnapshot(s *memdbSnapshot) {
 			if err == nil {
 				err = os.Rename(tmpdir, dir)
 				if err == nil {
-					mdb.cleanupOldSnapshotFiles(mdb.maxRollbacks)
+					mdb.cleanupSnapshots()
 				}
 			}
 		}
@@ -681,6 +876,9 @@ func (mdb *memdbSlice) doPersistSnapshot(s *memdbSnapshot) {
 }
 
 func (mdb *memdbSlice) cleanupOldSnapshotFiles(keepn int) {
+	mdb.retainLock.Lock()
+	defer mdb.retainLock.Unlock()
+
 	manifests := mdb.getSnapshotManifests()
 	if len(manifests) > keepn {
 		toRemove := len(manifests) - keepn
@@ -693,6 +891,172 @@ func (mdb *memdbSlice) cleanupOldSnapshotFiles(keepn int) {
 	}
 }
 
+// cleanupSnapshots removes disk snapshots which are not kept by the
+// retention policy of the slice
+func (mdb *memdbSlice) cleanupSnapshots() {
+	policy := mdb.RetentionPolicy()
+
+	mdb.retainLock.Lock()
+	defer mdb.retainLock.Unlock()
+
+	var dirs []string
+	var created []time.Time
+	var pinned []bool
+	for _, m := range mdb.getSnapshotManifests() {
+		info, err := readSnapshotManifest(m)
+		if err != nil {
+			continue
+		}
+
+		dir := filepath.Dir(m)
+		dirs = append(dirs, dir)
+		created = append(created, info.CreatedAt)
+		pinned = append(pinned, isSnapshotPinned(dir))
+	}
+
+	keep := policy.Retain(created, pinned, time.Now())
+	for i, dir := range dirs {
+		if !keep[i] {
+			logging.Infof("MemDBSlice Removing disk snapshot %v", dir)
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func (mdb *memdbSlice) RetentionPolicy() RetentionPolicy {
+	mdb.confLock.RLock()
+	defer mdb.confLock.RUnlock()
+
+	if mdb.retention != nil {
+		return *mdb.retention
+	}
+
+	return retentionPolicyFromConfig(mdb.sysconf)
+}
+
+func (mdb *memdbSlice) SetRetentionPolicy(policy *RetentionPolicy) error {
+	file := filepath.Join(mdb.path, retentionPolicyFile)
+	if policy == nil {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+
+		bs, _ := json.Marshal(policy)
+		if err := ioutil.WriteFile(file, bs, 0644); err != nil {
+			return err
+		}
+
+		p := *policy
+		policy = &p
+	}
+
+	mdb.confLock.Lock()
+	mdb.retention = policy
+	mdb.confLock.Unlock()
+
+	logging.Infof("MemDBSlice Slice Id %v, IndexInstId %v using snapshot retention"+
+		" policy %+v", mdb.id, mdb.idxInstId, mdb.RetentionPolicy())
+	return nil
+}
+
+func loadRetentionPolicy(path string) *RetentionPolicy {
+	bs, err := ioutil.ReadFile(filepath.Join(path, retentionPolicyFile))
+	if err != nil {
+		return nil
+	}
+
+	policy := new(RetentionPolicy)
+	if err := json.Unmarshal(bs, policy); err != nil || policy.Validate() != nil {
+		logging.Warnf("MemDBSlice Ignoring invalid snapshot retention policy at %v", path)
+		return nil
+	}
+
+	return policy
+}
+
+// Returns retained disk snapshots, most recent first
+func (mdb *memdbSlice) DiskSnapshots() ([]DiskSnapshot, error) {
+	mdb.retainLock.Lock()
+	defer mdb.retainLock.Unlock()
+
+	var snaps []DiskSnapshot
+	files := mdb.getSnapshotManifests()
+	for i := len(files) - 1; i >= 0; i-- {
+		info, err := readSnapshotManifest(files[i])
+		if err != nil {
+			continue
+		}
+
+		dir := filepath.Dir(files[i])
+		size, _ := common.DiskUsage(dir)
+		snaps = append(snaps, DiskSnapshot{
+			Id:      filepath.Base(dir),
+			Created: info.CreatedAt,
+			Size:    size,
+			Items:   info.ItemsCount,
+			Pinned:  isSnapshotPinned(dir),
+			Ts:      summarizeTs(info.Ts),
+		})
+	}
+
+	return snaps, nil
+}
+
+func (mdb *memdbSlice) PinSnapshot(id string, pin bool) error {
+	mdb.retainLock.Lock()
+	defer mdb.retainLock.Unlock()
+
+	dir := filepath.Join(mdb.path, id)
+	if filepath.Base(id) != id || !strings.HasPrefix(id, "snapshot.") {
+		return ErrSnapshotNotFound
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err != nil {
+		return ErrSnapshotNotFound
+	}
+
+	pinfile := filepath.Join(dir, snapshotPinFile)
+	if pin {
+		return ioutil.WriteFile(pinfile, nil, 0644)
+	}
+
+	if err := os.Remove(pinfile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func isSnapshotPinned(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, snapshotPinFile))
+	return err == nil
+}
+
+// Snapshots persisted by older versions do not carry the creation time
+func readSnapshotManifest(f string) (*memdbSnapshotInfo, error) {
+	info := &memdbSnapshotInfo{dataPath: filepath.Dir(f)}
+	bs, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(bs, info); err != nil {
+		return nil, err
+	}
+
+	if info.CreatedAt.IsZero() {
+		if fi, err := os.Stat(f); err == nil {
+			info.CreatedAt = fi.ModTime()
+		}
+	}
+
+	return info, nil
+}
+
 func (mdb *memdbSlice) diskSize() int64 {
 	var sz int64
 	snapdirs, _ := filepath.Glob(filepath.Join(mdb.path, "snapshot.*"))
@@ -723,20 +1087,9 @@ func (mdb *memdbSlice) GetSnapshots() ([]SnapshotInfo, error) {
 
 	files := mdb.getSnapshotManifests()
 	for i := len(files) - 1; i >= 0; i-- {
-		f := files[i]
-		info := &memdbSnapshotInfo{dataPath: filepath.Dir(f)}
-		fd, err := os.Open(f)
-		if err == nil {
-			defer fd.Close()
-			bs, err := ioutil.ReadAll(fd)
-			if err == nil {
-				err = json.Unmarshal(bs, info)
-				if err == nil {
-					infos = append(infos, info)
-				}
-			}
+		if info, err := readSnapshotManifest(files[i]); err == nil {
+			infos = append(infos, info)
 		}
-
 	}
 	return infos, nil
 }
@@ -753,9 +1106,11 @@ func (mdb *memdbSlice) GetCommittedCount() uint64 {
 }
 
 func (mdb *memdbSlice) resetStores() {
+	mdb.abortBulkLoad()
+
 	// This is blocking call if snap refcounts != 0
 	go mdb.mainstore.Close()
-	if !mdb.isPrimary {
+	if mdb.hasBackIndex() {
 		for i := 0; i < mdb.numWriters; i++ {
 			mdb.back[i].Close()
 		}
@@ -779,39 +1134,47 @@ func (mdb *memdbSlice) Rollback(info SnapshotInfo) error {
 }
 
 func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) error {
-	var wg sync.WaitGroup
+	var bil *backIndexLoader
+	var addNode func(*skiplist.Node)
+	var waitBuild func()
 	var backIndexCallback memdb.ItemCallback
 	mdb.confLock.RLock()
 	numVbuckets := mdb.sysconf["numVbuckets"].Int()
 	mdb.confLock.RUnlock()
 
-	partShardCh := make([]chan *memdb.ItemEntry, mdb.numWriters)
-
 	logging.Infof("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v reading %v",
 		mdb.id, mdb.idxInstId, snapInfo.dataPath)
 
 	t0 := time.Now()
-	if !mdb.isPrimary {
-		for wId := 0; wId < mdb.numWriters; wId++ {
-			wg.Add(1)
-			partShardCh[wId] = make(chan *memdb.ItemEntry, 1000)
-			go func(i int, wg *sync.WaitGroup) {
-				defer wg.Done()
-				for entry := range partShardCh[i] {
-					if !mdb.isPrimary {
-						entryBytes := entry.Item().Bytes()
-						if updated, oldPtr := mdb.back[i].Update(entryBytes, unsafe.Pointer(entry.Node())); updated {
-							oldNode := (*skiplist.Node)(oldPtr)
-							entry.Node().SetLink(oldNode)
-						}
-					}
-				}
-			}(wId, &wg)
+	if mdb.isImmutable {
+		recs, err := loadImmutableLog(snapInfo.dataPath)
+		if err != nil {
+			logging.Warnf("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v unable to "+
+				"load insert times (%v)", mdb.id, mdb.idxInstId, err)
+		}
+		addNode, waitBuild = mdb.newImmutableLogBuilder(numVbuckets, recs)
+		backIndexCallback = func(e *memdb.ItemEntry) {
+			addNode(e.Node())
+		}
+	} else if !mdb.isPrimary {
+		var err error
+		if bil, err = openBackIndex(snapInfo.dataPath, mdb.numWriters, numVbuckets); err == nil {
+			for i := 0; i < mdb.numWriters; i++ {
+				mdb.back[i].Reserve(bil.meta.Counts[i])
+			}
+		} else {
+			logging.Infof("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v rebuilding "+
+				"back index (%v)", mdb.id, mdb.idxInstId, err)
 		}
 
+		// Items restored from delta files are not part of the persisted back index
+		addNode, waitBuild = mdb.newBackIndexBuilder(numVbuckets)
 		backIndexCallback = func(e *memdb.ItemEntry) {
-			wId := vbucketFromEntryBytes(e.Item().Bytes(), numVbuckets) % mdb.numWriters
-			partShardCh[wId] <- e
+			if shard, pos := e.Position(); bil != nil && shard >= 0 {
+				bil.AddNode(shard, pos, e.Node())
+			} else {
+				addNode(e.Node())
+			}
 		}
 	}
 
@@ -819,18 +1182,30 @@ func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) error {
 	concurrency := mdb.sysconf["settings.moi.recovery_threads"].Int()
 	mdb.confLock.RUnlock()
 
-	snap, err := mdb.mainstore.LoadFromDisk(snapInfo.dataPath, concurrency, backIndexCallback)
+	var err error
+	var snap *memdb.Snapshot
+	if mdb.largeKeys != nil {
+		err = mdb.largeKeys.LoadFromDisk(snapInfo.dataPath)
+	}
+	if err == nil {
+		snap, err = mdb.mainstore.LoadFromDisk(snapInfo.dataPath, concurrency, backIndexCallback)
+	}
 
-	if !mdb.isPrimary {
-		for wId := 0; wId < mdb.numWriters; wId++ {
-			close(partShardCh[wId])
+	if waitBuild != nil {
+		waitBuild()
+		if err == nil && bil != nil {
+			if berr := mdb.loadBackIndex(bil); berr != nil {
+				logging.Warnf("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v unable to "+
+					"load back index (%v). Rebuilding.", mdb.id, mdb.idxInstId, berr)
+				mdb.rebuildBackIndex(snap, numVbuckets)
+			}
 		}
-		wg.Wait()
 	}
 
 	dur := time.Since(t0)
 	if err == nil {
 		snapInfo.MainSnap = snap
+		snapInfo.largeKeys = mdb.largeKeys
 		mdb.setCommittedCount()
 		logging.Infof("MemDBSlice::loadSnapshot Slice Id %v, IndexInstId %v finished reading %v. Took %v",
 			mdb.id, mdb.idxInstId, snapInfo.dataPath, dur)
@@ -844,6 +1219,94 @@ func (mdb *memdbSlice) loadSnapshot(snapInfo *memdbSnapshotInfo) error {
 	return err
 }
 
+// newBackIndexBuilder returns a function which routes nodes to back index
+// workers of the slice writers and a function which waits for them to finish
+func (mdb *memdbSlice) newBackIndexBuilder(numVbuckets int) (func(*skiplist.Node), func()) {
+	var wg sync.WaitGroup
+	partShardCh := make([]chan *skiplist.Node, mdb.numWriters)
+
+	for wId := 0; wId < mdb.numWriters; wId++ {
+		wg.Add(1)
+		partShardCh[wId] = make(chan *skiplist.Node, 1000)
+		go func(i int, wg *sync.WaitGroup) {
+			defer wg.Done()
+			for node := range partShardCh[i] {
+				entryBytes := mdb.itemBytes(node)
+				if updated, oldPtr := mdb.back[i].Update(entryBytes, unsafe.Pointer(node)); updated {
+					oldNode := (*skiplist.Node)(oldPtr)
+					node.SetLink(oldNode)
+				}
+			}
+		}(wId, &wg)
+	}
+
+	addNode := func(n *skiplist.Node) {
+		wId := vbucketFromEntryBytes(mdb.itemBytes(n), numVbuckets) % mdb.numWriters
+		partShardCh[wId] <- n
+	}
+
+	wait := func() {
+		for wId := 0; wId < mdb.numWriters; wId++ {
+			close(partShardCh[wId])
+		}
+		wg.Wait()
+	}
+
+	return addNode, wait
+}
+
+// loadBackIndex builds back index tables from the persisted back index
+// using a worker per slice writer
+func (mdb *memdbSlice) loadBackIndex(bil *backIndexLoader) error {
+	var wg sync.WaitGroup
+
+	if err := bil.validate(); err != nil {
+		return err
+	}
+
+	errs := make([]error, mdb.numWriters)
+	for wId := 0; wId < mdb.numWriters; wId++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = bil.Build(i, func(h uint32, node *skiplist.Node) {
+				entryBytes := mdb.itemBytes(node)
+				if updated, oldPtr := mdb.back[i].UpdateWithHash(h, entryBytes, unsafe.Pointer(node)); updated {
+					node.SetLink((*skiplist.Node)(oldPtr))
+				}
+			})
+		}(wId)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildBackIndex discards back index tables and rebuilds them from
+// all items of the snapshot
+func (mdb *memdbSlice) rebuildBackIndex(snap *memdb.Snapshot, numVbuckets int) {
+	for i := 0; i < mdb.numWriters; i++ {
+		mdb.back[i].Close()
+		mdb.back[i] = nodetable.New(hashDocId, nodeEquality)
+	}
+
+	addNode, waitBuild := mdb.newBackIndexBuilder(numVbuckets)
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		node := itr.GetNode()
+		node.SetLink(nil)
+		addNode(node)
+	}
+	itr.Close()
+	waitBuild()
+}
+
 //RollbackToZero rollbacks the slice to initial state. Return error if
 //not possible
 func (mdb *memdbSlice) RollbackToZero() error {
@@ -852,6 +1315,73 @@ func (mdb *memdbSlice) RollbackToZero() error {
 	return nil
 }
 
+//RollbackVbuckets rollbacks the slice to given snapshot and removes
+//all entries of the given vbuckets
+func (mdb *memdbSlice) RollbackVbuckets(info SnapshotInfo, vbs []Vbucket,
+	ts *common.TsVbuuid) (SnapshotInfo, error) {
+
+	if err := mdb.Rollback(info); err != nil {
+		return nil, err
+	}
+
+	mdb.confLock.RLock()
+	numVbuckets := mdb.sysconf["numVbuckets"].Int()
+	mdb.confLock.RUnlock()
+
+	rollback := make([]bool, numVbuckets)
+	for _, vb := range vbs {
+		rollback[vb] = true
+	}
+
+	if mdb.isImmutable {
+		nitems, err := mdb.rollbackImmutableVbuckets(rollback)
+		if err != nil {
+			return nil, err
+		}
+
+		logging.Infof("MemDBSlice::RollbackVbuckets SliceId %v IndexInstId %v Removed %v "+
+			"Entries of %v Vbuckets", mdb.id, mdb.idxInstId, nitems, len(vbs))
+		return mdb.NewSnapshot(ts, true)
+	}
+
+	snap, err := mdb.mainstore.NewSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	//entries of a vbucket are owned by the writer of the vbucket.
+	//writers are idle as the stream is stopped for rollback.
+	var ndocs int
+	itr := snap.NewIterator()
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		docid := itr.Get()
+		if docid == nil {
+			break
+		}
+		if !mdb.isPrimary {
+			docid = docIdFromEntryBytes(docid)
+		}
+
+		if vb := vbucketFromDocId(docid, numVbuckets); rollback[vb] {
+			mdb.delete(append([]byte(nil), docid...), vb%mdb.numWriters)
+			ndocs++
+		}
+	}
+	err = itr.Err()
+	itr.Close()
+	snap.Close()
+
+	if err != nil {
+		mdb.setTierError(err)
+		return nil, err
+	}
+
+	logging.Infof("MemDBSlice::RollbackVbuckets SliceId %v IndexInstId %v Removed %v "+
+		"Entries of %v Vbuckets", mdb.id, mdb.idxInstId, ndocs, len(vbs))
+
+	return mdb.NewSnapshot(ts, true)
+}
+
 //slice insert/delete methods are async. There
 //can be outstanding mutations in internal queue to flush even
 //after insert/delete have return success to caller.
@@ -885,6 +1415,11 @@ func (mdb *memdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotIn
 	mdb.waitPersist()
 	mdb.isDirty = false
 
+	// Buffered mutations are not in the store until bulk load ends
+	if commit && mdb.getBulkLoad() != nil {
+		commit = false
+	}
+
 	snap, err := mdb.mainstore.NewSnapshot()
 	if err == memdb.ErrMaxSnapshotsLimitReached {
 		logging.Warnf("Maximum snapshots limit reached for indexer. Restarting indexer...")
@@ -895,12 +1430,60 @@ func (mdb *memdbSlice) NewSnapshot(ts *common.TsVbuuid, commit bool) (SnapshotIn
 		Ts:        ts,
 		MainSnap:  snap,
 		Committed: commit,
+		largeKeys: mdb.largeKeys,
 	}
 	mdb.setCommittedCount()
 
+	// Keys of buffered mutations are not referenced by the store yet
+	if err == nil && mdb.largeKeys != nil {
+		mdb.largeKeys.newSnapshot(mdb.mainstore, snap, mdb.getBulkLoad() == nil)
+	}
+
+	if err == nil && mdb.sysconf["moi.tiering.enabled"].Bool() {
+		maxBytes := int64(mdb.sysconf["moi.tiering.maxEvictPerRound"].Uint64())
+		// Mutations of the next flush may already be queued to the writers
+		mdb.balanceLock.Lock()
+		err := mdb.mainstore.BalanceMemory(maxBytes)
+		mdb.balanceLock.Unlock()
+		if err != nil {
+			logging.Errorf("MemDBSlice::NewSnapshot SliceId %v IndexInstId %v "+
+				"Unable to balance memory (%v)", mdb.id, mdb.idxInstId, err)
+		}
+		mdb.setTierError(mdb.mainstore.TierError())
+	}
+
+	// Writers purge expired entries along with the next mutations
+	if err == nil && mdb.isImmutable {
+		mdb.triggerImmutablePurge()
+	}
+
 	return newSnapshotInfo, err
 }
 
+// setTierError marks the slice errored once an evicted page could not be
+// read. Writers would have misplaced items compared with it.
+func (mdb *memdbSlice) setTierError(err error) {
+	if err == nil || err == memdb.ErrTieringWithMemoryMgmt {
+		return
+	}
+
+	mdb.tierErrLock.Lock()
+	defer mdb.tierErrLock.Unlock()
+	if mdb.fatalDbErr == nil {
+		logging.Errorf("MemDBSlice SliceId %v IndexInstId %v Unable to read "+
+			"evicted items (%v)", mdb.id, mdb.idxInstId, err)
+		mdb.fatalDbErr = err
+	}
+}
+
+//itemBytes returns the entry of a node, an evicted entry which cannot be
+//read marks the slice errored
+func (mdb *memdbSlice) itemBytes(n *skiplist.Node) []byte {
+	bs, err := (*memdb.Item)(n.Item()).LoadBytes()
+	mdb.setTierError(err)
+	return bs
+}
+
 //checkAllWorkersDone return true if all workers have
 //finished processing
 func (mdb *memdbSlice) checkAllWorkersDone() bool {
@@ -1017,15 +1600,24 @@ func (mdb *memdbSlice) Statistics() (StorageStatistics, error) {
 	var internalData []string
 
 	internalData = append(internalData, fmt.Sprintf("----MainStore----\n%s", mdb.mainstore.DumpStats()))
-	if !mdb.isPrimary {
+	if mdb.hasBackIndex() {
 		for i := 0; i < mdb.numWriters; i++ {
 			internalData = append(internalData, fmt.Sprintf("\n----BackStore[%d]----\n%s", i, mdb.back[i].Stats()))
 		}
 	}
 
+	if mdb.largeKeys != nil {
+		count, size := mdb.largeKeys.Count()
+		internalData = append(internalData, fmt.Sprintf("\n----LargeKeys----\n"+
+			"\nCount = %d\nSize  = %d\n", count, size))
+	}
+
 	sts.InternalData = internalData
 	sts.DataSize = mdb.mainstore.MemoryInUse()
 	sts.DiskSize = mdb.diskSize()
+	if mdb.sysconf["moi.tiering.enabled"].Bool() {
+		sts.DiskSize += mdb.mainstore.TierStats().DiskSize
+	}
 	return sts, nil
 }
 
@@ -1057,7 +1649,7 @@ func tryDeletememdbSlice(mdb *memdbSlice) {
 
 func tryClosememdbSlice(mdb *memdbSlice) {
 	mdb.mainstore.Close()
-	if !mdb.isPrimary {
+	if mdb.hasBackIndex() {
 		for i := 0; i < mdb.numWriters; i++ {
 			mdb.back[i].Close()
 		}
@@ -1265,7 +1857,7 @@ func (s *memdbSnapshot) Iterate(low, high IndexKey, inclusion Inclusion,
 	var entry IndexEntry
 	var err error
 	t0 := time.Now()
-	it := s.info.MainSnap.NewIterator()
+	it := s.newIterator()
 	defer it.Close()
 
 	if low.Bytes() == nil {
@@ -1286,6 +1878,9 @@ func (s *memdbSnapshot) Iterate(low, high IndexKey, inclusion Inclusion,
 loop:
 	for it.Valid() {
 		itm := it.Get()
+		if itm == nil {
+			break loop
+		}
 		entry = s.newIndexEntry(itm)
 
 		// Iterator has reached past the high key, no need to scan further
@@ -1311,7 +1906,7 @@ loop:
 		}
 	}
 
-	return nil
+	return it.Err()
 }
 
 func (s *memdbSnapshot) isPrimary() bool {
@@ -1331,13 +1926,34 @@ func (s *memdbSnapshot) newIndexEntry(b []byte) IndexEntry {
 	return entry
 }
 
-func (s *memdbSnapshot) iterEqualKeys(k IndexKey, it *memdb.Iterator,
+// Iterator over entries of a snapshot, entries of large keys are expanded
+type memdbIterator interface {
+	SeekFirst()
+	Seek([]byte)
+	Valid() bool
+	Get() []byte
+	Next()
+	Close()
+	Err() error
+}
+
+func (s *memdbSnapshot) newIterator() memdbIterator {
+	if s.info.largeKeys != nil {
+		return s.info.largeKeys.NewIterator(s.info.MainSnap)
+	}
+	return s.info.MainSnap.NewIterator()
+}
+
+func (s *memdbSnapshot) iterEqualKeys(k IndexKey, it memdbIterator,
 	cmpFn CmpEntry, callback func([]byte) error) error {
 	var err error
 
 	var entry IndexEntry
 	for ; it.Valid(); it.Next() {
 		itm := it.Get()
+		if itm == nil {
+			break
+		}
 		entry = s.newIndexEntry(itm)
 		if cmpFn(k, entry) == 0 {
 			if callback != nil {
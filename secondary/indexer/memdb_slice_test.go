@@ -1,12 +1,21 @@
 package indexer
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/couchbase/indexing/secondary/collatejson"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
+	"github.com/couchbase/indexing/secondary/memdb"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -171,3 +180,726 @@ func TestMemDBInsertionPerf(t *testing.T) {
 		}
 	}
 }
+
+func TestBulkSources(t *testing.T) {
+	n, nruns := 100000, 8
+	runs := make([][][]byte, nruns)
+	for i := 0; i < n; i++ {
+		r := rand.Intn(nruns)
+		runs[r] = append(runs[r], []byte(fmt.Sprintf("%010d", i)))
+	}
+
+	var items [][]byte
+	sources := newBulkSources(runs, 4)
+	for _, src := range sources {
+		for itm := src(); itm != nil; itm = src() {
+			items = append(items, itm)
+		}
+	}
+
+	if len(items) != n {
+		t.Fatalf("Expected %d items, got %d", n, len(items))
+	}
+
+	for i, itm := range items {
+		if string(itm) != fmt.Sprintf("%010d", i) {
+			t.Fatalf("Expected %010d, got %s", i, itm)
+		}
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	now := time.Date(2016, 5, 1, 12, 30, 0, 0, time.UTC)
+
+	// 12 snapshots, one every 20 minutes, most recent one at now
+	var created []time.Time
+	for i := 11; i >= 0; i-- {
+		created = append(created, now.Add(-time.Duration(i)*20*time.Minute))
+	}
+
+	pinned := make([]bool, len(created))
+	pinned[0] = true
+
+	kept := func(p RetentionPolicy) string {
+		var idx []int
+		for i, keep := range p.Retain(created, pinned, now) {
+			if keep {
+				idx = append(idx, i)
+			}
+		}
+		return fmt.Sprint(idx)
+	}
+
+	cases := []struct {
+		policy   RetentionPolicy
+		expected string
+	}{
+		{RetentionPolicy{Mode: RetainByCount, Count: 3}, "[0 9 10 11]"},
+		{RetentionPolicy{Mode: RetainByAge, MaxAge: 3600}, "[0 8 9 10 11]"},
+		{RetentionPolicy{Mode: RetainHourly, Hours: 2}, "[0 6 9 11]"},
+	}
+
+	for _, c := range cases {
+		if err := c.policy.Validate(); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+
+		if got := kept(c.policy); got != c.expected {
+			t.Errorf("Policy %+v: expected %v, got %v", c.policy, c.expected, got)
+		}
+	}
+
+	if err := (RetentionPolicy{Mode: RetainByCount}).Validate(); err == nil {
+		t.Errorf("Expected error for invalid policy")
+	}
+
+	config := common.SystemConfig.Clone()
+	if err := validateSettings(config); err != nil {
+		t.Errorf("Unexpected error for default settings %v", err)
+	}
+
+	config.SetValue("indexer.settings.recovery.retention.mode", "weekly")
+	if err := validateSettings(config); err == nil {
+		t.Errorf("Expected error for unknown retention mode")
+	}
+}
+
+func TestVbucketRollbackTs(t *testing.T) {
+	snapTs := common.NewTsVbuuid("default", 4)
+	rollbackTs := common.NewTsVbuuid("default", 4)
+	for i := 0; i < 4; i++ {
+		snapTs.Seqnos[i] = 100
+		snapTs.Vbuuids[i] = 1
+		snapTs.Snapshots[i] = [2]uint64{90, 100}
+		rollbackTs.Seqnos[i] = 100
+	}
+	rollbackTs.Seqnos[1] = 50
+	rollbackTs.Seqnos[3] = 99
+
+	vbs := vbucketsToRollback(snapTs, rollbackTs)
+	if fmt.Sprint(vbs) != "[1 3]" {
+		t.Fatalf("Expected vbuckets [1 3], got %v", vbs)
+	}
+
+	ts := vbucketRollbackTs(snapTs, vbs)
+	if fmt.Sprint(ts.Seqnos) != "[100 0 100 0]" || ts.Vbuuids[1] != 0 || ts.Snapshots[3][1] != 0 {
+		t.Fatalf("Unexpected rollback ts %v", ts)
+	}
+
+	if minRestartTs(ts, nil) != nil {
+		t.Errorf("Expected nil restart ts")
+	}
+
+	other := snapTs.Copy()
+	other.Seqnos[2] = 10
+	if m := minRestartTs(ts, other); fmt.Sprint(m.Seqnos) != "[100 0 10 0]" {
+		t.Errorf("Unexpected min restart ts %v", m.Seqnos)
+	}
+}
+
+func TestRollbackVbuckets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdbrollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	numVbuckets := 8
+	stats := &IndexStats{}
+	stats.Init()
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("numSliceWriters", 1)
+	cfg.SetValue("numVbuckets", numVbuckets)
+	idxDefn := common.IndexDefn{DefnId: common.IndexDefnId(0)}
+	slice, err := NewMemDBSlice(dir, SliceId(0), idxDefn, common.IndexInstId(0),
+		false, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slice.Close()
+
+	insert := func(prefix string, n int) {
+		for i := 0; i < n; i++ {
+			docid := []byte(fmt.Sprintf("%v-%d", prefix, i))
+			slice.insert([]byte(fmt.Sprintf("[\"key-%d\"]", i)), docid, docPos{}, 0)
+		}
+	}
+
+	docids := func() map[string]bool {
+		snap, err := slice.mainstore.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		ids := make(map[string]bool)
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			ids[string(docIdFromEntryBytes(itr.Get()))] = true
+		}
+		itr.Close()
+		return ids
+	}
+
+	//persist a snapshot of the initial documents
+	insert("docid", 100)
+	snapTs := common.NewTsVbuuid("default", numVbuckets)
+	for vb := 0; vb < numVbuckets; vb++ {
+		snapTs.Seqnos[vb] = 100
+		snapTs.Vbuuids[vb] = 1
+	}
+	info, err := slice.NewSnapshot(snapTs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := slice.OpenSnapshot(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	var infos []SnapshotInfo
+	for i := 0; i < 100 && len(infos) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		infos, _ = slice.GetSnapshots()
+	}
+	if len(infos) != 1 {
+		t.Fatalf("Expected a disk snapshot, got %v", len(infos))
+	}
+
+	//mutations past the snapshot are lost by the rollback
+	insert("newdoc", 20)
+
+	rollbackTs := snapTs.Copy()
+	rollbackTs.Seqnos[1], rollbackTs.Seqnos[3] = 50, 50
+	vbs := vbucketsToRollback(infos[0].Timestamp(), rollbackTs)
+	ts := vbucketRollbackTs(infos[0].Timestamp(), vbs)
+	newInfo, err := slice.RollbackVbuckets(infos[0], vbs, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqnos := newInfo.Timestamp().Seqnos; seqnos[1] != 0 || seqnos[3] != 0 ||
+		seqnos[0] != 100 {
+		t.Errorf("Unexpected rollback timestamp %v", seqnos)
+	}
+
+	expected := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		docid := fmt.Sprintf("docid-%d", i)
+		if vb := vbucketFromDocId([]byte(docid), numVbuckets); vb != 1 && vb != 3 {
+			expected[docid] = true
+		}
+	}
+	if len(expected) == 0 || len(expected) == 100 {
+		t.Fatalf("Expected documents in rolled back and surviving vbuckets")
+	}
+
+	got := docids()
+	if len(got) != len(expected) {
+		t.Errorf("Expected %v entries, got %v", len(expected), len(got))
+	}
+	for docid := range got {
+		if !expected[docid] {
+			t.Errorf("Unexpected entry %v", docid)
+		}
+	}
+}
+
+func TestImmutableSlice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdbimmutable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	stats := &IndexStats{}
+	stats.Init()
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("numSliceWriters", 1)
+	cfg.SetValue("settings.immutable.fast_path", true)
+	idxDefn := common.IndexDefn{DefnId: common.IndexDefnId(0), Immutable: true}
+
+	//fast path is not used without ttl
+	noTTL, err := NewMemDBSlice(filepath.Join(dir, "nottl"), SliceId(0), idxDefn,
+		common.IndexInstId(1), false, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noTTL.isImmutable {
+		t.Errorf("Expected no immutable fast path without ttl")
+	}
+	noTTL.Close()
+
+	cfg.SetValue("settings.immutable.ttl", uint64(3600))
+	slice, err := NewMemDBSlice(dir, SliceId(0), idxDefn, common.IndexInstId(0),
+		false, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slice.Close()
+
+	if !slice.isImmutable || slice.back != nil {
+		t.Fatalf("Expected immutable slice without back index")
+	}
+
+	countItems := func() int {
+		snap, err := slice.mainstore.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		n := 0
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			n++
+		}
+		itr.Close()
+		return n
+	}
+
+	for i := 0; i < 3; i++ {
+		docid := []byte(fmt.Sprintf("docid-%d", i))
+		slice.insert([]byte(fmt.Sprintf("[\"key-%d\"]", i)), docid, docPos{}, 0)
+	}
+	slice.insert([]byte("[\"key-3\"]"), []byte("docid-1"), docPos{}, 0)
+	slice.insert([]byte("[\"key-3\"]"), []byte("docid-1"), docPos{}, 0)
+	slice.delete([]byte("docid-0"), 0)
+
+	if n := countItems(); n != 4 {
+		t.Errorf("Expected 4 items, got %v", n)
+	}
+	if n := stats.numImmutableUpdates.Value(); n != 1 {
+		t.Errorf("Expected 1 update, got %v", n)
+	}
+	if n := stats.numWritesSkipped.Value(); n != 1 {
+		t.Errorf("Expected 1 skipped write, got %v", n)
+	}
+	if n := stats.numDeletesSkipped.Value(); n != 1 {
+		t.Errorf("Expected 1 skipped delete, got %v", n)
+	}
+
+	//insert times are kept across recovery
+	logged := slice.ilog[0].freeze()
+	slice.ilog[0].thaw()
+	if len(logged) != 1 || len(logged[0].nodes) != 4 {
+		t.Fatalf("Expected 4 logged items in a chunk")
+	}
+	if err := slice.storeImmutableLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	recs, err := loadImmutableLog(dir)
+	if err != nil || len(recs) != 4 {
+		t.Fatalf("Expected 4 insert times, got %v (%v)", len(recs), err)
+	}
+
+	ilog := slice.ilog[0]
+	slice.ilog[0] = &immutableLog{}
+	addNode, waitBuild := slice.newImmutableLogBuilder(1024, recs)
+	for _, ptr := range logged[0].nodes {
+		addNode((*skiplist.Node)(ptr))
+	}
+	waitBuild()
+	if chunks := slice.ilog[0].chunks; len(chunks) != 1 || len(chunks[0].nodes) != 4 ||
+		!chunks[0].newest.Equal(logged[0].newest) {
+		t.Errorf("Expected insert times to be restored")
+	}
+	if it := recs.insertTime([]byte("unknown")); !it.IsZero() {
+		t.Errorf("Expected no insert time of unknown entry, got %v", it)
+	}
+	slice.ilog[0] = ilog
+
+	//no purge while the log is read
+	slice.ilog[0].freeze()
+	if n := slice.ilog[0].purge(time.Now().Add(time.Hour), slice.main[0]); n != 0 {
+		t.Errorf("Expected no purged items while frozen, got %v", n)
+	}
+	slice.ilog[0].thaw()
+
+	if n := slice.ilog[0].purge(time.Now().Add(-time.Hour), slice.main[0]); n != 0 {
+		t.Errorf("Expected no purged items, got %v", n)
+	}
+	if n := slice.ilog[0].purge(time.Now().Add(time.Hour), slice.main[0]); n != 4 {
+		t.Errorf("Expected 4 purged items, got %v", n)
+	}
+	if n := countItems(); n != 0 {
+		t.Errorf("Expected 0 items, got %v", n)
+	}
+}
+
+func TestLargeKeyIterator(t *testing.T) {
+	long := strings.Repeat("x", MAX_SEC_KEY_BUFFER_LEN)
+	keys := []string{
+		`["a"]`,
+		`["` + long + `c"]`,
+		`["` + long + `a"]`,
+		`["` + long + `"]`,
+		`["` + long + `b","z"]`,
+		`["y"]`,
+	}
+
+	cfg := memdb.DefaultConfig()
+	cfg.SetKeyComparator(byteItemCompare)
+	db := memdb.NewWithConfig(cfg)
+	defer db.Close()
+
+	store := newLargeKeyStore()
+	w := db.NewWriter()
+	buf := make([]byte, 0, maxIndexEntrySize)
+	for i, k := range keys {
+		docid := []byte(fmt.Sprintf("doc-%d", i))
+		e, err := newSecondaryIndexEntry([]byte(k), docid, false, 1, buf, store)
+		if err != nil {
+			t.Fatalf("Unable to create entry for key %d (%v)", i, err)
+		}
+		if isLarge := len(k) > largeKeyPrefixLen; e.isLargeKey() != isLarge ||
+			isLarge && len(e) > largeKeyPrefixLen+largeKeySlotLen+len(docid)+2 {
+			t.Errorf("Unexpected encoding of key %d (%d bytes)", i, len(e))
+		}
+		if d := docIdFromEntryBytes(e); !bytes.Equal(d, docid) {
+			t.Errorf("Expected docid %s, got %s", docid, d)
+		}
+		w.Put(e)
+	}
+
+	if n, _ := store.Count(); n != 4 {
+		t.Errorf("Expected 4 large keys, got %d", n)
+	}
+
+	snap, _ := db.NewSnapshot()
+	defer snap.Close()
+
+	sorted := []int{0, 3, 2, 4, 1, 5}
+	var got []int
+	it := store.NewIterator(snap)
+	for it.SeekFirst(); it.Valid(); it.Next() {
+		e := secondaryIndexEntry(it.Get())
+		sk, err := e.ReadSecKey(make([]byte, 0, MAX_LARGE_SEC_KEY_BUFFER_LEN))
+		if err != nil {
+			t.Fatalf("Unable to read key (%v)", err)
+		}
+		docid, _ := e.ReadDocId(nil)
+
+		var i int
+		fmt.Sscanf(string(docid), "doc-%d", &i)
+		if string(sk) != keys[i] {
+			t.Errorf("Unexpected key for %s", docid)
+		}
+		got = append(got, i)
+	}
+	it.Close()
+
+	if fmt.Sprint(got) != fmt.Sprint(sorted) {
+		t.Errorf("Expected order %v, got %v", sorted, got)
+	}
+
+	// Seek to a large key in the middle of entries sharing the prefix
+	seek, _ := NewSecondaryKey([]byte(`["`+long+`b"]`), make([]byte, 0, MAX_SEC_KEY_BUFFER_LEN))
+	it = store.NewIterator(snap)
+	it.Seek(seek.Bytes())
+	if !it.Valid() || !bytes.HasSuffix(it.Get(), entryBytesFromDocId([]byte("doc-4"))) {
+		t.Errorf("Seek did not return doc-4")
+	}
+	it.Close()
+
+	dir, _ := ioutil.TempDir("", "largekeys")
+	defer os.RemoveAll(dir)
+	if err := store.StoreToDisk(dir); err != nil {
+		t.Fatalf("Unable to store large keys (%v)", err)
+	}
+
+	loaded := newLargeKeyStore()
+	if err := loaded.LoadFromDisk(dir); err != nil {
+		t.Fatalf("Unable to load large keys (%v)", err)
+	}
+	for slot, lk := range store.keys {
+		if key, err := loaded.get(slot); err != nil || !bytes.Equal(key, lk.key) {
+			t.Errorf("Large key of slot %v not restored", slot)
+		}
+	}
+
+	//reload replaces keys of the same slots
+	if err := loaded.LoadFromDisk(dir); err != nil {
+		t.Fatalf("Unable to load large keys (%v)", err)
+	}
+	if n, sz := loaded.Count(); n != len(store.keys) || sz != store.size {
+		t.Errorf("Expected %d keys of %d bytes, got %d keys of %d bytes",
+			len(store.keys), store.size, n, sz)
+	}
+
+	huge := []byte(`["` + strings.Repeat("x", maxLargeKeyLen()) + `"]`)
+	if _, err := newSecondaryIndexEntry(huge, []byte("doc"), false, 1, buf, store); err != ErrLargeSecKeyTooLong {
+		t.Errorf("Expected key beyond max_large_seckey_size to be rejected, got %v", err)
+	}
+}
+
+func TestSkipUnchangedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdbskip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newSlice := func(name string, isArray bool) (*memdbSlice, *IndexStats) {
+		stats := &IndexStats{}
+		stats.Init()
+		cfg := common.SystemConfig.SectionConfig("indexer.", true)
+		cfg.SetValue("numSliceWriters", 1)
+		idxDefn := common.IndexDefn{DefnId: common.IndexDefnId(0), IsArrayIndex: isArray}
+		slice, err := NewMemDBSlice(filepath.Join(dir, name), SliceId(0), idxDefn,
+			common.IndexInstId(0), false, cfg, stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isArray {
+			//array expression is the first of the keys
+			slice.arrayExprPosition = 0
+			slice.isArrayDistinct = true
+		}
+		return slice, stats
+	}
+
+	entries := func(slice *memdbSlice) []string {
+		snap, err := slice.mainstore.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		var es []string
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			es = append(es, string(itr.Get()))
+		}
+		itr.Close()
+		return es
+	}
+
+	//regular index
+	slice, stats := newSlice("regular", false)
+	defer slice.Close()
+
+	slice.insert([]byte("[\"key-1\"]"), []byte("docid-1"), docPos{}, 0)
+	before := entries(slice)
+	if nmut := slice.insert([]byte("[\"key-1\"]"), []byte("docid-1"), docPos{}, 0); nmut != 0 {
+		t.Errorf("Expected unchanged key to be skipped, got %v mutations", nmut)
+	}
+	if n := stats.numWritesSkipped.Value(); n != 1 {
+		t.Errorf("Expected 1 skipped write, got %v", n)
+	}
+	if after := entries(slice); len(after) != 1 || after[0] != before[0] {
+		t.Errorf("Expected the entry to be kept, got %v", after)
+	}
+
+	slice.insert([]byte("[\"key-2\"]"), []byte("docid-1"), docPos{}, 0)
+	if n := stats.numWritesSkipped.Value(); n != 1 {
+		t.Errorf("Expected changed key to be written, got %v skipped writes", n)
+	}
+	if after := entries(slice); len(after) != 1 || after[0] == before[0] ||
+		string(docIdFromEntryBytes([]byte(after[0]))) != "docid-1" {
+		t.Errorf("Expected the entry to be replaced, got %v", after)
+	}
+
+	//array index
+	arrSlice, arrStats := newSlice("array", true)
+	defer arrSlice.Close()
+
+	codec := collatejson.NewCodec(16)
+	arrayKey := func(json string) []byte {
+		key, err := codec.Encode([]byte(json), make([]byte, 0, 1024))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	arrSlice.insert(arrayKey(`[["a","b"]]`), []byte("docid-1"), docPos{}, 0)
+	before = entries(arrSlice)
+	if len(before) != 2 {
+		t.Fatalf("Expected 2 array entries, got %v", len(before))
+	}
+	if nmut := arrSlice.insert(arrayKey(`[["a","b"]]`), []byte("docid-1"), docPos{}, 0); nmut != 0 {
+		t.Errorf("Expected unchanged array key to be skipped, got %v mutations", nmut)
+	}
+	if n := arrStats.numWritesSkipped.Value(); n != 1 {
+		t.Errorf("Expected 1 skipped array write, got %v", n)
+	}
+	if after := entries(arrSlice); len(after) != 2 || after[0] != before[0] || after[1] != before[1] {
+		t.Errorf("Expected the array entries to be kept, got %v", len(after))
+	}
+
+	//the back index still refers to the entries once the write is skipped
+	arrSlice.insert(arrayKey(`[["b","c"]]`), []byte("docid-1"), docPos{}, 0)
+	if n := arrStats.numWritesSkipped.Value(); n != 1 {
+		t.Errorf("Expected changed array key to be written, got %v skipped writes", n)
+	}
+	after := entries(arrSlice)
+	if len(after) != 2 || after[0] != before[1] {
+		t.Errorf("Expected entry of b to be kept and a to be replaced by c, got %v", len(after))
+	}
+	for _, e := range after {
+		if string(docIdFromEntryBytes([]byte(e))) != "docid-1" {
+			t.Errorf("Unexpected entry of %s", docIdFromEntryBytes([]byte(e)))
+		}
+	}
+
+	arrSlice.delete([]byte("docid-1"), 0)
+	if after := entries(arrSlice); len(after) != 0 {
+		t.Errorf("Expected array entries to be deleted, got %v", len(after))
+	}
+}
+
+func TestBackIndexPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdbbackindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	numVbuckets, numWriters := 8, 2
+	stats := &IndexStats{}
+	stats.Init()
+	cfg := common.SystemConfig.SectionConfig("indexer.", true)
+	cfg.SetValue("numSliceWriters", numWriters)
+	cfg.SetValue("numVbuckets", numVbuckets)
+	idxDefn := common.IndexDefn{DefnId: common.IndexDefnId(0)}
+	slice, err := NewMemDBSlice(dir, SliceId(0), idxDefn, common.IndexInstId(0),
+		false, cfg, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slice.Close()
+
+	writerOf := func(docid string) int {
+		return vbucketFromDocId([]byte(docid), numVbuckets) % numWriters
+	}
+
+	insert := func(prefix, key string, n int) {
+		for i := 0; i < n; i++ {
+			docid := fmt.Sprintf("%v-%d", prefix, i)
+			slice.insert([]byte(fmt.Sprintf("[\"%v-%d\"]", key, i)), []byte(docid),
+				docPos{}, writerOf(docid))
+		}
+	}
+
+	countItems := func() int {
+		snap, err := slice.mainstore.NewSnapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer snap.Close()
+
+		n := 0
+		itr := snap.NewIterator()
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			n++
+		}
+		itr.Close()
+		return n
+	}
+
+	//every docid of the snapshot is found in the back index of its writer
+	checkBackIndex := func(name string) {
+		for i := 0; i < 100; i++ {
+			docid := fmt.Sprintf("docid-%d", i)
+			ptr := slice.back[writerOf(docid)].Get(entryBytesFromDocId([]byte(docid)))
+			if ptr == nil {
+				t.Fatalf("%v: expected back index entry of %v", name, docid)
+			}
+			entry := (*memdb.Item)((*skiplist.Node)(ptr).Item()).Bytes()
+			if string(docIdFromEntryBytes(entry)) != docid {
+				t.Fatalf("%v: expected entry of %v, got %s", name, docid, docIdFromEntryBytes(entry))
+			}
+		}
+		for w := 0; w < numWriters; w++ {
+			if ptr := slice.back[w].Get(entryBytesFromDocId([]byte("newdoc-0"))); ptr != nil {
+				t.Errorf("%v: unexpected back index entry of newdoc-0", name)
+			}
+		}
+		if n := countItems(); n != 100 {
+			t.Errorf("%v: expected 100 items, got %v", name, n)
+		}
+	}
+
+	insert("docid", "key", 100)
+	snapTs := common.NewTsVbuuid("default", numVbuckets)
+	info, err := slice.NewSnapshot(snapTs, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap, err := slice.OpenSnapshot(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snap.Close()
+
+	var infos []SnapshotInfo
+	for i := 0; i < 100 && len(infos) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		infos, _ = slice.GetSnapshots()
+	}
+	if len(infos) != 1 {
+		t.Fatalf("Expected a disk snapshot, got %v", len(infos))
+	}
+	dataPath := infos[0].(*memdbSnapshotInfo).dataPath
+
+	rollback := func() {
+		infos, err := slice.GetSnapshots()
+		if err != nil || len(infos) != 1 {
+			t.Fatalf("Expected a disk snapshot, got %v (%v)", len(infos), err)
+		}
+		if err := slice.Rollback(infos[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bil, err := openBackIndex(dataPath, numWriters, numVbuckets)
+	if err != nil {
+		t.Fatalf("Expected a persisted back index, got %v", err)
+	}
+	var total int
+	for _, count := range bil.meta.Counts {
+		total += count
+	}
+	if total != 100 {
+		t.Errorf("Expected 100 back index records, got %v", total)
+	}
+
+	//round trip through the persisted back index
+	insert("newdoc", "key", 10)
+	rollback()
+	checkBackIndex("loaded")
+
+	//updates of loaded documents replace their entries
+	insert("docid", "newkey", 100)
+	if n := countItems(); n != 100 {
+		t.Errorf("Expected updates to replace entries, got %v items", n)
+	}
+
+	//back index with a bad checksum is rebuilt from the snapshot
+	shard := backIndexFile(dataPath, 0)
+	bs, err := ioutil.ReadFile(shard)
+	if err != nil || len(bs) == 0 {
+		t.Fatalf("Expected back index records, got %v (%v)", len(bs), err)
+	}
+	bs[0] ^= 0xff
+	if err := ioutil.WriteFile(shard, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rollback()
+	checkBackIndex("bad checksum")
+
+	//back index of a different shard layout is rebuilt as well
+	bs[0] ^= 0xff
+	if err := ioutil.WriteFile(shard, bs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	bil.meta.NumShards = 0
+	metabs, _ := json.Marshal(bil.meta)
+	metafile := filepath.Join(dataPath, backIndexDirName, backIndexMetaFile)
+	if err := ioutil.WriteFile(metafile, metabs, 0644); err != nil {
+		t.Fatal(err)
+	}
+	rollback()
+	checkBackIndex("shard mismatch")
+}
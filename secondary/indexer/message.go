@@ -65,6 +65,7 @@ const (
 	STORAGE_INDEX_STORAGE_STATS
 	STORAGE_INDEX_COMPACT
 	STORAGE_SNAP_DONE
+	STORAGE_INDEX_DISK_SNAPSHOTS
 
 	//KVSender
 	KV_SENDER_SHUTDOWN
@@ -110,6 +111,9 @@ const (
 	INDEXER_PREPARE_UNPAUSE
 	INDEXER_UNPAUSE
 	INDEXER_BOOTSTRAP
+	INDEXER_PAUSE_INDEX
+	INDEXER_RESUME_INDEX
+	INDEXER_REPLAY_STREAM
 
 	//SCAN COORDINATOR
 	SCAN_COORD_SHUTDOWN
@@ -133,6 +137,7 @@ const (
 	SCAN_STATS
 	INDEX_PROGRESS_STATS
 	INDEXER_STATS
+	DATAPORT_STATS
 
 	STATS_RESET
 	REPAIR_ABORT
@@ -890,12 +895,13 @@ func (m *MsgRepairEndpoints) String() string {
 //INDEXER_RECOVERY_DONE
 //INDEXER_BUCKET_NOT_FOUND
 type MsgRecovery struct {
-	mType     MsgType
-	streamId  common.StreamId
-	bucket    string
-	restartTs *common.TsVbuuid
-	buildTs   Timestamp
-	activeTs  *common.TsVbuuid
+	mType       MsgType
+	streamId    common.StreamId
+	bucket      string
+	restartTs   *common.TsVbuuid
+	buildTs     Timestamp
+	activeTs    *common.TsVbuuid
+	bucketFlush bool
 }
 
 func (m *MsgRecovery) GetMsgType() MsgType {
@@ -922,10 +928,15 @@ func (m *MsgRecovery) GetBuildTs() Timestamp {
 	return m.buildTs
 }
 
+func (m *MsgRecovery) IsBucketFlush() bool {
+	return m.bucketFlush
+}
+
 type MsgRollback struct {
-	streamId   common.StreamId
-	bucket     string
-	rollbackTs *common.TsVbuuid
+	streamId    common.StreamId
+	bucket      string
+	rollbackTs  *common.TsVbuuid
+	bucketFlush bool
 }
 
 func (m *MsgRollback) GetMsgType() MsgType {
@@ -944,6 +955,11 @@ func (m *MsgRollback) GetRollbackTs() *common.TsVbuuid {
 	return m.rollbackTs
 }
 
+//IsBucketFlush returns true if the rollback is due to a flush of the bucket
+func (m *MsgRollback) IsBucketFlush() bool {
+	return m.bucketFlush
+}
+
 type MsgRepairAbort struct {
 	streamId common.StreamId
 	bucket   string
@@ -1042,6 +1058,37 @@ func (m *MsgIndexCompact) GetAbortTime() time.Time {
 	return m.abortTime
 }
 
+//STORAGE_INDEX_DISK_SNAPSHOTS
+//lists retained disk snapshots of an index (all indexes if instId
+//is 0). If snapshotId is set, the snapshot is pinned or unpinned.
+//If setPolicy is set, policy overrides the retention policy of the
+//index (nil restores the configured policy).
+type MsgIndexDiskSnapshots struct {
+	instId     common.IndexInstId
+	snapshotId string
+	pin        bool
+	setPolicy  bool
+	policy     *RetentionPolicy
+	errch      chan error
+	respch     chan []IndexDiskSnapshots
+}
+
+func (m *MsgIndexDiskSnapshots) GetMsgType() MsgType {
+	return STORAGE_INDEX_DISK_SNAPSHOTS
+}
+
+func (m *MsgIndexDiskSnapshots) GetInstId() common.IndexInstId {
+	return m.instId
+}
+
+func (m *MsgIndexDiskSnapshots) GetErrorChannel() chan error {
+	return m.errch
+}
+
+func (m *MsgIndexDiskSnapshots) GetReplyChannel() chan []IndexDiskSnapshots {
+	return m.respch
+}
+
 //KV_STREAM_REPAIR
 type MsgKVStreamRepair struct {
 	streamId  common.StreamId
@@ -1164,6 +1211,76 @@ func (m *MsgIndexerState) GetMsgType() MsgType {
 	return m.mType
 }
 
+//INDEXER_PAUSE_INDEX
+//INDEXER_RESUME_INDEX
+type MsgIndexMaintenance struct {
+	mType  MsgType
+	instId common.IndexInstId
+	bucket string
+	respCh MsgChannel
+}
+
+func (m *MsgIndexMaintenance) GetMsgType() MsgType {
+	return m.mType
+}
+
+func (m *MsgIndexMaintenance) GetIndexInstId() common.IndexInstId {
+	return m.instId
+}
+
+func (m *MsgIndexMaintenance) GetBucket() string {
+	return m.bucket
+}
+
+func (m *MsgIndexMaintenance) GetResponseChannel() MsgChannel {
+	return m.respCh
+}
+
+func (m *MsgIndexMaintenance) GetString() string {
+
+	str := "\n\tMessage: MsgIndexMaintenance"
+	str += fmt.Sprintf("\n\tType: %v", m.mType)
+	str += fmt.Sprintf("\n\tIndex: %v", m.instId)
+	return str
+}
+
+//INDEXER_REPLAY_STREAM
+type MsgReplayStream struct {
+	streamId common.StreamId
+	path     string
+	realtime bool
+	respCh   MsgChannel
+}
+
+func (m *MsgReplayStream) GetMsgType() MsgType {
+	return INDEXER_REPLAY_STREAM
+}
+
+func (m *MsgReplayStream) GetStreamId() common.StreamId {
+	return m.streamId
+}
+
+func (m *MsgReplayStream) GetPath() string {
+	return m.path
+}
+
+func (m *MsgReplayStream) GetRealtime() bool {
+	return m.realtime
+}
+
+func (m *MsgReplayStream) GetResponseChannel() MsgChannel {
+	return m.respCh
+}
+
+func (m *MsgReplayStream) String() string {
+
+	str := "\n\tMessage: MsgReplayStream"
+	str += fmt.Sprintf("\n\tStream: %v", m.streamId)
+	str += fmt.Sprintf("\n\tPath: %v", m.path)
+	str += fmt.Sprintf("\n\tRealtime: %v", m.realtime)
+	return str
+}
+
 //Helper function to return string for message type
 
 func (m MsgType) String() string {
@@ -1277,6 +1394,12 @@ func (m MsgType) String() string {
 		return "INDEXER_UNPAUSE"
 	case INDEXER_BOOTSTRAP:
 		return "INDEXER_BOOTSTRAP"
+	case INDEXER_PAUSE_INDEX:
+		return "INDEXER_PAUSE_INDEX"
+	case INDEXER_RESUME_INDEX:
+		return "INDEXER_RESUME_INDEX"
+	case INDEXER_REPLAY_STREAM:
+		return "INDEXER_REPLAY_STREAM"
 
 	case SCAN_COORD_SHUTDOWN:
 		return "SCAN_COORD_SHUTDOWN"
@@ -1340,6 +1463,8 @@ func (m MsgType) String() string {
 		return "STORAGE_INDEX_COMPACT"
 	case STORAGE_SNAP_DONE:
 		return "STORAGE_SNAP_DONE"
+	case STORAGE_INDEX_DISK_SNAPSHOTS:
+		return "STORAGE_INDEX_DISK_SNAPSHOTS"
 
 	case CONFIG_SETTINGS_UPDATE:
 		return "CONFIG_SETTINGS_UPDATE"
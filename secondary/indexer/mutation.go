@@ -21,6 +21,10 @@ type MutationMeta struct {
 	vbucket Vbucket //vbucket
 	vbuuid  Vbuuid  //uuid for vbucket
 	seqno   Seqno   //vbucket sequence number for this mutation
+
+	recvTime  int64          //unix nano time received from dataport
+	queueTime int64          //unix nano time enqueued in mutation queue
+	trace     *MutationTrace //sampled mutation trace, optional
 }
 
 var mutMetaPool = sync.Pool{New: newMutationMeta}
@@ -44,19 +48,23 @@ func (m *MutationMeta) Clone() *MutationMeta {
 	meta.vbucket = m.vbucket
 	meta.vbuuid = m.vbuuid
 	meta.seqno = m.seqno
+	meta.recvTime = m.recvTime
+	meta.queueTime = m.queueTime
+	meta.trace = m.trace
 	return meta
 }
 
 func (m *MutationMeta) Size() int64 {
 
 	size := int64(len(m.bucket))
-	size += 8 + 4 + 8 + 8 //fixed cost of members
+	size += 8 + 4 + 8 + 8 + 8 + 8 + 8 //fixed cost of members
 	return size
 
 }
 
 func (m *MutationMeta) Free() {
 	if useMutationSyncPool {
+		m.recvTime, m.queueTime, m.trace = 0, 0, nil
 		mutMetaPool.Put(m)
 	}
 }
@@ -11,10 +11,13 @@ package indexer
 
 import (
 	"errors"
+	"fmt"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/platform"
+	"os"
 	"sync"
+	"time"
 )
 
 //MutationManager handles messages from Indexer to manage Mutation Streams
@@ -62,6 +65,9 @@ type mutationMgr struct {
 
 	config common.Config
 	stats  IndexerStatsHolder
+
+	flushPrio  *flushPriorities //parsed on config update
+	flushSched *flushScheduler  //used by flushers if flush priorities are configured
 }
 
 //NewMutationManager creates a new Mutation Manager which listens for commands from
@@ -95,8 +101,13 @@ func NewMutationManager(supvCmdch MsgChannel, supvRespch MsgChannel,
 		config:                 config,
 		memUsed:                platform.NewAlignedInt64(0),
 		maxMemory:              platform.NewAlignedInt64(0),
+		flushPrio:              newFlushPriorities(config),
+		flushSched:             newFlushScheduler(config),
 	}
 
+	//spilled mutations of a previous run are not recoverable
+	cleanupMutationQueueSpill(config)
+
 	//start Mutation Manager loop which listens to commands from its supervisor
 	go m.run()
 
@@ -300,6 +311,12 @@ func (m *mutationMgr) handleSupervisorCommands(cmd Message) {
 	case INDEXER_RESUME:
 		m.handleIndexerResume(cmd)
 
+	case INDEXER_REPLAY_STREAM:
+		m.handleReplayStream(cmd)
+
+	case DATAPORT_STATS:
+		m.handleStats(cmd)
+
 	default:
 		logging.Fatalf("MutationMgr::handleSupervisorCommands Received Unknown Command %v", cmd)
 		common.CrashOnError(errors.New("Unknown Command On Supervisor Channel"))
@@ -665,6 +682,76 @@ func (m *mutationMgr) handleCloseStream(cmd Message) {
 
 }
 
+//handleReplayStream starts feeding a dataport recording into the
+//reader of an open stream. Replay runs in the background till the
+//recording is exhausted or the stream is closed.
+func (m *mutationMgr) handleReplayStream(cmd Message) {
+
+	logging.Infof("MutationMgr::handleReplayStream %v", cmd)
+
+	streamId := cmd.(*MsgReplayStream).GetStreamId()
+	path := cmd.(*MsgReplayStream).GetPath()
+	realtime := cmd.(*MsgReplayStream).GetRealtime()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	reader, ok := m.streamReaderMap[streamId]
+	if !ok {
+		logging.Errorf("MutationMgr::handleReplayStream Stream "+
+			"Not Open %v", streamId)
+
+		m.supvCmdch <- &MsgError{
+			err: Error{code: ERROR_MUT_MGR_STREAM_ALREADY_CLOSED,
+				severity: NORMAL,
+				category: MUTATION_MANAGER,
+				cause:    fmt.Errorf("Stream %v is not open", streamId)}}
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		m.supvCmdch <- &MsgError{
+			err: Error{code: ERROR_MUT_MGR_INTERNAL_ERROR,
+				severity: NORMAL,
+				category: MUTATION_MANAGER,
+				cause:    err}}
+		return
+	}
+
+	go reader.Replay(path, realtime)
+
+	m.supvCmdch <- &MsgSuccess{}
+}
+
+//handleStats updates statistics of the dataport connections of
+//each stream
+func (m *mutationMgr) handleStats(cmd Message) {
+	m.supvCmdch <- &MsgSuccess{}
+
+	req := cmd.(*MsgStatsRequest)
+	replych := req.GetReplyChannel()
+	stats := m.stats.Get()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for streamId, st := range stats.streams {
+		var conns []interface{}
+		if reader, ok := m.streamReaderMap[streamId]; ok {
+			dstats, err := reader.GetStatistics()
+			if err != nil {
+				logging.Errorf("MutationMgr::handleStats Stream %v. Error %v", streamId, err)
+			}
+			for _, v := range dstats {
+				conns = append(conns, v)
+			}
+		}
+		st.Set(conns)
+	}
+
+	replych <- true
+}
+
 //handleCleanupStream cleans up an already closed stream.
 //This handles the case when a MutationStreamReader closes
 //abruptly. This method can be used to clean up internal
@@ -832,7 +919,15 @@ func (m *mutationMgr) handlePersistMutationQueue(cmd Message) {
 
 	q := m.streamBucketQueueMap[streamId][bucket]
 	stats := m.stats.Get()
-	go m.persistMutationQueue(q, streamId, bucket, ts, changeVec, stats)
+
+	var sched *flushScheduler
+	var priorities map[common.IndexInstId]flushPriority
+	if !m.flushPrio.isEmpty() {
+		sched = m.flushSched
+		priorities = m.flushPrio.indexPriorities(streamId, bucket, m.indexInstMap)
+	}
+
+	go m.persistMutationQueue(q, streamId, bucket, ts, changeVec, sched, priorities, stats)
 	m.supvCmdch <- &MsgSuccess{}
 
 }
@@ -840,7 +935,8 @@ func (m *mutationMgr) handlePersistMutationQueue(cmd Message) {
 //persistMutationQueue implements the actual persist for the queue
 func (m *mutationMgr) persistMutationQueue(q IndexerMutationQueue,
 	streamId common.StreamId, bucket string, ts *common.TsVbuuid,
-	changeVec []bool, stats *IndexerStats) {
+	changeVec []bool, sched *flushScheduler,
+	priorities map[common.IndexInstId]flushPriority, stats *IndexerStats) {
 
 	m.flock.Lock()
 	defer m.flock.Unlock()
@@ -852,13 +948,19 @@ func (m *mutationMgr) persistMutationQueue(q IndexerMutationQueue,
 	go func(config common.Config) {
 		defer m.flusherWaitGroup.Done()
 
+		t0 := time.Now()
 		flusher := NewFlusher(config, stats)
+		flusher.sched, flusher.priorities = sched, priorities
 		sts := getSeqTsFromTsVbuuid(ts)
 		msgch := flusher.PersistUptoTS(q.queue, streamId, ts.Bucket,
 			m.indexInstMap, m.indexPartnMap, sts, changeVec, stopch)
 		//wait for flusher to finish
 		msg := <-msgch
 
+		if bucketStats, ok := stats.buckets[bucket]; ok {
+			bucketStats.flushLatency.Put(time.Since(t0))
+		}
+
 		//update map and free lock before blocking on the supv channel
 		func() {
 			m.flock.Lock()
@@ -1059,6 +1161,10 @@ func (m *mutationMgr) handleConfigUpdate(cmd Message) {
 	cfgUpdate := cmd.(*MsgConfigUpdate)
 	m.config = cfgUpdate.GetConfig()
 
+	//scheduler is updated in place, flushers in progress keep their slots
+	m.flushPrio = newFlushPriorities(m.config)
+	m.flushSched.update(m.config)
+
 	m.setMaxMemoryFromQuota()
 
 	m.supvCmdch <- &MsgSuccess{}
@@ -14,6 +14,9 @@ import (
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
 	"github.com/couchbase/indexing/secondary/platform"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -75,7 +78,8 @@ type atomicMutationQueue struct {
 	resultChanSize      uint64 //size of buffered result channel
 	minQueueLen         uint64
 
-	free        []*node //free pointer per vbucket queue
+	free        []*node    //free pointer per vbucket queue
+	spill       []*vbSpill //overflow segments per vbucket, nil if disabled
 	stopch      []StopChannel
 	numVbuckets uint16 //num vbuckets for the queue
 	isDestroyed bool
@@ -112,6 +116,16 @@ func NewAtomicMutationQueue(bucket string, numVbuckets uint16, maxMemory *platfo
 		q.size[x] = platform.NewAlignedInt64(0)
 	}
 
+	if config["mutation_queue.overflow.enabled"].Bool() {
+		id := atomic.AddUint64(&spillQueueId, 1)
+		dir := filepath.Join(mutationQueueSpillPath(config), bucket+"-"+strconv.FormatUint(id, 10))
+		segmentSize := int64(config["mutation_queue.overflow.segmentSize"].Uint64())
+		q.spill = make([]*vbSpill, numVbuckets)
+		for x = 0; x < numVbuckets; x++ {
+			q.spill[x] = newVbSpill(dir, bucket, Vbucket(x), segmentSize)
+		}
+	}
+
 	return q
 
 }
@@ -141,7 +155,18 @@ func (q *atomicMutationQueue) Enqueue(mutation *MutationKeys,
 	}
 
 	//create a new node
-	n := q.allocNode(vbucket, appch)
+	var n *node
+	if q.spill != nil {
+		var spilled bool
+		if n, spilled = q.trySpill(mutation, vbucket, appch); spilled {
+			return nil
+		}
+	}
+
+	if n == nil {
+		n = q.allocNode(vbucket, appch)
+	}
+
 	if n == nil {
 		return nil
 	}
@@ -182,6 +207,83 @@ func (q *atomicMutationQueue) DequeueUptoSeqno(vbucket Vbucket, seqno Seqno) (
 
 }
 
+//trySpill appends the mutation to the vbucket's overflow segments if
+//the vbucket has spilled mutations or the queue is out of memory.
+//Otherwise it returns a node for the in-memory queue. If spilling fails
+//or is suspended, it returns nil and the caller falls back to allocNode.
+func (q *atomicMutationQueue) trySpill(mutation *MutationKeys,
+	vbucket Vbucket, appch StopChannel) (*node, bool) {
+
+	s := q.spill[vbucket]
+	active := s.isActive()
+	if !active {
+		if n := q.checkMemAndAlloc(vbucket); n != nil {
+			return n, false
+		}
+	}
+
+	if !s.isSuspended() {
+		err := s.append(mutation)
+		if err == nil {
+			platform.AddInt64(&q.size[vbucket], 1)
+			mutation.Free()
+			return nil, true
+		}
+
+		s.suspend()
+		atomic.AddInt64(&mutationQueueSpillErrors, 1)
+		logging.Errorf("Indexer::MutationQueue Unable to spill mutation "+
+			"Bucket %v Vbucket %v. Spilling suspended for %v. Error %v",
+			q.bucket, vbucket, spillRetryInterval, err)
+	}
+
+	//mutations can go to memory only once spilled ones are dequeued
+	if active {
+		q.waitSpillDrain(vbucket, appch)
+	}
+	return nil, false
+}
+
+//waitSpillDrain waits till the reader has dequeued all spilled
+//mutations of the vbucket
+func (q *atomicMutationQueue) waitSpillDrain(vbucket Vbucket, appch StopChannel) {
+
+	ticker := time.NewTicker(time.Millisecond * time.Duration(q.allocPollInterval))
+	defer ticker.Stop()
+
+	for q.spill[vbucket].isActive() {
+		select {
+		case <-ticker.C:
+		case <-q.stopch[vbucket]:
+			return
+		case <-appch:
+			return
+		}
+	}
+}
+
+func (q *atomicMutationQueue) isMemQueueEmpty(vbucket Vbucket) bool {
+	return platform.LoadPointer(&q.head[vbucket]) ==
+		platform.LoadPointer(&q.tail[vbucket])
+}
+
+//peekSpilled returns the oldest spilled mutation of the vbucket once
+//the in-memory queue is drained
+func (q *atomicMutationQueue) peekSpilled(vbucket Vbucket) *MutationKeys {
+	if q.spill == nil {
+		return nil
+	}
+
+	return q.spill[vbucket].peek(func() bool {
+		return q.isMemQueueEmpty(vbucket)
+	})
+}
+
+func (q *atomicMutationQueue) popSpilled(vbucket Vbucket) {
+	q.spill[vbucket].pop()
+	platform.AddInt64(&q.size[vbucket], -1)
+}
+
 func (q *atomicMutationQueue) dequeueUptoSeqno(vbucket Vbucket, seqno Seqno,
 	datach chan *MutationKeys, errch chan bool) {
 
@@ -227,6 +329,27 @@ func (q *atomicMutationQueue) dequeueUptoSeqno(vbucket Vbucket, seqno Seqno,
 				return
 			}
 		}
+
+		//page in spilled mutations once in-memory queue is drained
+		for m := q.peekSpilled(vbucket); m != nil; m = q.peekSpilled(vbucket) {
+			if seqno < m.meta.seqno {
+				logging.Warnf("Indexer::MutationQueue Dequeue Aborted For "+
+					"Seqno %v Bucket %v Vbucket %v. Last Dequeue %v Spilled Head Seqno %v.", seqno,
+					q.bucket, vbucket, dequeueSeq, m.meta.seqno)
+				close(errch)
+				return
+			}
+
+			q.popSpilled(vbucket)
+			dequeueSeq = m.meta.seqno
+			datach <- m
+
+			if seqno <= dequeueSeq {
+				close(datach)
+				return
+			}
+		}
+
 		time.Sleep(time.Millisecond * time.Duration(q.dequeuePollInterval))
 	}
 }
@@ -292,11 +415,22 @@ func (q *atomicMutationQueue) DequeueSingleElement(vbucket Vbucket) *MutationKey
 		platform.AddInt64(q.memUsed, -m.Size())
 		return m
 	}
+
+	if m := q.peekSpilled(vbucket); m != nil {
+		q.popSpilled(vbucket)
+		return m
+	}
 	return nil
 }
 
 //PeekTail returns reference to a vbucket's mutation at tail of queue without dequeue
 func (q *atomicMutationQueue) PeekTail(vbucket Vbucket) *MutationKeys {
+	if q.spill != nil {
+		if m := q.spill[vbucket].lastSpilled(); m != nil {
+			return m
+		}
+	}
+
 	if platform.LoadPointer(&q.head[vbucket]) !=
 		platform.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
 		tail := (*node)(platform.LoadPointer(&q.tail[vbucket]))
@@ -305,14 +439,16 @@ func (q *atomicMutationQueue) PeekTail(vbucket Vbucket) *MutationKeys {
 	return nil
 }
 
-//PeekHead returns reference to a vbucket's mutation at head of queue without dequeue
+//PeekHead returns reference to a vbucket's mutation at head of queue without dequeue.
+//Spilled mutations follow the in-memory ones, the oldest of them is the head
+//once the in-memory queue is drained.
 func (q *atomicMutationQueue) PeekHead(vbucket Vbucket) *MutationKeys {
 	if platform.LoadPointer(&q.head[vbucket]) !=
 		platform.LoadPointer(&q.tail[vbucket]) { //if queue is nonempty
 		head := (*node)(platform.LoadPointer(&q.head[vbucket]))
-		return head.mutation
+		return head.next.mutation
 	}
-	return nil
+	return q.peekSpilled(vbucket)
 }
 
 //GetSize returns the size of the vbucket queue
@@ -425,6 +561,11 @@ func (q *atomicMutationQueue) Destroy() {
 		close(q.stopch[i])
 	}
 
+	//spilled mutations hold no memory
+	for _, s := range q.spill {
+		s.destroy()
+	}
+
 	//dequeue all the items in the queue and free
 	for i = 0; i < q.numVbuckets; i++ {
 		mutch := make(chan *MutationKeys)
@@ -1,9 +1,14 @@
 package indexer
 
 import (
+	"fmt"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/platform"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -418,6 +423,232 @@ func TestEnqueueAppCh(t *testing.T) {
 
 }
 
+func TestSpillA(t *testing.T) {
+
+	maxMemory = 1
+	conf := common.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("settings.minVbQueueLength", 10)
+	conf.SetValue("mutation_queue.overflow.enabled", true)
+	conf.SetValue("mutation_queue.overflow.segmentSize", 256)
+	dir, _ := ioutil.TempDir("", "mutation_queue")
+	defer os.RemoveAll(dir)
+	conf.SetValue("storage_dir", dir)
+
+	q := NewAtomicMutationQueue("default", 2, &maxMemory, &memUsed, conf)
+
+	newMut := func(vb, seqno int) *MutationKeys {
+		return &MutationKeys{
+			meta:  &MutationMeta{bucket: "default", vbucket: Vbucket(vb), vbuuid: 7, seqno: Seqno(seqno)},
+			docid: []byte(fmt.Sprintf("doc-%d", seqno)),
+			mut: []*Mutation{&Mutation{uuid: 1, command: common.Upsert,
+				key: []byte(fmt.Sprintf("key-%d", seqno))}},
+		}
+	}
+
+	//enqueue does not block once queue is full
+	for i := 1; i <= 100; i++ {
+		q.Enqueue(newMut(0, i), 0, nil)
+		q.Enqueue(newMut(1, i), 1, nil)
+	}
+	checkSizeA(t, q, 0, 100)
+
+	if m := q.PeekTail(0); m == nil || m.meta.seqno != 100 {
+		t.Errorf("expected tail seqno 100, got %v", m)
+	}
+
+	ch, errch, _ := q.DequeueUptoSeqno(0, 60)
+	next := 1
+	func() {
+		for {
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					return
+				}
+				expected := newMut(0, next)
+				if !reflect.DeepEqual(m, expected) {
+					t.Fatalf("expected %v, got %v", expected, m)
+				}
+				next++
+			case <-errch:
+				t.Fatalf("unexpected dequeue abort")
+			}
+		}
+	}()
+
+	if next != 61 {
+		t.Errorf("expected dequeue upto seqno 60, got %v", next-1)
+	}
+	checkSizeA(t, q, 0, 40)
+
+	//spilled mutations are appended after in-memory ones
+	for m := q.DequeueSingleElement(0); m != nil; m = q.DequeueSingleElement(0) {
+		if m.meta.seqno != Seqno(next) {
+			t.Fatalf("expected seqno %v, got %v", next, m.meta.seqno)
+		}
+		next++
+	}
+	checkSizeA(t, q, 0, 0)
+
+	//queue goes back to memory once spill is drained
+	q.Enqueue(newMut(0, 101), 0, nil)
+	if m := q.DequeueSingleElement(0); m == nil || m.meta.seqno != 101 {
+		t.Errorf("expected seqno 101, got %v", m)
+	}
+
+	q.Destroy()
+	files, _ := filepath.Glob(filepath.Join(mutationQueueSpillPath(conf), "*", "*"))
+	if len(files) != 0 {
+		t.Errorf("expected spill files to be removed, found %v", files)
+	}
+}
+
+func TestSpillFailureA(t *testing.T) {
+
+	maxMemory = 1
+	conf := common.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("settings.minVbQueueLength", 1)
+	conf.SetValue("mutation_queue.overflow.enabled", true)
+	//spill directory cannot be created under a regular file
+	fd, _ := ioutil.TempFile("", "mutation_queue")
+	fd.Close()
+	defer os.Remove(fd.Name())
+	conf.SetValue("storage_dir", fd.Name())
+
+	q := NewAtomicMutationQueue("default", 1, &maxMemory, &memUsed, conf)
+	defer q.Destroy()
+
+	newMut := func(seqno int) *MutationKeys {
+		return &MutationKeys{
+			meta: &MutationMeta{bucket: "default", vbuuid: 7, seqno: Seqno(seqno)},
+			mut:  []*Mutation{&Mutation{uuid: 1, command: common.Upsert}},
+		}
+	}
+
+	q.Enqueue(newMut(1), 0, nil)
+	errors := atomic.LoadInt64(&mutationQueueSpillErrors)
+
+	//spill fails, enqueue falls back to in-memory back-pressure
+	appch := make(StopChannel)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(appch)
+	}()
+	t0 := time.Now()
+	q.Enqueue(newMut(2), 0, appch)
+	if time.Since(t0) < 100*time.Millisecond {
+		t.Errorf("expected enqueue to block on back-pressure")
+	}
+	checkSizeA(t, q, 0, 2)
+
+	if n := atomic.LoadInt64(&mutationQueueSpillErrors); n != errors+1 {
+		t.Errorf("expected %v spill errors, got %v", errors+1, n)
+	}
+	if !q.spill[0].isSuspended() {
+		t.Errorf("expected spilling to be suspended")
+	}
+
+	for i := 1; i <= 2; i++ {
+		if m := q.DequeueSingleElement(0); m == nil || m.meta.seqno != Seqno(i) {
+			t.Errorf("expected seqno %v, got %v", i, m)
+		}
+	}
+}
+
+func TestPeekHeadSpillA(t *testing.T) {
+
+	maxMemory = 1
+	conf := common.SystemConfig.SectionConfig("indexer.", true /*trim*/)
+	conf.SetValue("settings.minVbQueueLength", 10)
+	conf.SetValue("mutation_queue.overflow.enabled", true)
+	conf.SetValue("mutation_queue.overflow.segmentSize", 256)
+	dir, _ := ioutil.TempDir("", "mutation_queue")
+	defer os.RemoveAll(dir)
+	conf.SetValue("storage_dir", dir)
+
+	q := NewAtomicMutationQueue("default", 2, &maxMemory, &memUsed, conf)
+	defer q.Destroy()
+
+	f := &flusher{}
+	if m := q.PeekHead(0); m != nil {
+		t.Errorf("expected no head of empty queue, got %v", m)
+	}
+	if !f.IsQueueLWTLowerThanTimestamp(q, Timestamp{0, 0}) {
+		t.Errorf("expected empty queue to be lower than any timestamp")
+	}
+
+	for i := 1; i <= 50; i++ {
+		q.Enqueue(&MutationKeys{
+			meta: &MutationMeta{bucket: "default", vbucket: 0, vbuuid: 7, seqno: Seqno(i)},
+			mut:  []*Mutation{&Mutation{uuid: 1, command: common.Upsert}},
+		}, 0, nil)
+	}
+	if m := q.PeekHead(0); m == nil || m.meta.seqno != 1 {
+		t.Errorf("expected head seqno 1, got %v", m)
+	}
+
+	//drain the in-memory queue, vbucket 0 is left with spilled mutations only
+	next := 1
+	for !q.isMemQueueEmpty(0) {
+		q.DequeueSingleElement(0)
+		next++
+	}
+	if !q.spill[0].isActive() {
+		t.Fatalf("expected spilled mutations")
+	}
+
+	for i := 0; i < 2; i++ {
+		if m := q.PeekHead(0); m == nil || m.meta.seqno != Seqno(next) {
+			t.Fatalf("expected spilled head seqno %v, got %v", next, m)
+		}
+	}
+	checkSizeA(t, q, 0, int64(51-next))
+
+	if lwt := f.GetQueueLWT(q); lwt[0] != Seqno(next) || lwt[1] != 0 {
+		t.Errorf("expected queue LWT [%v 0], got %v", next, lwt)
+	}
+	if f.IsQueueLWTLowerThanTimestamp(q, Timestamp{Seqno(next - 1), 0}) {
+		t.Errorf("expected spilled head above timestamp")
+	}
+	if !f.IsQueueLWTLowerThanTimestamp(q, Timestamp{Seqno(next), 0}) {
+		t.Errorf("expected spilled head within timestamp")
+	}
+
+	//the peeked mutation is the one dequeued
+	if m := q.DequeueSingleElement(0); m == nil || m.meta.seqno != Seqno(next) {
+		t.Errorf("expected seqno %v, got %v", next, m)
+	}
+	if m := q.PeekHead(0); m == nil || m.meta.seqno != Seqno(next+1) {
+		t.Errorf("expected head seqno %v, got %v", next+1, m)
+	}
+}
+
+func TestSpillRecordMeta(t *testing.T) {
+
+	m := &MutationKeys{
+		meta: &MutationMeta{bucket: "default", vbucket: 3, vbuuid: 7, seqno: 10,
+			recvTime: 100, queueTime: 200},
+		docid: []byte("doc-10"),
+		mut: []*Mutation{&Mutation{uuid: 1, command: common.Upsert,
+			key: []byte("key-10")}},
+	}
+	m.meta.trace = &MutationTrace{Bucket: "default", Stream: "MAINT_STREAM",
+		Docid: "doc-10", Vbucket: 3, Seqno: 10, Received: 100, Processed: 150,
+		Queued: 200}
+
+	buf := encodeSpillRecord(nil, m)
+	out, err := decodeSpillRecord(buf[4:], "default", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out, m) {
+		t.Errorf("expected %v, got %v", m, out)
+	}
+	if !reflect.DeepEqual(out.meta.trace, m.meta.trace) {
+		t.Errorf("expected trace %v, got %v", m.meta.trace, out.meta.trace)
+	}
+}
+
 /*
 func BenchmarkEnqueueA(b *testing.B) {
 
@@ -0,0 +1,439 @@
+//  Copyright (c) 2014 Couchbase, Inc.
+//  Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+//  except in compliance with the License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing, software distributed under the
+//  License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+//  either express or implied. See the License for the specific language governing permissions
+//  and limitations under the License.
+
+package indexer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/couchbase/indexing/secondary/common"
+	"github.com/couchbase/indexing/secondary/logging"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//In overflow mode, a vbucket queue which cannot allocate within the
+//mutation queue memory limit appends mutations to segment files instead
+//of blocking the stream. Once a vbucket has spilled, all further
+//mutations of the vbucket are spilled till the reader has drained the
+//segments. Mutations in memory are always older than spilled mutations,
+//so the reader drains the in-memory queue before paging spilled
+//mutations back in order.
+//
+//If a segment cannot be written (e.g. disk full), spilling of the vbucket
+//is suspended for spillRetryInterval and the enqueuer falls back to the
+//back-pressure of the in-memory queue, after the already spilled
+//mutations are drained.
+//
+//Record: [len - 4 bytes][vbuuid - 8 bytes][seqno - 8 bytes]
+//        [recvTime - 8 bytes][queueTime - 8 bytes]
+//        [docid len - 2 bytes][docid][has trace - 1 byte]
+//        trace: [stream len - 2 bytes][stream][received - 8 bytes]
+//               [processed - 8 bytes][queued - 8 bytes]
+//        [num mutations - 2 bytes]
+//        per mutation: [instId - 8 bytes][command - 1 byte]
+//                      [key][oldkey][partnkey] each prefixed by 4 byte len
+
+const mutationQueueSpillDir = "mutation_queue"
+
+const spillWriteBufSize = 64 * 1024
+const spillRetryInterval = 10 * time.Second
+
+var errSpillRecord = errors.New("Invalid mutation queue spill record")
+
+var spillQueueId uint64
+
+//spill writes failed across all mutation queues, reported in indexer stats
+var mutationQueueSpillErrors int64
+
+func mutationQueueSpillPath(config common.Config) string {
+	return filepath.Join(config["storage_dir"].String(), mutationQueueSpillDir)
+}
+
+//cleanupMutationQueueSpill removes spill files of a previous run
+func cleanupMutationQueueSpill(config common.Config) {
+	os.RemoveAll(mutationQueueSpillPath(config))
+}
+
+type spillSegment struct {
+	id    int
+	count int64 //records written to the segment
+}
+
+//vbSpill holds spilled mutations of a vbucket. Writer is the
+//enqueuer of the vbucket and reader is the dequeuer.
+type vbSpill struct {
+	sync.Mutex
+
+	dir         string
+	bucket      string
+	vbucket     Vbucket
+	segmentSize int64
+
+	pending   int64 //spilled mutations not yet dequeued
+	suspended int64 //unix nano time till which spilling is suspended
+	segments  []spillSegment
+	nextId    int
+
+	wfd   *os.File
+	wbuf  []byte //records not yet written to wfd
+	wsize int64
+
+	rfd   *os.File
+	r     *bufio.Reader
+	rdone int64 //records read from segments[0]
+	head  *MutationKeys
+	tail  *MutationKeys
+
+	buf []byte
+}
+
+func newVbSpill(dir string, bucket string, vbucket Vbucket, segmentSize int64) *vbSpill {
+	return &vbSpill{
+		dir:         dir,
+		bucket:      bucket,
+		vbucket:     vbucket,
+		segmentSize: segmentSize,
+	}
+}
+
+func (s *vbSpill) segmentFile(id int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("vb%d-%d", s.vbucket, id))
+}
+
+func (s *vbSpill) isActive() bool {
+	return atomic.LoadInt64(&s.pending) > 0
+}
+
+func (s *vbSpill) isSuspended() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&s.suspended)
+}
+
+//suspend stops spilling of the vbucket for spillRetryInterval
+func (s *vbSpill) suspend() {
+	atomic.StoreInt64(&s.suspended, time.Now().Add(spillRetryInterval).UnixNano())
+}
+
+//append writes a mutation to the current segment. On error the
+//mutation is not spilled and records spilled earlier are retained.
+func (s *vbSpill) append(m *MutationKeys) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.wfd == nil || s.wsize >= s.segmentSize {
+		if err := s.newSegment(); err != nil {
+			return err
+		}
+	}
+
+	s.buf = encodeSpillRecord(s.buf[:0], m)
+	if len(s.wbuf)+len(s.buf) > spillWriteBufSize {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+	s.wbuf = append(s.wbuf, s.buf...)
+
+	s.wsize += int64(len(s.buf))
+	s.segments[len(s.segments)-1].count++
+	atomic.AddInt64(&s.pending, 1)
+
+	if s.tail == nil {
+		s.tail = &MutationKeys{meta: &MutationMeta{}}
+	}
+	*s.tail.meta = *m.meta
+	return nil
+}
+
+//flush writes buffered records to the current segment. Records which
+//could not be written stay buffered, so flush can be retried.
+func (s *vbSpill) flush() error {
+	if len(s.wbuf) == 0 {
+		return nil
+	}
+
+	n, err := s.wfd.Write(s.wbuf)
+	s.wbuf = s.wbuf[:copy(s.wbuf, s.wbuf[n:])]
+	return err
+}
+
+func (s *vbSpill) newSegment() error {
+	if s.wfd != nil {
+		if err := s.flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(s.segmentFile(s.nextId), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if s.wfd != nil {
+		s.wfd.Close()
+	}
+	s.wfd = fd
+	s.wsize = 0
+	s.segments = append(s.segments, spillSegment{id: s.nextId})
+	s.nextId++
+	return nil
+}
+
+//peek returns the oldest spilled mutation without dequeuing it. Spilled
+//mutations are returned only once the in-memory queue is drained.
+func (s *vbSpill) peek(memEmpty func() bool) *MutationKeys {
+	if !s.isActive() {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.head == nil {
+		if !memEmpty() {
+			return nil
+		}
+
+		//records of the segment being written may still be buffered.
+		//If they can't be written, the reader retries on next peek.
+		if err := s.flush(); err != nil {
+			logging.Errorf("Indexer::MutationQueue Unable to write spilled mutations "+
+				"Bucket %v Vbucket %v. Error %v", s.bucket, s.vbucket, err)
+			return nil
+		}
+
+		m, err := s.read()
+		if err != nil {
+			logging.Fatalf("Indexer::MutationQueue Unable to read spilled mutations "+
+				"Bucket %v Vbucket %v. Error %v", s.bucket, s.vbucket, err)
+			common.CrashOnError(err)
+		}
+		s.head = m
+	}
+
+	return s.head
+}
+
+//pop dequeues the mutation returned by peek
+func (s *vbSpill) pop() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.head = nil
+	if atomic.AddInt64(&s.pending, -1) == 0 {
+		s.reset()
+	}
+}
+
+func (s *vbSpill) read() (*MutationKeys, error) {
+	seg := &s.segments[0]
+	if s.rdone == seg.count {
+		//segment is not the one being written as records are pending
+		s.rfd.Close()
+		os.Remove(s.segmentFile(seg.id))
+		s.rfd, s.r, s.rdone = nil, nil, 0
+		s.segments = s.segments[1:]
+		seg = &s.segments[0]
+	}
+
+	if s.rfd == nil {
+		fd, err := os.Open(s.segmentFile(seg.id))
+		if err != nil {
+			return nil, err
+		}
+		s.rfd = fd
+		s.r = bufio.NewReader(fd)
+	}
+
+	var l [4]byte
+	if _, err := io.ReadFull(s.r, l[:]); err != nil {
+		return nil, err
+	}
+
+	n := int(binary.BigEndian.Uint32(l[:]))
+	if cap(s.buf) < n {
+		s.buf = make([]byte, n)
+	}
+	s.buf = s.buf[:n]
+	if _, err := io.ReadFull(s.r, s.buf); err != nil {
+		return nil, err
+	}
+
+	s.rdone++
+	return decodeSpillRecord(s.buf, s.bucket, s.vbucket)
+}
+
+//reset removes segment files once all spilled mutations are dequeued
+func (s *vbSpill) reset() {
+	if s.rfd != nil {
+		s.rfd.Close()
+	}
+
+	if s.wfd != nil {
+		s.wfd.Close()
+	}
+
+	for _, seg := range s.segments {
+		os.Remove(s.segmentFile(seg.id))
+	}
+
+	s.segments = nil
+	s.wfd, s.wbuf, s.wsize = nil, s.wbuf[:0], 0
+	s.rfd, s.r, s.rdone = nil, nil, 0
+	s.tail = nil
+}
+
+//lastSpilled returns the most recent spilled mutation (meta only)
+func (s *vbSpill) lastSpilled() *MutationKeys {
+	if !s.isActive() {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.tail == nil {
+		return nil
+	}
+
+	return &MutationKeys{meta: s.tail.meta.Clone()}
+}
+
+func (s *vbSpill) destroy() {
+	s.Lock()
+	defer s.Unlock()
+
+	atomic.StoreInt64(&s.pending, 0)
+	s.head = nil
+	s.reset()
+}
+
+func encodeSpillRecord(buf []byte, m *MutationKeys) []byte {
+	var tmp [8]byte
+
+	appendUint := func(v uint64, n int) {
+		switch n {
+		case 1:
+			tmp[0] = byte(v)
+		case 2:
+			binary.BigEndian.PutUint16(tmp[:], uint16(v))
+		case 4:
+			binary.BigEndian.PutUint32(tmp[:], uint32(v))
+		case 8:
+			binary.BigEndian.PutUint64(tmp[:], v)
+		}
+		buf = append(buf, tmp[:n]...)
+	}
+
+	appendBytes := func(bs []byte) {
+		appendUint(uint64(len(bs)), 4)
+		buf = append(buf, bs...)
+	}
+
+	buf = append(buf, 0, 0, 0, 0)
+	appendUint(uint64(m.meta.vbuuid), 8)
+	appendUint(uint64(m.meta.seqno), 8)
+	appendUint(uint64(m.meta.recvTime), 8)
+	appendUint(uint64(m.meta.queueTime), 8)
+	appendUint(uint64(len(m.docid)), 2)
+	buf = append(buf, m.docid...)
+	if trace := m.meta.trace; trace == nil {
+		appendUint(0, 1)
+	} else {
+		appendUint(1, 1)
+		appendUint(uint64(len(trace.Stream)), 2)
+		buf = append(buf, trace.Stream...)
+		appendUint(uint64(trace.Received), 8)
+		appendUint(uint64(trace.Processed), 8)
+		appendUint(uint64(trace.Queued), 8)
+	}
+	appendUint(uint64(len(m.mut)), 2)
+	for _, mut := range m.mut {
+		appendUint(uint64(mut.uuid), 8)
+		appendUint(uint64(mut.command), 1)
+		appendBytes(mut.key)
+		appendBytes(mut.oldkey)
+		appendBytes(mut.partnkey)
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	return buf
+}
+
+func decodeSpillRecord(buf []byte, bucket string, vbucket Vbucket) (m *MutationKeys, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m, err = nil, errSpillRecord
+		}
+	}()
+
+	readBytes := func(n int) []byte {
+		bs := buf[:n:n]
+		buf = buf[n:]
+		return bs
+	}
+
+	copyBytes := func() []byte {
+		n := int(binary.BigEndian.Uint32(readBytes(4)))
+		if n == 0 {
+			return nil
+		}
+		return append([]byte(nil), readBytes(n)...)
+	}
+
+	m = NewMutationKeys()
+	m.meta = NewMutationMeta()
+	m.meta.bucket = bucket
+	m.meta.vbucket = vbucket
+	m.meta.vbuuid = Vbuuid(binary.BigEndian.Uint64(readBytes(8)))
+	m.meta.seqno = Seqno(binary.BigEndian.Uint64(readBytes(8)))
+	m.meta.recvTime = int64(binary.BigEndian.Uint64(readBytes(8)))
+	m.meta.queueTime = int64(binary.BigEndian.Uint64(readBytes(8)))
+	m.docid = append(m.docid[:0], readBytes(int(binary.BigEndian.Uint16(readBytes(2))))...)
+	if readBytes(1)[0] != 0 {
+		m.meta.trace = &MutationTrace{
+			Bucket:  bucket,
+			Stream:  string(readBytes(int(binary.BigEndian.Uint16(readBytes(2))))),
+			Docid:   string(m.docid),
+			Vbucket: vbucket,
+			Seqno:   m.meta.seqno,
+		}
+		m.meta.trace.Received = int64(binary.BigEndian.Uint64(readBytes(8)))
+		m.meta.trace.Processed = int64(binary.BigEndian.Uint64(readBytes(8)))
+		m.meta.trace.Queued = int64(binary.BigEndian.Uint64(readBytes(8)))
+	}
+
+	nmut := int(binary.BigEndian.Uint16(readBytes(2)))
+	m.mut = m.mut[:0]
+	for i := 0; i < nmut; i++ {
+		mut := NewMutation()
+		mut.uuid = common.IndexInstId(binary.BigEndian.Uint64(readBytes(8)))
+		mut.command = readBytes(1)[0]
+		mut.key = copyBytes()
+		mut.oldkey = copyBytes()
+		mut.partnkey = copyBytes()
+		m.mut = append(m.mut, mut)
+	}
+
+	if len(buf) != 0 {
+		return nil, errSpillRecord
+	}
+
+	return m, nil
+}
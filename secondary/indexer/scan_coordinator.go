@@ -33,6 +33,7 @@ var (
 	ErrSnapNotAvailable   = errors.New("No snapshot available for scan")
 	ErrUnsupportedRequest = errors.New("Unsupported query request")
 	ErrVbuuidMismatch     = errors.New("Mismatch in session vbuuids")
+	ErrIndexPaused        = errors.New("Index maintenance paused, consistent scans not allowed")
 )
 
 var secKeyBufPool *common.BytesBufPool
@@ -70,6 +71,7 @@ type ScanRequest struct {
 	Incl      Inclusion
 	Limit     int64
 	isPrimary bool
+	isPaused  bool
 
 	ScanId      uint64
 	ExpiredTime time.Time
@@ -467,6 +469,11 @@ func (s *scanCoordinator) newRequest(protoReq interface{},
 			}
 		}()
 		r.Consistency = &cons
+		//snapshots of a paused index do not advance
+		if r.isPaused && cons != common.AnyConsistency {
+			localErr = ErrIndexPaused
+			return
+		}
 		cfg := s.config.Load()
 		if cons == common.QueryConsistency && vector != nil {
 			r.Ts = common.NewTsVbuuid(r.Bucket, cfg["numVbuckets"].Int())
@@ -504,6 +511,7 @@ func (s *scanCoordinator) newRequest(protoReq interface{},
 			r.isPrimary = indexInst.Defn.IsPrimary
 			r.IndexName, r.Bucket = indexInst.Defn.Name, indexInst.Defn.Bucket
 			r.IndexInstId = indexInst.InstId
+			r.isPaused = isIndexPaused(*indexInst)
 
 			if indexInst.State != common.INDEX_STATE_ACTIVE {
 				localErr = common.ErrIndexNotReady
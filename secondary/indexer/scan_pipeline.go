@@ -235,6 +235,10 @@ func piSplitEntry(entry []byte, tmp []byte) ([]byte, []byte) {
 
 func siSplitEntry(entry []byte, tmp []byte) ([]byte, []byte, int) {
 	e := secondaryIndexEntry(entry)
+	// Large keys may not fit in a block
+	if cap(tmp) < len(entry) {
+		tmp = make([]byte, 0, len(entry))
+	}
 	sk, err := e.ReadSecKey(tmp)
 	c.CrashOnError(err)
 	docid, err := e.ReadDocId(sk)
@@ -11,7 +11,9 @@ package indexer
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/couchbase/cbauth/metakv"
 	"github.com/couchbase/indexing/secondary/common"
 	"github.com/couchbase/indexing/secondary/logging"
@@ -22,6 +24,7 @@ import (
 	"os"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"time"
 )
 
@@ -62,6 +65,10 @@ func NewSettingsManager(supvCmdch MsgChannel,
 	http.HandleFunc("/triggerCompaction", s.handleCompactionTrigger)
 	http.HandleFunc("/settings/runtime/freeMemory", s.handleFreeMemoryReq)
 	http.HandleFunc("/settings/runtime/forceGC", s.handleForceGCReq)
+	http.HandleFunc("/snapshots", s.handleSnapshotsReq)
+	http.HandleFunc("/pauseIndex", s.handleIndexMaintenanceReq)
+	http.HandleFunc("/resumeIndex", s.handleIndexMaintenanceReq)
+	http.HandleFunc("/replayStream", s.handleReplayStreamReq)
 	go func() {
 		fn := func(r int, err error) error {
 			if r > 0 {
@@ -128,6 +135,10 @@ func (s *settingsManager) handleSettingsReq(w http.ResponseWriter, r *http.Reque
 			err = config.Update(bytes)
 		}
 
+		if err == nil {
+			err = validateSettings(config)
+		}
+
 		if err != nil {
 			s.writeError(w, err)
 			return
@@ -182,6 +193,164 @@ func (s *settingsManager) handleCompactionTrigger(w http.ResponseWriter, r *http
 	s.writeOk(w)
 }
 
+// GET  /snapshots[?index=<instId>]
+// POST /snapshots?index=<instId>&snapshot=<id>&pin=<true|false>
+// POST /snapshots?index=<instId>&policy (body: retention policy, empty to reset)
+func (s *settingsManager) handleSnapshotsReq(w http.ResponseWriter, r *http.Request) {
+	if !s.validateAuth(w, r) {
+		return
+	}
+
+	msg := &MsgIndexDiskSnapshots{
+		errch:  make(chan error, 1),
+		respch: make(chan []IndexDiskSnapshots, 1),
+	}
+
+	q := r.URL.Query()
+	if index := q.Get("index"); index != "" {
+		id, err := strconv.ParseUint(index, 10, 64)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		msg.instId = common.IndexInstId(id)
+	}
+
+	if r.Method == "POST" {
+		if msg.instId == 0 {
+			s.writeError(w, errors.New("Missing index instance id"))
+			return
+		}
+
+		if _, ok := q["policy"]; ok {
+			msg.setPolicy = true
+			bs, _ := ioutil.ReadAll(r.Body)
+			if len(bytes.TrimSpace(bs)) > 0 {
+				msg.policy = new(RetentionPolicy)
+				if err := json.Unmarshal(bs, msg.policy); err != nil {
+					s.writeError(w, err)
+					return
+				}
+			}
+		} else if msg.snapshotId = q.Get("snapshot"); msg.snapshotId != "" {
+			msg.pin = q.Get("pin") != "false"
+		} else {
+			s.writeError(w, errors.New("Missing snapshot id or retention policy"))
+			return
+		}
+	} else if r.Method != "GET" {
+		w.WriteHeader(400)
+		w.Write([]byte("Unsupported method"))
+		return
+	}
+
+	s.supvMsgch <- msg
+	if err := <-msg.errch; err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	bs, err := json.Marshal(<-msg.respch)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.writeJson(w, bs)
+}
+
+func (s *settingsManager) handleIndexMaintenanceReq(w http.ResponseWriter, r *http.Request) {
+	if !s.validateAuth(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(400)
+		w.Write([]byte("Unsupported method"))
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if err != nil {
+		s.writeError(w, errors.New("Missing or invalid index instance id"))
+		return
+	}
+
+	var mType MsgType = INDEXER_PAUSE_INDEX
+	if r.URL.Path == "/resumeIndex" {
+		mType = INDEXER_RESUME_INDEX
+	}
+
+	respCh := make(MsgChannel, 1)
+	s.supvMsgch <- &MsgIndexMaintenance{mType: mType,
+		instId: common.IndexInstId(id),
+		respCh: respCh}
+
+	resp := <-respCh
+	if resp.GetMsgType() == MSG_ERROR {
+		s.writeError(w, resp.(*MsgError).GetError().cause)
+		return
+	}
+
+	s.writeOk(w)
+}
+
+//handleReplayStreamReq feeds a dataport recording into an open stream,
+//POST /replayStream?stream=MAINT_STREAM&path=<recording>&realtime=true
+func (s *settingsManager) handleReplayStreamReq(w http.ResponseWriter, r *http.Request) {
+	if !s.validateAuth(w, r) {
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(400)
+		w.Write([]byte("Unsupported method"))
+		return
+	}
+
+	query := r.URL.Query()
+	var streamId common.StreamId
+	for _, sid := range []common.StreamId{common.MAINT_STREAM,
+		common.CATCHUP_STREAM, common.INIT_STREAM} {
+		if sid.String() == query.Get("stream") {
+			streamId = sid
+		}
+	}
+	if streamId == common.NIL_STREAM {
+		s.writeError(w, errors.New("Missing or invalid stream"))
+		return
+	}
+
+	path := query.Get("path")
+	if path == "" {
+		s.writeError(w, errors.New("Missing recording path"))
+		return
+	}
+
+	realtime := false
+	if param := query.Get("realtime"); param != "" {
+		var err error
+		if realtime, err = strconv.ParseBool(param); err != nil {
+			s.writeError(w, errors.New("Invalid realtime"))
+			return
+		}
+	}
+
+	respCh := make(MsgChannel, 1)
+	s.supvMsgch <- &MsgReplayStream{streamId: streamId,
+		path:     path,
+		realtime: realtime,
+		respCh:   respCh}
+
+	resp := <-respCh
+	if resp.GetMsgType() == MSG_ERROR {
+		s.writeError(w, resp.(*MsgError).GetError().cause)
+		return
+	}
+
+	s.writeOk(w)
+}
+
 func (s *settingsManager) run() {
 loop:
 	for {
@@ -269,6 +438,16 @@ func (s *settingsManager) handleForceGCReq(w http.ResponseWriter, r *http.Reques
 	s.writeOk(w)
 }
 
+// Reject settings which would otherwise be silently ignored
+func validateSettings(config common.Config) error {
+	indexerConfig := config.SectionConfig("indexer.", true)
+	if err := retentionPolicyFromConfig(indexerConfig).Validate(); err != nil {
+		return fmt.Errorf("Invalid snapshot retention settings: %v", err)
+	}
+
+	return nil
+}
+
 func setLogger(config common.Config) {
 	logLevel := config["indexer.settings.log_level"].String()
 	level := logging.Level(logLevel)
@@ -306,4 +485,5 @@ func initGlobalSettings(oldCfg, newCfg common.Config) {
 	maxArrayKeyBufferLength = maxArrayKeyLength * 3
 	maxArrayIndexEntrySize = maxArrayKeyBufferLength + MAX_DOCID_LEN + 2
 	arrayEncBufPool = common.NewByteBufferPool(maxArrayIndexEntrySize)
+	setLargeKeySettings(newCfg)
 }
@@ -43,3 +43,42 @@ type Slice interface {
 
 	IndexWriter
 }
+
+//BulkLoader is implemented by slices which can build an index from
+//buffered mutations faster than maintaining it incrementally
+type BulkLoader interface {
+	//BeginBulkLoad starts buffering mutations of the initial build of
+	//an empty slice. Returns false if bulk load is not possible.
+	BeginBulkLoad() bool
+
+	//EndBulkLoad builds the index from buffered mutations and switches
+	//the slice to incremental maintenance
+	EndBulkLoad()
+}
+
+//VbucketRollbacker is implemented by slices which can roll back a subset
+//of vbuckets without discarding the entries of other vbuckets
+type VbucketRollbacker interface {
+	//RollbackVbuckets rolls back the slice to the given snapshot and removes
+	//all entries of the given vbuckets. Returns a new committed snapshot
+	//with the given timestamp.
+	RollbackVbuckets(info SnapshotInfo, vbs []Vbucket,
+		ts *common.TsVbuuid) (SnapshotInfo, error)
+}
+
+//SnapshotRetainer is implemented by slices which keep point-in-time
+//disk snapshots under a retention policy
+type SnapshotRetainer interface {
+	//RetentionPolicy returns the policy in effect for the slice
+	RetentionPolicy() RetentionPolicy
+
+	//SetRetentionPolicy overrides the configured policy for the slice.
+	//A nil policy restores the configured policy.
+	SetRetentionPolicy(*RetentionPolicy) error
+
+	//DiskSnapshots lists retained disk snapshots, most recent first
+	DiskSnapshots() ([]DiskSnapshot, error)
+
+	//PinSnapshot protects a disk snapshot from retention cleanup
+	PinSnapshot(id string, pin bool) error
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/common"
+	"time"
+)
+
+//Adaptive InMemory Snapshot Interval
+//
+//With settings.inmemory_snapshot.adaptive.enable, the stability timer
+//of a stream/bucket recomputes its interval after every tick, bounded
+//by settings.inmemory_snapshot.adaptive.min_interval and max_interval.
+//
+//While scans are waiting for a snapshot of an index in the stream/bucket,
+//the interval is halved on every tick, starting from at most the configured
+//interval, until it reaches the minimum. This serves consistent scans
+//sooner without a single waiting scan forcing the minimum interval. If the
+//mutation arrival rate, measured from the stream HWT, is below
+//settings.inmemory_snapshot.adaptive.low_mutation_rate, the interval is
+//doubled upto the maximum as frequent snapshots are not needed. Otherwise
+//the interval moves back towards the configured inmemory snapshot interval.
+
+type snapIntervalState struct {
+	interval  uint64 //current interval in milliseconds
+	lastSeqno uint64 //sum of HWT seqnos at last tick
+	lastTime  time.Time
+}
+
+func (tk *timekeeper) newSnapIntervalState(streamId common.StreamId,
+	bucket string) *snapIntervalState {
+
+	st := &snapIntervalState{
+		interval: tk.getInMemSnapInterval(),
+		lastTime: time.Now(),
+	}
+	st.lastSeqno = tk.sumHWTSeqnos(streamId, bucket)
+	tk.setInMemSnapIntervalStat(streamId, bucket, st.interval)
+	return st
+}
+
+//nextInMemSnapInterval computes the interval for the next tick of the
+//stream/bucket timer and reports it in bucket stats.
+func (tk *timekeeper) nextInMemSnapInterval(streamId common.StreamId,
+	bucket string, st *snapIntervalState) time.Duration {
+
+	tk.lock.Lock()
+	defer tk.lock.Unlock()
+
+	base := tk.getInMemSnapInterval()
+	if !tk.config["settings.inmemory_snapshot.adaptive.enable"].Bool() {
+		st.interval = base
+	} else {
+		now := time.Now()
+		seqno := tk.sumHWTSeqnos(streamId, bucket)
+
+		var rate float64
+		if elapsed := now.Sub(st.lastTime); elapsed > 0 && seqno >= st.lastSeqno {
+			rate = float64(seqno-st.lastSeqno) / elapsed.Seconds()
+		}
+		st.lastSeqno, st.lastTime = seqno, now
+
+		st.interval = adaptSnapInterval(st.interval, base,
+			tk.config["settings.inmemory_snapshot.adaptive.min_interval"].Uint64(),
+			tk.config["settings.inmemory_snapshot.adaptive.max_interval"].Uint64(),
+			rate,
+			tk.config["settings.inmemory_snapshot.adaptive.low_mutation_rate"].Float64(),
+			tk.numSnapshotWaiters(streamId, bucket))
+	}
+
+	tk.setInMemSnapIntervalStat(streamId, bucket, st.interval)
+	return time.Duration(st.interval) * time.Millisecond
+}
+
+//adaptSnapInterval returns the next snapshot interval given the current
+//one, the configured one, bounds, mutation rate and snapshot waiters.
+func adaptSnapInterval(curr, base, minInterval, maxInterval uint64,
+	rate, lowRate float64, waiters int64) uint64 {
+
+	if minInterval == 0 {
+		minInterval = 1
+	}
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+	base = clampSnapInterval(base, minInterval, maxInterval)
+	if curr == 0 {
+		curr = base
+	}
+
+	next := curr
+	switch {
+	case waiters > 0:
+		if next = curr / 2; next > base {
+			next = base
+		}
+	case rate < lowRate:
+		next = curr * 2
+	case curr > base:
+		if next = curr / 2; next < base {
+			next = base
+		}
+	case curr < base:
+		if next = curr * 2; next > base {
+			next = base
+		}
+	}
+
+	return clampSnapInterval(next, minInterval, maxInterval)
+}
+
+func clampSnapInterval(interval, minInterval, maxInterval uint64) uint64 {
+	if interval < minInterval {
+		return minInterval
+	} else if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+//sumHWTSeqnos returns the sum of HWT seqnos of the stream/bucket.
+//Caller must hold tk.lock.
+func (tk *timekeeper) sumHWTSeqnos(streamId common.StreamId,
+	bucket string) uint64 {
+
+	var sum uint64
+	if hwt, ok := tk.ss.streamBucketHWTMap[streamId][bucket]; ok && hwt != nil {
+		for _, seqno := range hwt.Seqnos {
+			sum += seqno
+		}
+	}
+	return sum
+}
+
+//numSnapshotWaiters returns the number of scans waiting for a snapshot
+//of any index of the stream/bucket. Caller must hold tk.lock.
+func (tk *timekeeper) numSnapshotWaiters(streamId common.StreamId,
+	bucket string) int64 {
+
+	stats := tk.stats.Get()
+	if stats == nil {
+		return 0
+	}
+
+	var waiters int64
+	for instId, inst := range tk.indexInstMap {
+		if inst.Defn.Bucket != bucket || inst.Stream != streamId {
+			continue
+		}
+		if idxStats, ok := stats.indexes[instId]; ok {
+			waiters += idxStats.numSnapshotWaiters.Value()
+		}
+	}
+	return waiters
+}
+
+func (tk *timekeeper) setInMemSnapIntervalStat(streamId common.StreamId,
+	bucket string, interval uint64) {
+
+	stats := tk.stats.Get()
+	if stats == nil {
+		return
+	}
+
+	if bStats, ok := stats.buckets[bucket]; ok {
+		if streamId == common.MAINT_STREAM {
+			bStats.inmemSnapInterval.Set(int64(interval))
+		} else {
+			bStats.initInmemSnapInterval.Set(int64(interval))
+		}
+	}
+}
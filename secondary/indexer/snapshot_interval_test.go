@@ -0,0 +1,38 @@
+package indexer
+
+import (
+	"testing"
+)
+
+func TestAdaptSnapInterval(t *testing.T) {
+	cases := []struct {
+		name                       string
+		curr, base, minInt, maxInt uint64
+		rate, lowRate              float64
+		waiters                    int64
+		expected                   uint64
+	}{
+		{"steady", 200, 200, 10, 1000, 1000, 100, 0, 200},
+		{"initial", 0, 200, 10, 1000, 1000, 100, 0, 200},
+		{"low rate doubles", 200, 200, 10, 1000, 50, 100, 0, 400},
+		{"low rate capped", 800, 200, 10, 1000, 50, 100, 0, 1000},
+		{"high rate backs off", 1000, 200, 10, 1000, 1000, 100, 0, 500},
+		{"high rate restores base", 300, 200, 10, 1000, 1000, 100, 0, 200},
+		{"recovers after waiters", 50, 200, 10, 1000, 1000, 100, 0, 100},
+		{"waiters halve", 200, 200, 10, 1000, 1000, 100, 1, 100},
+		{"waiters start from base", 1000, 200, 10, 1000, 50, 100, 3, 200},
+		{"waiters bounded by min", 15, 200, 10, 1000, 1000, 100, 1, 10},
+		{"base below min", 0, 5, 10, 1000, 1000, 100, 0, 10},
+		{"base above max", 0, 5000, 10, 1000, 1000, 100, 0, 1000},
+		{"zero min", 1, 200, 0, 1000, 1000, 100, 1, 1},
+		{"max below min", 100, 200, 50, 20, 1000, 100, 0, 50},
+	}
+
+	for _, c := range cases {
+		got := adaptSnapInterval(c.curr, c.base, c.minInt, c.maxInt,
+			c.rate, c.lowRate, c.waiters)
+		if got != c.expected {
+			t.Errorf("%v: expected %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/couchbase/indexing/secondary/common"
+	"time"
+)
+
+const (
+	RetainByCount = "count"
+	RetainByAge   = "age"
+	RetainHourly  = "hourly"
+)
+
+var ErrSnapshotNotFound = errors.New("Disk snapshot not found")
+
+//RetentionPolicy decides which disk snapshots of an index are kept
+//after a new snapshot is persisted. The most recent snapshot and
+//pinned snapshots are never removed.
+//
+//count  - keep the most recent Count snapshots
+//age    - keep snapshots created within MaxAge seconds
+//hourly - keep the most recent snapshot of every hour for Hours hours
+type RetentionPolicy struct {
+	Mode   string `json:"mode"`
+	Count  int    `json:"count,omitempty"`
+	MaxAge int64  `json:"maxAge,omitempty"`
+	Hours  int    `json:"hours,omitempty"`
+}
+
+func retentionPolicyFromConfig(cfg common.Config) RetentionPolicy {
+	return RetentionPolicy{
+		Mode:   cfg["settings.recovery.retention.mode"].String(),
+		Count:  cfg["settings.recovery.max_rollbacks"].Int(),
+		MaxAge: int64(cfg["settings.recovery.retention.max_age"].Int()),
+		Hours:  cfg["settings.recovery.retention.hours"].Int(),
+	}
+}
+
+func (p RetentionPolicy) Validate() error {
+	switch p.Mode {
+	case RetainByCount:
+		if p.Count < 1 {
+			return fmt.Errorf("Invalid snapshot count %v", p.Count)
+		}
+	case RetainByAge:
+		if p.MaxAge < 1 {
+			return fmt.Errorf("Invalid snapshot age %v", p.MaxAge)
+		}
+	case RetainHourly:
+		if p.Hours < 1 {
+			return fmt.Errorf("Invalid snapshot hours %v", p.Hours)
+		}
+	default:
+		return fmt.Errorf("Unknown retention mode %v", p.Mode)
+	}
+
+	return nil
+}
+
+//Retain returns for each snapshot whether it should be kept. Snapshots
+//are ordered from oldest to most recent.
+func (p RetentionPolicy) Retain(created []time.Time, pinned []bool,
+	now time.Time) []bool {
+
+	keep := make([]bool, len(created))
+	hours := make(map[time.Time]bool)
+	count := 0
+
+	for i := len(created) - 1; i >= 0; i-- {
+		age := now.Sub(created[i])
+		switch {
+		case i == len(created)-1 || pinned[i]:
+			keep[i] = true
+		case p.Mode == RetainByCount:
+			keep[i] = count < p.Count
+		case p.Mode == RetainByAge:
+			keep[i] = age <= time.Duration(p.MaxAge)*time.Second
+		case p.Mode == RetainHourly:
+			hour := created[i].Truncate(time.Hour)
+			keep[i] = age <= time.Duration(p.Hours)*time.Hour && !hours[hour]
+		default:
+			keep[i] = true
+		}
+
+		if keep[i] && !pinned[i] {
+			count++
+			hours[created[i].Truncate(time.Hour)] = true
+		}
+	}
+
+	return keep
+}
+
+//DiskSnapshot describes a retained point-in-time disk snapshot
+type DiskSnapshot struct {
+	Id      string            `json:"id"`
+	Created time.Time         `json:"created"`
+	Size    int64             `json:"size"`
+	Items   int64             `json:"items"`
+	Pinned  bool              `json:"pinned"`
+	Ts      SnapshotTsSummary `json:"ts"`
+}
+
+//SnapshotTsSummary condenses the timestamp vector of a snapshot
+type SnapshotTsSummary struct {
+	Bucket      string `json:"bucket"`
+	NumVbuckets int    `json:"numVbuckets"`
+	SeqnoTotal  uint64 `json:"seqnoTotal"`
+	Crc64       uint64 `json:"crc64"`
+}
+
+func summarizeTs(ts *common.TsVbuuid) SnapshotTsSummary {
+	var sum SnapshotTsSummary
+	if ts == nil {
+		return sum
+	}
+
+	sum.Bucket = ts.Bucket
+	sum.Crc64 = ts.Crc64
+	for _, seqno := range ts.Seqnos {
+		if seqno != 0 {
+			sum.NumVbuckets++
+			sum.SeqnoTotal += seqno
+		}
+	}
+
+	return sum
+}
+
+//IndexDiskSnapshots lists disk snapshots retained by a slice of an index
+type IndexDiskSnapshots struct {
+	InstId    common.IndexInstId `json:"instId"`
+	Name      string             `json:"name"`
+	Bucket    string             `json:"bucket"`
+	PartnId   common.PartitionId `json:"partnId"`
+	SliceId   SliceId            `json:"sliceId"`
+	Policy    RetentionPolicy    `json:"policy"`
+	Snapshots []DiskSnapshot     `json:"snapshots"`
+}
@@ -20,6 +20,7 @@ import (
 	"net/http"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -39,6 +40,65 @@ type BucketStats struct {
 
 	tsQueueSize   stats.Int64Val
 	numNonAlignTS stats.Int64Val
+
+	flushLatency stats.TimingStat
+
+	numBucketFlushes stats.Int64Val
+
+	inmemSnapInterval     stats.Int64Val
+	initInmemSnapInterval stats.Int64Val
+
+	workerQueueLatency   stats.Histogram
+	mutationQueueLatency stats.Histogram
+	snapshotLatency      stats.Histogram
+}
+
+//StreamStats accounts for payloads received on the dataport
+//connections of a stream
+type StreamStats struct {
+	numConnections    stats.Int64Val
+	numPackets        stats.Int64Val
+	numCompressed     stats.Int64Val
+	rawBytes          stats.Int64Val
+	wireBytes         stats.Int64Val
+	decompressionTime stats.Int64Val
+}
+
+func (s *StreamStats) Init() {
+	s.numConnections.Init()
+	s.numPackets.Init()
+	s.numCompressed.Init()
+	s.rawBytes.Init()
+	s.wireBytes.Init()
+	s.decompressionTime.Init()
+}
+
+//Set sums up statistics of each connection, as returned by
+//dataport.Server.GetStatistics
+func (s *StreamStats) Set(conns []interface{}) {
+	var packets, compressed, raw, wire, decompress float64
+	for _, conn := range conns {
+		cs, ok := conn.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		get := func(key string) float64 {
+			v, _ := cs[key].(float64)
+			return v
+		}
+		packets += get("packets")
+		compressed += get("compressedPackets")
+		raw += get("rawBytes")
+		wire += get("wireBytes")
+		decompress += get("decompressTime")
+	}
+
+	s.numConnections.Set(int64(len(conns)))
+	s.numPackets.Set(int64(packets))
+	s.numCompressed.Set(int64(compressed))
+	s.rawBytes.Set(int64(raw))
+	s.wireBytes.Set(int64(wire))
+	s.decompressionTime.Set(int64(decompress))
 }
 
 func (s *BucketStats) Init() {
@@ -46,6 +106,13 @@ func (s *BucketStats) Init() {
 	s.numMutationsQueued.Init()
 	s.tsQueueSize.Init()
 	s.numNonAlignTS.Init()
+	s.flushLatency.Init()
+	s.numBucketFlushes.Init()
+	s.inmemSnapInterval.Init()
+	s.initInmemSnapInterval.Init()
+	initLatencyHistogram(&s.workerQueueLatency)
+	initLatencyHistogram(&s.mutationQueueLatency)
+	initLatencyHistogram(&s.snapshotLatency)
 }
 
 type IndexTimingStats struct {
@@ -112,6 +179,10 @@ type IndexStats struct {
 	numSnapshots          stats.Int64Val
 	numCompactions        stats.Int64Val
 	numItemsFlushed       stats.Int64Val
+	numWritesSkipped      stats.Int64Val
+	numImmutableUpdates   stats.Int64Val
+	numDeletesSkipped     stats.Int64Val
+	numItemsPurged        stats.Int64Val
 	avgTsInterval         stats.Int64Val
 	avgTsItemsCount       stats.Int64Val
 	lastNumFlushQueued    stats.Int64Val
@@ -125,6 +196,15 @@ type IndexStats struct {
 	diskSnapStoreDuration stats.Int64Val
 	diskSnapLoadDuration  stats.Int64Val
 	notReadyError         stats.Int64Val
+	numDocErrors          stats.Int64Val
+	numEvalErrors         stats.Int64Val
+	numKeySizeErrors      stats.Int64Val
+
+	docErrors *docErrorLog
+
+	flushApplyLatency     stats.Histogram
+	snapshotCreateLatency stats.Histogram
+	sliceCommitLatency    stats.Histogram
 
 	Timings IndexTimingStats
 }
@@ -171,6 +251,10 @@ func (s *IndexStats) Init() {
 	s.numSnapshots.Init()
 	s.numCompactions.Init()
 	s.numItemsFlushed.Init()
+	s.numWritesSkipped.Init()
+	s.numImmutableUpdates.Init()
+	s.numDeletesSkipped.Init()
+	s.numItemsPurged.Init()
 	s.numDocsFlushQueued.Init()
 	s.sinceLastSnapshot.Init()
 	s.numSnapshotWaiters.Init()
@@ -179,13 +263,21 @@ func (s *IndexStats) Init() {
 	s.diskSnapStoreDuration.Init()
 	s.diskSnapLoadDuration.Init()
 	s.notReadyError.Init()
+	s.numDocErrors.Init()
+	s.numEvalErrors.Init()
+	s.numKeySizeErrors.Init()
+	s.docErrors = &docErrorLog{}
 
 	s.Timings.Init()
+	initLatencyHistogram(&s.flushApplyLatency)
+	initLatencyHistogram(&s.snapshotCreateLatency)
+	initLatencyHistogram(&s.sliceCommitLatency)
 }
 
 type IndexerStats struct {
 	indexes map[common.IndexInstId]*IndexStats
 	buckets map[string]*BucketStats
+	streams map[common.StreamId]*StreamStats //fixed set of streams
 
 	numConnections    stats.Int64Val
 	memoryQuota       stats.Int64Val
@@ -202,6 +294,13 @@ type IndexerStats struct {
 func (s *IndexerStats) Init() {
 	s.indexes = make(map[common.IndexInstId]*IndexStats)
 	s.buckets = make(map[string]*BucketStats)
+	s.streams = make(map[common.StreamId]*StreamStats)
+	for _, streamId := range []common.StreamId{common.MAINT_STREAM,
+		common.CATCHUP_STREAM, common.INIT_STREAM} {
+		st := &StreamStats{}
+		st.Init()
+		s.streams[streamId] = st
+	}
 	s.numConnections.Init()
 	s.memoryQuota.Init()
 	s.memoryUsed.Init()
@@ -265,6 +364,7 @@ func (is IndexerStats) MarshalJSON() ([]byte, error) {
 	addStat("memory_used", is.memoryUsed.Value())
 	addStat("memory_used_storage", is.memoryUsedStorage.Value())
 	addStat("memory_used_queue", is.memoryUsedQueue.Value())
+	addStat("num_mutation_queue_spill_errors", atomic.LoadInt64(&mutationQueueSpillErrors))
 	addStat("needs_restart", is.needsRestart.Value())
 	storageMode := fmt.Sprintf("%s", common.GetStorageMode())
 	addStat("storage_mode", storageMode)
@@ -321,6 +421,10 @@ func (is IndexerStats) MarshalJSON() ([]byte, error) {
 		addStat("num_compactions", s.numCompactions.Value())
 		addStat("flush_queue_size", postiveNum(s.numDocsFlushQueued.Value()-s.numDocsIndexed.Value()))
 		addStat("num_items_flushed", s.numItemsFlushed.Value())
+		addStat("num_writes_skipped", s.numWritesSkipped.Value())
+		addStat("num_immutable_updates", s.numImmutableUpdates.Value())
+		addStat("num_immutable_deletes_skipped", s.numDeletesSkipped.Value())
+		addStat("num_items_purged", s.numItemsPurged.Value())
 		addStat("avg_scan_latency", scanLat)
 		addStat("avg_scan_wait_latency", waitLat)
 		addStat("avg_scan_request_latency", scanReqLat)
@@ -334,6 +438,9 @@ func (is IndexerStats) MarshalJSON() ([]byte, error) {
 		addStat("disk_store_duration", s.diskSnapStoreDuration.Value())
 		addStat("disk_load_duration", s.diskSnapLoadDuration.Value())
 		addStat("not_ready_errcount", s.notReadyError.Value())
+		addStat("num_doc_errors", s.numDocErrors.Value())
+		addStat("num_eval_errors", s.numEvalErrors.Value())
+		addStat("num_key_size_errors", s.numKeySizeErrors.Value())
 
 		addStat("timings/dcp_getseqs", s.Timings.dcpSeqs.Value())
 		addStat("timings/storage_clone_handle", s.Timings.stCloneHandle.Value())
@@ -350,6 +457,9 @@ func (is IndexerStats) MarshalJSON() ([]byte, error) {
 		addStat("timings/storage_info", s.Timings.stKVInfo.Value())
 		addStat("timings/storage_meta_get", s.Timings.stKVMetaGet.Value())
 		addStat("timings/storage_meta_set", s.Timings.stKVMetaSet.Value())
+		addStat("histogram/flush_apply_latency", s.flushApplyLatency)
+		addStat("histogram/snapshot_create_latency", s.snapshotCreateLatency)
+		addStat("histogram/slice_commit_latency", s.sliceCommitLatency)
 	}
 
 	for _, s := range is.buckets {
@@ -358,11 +468,28 @@ func (is IndexerStats) MarshalJSON() ([]byte, error) {
 		addStat("num_mutations_queued", s.numMutationsQueued.Value())
 		addStat("ts_queue_size", s.tsQueueSize.Value())
 		addStat("num_nonalign_ts", s.numNonAlignTS.Value())
+		addStat("timings/flush_latency", s.flushLatency.Value())
+		addStat("num_bucket_flushes", s.numBucketFlushes.Value())
+		addStat("inmem_snapshot_interval", s.inmemSnapInterval.Value())
+		addStat("init_inmem_snapshot_interval", s.initInmemSnapInterval.Value())
+		addStat("histogram/worker_queue_latency", s.workerQueueLatency)
+		addStat("histogram/mutation_queue_latency", s.mutationQueueLatency)
+		addStat("histogram/snapshot_latency", s.snapshotLatency)
 		if st := common.BucketSeqsTiming(s.bucket); st != nil {
 			addStat("timings/dcp_getseqs", st.Value())
 		}
 	}
 
+	for streamId, s := range is.streams {
+		prefix = fmt.Sprintf("%s:", streamId)
+		addStat("dataport_connections", s.numConnections.Value())
+		addStat("dataport_packets", s.numPackets.Value())
+		addStat("dataport_compressed_packets", s.numCompressed.Value())
+		addStat("dataport_raw_bytes", s.rawBytes.Value())
+		addStat("dataport_wire_bytes", s.wireBytes.Value())
+		addStat("dataport_decompression_time", s.decompressionTime.Value())
+	}
+
 	return json.Marshal(statsMap)
 }
 
@@ -410,12 +537,16 @@ func NewStatsManager(supvCmdch MsgChannel,
 	}
 
 	s.config.Store(config)
+	mTracer.UpdateConfig(config)
+	updateDocErrorConfig(config)
 
 	http.HandleFunc("/stats", s.handleStatsReq)
 	http.HandleFunc("/stats/mem", s.handleMemStatsReq)
 	http.HandleFunc("/stats/storage/mm", s.handleStorageMMStatsReq)
 	http.HandleFunc("/stats/storage", s.handleStorageStatsReq)
 	http.HandleFunc("/stats/reset", s.handleStatsResetReq)
+	http.HandleFunc("/stats/traces", s.handleTracesReq)
+	http.HandleFunc("/stats/errors", s.handleDocErrorsReq)
 	go s.run()
 	go s.runStatsDumpLogger()
 	return s, &MsgSuccess{}
@@ -440,7 +571,8 @@ func (s *statsManager) tryUpdateStats(sync bool) {
 		s.Unlock()
 
 		go func() {
-			stats_list := []MsgType{STORAGE_STATS, SCAN_STATS, INDEX_PROGRESS_STATS, INDEXER_STATS}
+			stats_list := []MsgType{STORAGE_STATS, SCAN_STATS, INDEX_PROGRESS_STATS,
+				INDEXER_STATS, DATAPORT_STATS}
 			for _, t := range stats_list {
 				ch := make(chan bool)
 				msg := &MsgStatsRequest{
@@ -544,6 +676,58 @@ func (s *statsManager) handleStorageMMStatsReq(w http.ResponseWriter, r *http.Re
 	}
 }
 
+//handleDocErrorsReq serves recent documents skipped by each index, keyed by
+//bucket:index. Optional bucket and index parameters filter the indexes.
+func (s *statsManager) handleDocErrorsReq(w http.ResponseWriter, r *http.Request) {
+	conf := s.config.Load()
+	valid, _ := common.IsAuthValid(r, conf["clusterAddr"].String())
+	if !valid {
+		w.WriteHeader(401)
+		w.Write([]byte("401 Unauthorized"))
+		return
+	}
+
+	if r.Method == "POST" || r.Method == "GET" {
+		bucket, index := r.FormValue("bucket"), r.FormValue("index")
+		docErrors := make(map[string][]*DocError)
+		if is := s.stats.Get(); is != nil {
+			for _, st := range is.indexes {
+				if (bucket != "" && st.bucket != bucket) ||
+					(index != "" && st.name != index) {
+					continue
+				}
+				key := fmt.Sprintf("%s:%s", st.bucket, st.name)
+				docErrors[key] = st.docErrors.Get()
+			}
+		}
+		bytes, _ := json.Marshal(docErrors)
+		w.WriteHeader(200)
+		w.Write(bytes)
+	} else {
+		w.WriteHeader(400)
+		w.Write([]byte("Unsupported method"))
+	}
+}
+
+func (s *statsManager) handleTracesReq(w http.ResponseWriter, r *http.Request) {
+	conf := s.config.Load()
+	valid, _ := common.IsAuthValid(r, conf["clusterAddr"].String())
+	if !valid {
+		w.WriteHeader(401)
+		w.Write([]byte("401 Unauthorized"))
+		return
+	}
+
+	if r.Method == "POST" || r.Method == "GET" {
+		bytes, _ := json.Marshal(mTracer.Traces())
+		w.WriteHeader(200)
+		w.Write(bytes)
+	} else {
+		w.WriteHeader(400)
+		w.Write([]byte("Unsupported method"))
+	}
+}
+
 func (s *statsManager) handleStatsResetReq(w http.ResponseWriter, r *http.Request) {
 	conf := s.config.Load()
 	valid, _ := common.IsAuthValid(r, conf["clusterAddr"].String())
@@ -595,6 +779,8 @@ func (s *statsManager) handleIndexInstanceUpdate(cmd Message) {
 func (s *statsManager) handleConfigUpdate(cmd Message) {
 	cfg := cmd.(*MsgConfigUpdate)
 	s.config.Store(cfg.GetConfig())
+	mTracer.UpdateConfig(cfg.GetConfig())
+	updateDocErrorConfig(cfg.GetConfig())
 	platform.StoreUint64(&s.statsLogDumpInterval, cfg.GetConfig()["settings.statsLogDumpInterval"].Uint64())
 	s.supvCmdch <- &MsgSuccess{}
 }
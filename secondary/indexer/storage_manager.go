@@ -14,7 +14,6 @@ import (
 	"encoding/gob"
 	"errors"
 	"github.com/couchbase/indexing/secondary/common"
-	"github.com/couchbase/indexing/secondary/fdb"
 	"github.com/couchbase/indexing/secondary/logging"
 	"sync"
 	"time"
@@ -47,8 +46,7 @@ type storageMgr struct {
 	// atleast-timestamp
 	waitersMap map[common.IndexInstId][]*snapshotWaiter
 
-	dbfile *forestdb.File
-	meta   *forestdb.KVStore // handle for index meta
+	meta *localMetaStore // index meta when the manager is disabled
 
 	config common.Config
 
@@ -109,16 +107,8 @@ func NewStorageManager(supvCmdch MsgChannel, supvRespch MsgChannel,
 
 	//if manager is not enabled, create meta file
 	if config["enableManager"].Bool() == false {
-		fdbconfig := forestdb.DefaultConfig()
-		kvconfig := forestdb.DefaultKVStoreConfig()
 		var err error
-
-		if s.dbfile, err = forestdb.Open("meta", fdbconfig); err != nil {
-			return nil, &MsgError{err: Error{cause: err}}
-		}
-
-		// Make use of default kvstore provided by forestdb
-		if s.meta, err = s.dbfile.OpenKVStore("default", kvconfig); err != nil {
+		if s.meta, err = openLocalMetaStore(); err != nil {
 			return nil, &MsgError{err: Error{cause: err}}
 		}
 	}
@@ -186,6 +176,9 @@ func (s *storageMgr) handleSupvervisorCommands(cmd Message) {
 
 	case STORAGE_STATS:
 		s.handleStats(cmd)
+
+	case STORAGE_INDEX_DISK_SNAPSHOTS:
+		s.handleIndexDiskSnapshots(cmd)
 	}
 }
 
@@ -241,6 +234,7 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 
 	defer destroyIndexSnapMap(indexSnapMap)
 
+	t0 := time.Now()
 	var needsCommit bool
 	var forceCommit bool
 	snapType := tsVbuuid.GetSnapType()
@@ -337,6 +331,9 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 							idxStats.numSnapshots.Add(1)
 							if needsCommit {
 								idxStats.numCommits.Add(1)
+								addLatency(&idxStats.sliceCommitLatency, snapCreateDur)
+							} else {
+								addLatency(&idxStats.snapshotCreateLatency, snapCreateDur)
 							}
 
 							snapOpenStart := time.Now()
@@ -398,6 +395,13 @@ func (s *storageMgr) createSnapshotWorker(streamId common.StreamId, bucket strin
 
 	wg.Wait()
 
+	if !flushWasAborted {
+		if bucketStats, ok := stats.buckets[bucket]; ok {
+			addLatency(&bucketStats.snapshotLatency, time.Since(t0))
+		}
+		mTracer.snapshotDone(streamId, bucket, tsVbuuid)
+	}
+
 	s.supvRespch <- &MsgMutMgrFlushDone{mType: STORAGE_SNAP_DONE,
 		streamId: streamId,
 		bucket:   bucket,
@@ -473,9 +477,24 @@ func (sm *storageMgr) handleRollback(cmd Message) {
 	streamId := cmd.(*MsgRollback).GetStreamId()
 	rollbackTs := cmd.(*MsgRollback).GetRollbackTs()
 	bucket := cmd.(*MsgRollback).GetBucket()
-	logging.Infof("StorageMgr::handleRollback rollbackTs is %v", rollbackTs)
+	bucketFlush := cmd.(*MsgRollback).IsBucketFlush()
+	logging.Infof("StorageMgr::handleRollback rollbackTs is %v. Bucket Flush %v",
+		rollbackTs, bucketFlush)
 
 	var respTs *common.TsVbuuid
+	var respSet bool
+
+	//restart the stream from the oldest timestamp any slice is rolled back to
+	setRespTs := func(ts *common.TsVbuuid) {
+		if respSet {
+			respTs = minRestartTs(respTs, ts)
+		} else {
+			respTs, respSet = ts, true
+		}
+	}
+
+	partialRollback := sm.config["settings.recovery.partial_rollback"].Bool()
+	partialSnaps := make(map[common.IndexInstId]SnapshotInfo)
 
 	//for every index managed by this indexer
 	for idxInstId, partnMap := range sm.indexPartnMap {
@@ -492,20 +511,49 @@ func (sm *storageMgr) handleRollback(cmd Message) {
 
 				//rollback all slices
 				for _, slice := range sc.GetAllSlices() {
-					infos, err := slice.GetSnapshots()
-					// TODO: Proper error handling if possible
-					if err != nil {
-						panic("Unable read snapinfo -" + err.Error())
+					//a flushed bucket has nothing in common with the snapshots,
+					//truncate the index
+					var snapInfo, latest SnapshotInfo
+					if !bucketFlush {
+						infos, err := slice.GetSnapshots()
+						// TODO: Proper error handling if possible
+						if err != nil {
+							panic("Unable read snapinfo -" + err.Error())
+						}
+						s := NewSnapshotInfoContainer(infos)
+						snapInfo = s.GetOlderThanTS(rollbackTs)
+						latest = s.GetLatest()
 					}
-					s := NewSnapshotInfoContainer(infos)
-					snapInfo := s.GetOlderThanTS(rollbackTs)
-					if snapInfo != nil {
+					vr, canRollbackVbuckets := slice.(VbucketRollbacker)
+					if snapInfo == nil && partialRollback && canRollbackVbuckets &&
+						latest != nil && rollbackTs != nil {
+
+						//rollback only the vbuckets past rollbackTs, others restart
+						//from the latest snapshot
+						vbs := vbucketsToRollback(latest.Timestamp(), rollbackTs)
+						ts := vbucketRollbackTs(latest.Timestamp(), vbs)
+						newInfo, err := vr.RollbackVbuckets(latest, vbs, ts)
+						if err == nil {
+							logging.Infof("StorageMgr::handleRollback Rollback Index: %v "+
+								"PartitionId: %v SliceId: %v To Snapshot %v. Vbuckets Rolled "+
+								"Back To Zero %v", idxInstId, partnId, slice.Id(), latest, vbs)
+							partialSnaps[idxInstId] = newInfo
+							setRespTs(ts)
+						} else {
+							sm.supvCmdch <- &MsgError{err: Error{code: ERROR_STORAGE_MGR_ROLLBACK_FAIL,
+								severity: FATAL,
+								category: STORAGE_MGR,
+								cause:    err}}
+							return
+						}
+
+					} else if snapInfo != nil {
 						err := slice.Rollback(snapInfo)
 						if err == nil {
 							logging.Infof("StorageMgr::handleRollback Rollback Index: %v "+
 								"PartitionId: %v SliceId: %v To Snapshot %v ", idxInstId, partnId,
 								slice.Id(), snapInfo)
-							respTs = snapInfo.Timestamp()
+							setRespTs(snapInfo.Timestamp())
 						} else {
 							//send error response back
 							//TODO handle the case where some of the slices fail to rollback
@@ -525,7 +573,7 @@ func (sm *storageMgr) handleRollback(cmd Message) {
 								slice.Id())
 							//once rollback to zero has happened, set response ts to nil
 							//to represent the initial state of storage
-							respTs = nil
+							setRespTs(nil)
 						} else {
 							//send error response back
 							//TODO handle the case where some of the slices fail to rollback
@@ -565,7 +613,28 @@ func (sm *storageMgr) handleRollback(cmd Message) {
 		}
 	}()
 
-	sm.updateIndexSnapMap(sm.indexPartnMap, streamId, bucket)
+	//snapshots of indexes rolled back per vbucket are not yet on disk,
+	//these are opened directly
+	indexPartnMap := sm.indexPartnMap
+	if len(partialSnaps) > 0 {
+		indexPartnMap = make(IndexPartnMap)
+		for idxInstId, partnMap := range sm.indexPartnMap {
+			if info, ok := partialSnaps[idxInstId]; ok {
+				slice := partnMap[0].Sc.GetSliceById(0)
+				if err := sm.updateIndexSnapshot(idxInstId, slice, info); err != nil {
+					sm.supvCmdch <- &MsgError{err: Error{code: ERROR_STORAGE_MGR_ROLLBACK_FAIL,
+						severity: FATAL,
+						category: STORAGE_MGR,
+						cause:    err}}
+					return
+				}
+			} else {
+				indexPartnMap[idxInstId] = partnMap
+			}
+		}
+	}
+
+	sm.updateIndexSnapMap(indexPartnMap, streamId, bucket)
 
 	sm.supvCmdch <- &MsgRollback{streamId: streamId,
 		bucket:     bucket,
@@ -668,12 +737,10 @@ func (s *storageMgr) handleUpdateIndexInstMap(cmd Message) {
 				"IndexInstMap %v. Err %v", instMap, err)
 		}
 
-		if err = s.meta.SetKV([]byte(INST_MAP_KEY_NAME), instBytes.Bytes()); err != nil {
+		if err = s.meta.set(INST_MAP_KEY_NAME, instBytes.Bytes()); err != nil {
 			logging.Errorf("StorageMgr::handleUpdateIndexInstMap \n\tError "+
 				"Storing IndexInstMap %v", err)
 		}
-
-		s.dbfile.Commit(forestdb.COMMIT_MANUAL_WAL_FLUSH)
 	}
 
 	s.supvCmdch <- &MsgSuccess{}
@@ -837,6 +904,108 @@ func (s *storageMgr) getIndexStorageStats() []IndexStorageStats {
 	return stats
 }
 
+func (s *storageMgr) handleIndexDiskSnapshots(cmd Message) {
+	s.supvCmdch <- &MsgSuccess{}
+	req := cmd.(*MsgIndexDiskSnapshots)
+	errch := req.GetErrorChannel()
+	instId := req.GetInstId()
+
+	if instId != 0 {
+		if inst, ok := s.indexInstMap[instId]; !ok || inst.State == common.INDEX_STATE_DELETED {
+			errch <- common.ErrIndexNotFound
+			return
+		}
+	}
+
+	type retainerSlice struct {
+		IndexDiskSnapshots
+		slice    Slice
+		retainer SnapshotRetainer
+	}
+
+	var slices []retainerSlice
+	for idxInstId, partnMap := range s.indexPartnMap {
+		inst, ok := s.indexInstMap[idxInstId]
+		if !ok || inst.State == common.INDEX_STATE_DELETED ||
+			instId != 0 && idxInstId != instId {
+			continue
+		}
+
+		for partnId, partnInst := range partnMap {
+			for _, slice := range partnInst.Sc.GetAllSlices() {
+				retainer, ok := slice.(SnapshotRetainer)
+				if !ok {
+					continue
+				}
+
+				slice.IncrRef()
+				slices = append(slices, retainerSlice{
+					IndexDiskSnapshots: IndexDiskSnapshots{
+						InstId:  idxInstId,
+						Name:    inst.Defn.Name,
+						Bucket:  inst.Defn.Bucket,
+						PartnId: partnId,
+						SliceId: slice.Id(),
+					},
+					slice:    slice,
+					retainer: retainer,
+				})
+			}
+		}
+	}
+
+	// Snapshot listing and pinning read the index directories, do not
+	// block the storage manager on it
+	go func() {
+		defer func() {
+			for _, rs := range slices {
+				rs.slice.DecrRef()
+			}
+		}()
+
+		var found bool
+		var result []IndexDiskSnapshots
+		for _, rs := range slices {
+			var err error
+			if req.setPolicy {
+				err = rs.retainer.SetRetentionPolicy(req.policy)
+			} else if req.snapshotId != "" {
+				// Snapshot is owned by one of the slices
+				if err = rs.retainer.PinSnapshot(req.snapshotId, req.pin); err == nil {
+					found = true
+				} else if err == ErrSnapshotNotFound {
+					err = nil
+				}
+			}
+
+			var snaps []DiskSnapshot
+			if err == nil {
+				snaps, err = rs.retainer.DiskSnapshots()
+			}
+
+			if err != nil {
+				logging.Errorf("StorageMgr::handleIndexDiskSnapshots Index %v Slice %v "+
+					"Error %v", rs.InstId, rs.SliceId, err)
+				errch <- err
+				return
+			}
+
+			snapshots := rs.IndexDiskSnapshots
+			snapshots.Policy = rs.retainer.RetentionPolicy()
+			snapshots.Snapshots = snaps
+			result = append(result, snapshots)
+		}
+
+		if req.snapshotId != "" && !req.setPolicy && !found {
+			errch <- ErrSnapshotNotFound
+			return
+		}
+
+		errch <- nil
+		req.GetReplyChannel() <- result
+	}()
+}
+
 func (s *storageMgr) handleIndexCompaction(cmd Message) {
 	s.supvCmdch <- &MsgSuccess{}
 	req := cmd.(*MsgIndexCompact)
@@ -889,7 +1058,6 @@ func (s *storageMgr) updateIndexSnapMap(indexPartnMap IndexPartnMap,
 	s.muSnap.Lock()
 	defer s.muSnap.Unlock()
 
-	var tsVbuuid *common.TsVbuuid
 	for idxInstId, partnMap := range indexPartnMap {
 
 		//if bucket and stream have been provided
@@ -925,38 +1093,68 @@ func (s *storageMgr) updateIndexSnapMap(indexPartnMap IndexPartnMap,
 		latestSnapshotInfo := snapInfoContainer.GetLatest()
 
 		if latestSnapshotInfo != nil {
-			logging.Infof("StorageMgr::updateIndexSnapMap IndexInst:%v Attempting to open snapshot (%v)",
-				idxInstId, latestSnapshotInfo)
-			latestSnapshot, err := slice.OpenSnapshot(latestSnapshotInfo)
-			if err != nil {
+			if err := s.openIndexSnapshot(idxInstId, slice, latestSnapshotInfo); err != nil {
 				panic("Unable to open snapshot -" + err.Error())
 			}
-			ss := &sliceSnapshot{
-				id:   SliceId(0),
-				snap: latestSnapshot,
-			}
+		} else {
+			s.addNilSnapshot(idxInstId, bucket)
+		}
+	}
+}
 
-			tsVbuuid = latestSnapshotInfo.Timestamp()
+//updateIndexSnapshot replaces the snapshot of an index with the given one.
+//If the snapshot cannot be opened, the index is left with a nil snapshot.
+func (s *storageMgr) updateIndexSnapshot(idxInstId common.IndexInstId,
+	slice Slice, info SnapshotInfo) error {
 
-			sid := SliceId(0)
-			pid := common.PartitionId(0)
+	s.muSnap.Lock()
+	defer s.muSnap.Unlock()
 
-			ps := &partitionSnapshot{
-				id:     pid,
-				slices: map[SliceId]SliceSnapshot{sid: ss},
-			}
+	DestroyIndexSnapshot(s.indexSnapMap[idxInstId])
+	delete(s.indexSnapMap, idxInstId)
+	s.notifySnapshotDeletion(idxInstId)
 
-			is := &indexSnapshot{
-				instId: idxInstId,
-				ts:     tsVbuuid,
-				partns: map[common.PartitionId]PartitionSnapshot{pid: ps},
-			}
-			s.indexSnapMap[idxInstId] = is
-			s.notifySnapshotCreation(is)
-		} else {
-			s.addNilSnapshot(idxInstId, bucket)
-		}
+	err := s.openIndexSnapshot(idxInstId, slice, info)
+	if err != nil {
+		logging.Errorf("StorageMgr::updateIndexSnapshot IndexInst:%v Unable to open "+
+			"snapshot (%v) - %v", idxInstId, info, err)
+		s.addNilSnapshot(idxInstId, s.indexInstMap[idxInstId].Defn.Bucket)
 	}
+	return err
+}
+
+//openIndexSnapshot opens the given slice snapshot as snapshot of the index.
+//Caller must hold muSnap.
+func (s *storageMgr) openIndexSnapshot(idxInstId common.IndexInstId,
+	slice Slice, info SnapshotInfo) error {
+
+	logging.Infof("StorageMgr::updateIndexSnapMap IndexInst:%v Attempting to open snapshot (%v)",
+		idxInstId, info)
+	latestSnapshot, err := slice.OpenSnapshot(info)
+	if err != nil {
+		return err
+	}
+	ss := &sliceSnapshot{
+		id:   SliceId(0),
+		snap: latestSnapshot,
+	}
+
+	sid := SliceId(0)
+	pid := common.PartitionId(0)
+
+	ps := &partitionSnapshot{
+		id:     pid,
+		slices: map[SliceId]SliceSnapshot{sid: ss},
+	}
+
+	is := &indexSnapshot{
+		instId: idxInstId,
+		ts:     info.Timestamp(),
+		partns: map[common.PartitionId]PartitionSnapshot{pid: ps},
+	}
+	s.indexSnapMap[idxInstId] = is
+	s.notifySnapshotCreation(is)
+	return nil
 }
 
 func copyIndexSnapMap(inMap IndexSnapMap) IndexSnapMap {
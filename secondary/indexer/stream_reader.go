@@ -26,6 +26,14 @@ import (
 //in mutation queue. This is the only component writing to a mutation queue.
 type MutationStreamReader interface {
 	Shutdown()
+
+	//Replay feeds a dataport recording into this stream reader, as if
+	//the messages were received from projector. If realtime is true,
+	//messages are fed with their recorded spacing.
+	Replay(path string, realtime bool) error
+
+	//GetStatistics returns statistics of each dataport connection
+	GetStatistics() (map[string]interface{}, error)
 }
 
 type mutationStreamReader struct {
@@ -125,6 +133,30 @@ func CreateMutationStreamReader(streamId common.StreamId, bucketQueueMap BucketQ
 	return r, &MsgSuccess{}
 }
 
+func (r *mutationStreamReader) GetStatistics() (map[string]interface{}, error) {
+	return r.stream.GetStatistics()
+}
+
+//Replay feeds a dataport recording into the mutation stream.
+//This call doesn't return till the recording is exhausted or
+//the reader is shutdown.
+func (r *mutationStreamReader) Replay(path string, realtime bool) error {
+
+	logging.Infof("MutationStreamReader:Replay StreamReader %v Recording %v "+
+		"Realtime %v", r.streamId, path, realtime)
+
+	count, err := dataport.Replay(path, r.streamMutch, realtime, r.killch)
+	if err != nil {
+		logging.Errorf("MutationStreamReader:Replay StreamReader %v Recording %v "+
+			"Error %v", r.streamId, path, err)
+		return err
+	}
+
+	logging.Infof("MutationStreamReader:Replay StreamReader %v Replayed %v "+
+		"Messages", r.streamId, count)
+	return nil
+}
+
 //Shutdown shuts down the mutation stream and all workers.
 //This call doesn't return till shutdown is complete.
 func (r *mutationStreamReader) Shutdown() {
@@ -219,8 +251,12 @@ func (r *mutationStreamReader) listenSupvCmd() {
 
 func (r *mutationStreamReader) handleVbKeyVersions(vbKeyVers []*protobuf.VbKeyVersions) {
 
+	recvTime := time.Now().UnixNano()
 	for _, vb := range vbKeyVers {
-		r.streamWorkers[int(vb.GetVbucket())%r.numWorkers].workerch <- vb
+		r.streamWorkers[int(vb.GetVbucket())%r.numWorkers].workerch <- streamWorkerMsg{
+			vb:       vb,
+			recvTime: recvTime,
+		}
 	}
 
 }
@@ -430,9 +466,16 @@ func (r *mutationStreamReader) setIndexerState(is common.IndexerState) {
 
 //Stream Worker
 
+//streamWorkerMsg is a vbucket's key versions along with the time
+//these were received by the stream reader
+type streamWorkerMsg struct {
+	vb       *protobuf.VbKeyVersions
+	recvTime int64
+}
+
 type streamWorker struct {
-	workerch     chan *protobuf.VbKeyVersions //buffered channel for each worker
-	workerStopCh StopChannel                  //stop channels of workers
+	workerch     chan streamWorkerMsg //buffered channel for each worker
+	workerStopCh StopChannel          //stop channels of workers
 	bucketFilter map[string]*common.TsVbuuid
 
 	bucketPrevSnapMap map[string]*common.TsVbuuid
@@ -458,7 +501,7 @@ func newStreamWorker(streamId common.StreamId, numWorkers int, workerId int, con
 
 	w := &streamWorker{streamId: streamId,
 		workerId:          workerId,
-		workerch:          make(chan *protobuf.VbKeyVersions, getWorkerBufferSize(config)/uint64(numWorkers)),
+		workerch:          make(chan streamWorkerMsg, getWorkerBufferSize(config)/uint64(numWorkers)),
 		workerStopCh:      make(StopChannel),
 		bucketFilter:      make(map[string]*common.TsVbuuid),
 		bucketPrevSnapMap: make(map[string]*common.TsVbuuid),
@@ -477,9 +520,14 @@ func (w *streamWorker) start() {
 	for {
 		select {
 
-		case vb := <-w.workerch:
+		case msg := <-w.workerch:
+			vb := msg.vb
+			stats := w.reader.stats.Get()
+			if bstats, ok := stats.buckets[vb.GetBucketname()]; ok {
+				addLatencySince(&bstats.workerQueueLatency, msg.recvTime, time.Now())
+			}
 			w.handleKeyVersions(vb.GetBucketname(), Vbucket(vb.GetVbucket()),
-				Vbuuid(vb.GetVbuuid()), vb.GetKvs())
+				Vbuuid(vb.GetVbuuid()), vb.GetKvs(), msg.recvTime)
 
 		case <-w.workerStopCh:
 			return
@@ -491,10 +539,10 @@ func (w *streamWorker) start() {
 }
 
 func (w *streamWorker) handleKeyVersions(bucket string, vbucket Vbucket, vbuuid Vbuuid,
-	kvs []*protobuf.KeyVersions) {
+	kvs []*protobuf.KeyVersions, recvTime int64) {
 
 	for _, kv := range kvs {
-		w.handleSingleKeyVersion(bucket, vbucket, vbuuid, kv)
+		w.handleSingleKeyVersion(bucket, vbucket, vbuuid, kv, recvTime)
 	}
 
 }
@@ -502,13 +550,14 @@ func (w *streamWorker) handleKeyVersions(bucket string, vbucket Vbucket, vbuuid
 //handleSingleKeyVersion processes a single mutation based on the command type
 //A mutation is put in a worker queue and control message is sent to supervisor
 func (w *streamWorker) handleSingleKeyVersion(bucket string, vbucket Vbucket, vbuuid Vbuuid,
-	kv *protobuf.KeyVersions) {
+	kv *protobuf.KeyVersions, recvTime int64) {
 
 	meta := NewMutationMeta()
 	meta.bucket = bucket
 	meta.vbucket = vbucket
 	meta.vbuuid = vbuuid
 	meta.seqno = Seqno(kv.GetSeqno())
+	meta.recvTime = recvTime
 
 	defer meta.Free()
 
@@ -526,7 +575,7 @@ func (w *streamWorker) handleSingleKeyVersion(bucket string, vbucket Vbucket, vb
 		switch byte(cmd) {
 
 		//case protobuf.Command_Upsert, protobuf.Command_Deletion, protobuf.Command_UpsertDeletion:
-		case common.Upsert, common.Deletion, common.UpsertDeletion:
+		case common.Upsert, common.Deletion, common.UpsertDeletion, common.EvalError:
 
 			//As there can multiple keys in a KeyVersion for a mutation,
 			//filter needs to be evaluated and set only once.
@@ -558,6 +607,7 @@ func (w *streamWorker) handleSingleKeyVersion(bucket string, vbucket Vbucket, vb
 				//TODO use free list here to reuse the struct and reduce garbage
 				mutk = NewMutationKeys()
 				mutk.meta = meta.Clone()
+				mutk.meta.trace = mTracer.newTrace(w.streamId, meta, kv.GetDocid(), recvTime)
 				mutk.docid = kv.GetDocid()
 				mutk.mut = mutk.mut[:0]
 			}
@@ -626,6 +676,10 @@ func (w *streamWorker) handleSingleMutation(mut *MutationKeys, stopch StopChanne
 
 	//based on the index, enqueue the mutation in the right queue
 	if q, ok := w.reader.bucketQueueMap[mut.meta.bucket]; ok {
+		mut.meta.queueTime = time.Now().UnixNano()
+		if mut.meta.trace != nil {
+			mut.meta.trace.Queued = mut.meta.queueTime
+		}
 		q.queue.Enqueue(mut, mut.meta.vbucket, stopch)
 
 		stats := w.reader.stats.Get()
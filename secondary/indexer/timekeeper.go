@@ -55,6 +55,13 @@ type timekeeper struct {
 	lock sync.RWMutex //lock to protect this structure
 
 	indexerState common.IndexerState
+
+	//flush QoS
+	flushPrio          *flushPriorities
+	flushDeferredSince map[string]time.Time //stream:bucket
+
+	//minimum merge ts of CATCHUP_STREAM for indexes resumed from pause
+	catchupMergeTs map[string]*common.TsVbuuid
 }
 
 type InitialBuildInfo struct {
@@ -90,6 +97,10 @@ func NewTimekeeper(supvCmdch MsgChannel, supvRespch MsgChannel,
 		indexPartnMap:  make(IndexPartnMap),
 		indexBuildInfo: make(map[common.IndexInstId]*InitialBuildInfo),
 		bucketConn:     make(map[string]*couchbase.Bucket),
+
+		flushPrio:          newFlushPriorities(config),
+		flushDeferredSince: make(map[string]time.Time),
+		catchupMergeTs:     make(map[string]*common.TsVbuuid),
 	}
 
 	//start timekeeper loop which listens to commands from its supervisor
@@ -246,6 +257,9 @@ func (tk *timekeeper) handleStreamOpen(cmd Message) {
 
 	//fresh start or recovery
 	case STREAM_INACTIVE, STREAM_PREPARE_DONE:
+		if streamId == common.CATCHUP_STREAM && status == STREAM_INACTIVE {
+			delete(tk.catchupMergeTs, bucket)
+		}
 		tk.ss.initBucketInStream(streamId, bucket)
 		if restartTs != nil {
 			tk.ss.streamBucketRestartTsMap[streamId][bucket] = restartTs
@@ -551,6 +565,9 @@ func (tk *timekeeper) handleFlushDone(cmd Message) {
 	case common.INIT_STREAM:
 		tk.handleFlushDoneInitStream(cmd)
 
+	case common.CATCHUP_STREAM:
+		tk.handleFlushDoneCatchupStream(cmd)
+
 	default:
 		logging.Errorf("Timekeeper::handleFlushDone \n\tInvalid StreamId %v ", streamId)
 	}
@@ -666,9 +683,11 @@ func (tk *timekeeper) handleFlushDoneCatchupStream(cmd Message) {
 
 	case STREAM_ACTIVE:
 
-		if tk.checkCatchupStreamReadyToMerge(cmd) {
+		lastFlushedTs := tk.ss.streamBucketLastFlushedTsMap[streamId][bucket]
+		if tk.checkCatchupStreamReadyToMerge(streamId, bucket, lastFlushedTs) {
 			//if stream is ready to merge, further processing is
 			//not required, return from here.
+			tk.supvCmdch <- &MsgSuccess{}
 			return
 		}
 
@@ -1368,11 +1387,24 @@ func (tk *timekeeper) handleInitBuildDoneAck(cmd Message) {
 		}
 	}
 
+	//for CATCHUP_STREAM, this means the index resumed from pause got added
+	//to MAINT_STREAM.
+	if streamId == common.CATCHUP_STREAM {
+		if mergeTs != nil {
+			tk.catchupMergeTs[bucket] = mergeTs.Copy()
+		} else {
+			logging.Fatalf("Timekeeper::handleInitBuildDoneAck %v %v. Received unexpected nil mergeTs.",
+				streamId, bucket)
+			common.CrashOnError(errors.New("Nil MergeTs Received"))
+		}
+	}
+
 	if !tk.ss.checkAnyFlushPending(streamId, bucket) &&
 		!tk.ss.checkAnyAbortPending(streamId, bucket) {
 
 		lastFlushedTs := tk.ss.streamBucketLastFlushedTsMap[streamId][bucket]
-		if tk.checkInitStreamReadyToMerge(streamId, bucket, lastFlushedTs) {
+		if tk.checkInitStreamReadyToMerge(streamId, bucket, lastFlushedTs) ||
+			tk.checkCatchupStreamReadyToMerge(streamId, bucket, lastFlushedTs) {
 			//if stream is ready to merge, further STREAM_ACTIVE processing is
 			//not required, return from here.
 			tk.supvCmdch <- &MsgSuccess{}
@@ -1483,6 +1515,11 @@ func (tk *timekeeper) handleRecoveryDone(cmd Message) {
 			logging.Warnf("Timekeeper::handleRecoveryDone %v %v. Received nil mergeTs. Ignored",
 				streamId, bucket)
 		}
+
+		//index resumed from pause got added to MAINT_STREAM again
+		if _, ok := tk.catchupMergeTs[bucket]; ok && mergeTs != nil {
+			tk.catchupMergeTs[bucket] = mergeTs.Copy()
+		}
 	}
 
 	//Check for possiblity of build done after recovery is done.
@@ -1529,6 +1566,10 @@ func (tk *timekeeper) handleConfigUpdate(cmd Message) {
 	tk.config = cfgUpdate.GetConfig()
 	tk.ss.UpdateConfig(tk.config)
 
+	tk.lock.Lock()
+	tk.flushPrio = newFlushPriorities(tk.config)
+	tk.lock.Unlock()
+
 	tk.supvCmdch <- &MsgSuccess{}
 }
 
@@ -1823,48 +1864,88 @@ func (tk *timekeeper) checkInitStreamReadyToMerge(streamId common.StreamId,
 	return false
 }
 
-func (tk *timekeeper) checkCatchupStreamReadyToMerge(cmd Message) bool {
+//checkCatchupStreamReadyToMerge checks if CATCHUP_STREAM of an index
+//resumed from pause has flushed past MAINT_STREAM. The index is already
+//in MAINT_STREAM from catchupMergeTs, so both streams can be merged.
+func (tk *timekeeper) checkCatchupStreamReadyToMerge(streamId common.StreamId,
+	bucket string, flushTs *common.TsVbuuid) bool {
 
-	streamId := cmd.(*MsgMutMgrFlushDone).GetStreamId()
-	bucket := cmd.(*MsgMutMgrFlushDone).GetBucket()
+	logging.LazyTrace(func() string {
+		return fmt.Sprintf("Timekeeper::checkCatchupStreamReadyToMerge \n\t Stream %v Bucket %v "+
+			"FlushTs %v", streamId, bucket, flushTs)
+	})
 
-	if streamId == common.CATCHUP_STREAM {
+	if streamId != common.CATCHUP_STREAM {
+		return false
+	}
 
-		//get the lowest TS for this bucket in MAINT_STREAM
-		bucketTsListMap := tk.ss.streamBucketTsListMap[common.MAINT_STREAM]
-		tsList := bucketTsListMap[bucket]
-		var maintTs *common.TsVbuuid
-		if tsList.Len() > 0 {
-			e := tsList.Front()
-			maintTs = e.Value.(*common.TsVbuuid)
-		} else {
-			return false
-		}
+	//merge cannot be done till the index has been added to MAINT_STREAM
+	minMergeTs, ok := tk.catchupMergeTs[bucket]
+	if !ok || minMergeTs == nil {
+		return false
+	}
+
+	//if flushTs is not on snap boundary, merge cannot be done
+	if flushTs == nil || !flushTs.IsSnapAligned() {
+		return false
+	}
 
-		//get the lastFlushedTs of CATCHUP_STREAM
-		bucketLastFlushedTsMap := tk.ss.streamBucketLastFlushedTsMap[common.CATCHUP_STREAM]
-		lastFlushedTs := bucketLastFlushedTsMap[bucket]
-		if lastFlushedTs == nil {
+	//CATCHUP_STREAM cannot be merged to MAINT_STREAM if its not ACTIVE
+	if tk.ss.streamBucketStatus[common.MAINT_STREAM][bucket] != STREAM_ACTIVE {
+		logging.Infof("Timekeeper::checkCatchupStreamReadyToMerge MAINT_STREAM in %v. "+
+			"CATCHUP_STREAM cannot be merged. Continue both streams.",
+			tk.ss.streamBucketStatus[common.MAINT_STREAM][bucket])
+		return false
+	}
+
+	//If any repair is going on, merge cannot happen
+	for _, sid := range []common.StreamId{common.MAINT_STREAM, common.CATCHUP_STREAM} {
+		if stopCh, ok := tk.ss.streamBucketRepairStopCh[sid][bucket]; ok && stopCh != nil {
+			logging.Infof("Timekeeper::checkCatchupStreamReadyToMerge %v In Repair."+
+				"CATCHUP_STREAM cannot be merged. Continue both streams.", sid)
 			return false
 		}
+	}
 
-		if compareTsSnapshot(lastFlushedTs, maintTs) {
-			//disable drain for MAINT_STREAM for this bucket, so it doesn't
-			//drop mutations till merge is complete
-			tk.ss.streamBucketDrainEnabledMap[common.MAINT_STREAM][bucket] = false
-
-			logging.Infof("Timekeeper::checkCatchupStreamReadyToMerge Bucket Ready To Merge. "+
-				"Stream: %v Bucket: %v ", streamId, bucket)
+	//compare with the in progress flush of MAINT_STREAM if there is one,
+	//as after merge MAINT_STREAM will include the index after that flush.
+	var lastFlushedTsVbuuid *common.TsVbuuid
+	if lts, ok := tk.ss.streamBucketFlushInProgressTsMap[common.MAINT_STREAM][bucket]; ok && lts != nil {
+		lastFlushedTsVbuuid = lts
+	} else {
+		lastFlushedTsVbuuid = tk.ss.streamBucketLastFlushedTsMap[common.MAINT_STREAM][bucket]
+	}
 
-			tk.supvRespch <- &MsgTKMergeStream{
-				streamId: streamId,
-				bucket:   bucket}
+	ts := getSeqTsFromTsVbuuid(flushTs)
+	if !ts.GreaterThanEqual(getSeqTsFromTsVbuuid(minMergeTs)) {
+		return false
+	}
 
-			tk.supvCmdch <- &MsgSuccess{}
-			return true
-		}
+	if lastFlushedTsVbuuid != nil &&
+		!ts.GreaterThanEqual(getSeqTsFromTsVbuuid(lastFlushedTsVbuuid)) {
+		return false
 	}
-	return false
+
+	//disable flush for MAINT_STREAM for this bucket, so it doesn't
+	//move ahead till merge is complete
+	tk.ss.streamBucketFlushEnabledMap[common.MAINT_STREAM][bucket] = false
+	tk.ss.streamBucketFlushEnabledMap[common.CATCHUP_STREAM][bucket] = false
+
+	logging.Infof("Timekeeper::checkCatchupStreamReadyToMerge Bucket Ready To Merge. "+
+		"Stream: %v Bucket: %v LastFlushTS: %v", streamId, bucket, lastFlushedTsVbuuid)
+
+	tk.supvRespch <- &MsgTKMergeStream{
+		mType:    TK_MERGE_STREAM,
+		streamId: streamId,
+		bucket:   bucket,
+		mergeTs:  ts}
+
+	logging.Infof("Timekeeper::checkCatchupStreamReadyToMerge \n\t Stream %v "+
+		"Bucket %v State Changed to INACTIVE", streamId, bucket)
+	delete(tk.catchupMergeTs, bucket)
+	tk.stopTimer(streamId, bucket)
+	tk.ss.cleanupBucketFromStream(streamId, bucket)
+	return true
 }
 
 //generates a new StabilityTS
@@ -1883,6 +1964,10 @@ func (tk *timekeeper) generateNewStabilityTS(streamId common.StreamId,
 	}
 
 	if tk.ss.checkNewTSDue(streamId, bucket) {
+		if tk.deferFlushForPriority(streamId, bucket) {
+			return
+		}
+
 		tsVbuuid := tk.ss.getNextStabilityTS(streamId, bucket)
 
 		//persist TS which completes the build
@@ -1931,6 +2016,52 @@ func (tk *timekeeper) generateNewStabilityTS(streamId common.StreamId,
 
 }
 
+//deferFlushForPriority returns true if a new stability timestamp for the
+//stream-bucket should wait as a bucket of higher flush priority is being
+//flushed. A bucket is not held back longer than settings.flush.maxDeferral.
+func (tk *timekeeper) deferFlushForPriority(streamId common.StreamId,
+	bucket string) bool {
+
+	if tk.flushPrio.isEmpty() {
+		return false
+	}
+
+	key := fmt.Sprintf("%v:%v", streamId, bucket)
+	priority := tk.flushPrio.bucketPriority(streamId, bucket, tk.indexInstMap)
+
+	higherInProgress := false
+	for sid, bucketMap := range tk.ss.streamBucketFlushInProgressTsMap {
+		for b, ts := range bucketMap {
+			if ts == nil || sid == streamId && b == bucket {
+				continue
+			}
+
+			if tk.flushPrio.bucketPriority(sid, b, tk.indexInstMap) > priority {
+				higherInProgress = true
+			}
+		}
+	}
+
+	if !higherInProgress {
+		delete(tk.flushDeferredSince, key)
+		return false
+	}
+
+	since, ok := tk.flushDeferredSince[key]
+	if !ok {
+		tk.flushDeferredSince[key] = time.Now()
+		return true
+	}
+
+	maxDeferral := time.Duration(tk.config["settings.flush.maxDeferral"].Uint64()) * time.Millisecond
+	if time.Since(since) < maxDeferral {
+		return true
+	}
+
+	delete(tk.flushDeferredSince, key)
+	return false
+}
+
 //merge a new Ts with one already pending for the stream-bucket,
 //if large snapshots are being processed
 func (tk *timekeeper) maybeMergeTs(streamId common.StreamId,
@@ -2559,12 +2690,14 @@ func (tk *timekeeper) sendRestartMsg(restartMsg Message) {
 		}
 
 		//if rollback msg, call initPrepareRecovery
+		bucketFlush := kvresp.(*MsgRollback).IsBucketFlush()
 		logging.Infof("Timekeeper::sendRestartMsg Received Rollback Msg For "+
-			"%v %v. Sending Init Prepare.", streamId, bucket)
+			"%v %v. Bucket Flush %v. Sending Init Prepare.", streamId, bucket, bucketFlush)
 
 		tk.supvRespch <- &MsgRecovery{mType: INDEXER_INIT_PREP_RECOVERY,
-			streamId: streamId,
-			bucket:   bucket}
+			streamId:    streamId,
+			bucket:      bucket,
+			bucketFlush: bucketFlush}
 
 	case KV_STREAM_REPAIR:
 
@@ -2869,14 +3002,15 @@ func (tk *timekeeper) checkPendingStreamMerge(streamId common.StreamId,
 
 	logging.Debugf("Timekeeper::checkPendingStreamMerge Stream: %v Bucket: %v", streamId, bucket)
 
-	//for repair done of MAINT_STREAM, if there is any corresponding INIT_STREAM,
-	//check the possibility of merge
+	//for repair done of MAINT_STREAM, if there is any corresponding INIT_STREAM
+	//or CATCHUP_STREAM, check the possibility of merge
 	if streamId == common.MAINT_STREAM {
-		if tk.ss.streamBucketStatus[common.INIT_STREAM][bucket] == STREAM_ACTIVE {
-			streamId = common.INIT_STREAM
-		} else {
-			return
+		for _, sid := range []common.StreamId{common.INIT_STREAM, common.CATCHUP_STREAM} {
+			if tk.ss.streamBucketStatus[sid][bucket] == STREAM_ACTIVE {
+				tk.checkPendingStreamMerge(sid, bucket)
+			}
 		}
+		return
 	}
 
 	if !tk.ss.checkAnyFlushPending(streamId, bucket) &&
@@ -2884,6 +3018,7 @@ func (tk *timekeeper) checkPendingStreamMerge(streamId common.StreamId,
 
 		lastFlushedTs := tk.ss.streamBucketLastFlushedTsMap[streamId][bucket]
 		tk.checkInitStreamReadyToMerge(streamId, bucket, lastFlushedTs)
+		tk.checkCatchupStreamReadyToMerge(streamId, bucket, lastFlushedTs)
 
 	}
 }
@@ -2895,18 +3030,19 @@ func (tk *timekeeper) startTimer(streamId common.StreamId,
 
 	logging.Infof("Timekeeper::startTimer %v %v", streamId, bucket)
 
-	snapInterval := tk.getInMemSnapInterval()
-	ticker := time.NewTicker(time.Millisecond * time.Duration(snapInterval))
+	st := tk.newSnapIntervalState(streamId, bucket)
+	timer := time.NewTimer(time.Millisecond * time.Duration(st.interval))
 	stopCh := tk.ss.streamBucketTimerStopCh[streamId][bucket]
 
 	go func() {
 		for {
 			select {
-			case <-ticker.C:
+			case <-timer.C:
 				tk.generateNewStabilityTS(streamId, bucket)
+				timer.Reset(tk.nextInMemSnapInterval(streamId, bucket, st))
 
 			case <-stopCh:
-				ticker.Stop()
+				timer.Stop()
 				return
 			}
 		}
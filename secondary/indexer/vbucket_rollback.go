@@ -0,0 +1,68 @@
+// Copyright (c) 2014 Couchbase, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file
+// except in compliance with the License. You may obtain a copy of the License at
+//   http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software distributed under the
+// License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+// either express or implied. See the License for the specific language governing permissions
+// and limitations under the License.
+
+package indexer
+
+import (
+	"github.com/couchbase/indexing/secondary/common"
+)
+
+//Per Vbucket Rollback
+//
+//When no disk snapshot is older than the rollback timestamp, a slice which
+//implements VbucketRollbacker is rolled back to its latest disk snapshot and
+//only the vbuckets for which the snapshot is past the rollback timestamp are
+//rolled back to zero. All entries of these vbuckets are removed, as index
+//entries don't carry the seqno of the mutation and the older version of a
+//document updated past the rollback point cannot be restored. The stream
+//then restarts these vbuckets from zero and all other vbuckets from the
+//snapshot, instead of rebuilding the whole index.
+
+//vbucketsToRollback returns the vbuckets for which snapTs is past rollbackTs
+func vbucketsToRollback(snapTs, rollbackTs *common.TsVbuuid) []Vbucket {
+
+	var vbs []Vbucket
+	for i, seqno := range snapTs.Seqnos {
+		if seqno > rollbackTs.Seqnos[i] {
+			vbs = append(vbs, Vbucket(i))
+		}
+	}
+	return vbs
+}
+
+//vbucketRollbackTs returns a copy of snapTs with the given vbuckets at zero
+func vbucketRollbackTs(snapTs *common.TsVbuuid, vbs []Vbucket) *common.TsVbuuid {
+
+	ts := snapTs.Copy()
+	for _, vb := range vbs {
+		ts.Seqnos[vb] = 0
+		ts.Vbuuids[vb] = 0
+		ts.Snapshots[vb] = [2]uint64{0, 0}
+	}
+	return ts
+}
+
+//minRestartTs returns the lower of the two restart timestamps for every
+//vbucket. A nil timestamp means all vbuckets restart from zero.
+func minRestartTs(ts1, ts2 *common.TsVbuuid) *common.TsVbuuid {
+
+	if ts1 == nil || ts2 == nil {
+		return nil
+	}
+
+	ts := ts1.Copy()
+	for i, seqno := range ts2.Seqnos {
+		if seqno < ts.Seqnos[i] {
+			ts.Seqnos[i] = seqno
+			ts.Vbuuids[i] = ts2.Vbuuids[i]
+			ts.Snapshots[i] = ts2.Snapshots[i]
+		}
+	}
+	return ts
+}
@@ -30,6 +30,8 @@ const (
 	OPCODE_INDEXER_READY                   = OPCODE_DELETE_BUCKET + 1
 	OPCODE_CLEANUP_INDEX                   = OPCODE_INDEXER_READY + 1
 	OPCODE_CLEANUP_DEFER_INDEX             = OPCODE_CLEANUP_INDEX + 1
+	OPCODE_PAUSE_INDEX                     = OPCODE_CLEANUP_DEFER_INDEX + 1
+	OPCODE_RESUME_INDEX                    = OPCODE_PAUSE_INDEX + 1
 )
 
 /////////////////////////////////////////////////////////////////////////
@@ -439,6 +439,38 @@ func (o *MetadataProvider) DropIndex(defnID c.IndexDefnId) error {
 	return err
 }
 
+// PauseIndex suspends maintenance of an index. The index can still be
+// scanned at its last snapshot.
+func (o *MetadataProvider) PauseIndex(defnID c.IndexDefnId) error {
+	return o.indexMaintenance(defnID, OPCODE_PAUSE_INDEX)
+}
+
+// ResumeIndex restarts maintenance of a paused index.
+func (o *MetadataProvider) ResumeIndex(defnID c.IndexDefnId) error {
+	return o.indexMaintenance(defnID, OPCODE_RESUME_INDEX)
+}
+
+func (o *MetadataProvider) indexMaintenance(defnID c.IndexDefnId, opCode common.OpCode) error {
+
+	meta := o.FindIndex(defnID)
+	if meta == nil {
+		return errors.New("Index does not exist.")
+	}
+
+	if meta.Instances == nil || meta.Instances[0].State != c.INDEX_STATE_ACTIVE {
+		return errors.New(fmt.Sprintf("Index %s is not active.", meta.Definition.Name))
+	}
+
+	watcher, err := o.findWatcherByDefnIdIgnoreStatus(defnID)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Cannot locate cluster node hosting Index %s.", meta.Definition.Name))
+	}
+
+	key := fmt.Sprintf("%d", defnID)
+	_, err = watcher.makeRequest(opCode, key, []byte(""))
+	return err
+}
+
 func (o *MetadataProvider) BuildIndexes(defnIDs []c.IndexDefnId) error {
 
 	watcherIndexMap := make(map[c.IndexerId][]c.IndexDefnId)
@@ -207,6 +207,10 @@ func (m *LifecycleMgr) dispatchRequest(request *requestHolder, factory *message.
 		err = m.handleCleanupIndex(key)
 	case client.OPCODE_CLEANUP_DEFER_INDEX:
 		err = m.handleCleanupDeferIndexFromBucket(key)
+	case client.OPCODE_PAUSE_INDEX:
+		err = m.handleIndexMaintenance(key, true)
+	case client.OPCODE_RESUME_INDEX:
+		err = m.handleIndexMaintenance(key, false)
 	}
 
 	logging.Debugf("LifecycleMgr.dispatchRequest () : send response for requestId %d, op %d, len(result) %d", reqId, op, len(result))
@@ -457,6 +461,32 @@ func (m *LifecycleMgr) DeleteIndex(id common.IndexDefnId, notify bool) error {
 	return nil
 }
 
+//handleIndexMaintenance pauses or resumes maintenance of an index. Index
+//metadata is not changed, the index stays ACTIVE and can be scanned.
+func (m *LifecycleMgr) handleIndexMaintenance(key string, pause bool) error {
+
+	id, err := indexDefnId(key)
+	if err != nil {
+		logging.Errorf("LifecycleMgr.handleIndexMaintenance() : fails. Reason = %v", err)
+		return err
+	}
+
+	defn, err := m.repo.GetIndexDefnById(id)
+	if err != nil {
+		logging.Errorf("LifecycleMgr.handleIndexMaintenance() : fails. Reason = %v", err)
+		return err
+	}
+
+	if m.notifier == nil {
+		return nil
+	}
+
+	if pause {
+		return m.notifier.OnIndexPause(defn.DefnId, defn.Bucket)
+	}
+	return m.notifier.OnIndexResume(defn.DefnId, defn.Bucket)
+}
+
 func (m *LifecycleMgr) handleTopologyChange(content []byte) error {
 
 	change := new(topologyChange)
@@ -103,6 +103,8 @@ type MetadataNotifier interface {
 	OnIndexCreate(*common.IndexDefn) error
 	OnIndexDelete(common.IndexDefnId, string) error
 	OnIndexBuild([]common.IndexDefnId, []string) map[common.IndexInstId]error
+	OnIndexPause(common.IndexDefnId, string) error
+	OnIndexResume(common.IndexDefnId, string) error
 }
 
 type RequestServer interface {
@@ -49,11 +49,15 @@ func (m *MemDB) EncodeItem(itm *Item, buf []byte, w io.Writer) error {
 		return ErrNotEnoughSpace
 	}
 
-	binary.BigEndian.PutUint16(buf[0:2], uint16(itm.dataLen))
+	bs, err := itm.LoadBytes()
+	if err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(bs)))
 	if _, err := w.Write(buf[0:2]); err != nil {
 		return err
 	}
-	if _, err := w.Write(itm.Bytes()); err != nil {
+	if _, err := w.Write(bs); err != nil {
 		return err
 	}
 
@@ -76,8 +80,16 @@ func (m *MemDB) DecodeItem(buf []byte, r io.Reader) (*Item, error) {
 	return nil, nil
 }
 
+// Bytes returns nil if the item is evicted and its page cannot be read,
+// the failure is kept and reported by MemDB.TierError(). Use LoadBytes()
+// where the failure has to be handled right away.
 func (itm *Item) Bytes() (bs []byte) {
 	l := itm.dataLen
+	if l&itemEvicted != 0 {
+		bs, _ = itm.evictedBytes()
+		return
+	}
+
 	dataOffset := uintptr(unsafe.Pointer(itm)) + itemHeaderSize
 
 	hdr := (*reflect.SliceHeader)(unsafe.Pointer(&bs))
@@ -87,7 +99,16 @@ func (itm *Item) Bytes() (bs []byte) {
 	return
 }
 
+// LoadBytes is Bytes() which fails if an evicted item cannot be read
+func (itm *Item) LoadBytes() ([]byte, error) {
+	if itm.isEvicted() {
+		return itm.evictedBytes()
+	}
+
+	return itm.Bytes(), nil
+}
+
 func ItemSize(p unsafe.Pointer) int {
 	itm := (*Item)(p)
-	return int(itemHeaderSize + uintptr(itm.dataLen))
+	return int(itemHeaderSize + uintptr(itm.dataLen&^itemEvicted))
 }
@@ -9,9 +9,11 @@ type Iterator struct {
 	count       int
 	refreshRate int
 
-	snap *Snapshot
-	iter *skiplist.Iterator
-	buf  *skiplist.ActionBuffer
+	snap  *Snapshot
+	store *skiplist.Skiplist
+	iter  *skiplist.Iterator
+	buf   *skiplist.ActionBuffer
+	err   error
 }
 
 func (it *Iterator) skipUnwanted() {
@@ -28,22 +30,44 @@ loop:
 }
 
 func (it *Iterator) SeekFirst() {
+	it.snap.db.touch(nil)
 	it.iter.SeekFirst()
 	it.skipUnwanted()
 }
 
 func (it *Iterator) Seek(bs []byte) {
+	it.snap.db.touch(bs)
 	itm := it.snap.db.newItem(bs, false)
 	it.iter.Seek(unsafe.Pointer(itm))
 	it.skipUnwanted()
+	it.checkTierError()
 }
 
+// checkTierError fails the iterator if a seek may have compared with an
+// evicted item which could not be read
+func (it *Iterator) checkTierError() {
+	if it.err == nil && it.snap.db.useTiering {
+		it.err = it.snap.db.TierError()
+	}
+}
+
+// Valid returns false once an evicted item could not be read
 func (it *Iterator) Valid() bool {
-	return it.iter.Valid()
+	return it.err == nil && it.iter.Valid()
 }
 
+// Get returns nil if the item is evicted and cannot be read, Err()
+// returns the error
 func (it *Iterator) Get() []byte {
-	return (*Item)(it.iter.Get()).Bytes()
+	bs, err := (*Item)(it.iter.Get()).LoadBytes()
+	if err != nil {
+		it.err = err
+	}
+	return bs
+}
+
+func (it *Iterator) Err() error {
+	return it.err
 }
 
 func (it *Iterator) GetNode() *skiplist.Node {
@@ -65,8 +89,9 @@ func (it *Iterator) Refresh() {
 	if it.Valid() {
 		itm := it.snap.db.ptrToItem(it.GetNode().Item())
 		it.iter.Close()
-		it.iter = it.snap.db.store.NewIterator(it.snap.db.iterCmp, it.buf)
+		it.iter = it.store.NewIterator(it.snap.db.iterCmp, it.buf)
 		it.iter.Seek(unsafe.Pointer(itm))
+		it.checkTierError()
 	}
 }
 
@@ -76,7 +101,7 @@ func (it *Iterator) SetRefreshRate(rate int) {
 
 func (it *Iterator) Close() {
 	it.snap.Close()
-	it.snap.db.store.FreeBuf(it.buf)
+	it.store.FreeBuf(it.buf)
 	it.iter.Close()
 }
 
@@ -84,10 +109,12 @@ func (m *MemDB) NewIterator(snap *Snapshot) *Iterator {
 	if !snap.Open() {
 		return nil
 	}
-	buf := snap.db.store.MakeBuf()
+	store := m.getStore()
+	buf := store.MakeBuf()
 	return &Iterator{
-		snap: snap,
-		iter: m.store.NewIterator(m.iterCmp, buf),
-		buf:  buf,
+		snap:  snap,
+		store: store,
+		iter:  store.NewIterator(m.iterCmp, buf),
+		buf:   buf,
 	}
 }
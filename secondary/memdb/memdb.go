@@ -24,6 +24,7 @@ import (
 var (
 	ErrMaxSnapshotsLimitReached = fmt.Errorf("Maximum snapshots limit reached")
 	ErrShutdown                 = fmt.Errorf("MemDB instance has been shutdown")
+	ErrNotEmpty                 = fmt.Errorf("MemDB instance is not empty")
 )
 
 type KeyCompare func([]byte, []byte) int
@@ -31,8 +32,10 @@ type KeyCompare func([]byte, []byte) int
 type VisitorCallback func(*Item, int) error
 
 type ItemEntry struct {
-	itm *Item
-	n   *skiplist.Node
+	itm   *Item
+	n     *skiplist.Node
+	shard int
+	pos   int
 }
 
 func (e *ItemEntry) Item() *Item {
@@ -43,6 +46,12 @@ func (e *ItemEntry) Node() *skiplist.Node {
 	return e.n
 }
 
+// Position returns the data file shard of the item and its ordinal within
+// the shard. Shard is -1 for items which are not stored in data files.
+func (e *ItemEntry) Position() (shard int, pos int) {
+	return e.shard, e.pos
+}
+
 type ItemCallback func(*ItemEntry)
 type CheckPointCallback func()
 
@@ -192,7 +201,7 @@ func (w *Writer) Put2(bs []byte) (n *skiplist.Node) {
 	var success bool
 	x := w.newItem(bs, w.useMemoryMgmt)
 	x.bornSn = w.getCurrSn()
-	n, success = w.store.Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
+	n, success = w.getStore().Insert2(unsafe.Pointer(x), w.insCmp, w.existCmp, w.buf,
 		w.rand.Float32, &w.slSts1)
 	if success {
 		w.count += 1
@@ -209,7 +218,7 @@ func (w *Writer) Delete(bs []byte) (success bool) {
 }
 
 func (w *Writer) GetNode(bs []byte) *skiplist.Node {
-	iter := w.store.NewIterator(w.iterCmp, w.buf)
+	iter := w.getStore().NewIterator(w.iterCmp, w.buf)
 	defer iter.Close()
 
 	x := w.newItem(bs, false)
@@ -241,9 +250,10 @@ func (w *Writer) DeleteNode(x *skiplist.Node) (success bool) {
 	sn := w.getCurrSn()
 	gotItem := (*Item)(x.Item())
 	if gotItem.bornSn == sn {
-		success = w.store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
+		store := w.getStore()
+		success = store.DeleteNode(x, w.insCmp, w.buf, &w.slSts1)
 
-		barrier := w.store.GetAccesBarrier()
+		barrier := store.GetAccesBarrier()
 		barrier.FlushSession(unsafe.Pointer(x))
 		return
 	}
@@ -276,6 +286,10 @@ type Config struct {
 	useDeltaFiles bool
 	mallocFun     skiplist.MallocFn
 	freeFun       skiplist.FreeFn
+
+	useTiering    bool
+	tierDir       string
+	pageCacheSize int64
 }
 
 func (cfg *Config) SetKeyComparator(cmp KeyCompare) {
@@ -320,6 +334,7 @@ type restoreStats struct {
 type MemDB struct {
 	id           int
 	store        *skiplist.Skiplist
+	storeLock    sync.RWMutex // store is replaced by bulk load and restore
 	currSn       uint32
 	snapshots    *skiplist.Skiplist
 	gcsnapshots  *skiplist.Skiplist
@@ -336,6 +351,12 @@ type MemDB struct {
 	shutdownWg1 sync.WaitGroup // GC workers and StoreToDisk task
 	shutdownWg2 sync.WaitGroup // Free workers
 
+	// Tiering
+	pstore    *pageStore
+	ranges    unsafe.Pointer // *keyRanges
+	tierStats TierStats
+	tierErr   error
+
 	Config
 	restoreStats
 }
@@ -351,6 +372,7 @@ func NewWithConfig(cfg Config) *MemDB {
 	}
 
 	m.freechan = make(chan *skiplist.Node, gcchanBufSize)
+	m.tierErr = m.initTiering()
 	m.store = skiplist.NewWithConfig(m.newStoreConfig())
 	m.initSizeFuns()
 
@@ -388,7 +410,7 @@ func (m *MemDB) initSizeFuns() {
 	m.snapshots.SetItemSizeFunc(SnapshotSize)
 	m.gcsnapshots.SetItemSizeFunc(SnapshotSize)
 	if !m.ignoreItemSize {
-		m.store.SetItemSizeFunc(ItemSize)
+		m.getStore().SetItemSizeFunc(ItemSize)
 	}
 }
 
@@ -398,7 +420,12 @@ func New() *MemDB {
 
 func (m *MemDB) MemoryInUse() int64 {
 	storeStats := m.aggrStoreStats()
-	return storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+	sz := storeStats.Memory + m.snapshots.MemoryInUse() + m.gcsnapshots.MemoryInUse()
+	if m.useTiering {
+		sz += m.pstore.cache.memoryInUse()
+	}
+
+	return sz
 }
 
 func (m *MemDB) Close() {
@@ -420,6 +447,12 @@ func (m *MemDB) Close() {
 	defer dbInstances.FreeBuf(buf)
 	dbInstances.Delete(unsafe.Pointer(m), CompareMemDB, buf, &dbInstances.Stats)
 
+	if m.useTiering {
+		// GC workers may still read evicted items
+		m.shutdownWg1.Wait()
+		m.pstore.Close()
+	}
+
 	if m.useMemoryMgmt {
 		buf := m.snapshots.MakeBuf()
 		defer m.snapshots.FreeBuf(buf)
@@ -429,7 +462,8 @@ func (m *MemDB) Close() {
 		m.shutdownWg2.Wait()
 
 		// Manually free up all nodes
-		iter := m.store.NewIterator(m.iterCmp, buf)
+		store := m.getStore()
+		iter := store.NewIterator(m.iterCmp, buf)
 		defer iter.Close()
 		var lastNode *skiplist.Node
 
@@ -441,7 +475,7 @@ func (m *MemDB) Close() {
 
 		for lastNode != nil {
 			m.freeItem((*Item)(lastNode.Item()))
-			m.store.FreeNode(lastNode, &m.store.Stats)
+			store.FreeNode(lastNode, &store.Stats)
 			lastNode = nil
 
 			if iter.Valid() {
@@ -459,7 +493,7 @@ func (m *MemDB) getCurrSn() uint32 {
 func (m *MemDB) newWriter() *Writer {
 	w := &Writer{
 		rand:  rand.New(rand.NewSource(int64(rand.Int()))),
-		buf:   m.store.MakeBuf(),
+		buf:   m.getStore().MakeBuf(),
 		MemDB: m,
 	}
 
@@ -579,7 +613,7 @@ func (m *MemDB) NewSnapshot() (*Snapshot, error) {
 		w.gctail = nil
 
 		// Update global stats
-		m.store.Stats.Merge(&w.slSts1)
+		m.getStore().Stats.Merge(&w.slSts1)
 		atomic.AddInt64(&m.itemsCount, w.count)
 		w.count = 0
 	}
@@ -600,8 +634,8 @@ func (m *MemDB) ItemsCount() int64 {
 }
 
 func (m *MemDB) collectionWorker(w *Writer) {
-	buf := m.store.MakeBuf()
-	defer m.store.FreeBuf(buf)
+	buf := m.getStore().MakeBuf()
+	defer m.getStore().FreeBuf(buf)
 	defer m.shutdownWg1.Done()
 
 	for {
@@ -613,14 +647,15 @@ func (m *MemDB) collectionWorker(w *Writer) {
 				close(w.dwrCtx.closed)
 				return
 			}
+			store := m.getStore()
 			for n := gclist; n != nil; n = n.GClink {
 				w.doDeltaWrite((*Item)(n.Item()))
-				m.store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
+				store.DeleteNode(n, m.insCmp, buf, &w.slSts2)
 			}
 
-			m.store.Stats.Merge(&w.slSts2)
+			store.Stats.Merge(&w.slSts2)
 
-			barrier := m.store.GetAccesBarrier()
+			barrier := store.GetAccesBarrier()
 			barrier.FlushSession(unsafe.Pointer(gclist))
 		}
 	}
@@ -628,16 +663,17 @@ func (m *MemDB) collectionWorker(w *Writer) {
 
 func (m *MemDB) freeWorker(w *Writer) {
 	for freelist := range m.freechan {
+		store := m.getStore()
 		for n := freelist; n != nil; {
 			dnode := n
 			n = n.GClink
 
 			itm := (*Item)(dnode.Item())
 			m.freeItem(itm)
-			m.store.FreeNode(dnode, &w.slSts3)
+			store.FreeNode(dnode, &w.slSts3)
 		}
 
-		m.store.Stats.Merge(&w.slSts3)
+		store.Stats.Merge(&w.slSts3)
 	}
 
 	m.shutdownWg2.Done()
@@ -690,7 +726,8 @@ func (m *MemDB) GetSnapshots() []*Snapshot {
 func (m *MemDB) ptrToItem(itmPtr unsafe.Pointer) *Item {
 	o := (*Item)(itmPtr)
 	itm := m.newItem(o.Bytes(), false)
-	*itm = *o
+	itm.bornSn = o.bornSn
+	itm.deadSn = o.deadSn
 
 	return itm
 }
@@ -705,22 +742,27 @@ func (m *MemDB) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 		panic("snapshot cannot be nil")
 	}
 
-	func() {
+	err := func() error {
 		tmpIter := m.NewIterator(snap)
 		if tmpIter == nil {
 			panic("iterator cannot be nil")
 		}
 		defer tmpIter.Close()
 
-		barrier := m.store.GetAccesBarrier()
+		store := m.getStore()
+		barrier := store.GetAccesBarrier()
 		token := barrier.Acquire()
 		defer barrier.Release(token)
 
 		pivotItems = append(pivotItems, nil) // start item
-		pivotPtrs := m.store.GetRangeSplitItems(shards)
+		pivotPtrs := store.GetRangeSplitItems(shards)
 		for _, itmPtr := range pivotPtrs {
 			itm := m.ptrToItem(itmPtr)
-			tmpIter.Seek(itm.Bytes())
+			bs, err := itm.LoadBytes()
+			if err != nil {
+				return err
+			}
+			tmpIter.Seek(bs)
 			if tmpIter.Valid() {
 				prevItm := pivotItems[len(pivotItems)-1]
 				// Find bigger item than prev pivot
@@ -730,8 +772,13 @@ func (m *MemDB) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 			}
 		}
 		pivotItems = append(pivotItems, nil) // end item
+		return nil
 	}()
 
+	if err != nil {
+		return err
+	}
+
 	errors := make([]error, len(pivotItems)-1)
 
 	// Run workers
@@ -768,6 +815,11 @@ func (m *MemDB) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 						return
 					}
 				}
+
+				if err := itr.Err(); err != nil {
+					errors[shard] = err
+					return
+				}
 			}
 		}(&wg)
 	}
@@ -786,6 +838,11 @@ func (m *MemDB) Visitor(snap *Snapshot, callb VisitorCallback, shards int, concu
 		}
 	}
 
+	// Shard boundaries are compared with the keys of evicted items
+	if m.useTiering {
+		return m.pstore.Error()
+	}
+
 	return nil
 }
 
@@ -920,6 +977,8 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		}()
 	}
 
+	// A shard is written by a single visitor worker
+	positions := make([]int, shards)
 	visitorCallback := func(itm *Item, shard int) error {
 		if m.hasShutdown {
 			return ErrShutdown
@@ -931,8 +990,9 @@ func (m *MemDB) StoreToDisk(dir string, snap *Snapshot, concurr int, itmCallback
 		}
 
 		if itmCallback != nil {
-			itmCallback(&ItemEntry{itm: itm, n: nil})
+			itmCallback(&ItemEntry{itm: itm, n: nil, shard: shard, pos: positions[shard]})
 		}
+		positions[shard]++
 
 		return nil
 	}
@@ -966,7 +1026,20 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 	if callb != nil {
 		nodeCallb = func(n *skiplist.Node) {
-			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n})
+			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n, shard: -1})
+		}
+	}
+
+	// A shard is read by a single reader worker
+	newShardCallback := func(shard int) skiplist.NodeCallback {
+		if callb == nil {
+			return nil
+		}
+
+		var pos int
+		return func(n *skiplist.Node) {
+			callb(&ItemEntry{itm: (*Item)(n.Item()), n: n, shard: shard, pos: pos})
+			pos++
 		}
 	}
 
@@ -980,7 +1053,7 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 	for i, file := range files {
 		segments[i] = b.NewSegment()
-		segments[i].SetNodeCallback(nodeCallb)
+		segments[i].SetNodeCallback(newShardCallback(i))
 		r := m.newFileReader(m.fileType)
 		datafile := filepath.Join(datadir, file)
 		if err := r.Open(datafile); err != nil {
@@ -1026,7 +1099,7 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}
 	}
 
-	m.store = b.Assemble(segments...)
+	m.setStore(b.Assemble(segments...))
 
 	// Delta processing
 	if m.useDeltaFiles {
@@ -1083,7 +1156,7 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 						}
 
 						w := writers[id]
-						if n, success := w.store.Insert2(unsafe.Pointer(itm),
+						if n, success := w.getStore().Insert2(unsafe.Pointer(itm),
 							w.insCmp, w.existCmp, w.buf, w.rand.Float32, &w.slSts1); success {
 
 							w.resSts.DeltaRestored += 1
@@ -1099,7 +1172,7 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 
 				// Aggregate stats
 				w := writers[id]
-				m.store.Stats.Merge(&w.slSts1)
+				m.getStore().Stats.Merge(&w.slSts1)
 				atomic.AddUint64(&m.restoreStats.DeltaRestored, w.resSts.DeltaRestored)
 				atomic.AddUint64(&m.restoreStats.DeltaRestoreFailed, w.resSts.DeltaRestoreFailed)
 			}(&wg, i)
@@ -1118,17 +1191,106 @@ func (m *MemDB) LoadFromDisk(dir string, concurr int, callb ItemCallback) (*Snap
 		}
 	}
 
-	stats := m.store.GetStats()
+	stats := m.getStore().GetStats()
 	m.itemsCount = int64(stats.NodeCount)
 	return m.NewSnapshot()
 }
 
+// isEmpty returns true if the store has no nodes, including the
+// deleted nodes which are yet to be garbage collected
+func (m *MemDB) isEmpty() bool {
+	store := m.getStore()
+	buf := store.MakeBuf()
+	defer store.FreeBuf(buf)
+
+	itr := store.NewIterator(m.iterCmp, buf)
+	defer itr.Close()
+
+	itr.SeekFirst()
+	return m.ItemsCount() == 0 && !itr.Valid()
+}
+
+// ItemSource returns items in sorted order and nil at the end
+type ItemSource func() []byte
+
+// BulkLoad builds the store of an empty MemDB from sorted item sources,
+// which is much faster than inserting items one by one. All items of a
+// source should be smaller than the items of the next source. Sources are
+// loaded concurrently and callb is invoked for every node created. Items
+// become visible from the next snapshot. Writers should not be active
+// during bulk load, readers may be. The store is built aside and swapped
+// in under storeLock, iterators opened before keep reading the empty store.
+func (m *MemDB) BulkLoad(sources []ItemSource, callb ItemCallback) error {
+	var wg sync.WaitGroup
+
+	if !m.isEmpty() {
+		return ErrNotEmpty
+	}
+
+	sn := m.getCurrSn()
+	b := skiplist.NewBuilderWithConfig(m.newStoreConfig())
+	b.SetItemSizeFunc(ItemSize)
+	segments := make([]*skiplist.Segment, len(sources))
+	counts := make([]int64, len(sources))
+
+	for i, src := range sources {
+		segments[i] = b.NewSegment()
+		if callb != nil {
+			shard := i
+			var pos int
+			segments[i].SetNodeCallback(func(n *skiplist.Node) {
+				callb(&ItemEntry{itm: (*Item)(n.Item()), n: n, shard: shard, pos: pos})
+				pos++
+			})
+		}
+
+		wg.Add(1)
+		go func(i int, src ItemSource) {
+			defer wg.Done()
+
+			for bs := src(); bs != nil; bs = src() {
+				itm := m.newItem(bs, m.useMemoryMgmt)
+				itm.bornSn = sn
+				segments[i].Add(unsafe.Pointer(itm))
+				counts[i]++
+			}
+		}(i, src)
+	}
+	wg.Wait()
+
+	m.setStore(b.Assemble(segments...))
+	for _, count := range counts {
+		atomic.AddInt64(&m.itemsCount, count)
+	}
+
+	return nil
+}
+
+// setStore replaces the empty store, iterators opened meanwhile keep
+// using the store they were opened on
+func (m *MemDB) setStore(s *skiplist.Skiplist) {
+	m.storeLock.Lock()
+	defer m.storeLock.Unlock()
+	m.store = s
+}
+
+func (m *MemDB) getStore() *skiplist.Skiplist {
+	m.storeLock.RLock()
+	defer m.storeLock.RUnlock()
+	return m.store
+}
+
 func (m *MemDB) DumpStats() string {
-	return m.aggrStoreStats().String()
+	str := m.aggrStoreStats().String()
+	if m.useTiering {
+		str += "\n" + m.TierStats().String()
+	}
+
+	return str
 }
 
 func (m *MemDB) aggrStoreStats() skiplist.StatsReport {
-	sts := m.store.GetStats()
+	sts := m.getStore().GetStats()
 	for w := m.wlist; w != nil; w = w.next {
 		sts.Apply(&w.slSts1)
 		sts.Apply(&w.slSts2)
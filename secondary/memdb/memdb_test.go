@@ -266,6 +266,147 @@ func TestLoadStoreDisk(t *testing.T) {
 	fmt.Println(db.DumpStats())
 }
 
+func TestLoadStoreDiskPositions(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%010d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+
+	var mu sync.Mutex
+	stored := make(map[[2]int]string)
+	err := db.StoreToDisk("db.dump", snap, 4, func(e *ItemEntry) {
+		shard, pos := e.Position()
+		mu.Lock()
+		stored[[2]int{shard, pos}] = string(e.Item().Bytes())
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	db2 := NewWithConfig(testConf)
+	defer db2.Close()
+	loaded := 0
+	snap2, err := db2.LoadFromDisk("db.dump", 4, func(e *ItemEntry) {
+		shard, pos := e.Position()
+		mu.Lock()
+		if stored[[2]int{shard, pos}] != string(e.Item().Bytes()) {
+			t.Errorf("Item mismatch at shard %d pos %d", shard, pos)
+		}
+		loaded++
+		mu.Unlock()
+	})
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+	defer snap2.Close()
+
+	if len(stored) != n || loaded != n {
+		t.Errorf("Expected %d items, stored %d loaded %d", n, len(stored), loaded)
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	db := NewWithConfig(testConf)
+	defer db.Close()
+
+	snap0, _ := db.NewSnapshot()
+	defer snap0.Close()
+
+	n, nsrc := 100000, 4
+	sources := make([]ItemSource, nsrc)
+	for i := 0; i < nsrc; i++ {
+		next, end := i*n/nsrc, (i+1)*n/nsrc
+		sources[i] = func() []byte {
+			if next == end {
+				return nil
+			}
+			next++
+			return []byte(fmt.Sprintf("%010d", next-1))
+		}
+	}
+
+	// Readers may be active during bulk load
+	donech := make(chan bool)
+	var rwg sync.WaitGroup
+	rwg.Add(1)
+	go func() {
+		defer rwg.Done()
+		for {
+			select {
+			case <-donech:
+				return
+			default:
+				itr := db.NewIterator(snap0)
+				for itr.SeekFirst(); itr.Valid(); itr.Next() {
+				}
+				itr.Close()
+			}
+		}
+	}()
+
+	var nodes int64
+	err := db.BulkLoad(sources, func(e *ItemEntry) {
+		if shard, _ := e.Position(); shard < 0 || shard >= nsrc || e.Node() == nil {
+			t.Errorf("Unexpected item entry")
+		}
+		atomic.AddInt64(&nodes, 1)
+	})
+	close(donech)
+	rwg.Wait()
+	if err != nil {
+		t.Fatalf("Expected no error. got=%v", err)
+	}
+
+	if nodes != int64(n) {
+		t.Errorf("Expected %d callbacks, got %d", n, nodes)
+	}
+
+	w := db.NewWriter()
+	for i := 0; i < n; i += 1000 {
+		w.Delete([]byte(fmt.Sprintf("%010d", i)))
+	}
+	w.Put([]byte(fmt.Sprintf("%010d", n)))
+	snap1, _ := w.NewSnapshot()
+	defer snap1.Close()
+
+	VerifyCount(snap0, 0, t)
+	if err := db.BulkLoad(sources, nil); err != ErrNotEmpty {
+		t.Errorf("Expected ErrNotEmpty, got=%v", err)
+	}
+
+	count := 0
+	itr := db.NewIterator(snap1)
+	defer itr.Close()
+	for i := 0; i <= n; i++ {
+		if i%1000 == 0 && i != n {
+			continue
+		}
+
+		if count == 0 {
+			itr.SeekFirst()
+		} else {
+			itr.Next()
+		}
+
+		if !itr.Valid() || string(itr.Get()) != fmt.Sprintf("%010d", i) {
+			t.Fatalf("Expected item %010d", i)
+		}
+		count++
+	}
+
+	if int(snap1.Count()) != count {
+		t.Errorf("Expected snapshot count %d, got %d", count, snap1.Count())
+	}
+}
+
 func TestStoreDiskShutdown(t *testing.T) {
 	os.RemoveAll("db.dump")
 	var wg sync.WaitGroup
@@ -727,3 +868,147 @@ func TestCloseWithActiveIterators(t *testing.T) {
 	wg.Wait()
 
 }
+
+func TestTieredEviction(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	defer SetTieringBudget(0)
+
+	cfg := DefaultConfig()
+	cfg.UseTiering("db.dump", 1024*1024)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("%0100d", i))
+	}
+
+	n := 100000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put(key(i))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	used := db.MemoryInUse()
+	SetTieringBudget(used / 2)
+	for i := 0; i < 10 && db.MemoryInUse() > used/2; i++ {
+		if err := db.BalanceMemory(used); err != nil {
+			t.Fatalf("Eviction failed: %v", err)
+		}
+	}
+
+	sts := db.TierStats()
+	if sts.BytesEvicted == 0 || sts.NumPages == 0 {
+		t.Fatalf("Expected items to be evicted - %v", sts)
+	}
+	if db.MemoryInUse() > used/2 {
+		t.Errorf("Expected memory %d to be within budget %d", db.MemoryInUse(), used/2)
+	}
+
+	// Evicted items are transparently read back
+	for i := 0; i < n; i += 5000 {
+		w.Put(key(i))
+		w.Delete(key(i + 1))
+	}
+	snap2, _ := w.NewSnapshot()
+	defer snap2.Close()
+
+	for _, s := range []*Snapshot{snap, snap2} {
+		count := 0
+		itr := db.NewIterator(s)
+		for itr.SeekFirst(); itr.Valid(); itr.Next() {
+			count++
+		}
+		itr.Close()
+
+		if s == snap && count != n || s == snap2 && count != n-n/5000 {
+			t.Errorf("Unexpected count %d", count)
+		}
+	}
+
+	// Hot ranges are brought back when there is room
+	SetTieringBudget(used * 4)
+	itr := db.NewIterator(snap2)
+	for i := 0; i < 100*tierHotHits; i++ {
+		itr.Seek(key(10))
+	}
+	itr.Close()
+
+	if err := db.BalanceMemory(used); err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if db.TierStats().BytesRestored == 0 {
+		t.Errorf("Expected hot range to be restored")
+	}
+
+	itr = db.NewIterator(snap2)
+	defer itr.Close()
+	itr.Seek(key(10))
+	if !itr.Valid() || string(itr.Get()) != string(key(10)) {
+		t.Errorf("Unexpected item after restore")
+	}
+}
+
+func TestTieredReadFailure(t *testing.T) {
+	os.RemoveAll("db.dump")
+	defer os.RemoveAll("db.dump")
+	defer SetTieringBudget(0)
+
+	cfg := DefaultConfig()
+	cfg.UseTiering("db.dump", 1024*1024)
+	db := NewWithConfig(cfg)
+	defer db.Close()
+
+	n := 10000
+	w := db.NewWriter()
+	for i := 0; i < n; i++ {
+		w.Put([]byte(fmt.Sprintf("%0100d", i)))
+	}
+	snap, _ := w.NewSnapshot()
+	defer snap.Close()
+
+	used := db.MemoryInUse()
+	SetTieringBudget(used / 2)
+	if err := db.BalanceMemory(used); err != nil || db.TierStats().NumPages == 0 {
+		t.Fatalf("Eviction failed: %v", err)
+	}
+
+	// Evicted pages can no longer be read
+	db.pstore.Lock()
+	for _, seg := range db.pstore.segs {
+		seg.fd.Close()
+	}
+	db.pstore.Unlock()
+	db.pstore.cache.reset()
+
+	count := 0
+	itr := db.NewIterator(snap)
+	for itr.SeekFirst(); itr.Valid(); itr.Next() {
+		if itr.Get() == nil {
+			break
+		}
+		count++
+	}
+	err := itr.Err()
+	itr.Close()
+
+	if err == nil || count == n {
+		t.Errorf("Expected iteration to fail, got %d items", count)
+	}
+	if db.TierError() == nil {
+		t.Errorf("Expected read failure to be kept")
+	}
+
+	callb := func(itm *Item, shard int) error {
+		_, err := itm.LoadBytes()
+		return err
+	}
+	if err := db.Visitor(snap, callb, 4, 2); err == nil {
+		t.Errorf("Expected visitor to fail")
+	}
+	if err := db.BalanceMemory(used); err == nil {
+		t.Errorf("Expected balancing to fail")
+	}
+}
@@ -26,12 +26,28 @@ func (l *NodeList) Keys() (keys [][]byte) {
 	return
 }
 
+// LoadKeys is Keys() which fails if an evicted item cannot be read
+func (l *NodeList) LoadKeys() ([][]byte, error) {
+	var keys [][]byte
+	node := l.head
+	for node != nil {
+		key, err := (*Item)(node.Item()).LoadBytes()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		node = node.GetLink()
+	}
+
+	return keys, nil
+}
+
 func (l *NodeList) Remove(key []byte) *skiplist.Node {
 	var prev *skiplist.Node
 	node := l.head
 	for node != nil {
-		nodeKey := (*Item)(node.Item()).Bytes()
-		if bytes.Equal(nodeKey, key) {
+		nodeKey, err := (*Item)(node.Item()).LoadBytes()
+		if err == nil && bytes.Equal(nodeKey, key) {
 			if prev == nil {
 				l.head = node.GetLink()
 				return node
@@ -103,8 +103,21 @@ func (nt *NodeTable) Get(key []byte) unsafe.Pointer {
 	return nil
 }
 
+// Reserve presizes an empty table for n keys to avoid rehashing during
+// bulk builds
+func (nt *NodeTable) Reserve(n int) {
+	if nt.fastHTCount == 0 && nt.slowHTCount == 0 {
+		nt.fastHT = make(map[uint32]uint64, n)
+	}
+}
+
 func (nt *NodeTable) Update(key []byte, nptr unsafe.Pointer) (updated bool, oldPtr unsafe.Pointer) {
-	res := nt.find(key)
+	return nt.UpdateWithHash(nt.hash(key), key, nptr)
+}
+
+// UpdateWithHash is same as Update, but uses a precomputed hash of the key
+func (nt *NodeTable) UpdateWithHash(h uint32, key []byte, nptr unsafe.Pointer) (updated bool, oldPtr unsafe.Pointer) {
+	res := nt.findWithHash(h, key)
 	if res.status&ntFoundMask == ntFoundMask {
 		// Found key, replace old pointer value with new one
 		updated = true
@@ -218,10 +231,13 @@ func (nt *NodeTable) isEqual(key []byte, v uint64) bool {
 }
 
 func (nt *NodeTable) find(key []byte) (res *ntResult) {
+	return nt.findWithHash(nt.hash(key), key)
+}
+
+func (nt *NodeTable) findWithHash(h uint32, key []byte) (res *ntResult) {
 	nt.res = emptyResult
 	res = &nt.res
 	res.status = ntNotFound
-	h := nt.hash(key)
 	res.hash = h
 
 	v, ok := nt.fastHT[h]
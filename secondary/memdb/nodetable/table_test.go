@@ -294,6 +294,36 @@ func TestLargeConflicts(t *testing.T) {
 
 }
 
+func TestUpdateWithHash(t *testing.T) {
+	n := 10000
+	hfn := func(k []byte) uint32 {
+		return crc32.ChecksumIEEE(k) % 100
+	}
+	table := New(hfn, equalObject)
+	table.Reserve(n)
+	objects := make([]*object, n)
+	for i := 0; i < n; i++ {
+		objects[i] = mkObject(fmt.Sprintf("key-%d", i), i)
+		updated, _ := table.UpdateWithHash(hfn(objects[i].key), objects[i].key, unsafe.Pointer(objects[i]))
+		if updated {
+			t.Errorf("Expected insert")
+		}
+	}
+
+	o := mkObject("key-10", 10)
+	updated, old := table.UpdateWithHash(hfn(o.key), o.key, unsafe.Pointer(o))
+	if !updated || (*object)(old) != objects[10] {
+		t.Errorf("Expected old object to be returned")
+	}
+	objects[10] = o
+
+	for i := 0; i < n; i++ {
+		if (*object)(table.Get(objects[i].key)) != objects[i] {
+			t.Fatalf("Expected to find the object %s", string(objects[i].key))
+		}
+	}
+}
+
 func TestMemoryOverhead(t *testing.T) {
 	n := 100000
 	table := New(crc32.ChecksumIEEE, equalObject)
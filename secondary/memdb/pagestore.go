@@ -0,0 +1,490 @@
+package memdb
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Page store keeps items evicted from memory in log structured segment
+// files. A page is a batch of consecutive items written together and
+// is addressed by a page id. Page locations are kept in an in-memory
+// page table so that pages can be relocated by compaction without
+// touching the items which refer to them.
+//
+// Page record: [crc32 - 4 bytes][count - 4 bytes]{[len - 4 bytes][data]}...
+//
+// Pages are released when the block of stub items referring to them is
+// garbage collected, which guarantees that no reader is using them.
+
+const (
+	pageSegmentSize    = 64 * 1024 * 1024
+	pageHeaderSize     = 8
+	pageSegmentPrefix  = "segment-"
+	pageCompactionFrac = 0.5
+)
+
+var (
+	ErrCorruptedPage   = errors.New("Page checksum mismatch")
+	ErrPageStoreClosed = errors.New("Page store is closed")
+
+	ErrTieringWithMemoryMgmt = errors.New("Tiering is not supported along with memory management")
+
+	pageStoresLock sync.RWMutex
+	pageStores     = make(map[uint32]*pageStore)
+)
+
+type pageSegment struct {
+	id   uint32
+	fd   *os.File
+	size int64
+	live int64
+}
+
+type pageEntry struct {
+	seg     *pageSegment
+	off     int64
+	size    uint32
+	lastKey []byte
+}
+
+type page struct {
+	id    uint32
+	items [][]byte
+	size  int64
+}
+
+type PageStoreStats struct {
+	NumPages    int64
+	DataSize    int64
+	DiskSize    int64
+	CacheSize   int64
+	CacheHits   int64
+	CacheMisses int64
+}
+
+type pageStore struct {
+	cacheHits   int64
+	cacheMisses int64
+
+	id  uint32
+	dir string
+
+	sync.RWMutex
+	pages    []pageEntry
+	freeIds  []uint32
+	segs     map[uint32]*pageSegment
+	active   *pageSegment
+	nextSeg  uint32
+	numPages int64
+	dataSize int64
+	closed   bool
+
+	// First failure to read an evicted page
+	errLock sync.Mutex
+	readErr error
+
+	cache *pageCache
+}
+
+func newPageStore(id uint32, dir string, cacheSize int64) (*pageStore, error) {
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &pageStore{
+		id:    id,
+		dir:   dir,
+		segs:  make(map[uint32]*pageSegment),
+		cache: newPageCache(cacheSize),
+	}
+
+	pageStoresLock.Lock()
+	pageStores[id] = s
+	pageStoresLock.Unlock()
+
+	return s, nil
+}
+
+func getPageStore(id uint32) *pageStore {
+	pageStoresLock.RLock()
+	defer pageStoresLock.RUnlock()
+	return pageStores[id]
+}
+
+func (s *pageStore) newSegment() (*pageSegment, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%s%d", pageSegmentPrefix, s.nextSeg))
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	seg := &pageSegment{id: s.nextSeg, fd: fd}
+	s.segs[seg.id] = seg
+	s.nextSeg++
+	return seg, nil
+}
+
+func (s *pageStore) removeSegment(seg *pageSegment) {
+	delete(s.segs, seg.id)
+	seg.fd.Close()
+	os.Remove(seg.fd.Name())
+}
+
+// append writes a page record to the active segment
+// Caller should hold the lock
+func (s *pageStore) append(buf []byte) (*pageSegment, int64, error) {
+	if s.active == nil || s.active.size+int64(len(buf)) > pageSegmentSize {
+		seg, err := s.newSegment()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if old := s.active; old != nil && old.live == 0 {
+			s.removeSegment(old)
+		}
+		s.active = seg
+	}
+
+	seg := s.active
+	off := seg.size
+	if _, err := seg.fd.WriteAt(buf, off); err != nil {
+		return nil, 0, err
+	}
+
+	seg.size += int64(len(buf))
+	seg.live += int64(len(buf))
+	return seg, off, nil
+}
+
+func encodePage(items [][]byte) []byte {
+	sz := pageHeaderSize
+	for _, itm := range items {
+		sz += 4 + len(itm)
+	}
+
+	buf := make([]byte, sz)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(items)))
+	off := pageHeaderSize
+	for _, itm := range items {
+		binary.BigEndian.PutUint32(buf[off:off+4], uint32(len(itm)))
+		off += 4
+		off += copy(buf[off:], itm)
+	}
+
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func decodePage(id uint32, buf []byte) (*page, error) {
+	if len(buf) < pageHeaderSize || binary.BigEndian.Uint32(buf[0:4]) != crc32.ChecksumIEEE(buf[4:]) {
+		return nil, ErrCorruptedPage
+	}
+
+	n := int(binary.BigEndian.Uint32(buf[4:8]))
+	p := &page{id: id, items: make([][]byte, n), size: int64(len(buf))}
+	off := pageHeaderSize
+	for i := 0; i < n; i++ {
+		if off+4 > len(buf) {
+			return nil, ErrCorruptedPage
+		}
+		l := int(binary.BigEndian.Uint32(buf[off : off+4]))
+		off += 4
+		if off+l > len(buf) {
+			return nil, ErrCorruptedPage
+		}
+		p.items[i] = buf[off : off+l]
+		off += l
+	}
+
+	return p, nil
+}
+
+// writePage stores a batch of items and returns the page id
+func (s *pageStore) writePage(items [][]byte) (uint32, error) {
+	buf := encodePage(items)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return 0, ErrShutdown
+	}
+
+	seg, off, err := s.append(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	var id uint32
+	if n := len(s.freeIds); n > 0 {
+		id = s.freeIds[n-1]
+		s.freeIds = s.freeIds[:n-1]
+	} else {
+		id = uint32(len(s.pages))
+		s.pages = append(s.pages, pageEntry{})
+	}
+
+	s.pages[id] = pageEntry{
+		seg:     seg,
+		off:     off,
+		size:    uint32(len(buf)),
+		lastKey: append([]byte(nil), items[len(items)-1]...),
+	}
+
+	s.numPages++
+	s.dataSize += int64(len(buf))
+	return id, nil
+}
+
+// freePage releases the space of a page which is no longer referenced
+func (s *pageStore) freePage(id uint32) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	e := &s.pages[id]
+	e.seg.live -= int64(e.size)
+	if e.seg != s.active && e.seg.live == 0 {
+		s.removeSegment(e.seg)
+	}
+
+	s.numPages--
+	s.dataSize -= int64(e.size)
+	*e = pageEntry{}
+	s.freeIds = append(s.freeIds, id)
+	s.cache.remove(id)
+}
+
+func (s *pageStore) readPage(id uint32) (*page, error) {
+	if p := s.cache.get(id); p != nil {
+		atomic.AddInt64(&s.cacheHits, 1)
+		return p, nil
+	}
+
+	atomic.AddInt64(&s.cacheMisses, 1)
+
+	s.RLock()
+	if s.closed {
+		s.RUnlock()
+		return nil, ErrPageStoreClosed
+	}
+	e := s.pages[id]
+	buf := make([]byte, e.size)
+	_, err := e.seg.fd.ReadAt(buf, e.off)
+	s.RUnlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decodePage(id, buf)
+	if err == nil {
+		s.cache.put(p)
+	}
+
+	return p, err
+}
+
+// get returns an item of an evicted page. The first failure is kept, so
+// that it is reported by callers of Item.Bytes() which cannot fail.
+func (s *pageStore) get(id, slot uint32) ([]byte, error) {
+	p, err := s.readPage(id)
+	if err != nil {
+		err = fmt.Errorf("memdb: unable to read evicted page %d of %s (%v)", id, s.dir, err)
+		s.errLock.Lock()
+		if s.readErr == nil {
+			s.readErr = err
+		}
+		s.errLock.Unlock()
+		return nil, err
+	}
+
+	return p.items[slot], nil
+}
+
+func (s *pageStore) Error() error {
+	s.errLock.Lock()
+	defer s.errLock.Unlock()
+	return s.readErr
+}
+
+func (s *pageStore) lastKey(id uint32) []byte {
+	s.RLock()
+	defer s.RUnlock()
+	return s.pages[id].lastKey
+}
+
+// compact relocates live pages from segments which are mostly garbage
+// and removes those segments. It copies at most maxBytes.
+func (s *pageStore) compact(maxBytes int64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var victims []*pageSegment
+	for _, seg := range s.segs {
+		if seg != s.active && float64(seg.live) < float64(seg.size)*pageCompactionFrac {
+			victims = append(victims, seg)
+		}
+	}
+
+	if len(victims) == 0 {
+		return nil
+	}
+
+	var copied int64
+	for _, victim := range victims {
+		if copied+victim.live > maxBytes {
+			break
+		}
+
+		for id := range s.pages {
+			e := &s.pages[id]
+			if e.seg != victim {
+				continue
+			}
+
+			buf := make([]byte, e.size)
+			if _, err := victim.fd.ReadAt(buf, e.off); err != nil {
+				return err
+			}
+
+			seg, off, err := s.append(buf)
+			if err != nil {
+				return err
+			}
+
+			victim.live -= int64(e.size)
+			e.seg = seg
+			e.off = off
+			copied += int64(e.size)
+		}
+
+		s.removeSegment(victim)
+	}
+
+	return nil
+}
+
+func (s *pageStore) Stats() PageStoreStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	sts := PageStoreStats{
+		NumPages:    s.numPages,
+		DataSize:    s.dataSize,
+		CacheSize:   s.cache.memoryInUse(),
+		CacheHits:   atomic.LoadInt64(&s.cacheHits),
+		CacheMisses: atomic.LoadInt64(&s.cacheMisses),
+	}
+
+	for _, seg := range s.segs {
+		sts.DiskSize += seg.size
+	}
+
+	return sts
+}
+
+func (s *pageStore) Close() {
+	pageStoresLock.Lock()
+	delete(pageStores, s.id)
+	pageStoresLock.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+	for _, seg := range s.segs {
+		seg.fd.Close()
+	}
+	s.segs = nil
+	s.cache.reset()
+	os.RemoveAll(s.dir)
+}
+
+// pageCache keeps recently read pages within a byte budget
+type pageCache struct {
+	used int64
+
+	sync.Mutex
+	limit int64
+	lru   *list.List
+	items map[uint32]*list.Element
+}
+
+func newPageCache(limit int64) *pageCache {
+	return &pageCache{
+		limit: limit,
+		lru:   list.New(),
+		items: make(map[uint32]*list.Element),
+	}
+}
+
+func (c *pageCache) get(id uint32) *page {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.items[id]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*page)
+	}
+
+	return nil
+}
+
+func (c *pageCache) put(p *page) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.items[p.id]; ok {
+		return
+	}
+
+	c.items[p.id] = c.lru.PushFront(p)
+	c.used += p.size
+
+	for c.used > c.limit && c.lru.Len() > 1 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *pageCache) remove(id uint32) {
+	c.Lock()
+	defer c.Unlock()
+
+	if e, ok := c.items[id]; ok {
+		c.removeElement(e)
+	}
+}
+
+func (c *pageCache) removeElement(e *list.Element) {
+	p := e.Value.(*page)
+	c.lru.Remove(e)
+	delete(c.items, p.id)
+	c.used -= p.size
+}
+
+func (c *pageCache) memoryInUse() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.used
+}
+
+func (c *pageCache) reset() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.lru.Init()
+	c.items = make(map[uint32]*list.Element)
+	c.used = 0
+}
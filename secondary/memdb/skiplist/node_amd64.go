@@ -40,7 +40,7 @@ func (n Node) Size() int {
 }
 
 func (n *Node) Item() unsafe.Pointer {
-	return n.itm
+	return atomic.LoadPointer(&n.itm)
 }
 
 func (n *Node) SetLink(l *Node) {
@@ -106,6 +106,17 @@ func (s *Skiplist) FreeNode(n *Node, sts *Stats) {
 	sts.AddInt64(&sts.nodeFrees, 1)
 }
 
+// SwapItem replaces the item of a node if it has not changed meanwhile.
+// Memory usage is adjusted for the difference in item sizes.
+func (s *Skiplist) SwapItem(n *Node, old, new unsafe.Pointer, sts *Stats) bool {
+	if atomic.CompareAndSwapPointer(&n.itm, old, new) {
+		sts.AddInt64(&sts.usedBytes, int64(s.ItemSize(new)-s.ItemSize(old)))
+		return true
+	}
+
+	return false
+}
+
 type ActionBuffer struct {
 	preds []*Node
 	succs []*Node
@@ -0,0 +1,526 @@
+package memdb
+
+import (
+	"fmt"
+	"github.com/couchbase/indexing/secondary/memdb/skiplist"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Tiering keeps hot key ranges of the skiplist in memory and evicts cold
+// ranges to a page store on disk when the memory used by all tiered MemDB
+// instances exceeds the memory budget. An evicted item is replaced in its
+// skiplist node by a stub item which refers to the page holding the item
+// data. Item.Bytes() on a stub transparently reads the page through the
+// page cache, so that scans, lookups and writers need not know about it.
+// Skiplist nodes always stay in memory, only item data is evicted.
+//
+// A page which cannot be read makes Item.Bytes() return nil. Iterators end
+// with Iterator.Err() set and the failure is kept in MemDB.TierError().
+//
+// Access is tracked per key range. Ranges are derived from skiplist split
+// points and every iterator seek bumps the hit count of its range. Hit
+// counts decay on every balancing round, so that ranges which are no
+// longer scanned become eviction candidates.
+
+const (
+	itemEvicted = 1 << 31
+
+	tierNumRanges   = 256
+	tierPageSize    = 64 * 1024
+	tierLowWater    = 0.9
+	tierHotHits     = 16
+	tierRangesDrift = 2
+)
+
+var tierBudget int64
+
+// SetTieringBudget sets the memory budget shared by all MemDB instances
+// configured with tiering
+func SetTieringBudget(sz int64) {
+	atomic.StoreInt64(&tierBudget, sz)
+}
+
+// stubRef is the data of an evicted item
+type stubRef struct {
+	store uint32
+	page  uint32
+	slot  uint32
+}
+
+var stubItemSize = itemHeaderSize + unsafe.Sizeof(stubRef{})
+
+func (itm *Item) evictedBytes() ([]byte, error) {
+	ref := itm.stubRef()
+	s := getPageStore(ref.store)
+	if s == nil {
+		return nil, ErrPageStoreClosed
+	}
+
+	return s.get(ref.page, ref.slot)
+}
+
+func (itm *Item) isEvicted() bool {
+	return itm.dataLen&itemEvicted != 0
+}
+
+func (itm *Item) stubRef() *stubRef {
+	return (*stubRef)(unsafe.Pointer(uintptr(unsafe.Pointer(itm)) + itemHeaderSize))
+}
+
+type keyRange struct {
+	hits     int64
+	low      []byte
+	hasStubs bool
+}
+
+type keyRanges struct {
+	ranges []keyRange
+	count  int64
+}
+
+type TierStats struct {
+	BytesEvicted  int64
+	BytesRestored int64
+	PageStoreStats
+}
+
+// UseTiering enables eviction of cold items to a page store created
+// under dir. Pages read back from disk are cached within pageCacheSize.
+func (cfg *Config) UseTiering(dir string, pageCacheSize int64) {
+	cfg.useTiering = true
+	cfg.tierDir = dir
+	cfg.pageCacheSize = pageCacheSize
+}
+
+func (m *MemDB) initTiering() error {
+	if !m.useTiering {
+		return nil
+	}
+
+	// Evicted pages are reclaimed through finalizers of stub items, which
+	// does not work along with manually managed memory
+	if m.useMemoryMgmt {
+		m.useTiering = false
+		return ErrTieringWithMemoryMgmt
+	}
+
+	dir := filepath.Join(m.tierDir, fmt.Sprintf("tier-%d", m.id))
+	var err error
+	if m.pstore, err = newPageStore(uint32(m.id), dir, m.pageCacheSize); err != nil {
+		m.useTiering = false
+	}
+
+	return err
+}
+
+func (m *MemDB) getRanges() *keyRanges {
+	return (*keyRanges)(atomic.LoadPointer(&m.ranges))
+}
+
+// touch records an access to the key range containing key
+func (m *MemDB) touch(key []byte) {
+	kr := m.getRanges()
+	if kr == nil {
+		return
+	}
+
+	i := m.findRange(kr, key)
+	atomic.AddInt64(&kr.ranges[i].hits, 1)
+}
+
+func (m *MemDB) findRange(kr *keyRanges, key []byte) int {
+	if key == nil {
+		return 0
+	}
+
+	i := sort.Search(len(kr.ranges), func(i int) bool {
+		return kr.ranges[i].low != nil && m.keyCmp(kr.ranges[i].low, key) > 0
+	})
+
+	return i - 1
+}
+
+// refreshRanges recomputes the key ranges once the number of items has
+// drifted too much from the time they were computed
+func (m *MemDB) refreshRanges() error {
+	count := m.ItemsCount()
+	kr := m.getRanges()
+	if kr != nil && count < kr.count*tierRangesDrift && count*tierRangesDrift > kr.count {
+		return nil
+	}
+
+	nkr := &keyRanges{count: count}
+	nkr.ranges = append(nkr.ranges, keyRange{})
+	for _, itmPtr := range m.getStore().GetRangeSplitItems(tierNumRanges) {
+		bs, err := (*Item)(itmPtr).LoadBytes()
+		if err != nil {
+			return err
+		}
+
+		low := append([]byte(nil), bs...)
+		if last := nkr.ranges[len(nkr.ranges)-1].low; last == nil || m.keyCmp(last, low) < 0 {
+			nkr.ranges = append(nkr.ranges, keyRange{low: low})
+		}
+	}
+
+	hasStubs := m.pstore.Stats().NumPages > 0
+	for i := range nkr.ranges {
+		nkr.ranges[i].hasStubs = hasStubs
+	}
+
+	atomic.StorePointer(&m.ranges, unsafe.Pointer(nkr))
+	return nil
+}
+
+// tieredMemoryInUse returns memory used by all tiered MemDB instances
+func tieredMemoryInUse() (sz int64) {
+	buf := dbInstances.MakeBuf()
+	defer dbInstances.FreeBuf(buf)
+	iter := dbInstances.NewIterator(CompareMemDB, buf)
+	defer iter.Close()
+	for iter.SeekFirst(); iter.Valid(); iter.Next() {
+		db := (*MemDB)(iter.Get())
+		if db.useTiering {
+			sz += db.MemoryInUse()
+		}
+	}
+
+	return
+}
+
+// BalanceMemory evicts cold key ranges to disk when the tiered instances
+// use more memory than the budget and brings hot ranges back into memory
+// when there is room. At most maxBytes are moved in either direction.
+// Writers should be idle during the call, concurrent readers are fine.
+func (m *MemDB) BalanceMemory(maxBytes int64) error {
+	budget := atomic.LoadInt64(&tierBudget)
+	if err := m.TierError(); err != nil {
+		return err
+	} else if !m.useTiering || budget <= 0 {
+		return nil
+	}
+
+	if err := m.refreshRanges(); err != nil {
+		return err
+	}
+	kr := m.getRanges()
+
+	total := tieredMemoryInUse()
+	used := m.MemoryInUse()
+	lowWater := int64(float64(budget) * tierLowWater)
+
+	var err error
+	if total > budget {
+		// Every instance gives up memory in proportion to its usage
+		toEvict := (total - lowWater) * used / total
+		if toEvict > maxBytes {
+			toEvict = maxBytes
+		}
+		err = m.evictColdRanges(kr, toEvict)
+	} else if total < lowWater && total > 0 {
+		room := (lowWater - total) * used / total
+		if room > maxBytes {
+			room = maxBytes
+		}
+		err = m.restoreHotRanges(kr, room)
+	}
+
+	for i := range kr.ranges {
+		r := &kr.ranges[i]
+		atomic.StoreInt64(&r.hits, atomic.LoadInt64(&r.hits)/2)
+	}
+
+	if err == nil {
+		err = m.pstore.compact(maxBytes)
+	}
+
+	return err
+}
+
+type rangeHits struct {
+	idxs []int
+	hits []int64
+	hot  bool
+}
+
+func (r *rangeHits) Len() int {
+	return len(r.idxs)
+}
+
+func (r *rangeHits) Less(i, j int) bool {
+	if r.hot {
+		return r.hits[r.idxs[i]] > r.hits[r.idxs[j]]
+	}
+	return r.hits[r.idxs[i]] < r.hits[r.idxs[j]]
+}
+
+func (r *rangeHits) Swap(i, j int) {
+	r.idxs[i], r.idxs[j] = r.idxs[j], r.idxs[i]
+}
+
+// rangesByHits returns range indexes ordered by hits, hottest first
+// if hot is set
+func (m *MemDB) rangesByHits(kr *keyRanges, hot bool) []int {
+	r := &rangeHits{
+		idxs: make([]int, len(kr.ranges)),
+		hits: make([]int64, len(kr.ranges)),
+		hot:  hot,
+	}
+
+	for i := range r.idxs {
+		r.idxs[i] = i
+		r.hits[i] = atomic.LoadInt64(&kr.ranges[i].hits)
+	}
+
+	sort.Sort(r)
+	return r.idxs
+}
+
+func (m *MemDB) evictColdRanges(kr *keyRanges, toEvict int64) error {
+	var evicted int64
+	for _, i := range m.rangesByHits(kr, false) {
+		if evicted >= toEvict {
+			break
+		}
+
+		n, err := m.evictRange(kr, i, toEvict-evicted)
+		evicted += n
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MemDB) restoreHotRanges(kr *keyRanges, room int64) error {
+	var restored int64
+	for _, i := range m.rangesByHits(kr, true) {
+		r := &kr.ranges[i]
+		if restored >= room || atomic.LoadInt64(&r.hits) < tierHotHits {
+			break
+		}
+
+		if !r.hasStubs {
+			continue
+		}
+
+		n, done, err := m.restoreRange(kr, i, room-restored)
+		restored += n
+		if err != nil {
+			return err
+		} else if done {
+			r.hasStubs = false
+		}
+	}
+
+	return nil
+}
+
+// walkRange calls fn for every live node in the key range i until fn
+// returns false. It fails if the end of the range cannot be told apart
+// because an evicted item cannot be read.
+func (m *MemDB) walkRange(kr *keyRanges, i int, fn func(*skiplist.Node, *Item) bool) error {
+	var high []byte
+	if i+1 < len(kr.ranges) {
+		high = kr.ranges[i+1].low
+	}
+
+	store := m.getStore()
+	buf := store.MakeBuf()
+	defer store.FreeBuf(buf)
+	iter := store.NewIterator(m.iterCmp, buf)
+	defer iter.Close()
+
+	if low := kr.ranges[i].low; low == nil {
+		iter.SeekFirst()
+	} else {
+		iter.Seek(unsafe.Pointer(m.newItem(low, false)))
+	}
+
+	for ; iter.Valid(); iter.Next() {
+		n := iter.GetNode()
+		itm := (*Item)(n.Item())
+		if high != nil {
+			// Avoid reading pages which are entirely within the range
+			if !itm.isEvicted() || m.keyCmp(m.pstore.lastKey(itm.stubRef().page), high) >= 0 {
+				bs, err := itm.LoadBytes()
+				if err != nil {
+					return err
+				} else if m.keyCmp(bs, high) >= 0 {
+					return nil
+				}
+			}
+		}
+
+		if atomic.LoadUint32(&itm.deadSn) != 0 {
+			continue
+		}
+
+		if !fn(n, itm) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// evictRange moves resident items of the key range i to the page store
+func (m *MemDB) evictRange(kr *keyRanges, i int, maxBytes int64) (int64, error) {
+	var nodes []*skiplist.Node
+	var items [][]byte
+	var pageBytes, evicted int64
+	var err error
+
+	flush := func() {
+		if len(nodes) > 0 && err == nil {
+			var n int64
+			n, err = m.writeStubs(nodes, items)
+			evicted += n
+		}
+		nodes = nodes[:0]
+		items = items[:0]
+		pageBytes = 0
+	}
+
+	werr := m.walkRange(kr, i, func(n *skiplist.Node, itm *Item) bool {
+		// Items no larger than a stub are not worth evicting
+		if itm.isEvicted() || ItemSize(unsafe.Pointer(itm)) <= int(stubItemSize) {
+			return true
+		}
+
+		nodes = append(nodes, n)
+		items = append(items, itm.Bytes())
+		pageBytes += int64(ItemSize(unsafe.Pointer(itm)))
+		if pageBytes >= tierPageSize {
+			flush()
+		}
+
+		return err == nil && evicted+pageBytes < maxBytes
+	})
+
+	flush()
+	if evicted > 0 {
+		kr.ranges[i].hasStubs = true
+		atomic.AddInt64(&m.tierStats.BytesEvicted, evicted)
+	}
+
+	if err == nil {
+		err = werr
+	}
+
+	return evicted, err
+}
+
+// writeStubs writes a page and replaces its items by stubs. The stubs of
+// a page share one allocation and the page is freed once it is collected.
+func (m *MemDB) writeStubs(nodes []*skiplist.Node, items [][]byte) (int64, error) {
+	pageId, err := m.pstore.writePage(items)
+	if err != nil {
+		return 0, err
+	}
+
+	block := make([]byte, int(stubItemSize)*len(nodes))
+	pstore := m.pstore
+	runtime.SetFinalizer(&block[0], func(*byte) {
+		pstore.freePage(pageId)
+	})
+
+	var freed int64
+	store := m.getStore()
+	for i, n := range nodes {
+		old := (*Item)(n.Item())
+		stub := (*Item)(unsafe.Pointer(&block[i*int(stubItemSize)]))
+		stub.bornSn = old.bornSn
+		stub.dataLen = itemEvicted | uint32(unsafe.Sizeof(stubRef{}))
+		*stub.stubRef() = stubRef{store: pstore.id, page: pageId, slot: uint32(i)}
+
+		if store.SwapItem(n, unsafe.Pointer(old), unsafe.Pointer(stub), &store.Stats) {
+			freed += int64(ItemSize(unsafe.Pointer(old)) - ItemSize(unsafe.Pointer(stub)))
+		}
+	}
+
+	return freed, nil
+}
+
+// restoreRange brings evicted items of the key range i back into memory.
+// It returns true if the range has no stubs left.
+func (m *MemDB) restoreRange(kr *keyRanges, i int, maxBytes int64) (int64, bool, error) {
+	var restored int64
+	var err error
+	done := true
+	store := m.getStore()
+
+	werr := m.walkRange(kr, i, func(n *skiplist.Node, itm *Item) bool {
+		if !itm.isEvicted() {
+			return true
+		}
+
+		if restored >= maxBytes {
+			done = false
+			return false
+		}
+
+		var bs []byte
+		if bs, err = itm.LoadBytes(); err != nil {
+			done = false
+			return false
+		}
+
+		x := m.newItem(bs, false)
+		x.bornSn = itm.bornSn
+		if store.SwapItem(n, unsafe.Pointer(itm), unsafe.Pointer(x), &store.Stats) {
+			restored += int64(ItemSize(unsafe.Pointer(x)) - ItemSize(unsafe.Pointer(itm)))
+		}
+
+		return true
+	})
+
+	atomic.AddInt64(&m.tierStats.BytesRestored, restored)
+	if err == nil {
+		err = werr
+	}
+
+	return restored, done && err == nil, err
+}
+
+// TierError returns the error which disabled tiering or the first failure
+// to read an evicted item
+func (m *MemDB) TierError() error {
+	if m.tierErr != nil {
+		return m.tierErr
+	} else if m.useTiering {
+		return m.pstore.Error()
+	}
+
+	return nil
+}
+
+func (m *MemDB) TierStats() TierStats {
+	var sts TierStats
+	if m.useTiering {
+		sts.BytesEvicted = atomic.LoadInt64(&m.tierStats.BytesEvicted)
+		sts.BytesRestored = atomic.LoadInt64(&m.tierStats.BytesRestored)
+		sts.PageStoreStats = m.pstore.Stats()
+	}
+
+	return sts
+}
+
+func (s TierStats) String() string {
+	return fmt.Sprintf(
+		"tier_bytes_evicted     = %d\n"+
+			"tier_bytes_restored    = %d\n"+
+			"tier_num_pages         = %d\n"+
+			"tier_data_size         = %d\n"+
+			"tier_disk_size         = %d\n"+
+			"tier_cache_size        = %d\n"+
+			"tier_cache_hits        = %d\n"+
+			"tier_cache_misses      = %d\n",
+		s.BytesEvicted, s.BytesRestored, s.NumPages, s.DataSize,
+		s.DiskSize, s.CacheSize, s.CacheHits, s.CacheMisses)
+}
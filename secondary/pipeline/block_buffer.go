@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"github.com/couchbase/indexing/secondary/platform"
+	"math"
 	"sync"
 	"unsafe"
 )
@@ -47,6 +48,22 @@ func PutBlock(b *[]byte) {
 	p.Put(b)
 }
 
+// Returns a block for items which do not fit in a block of the pool.
+// Block length is limited by the 2 bytes block header.
+func getLargeBlock(itms ...[]byte) (*[]byte, error) {
+	sz := 4
+	for _, itm := range itms {
+		sz += 2 + len(itm)
+	}
+
+	if sz > math.MaxUint16 {
+		return nil, ErrNoBlockSpace
+	}
+
+	b := make([]byte, sz)
+	return &b, nil
+}
+
 type BlockBufferWriter struct {
 	buf *[]byte
 	cap int
@@ -58,6 +58,10 @@ func (w *ItemWriter) WriteItem(itm ...[]byte) error {
 	}
 
 	if w.wr.Put(itm...) == ErrNoBlockSpace {
+		if w.wr.IsEmpty() {
+			return w.grabLargeBlock(itm...)
+		}
+
 		err = w.HasShutdown()
 		if err != nil {
 			return err
@@ -67,12 +71,28 @@ func (w *ItemWriter) WriteItem(itm ...[]byte) error {
 			return err
 		}
 		w.grabBlock()
-		return w.wr.Put(itm...)
+		if err = w.wr.Put(itm...); err == ErrNoBlockSpace {
+			err = w.grabLargeBlock(itm...)
+		}
+		return err
 	}
 
 	return nil
 }
 
+// Items larger than a block are sent in a block of their own size
+func (w *ItemWriter) grabLargeBlock(itm ...[]byte) error {
+	b, err := getLargeBlock(itm...)
+	if err != nil {
+		return err
+	}
+
+	PutBlock(w.wblock)
+	w.wblock = b
+	w.wr.Init(w.wblock)
+	return w.wr.Put(itm...)
+}
+
 func (w *ItemWriter) Channel() chan interface{} {
 	return w.wchan
 }
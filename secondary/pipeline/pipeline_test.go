@@ -233,3 +233,50 @@ func TestErrorPipeline(t *testing.T) {
 	testFn("filter")
 	testFn("sink")
 }
+
+func TestLargeItemPipeline(t *testing.T) {
+	SetupBlockPool(512)
+
+	var w ItemWriter
+	var r ItemReader
+	w.InitWriter()
+	w.SetNumBuffers(4)
+	r.InitReader()
+	r.SetSource(&w)
+
+	items := [][]byte{
+		[]byte("small"),
+		bytes.Repeat([]byte("l"), 2000),
+		[]byte("small"),
+	}
+
+	go func() {
+		for _, itm := range items {
+			if err := w.WriteItem(itm); err != nil {
+				w.CloseWithError(err)
+				return
+			}
+		}
+		w.CloseWrite()
+	}()
+
+	for i := 0; ; i++ {
+		itm, err := r.ReadItem()
+		if err == ErrNoMoreItem {
+			if i != len(items) {
+				t.Errorf("Count: got %v, expected %v", i, len(items))
+			}
+			break
+		} else if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+
+		if !bytes.Equal(itm, items[i]) {
+			t.Errorf("Item %v: got %v bytes, expected %v bytes", i, len(itm), len(items[i]))
+		}
+	}
+
+	if _, err := getLargeBlock(make([]byte, 1<<16)); err != ErrNoBlockSpace {
+		t.Errorf("Expected %v, got %v", ErrNoBlockSpace, err)
+	}
+}
@@ -620,6 +620,39 @@ func (client *Client) ShutdownTopic(topic string) error {
 	return nil
 }
 
+// EvaluateIndex will evaluate index definition `defn` against sample
+// `docs` and documents fetched from `pooln` for `docids`, without
+// creating the index. Keys larger than the indexer limits, `maxSecKeySize`
+// (MAX_SEC_KEY_LEN) and `maxArrayKeySize` (max_array_seckey_size), are
+// reported as too large.
+// - return http errors for transport related failures.
+// - return couchbase SDK error if any.
+//
+// Idempotent API.
+func (client *Client) EvaluateIndex(
+	pooln string, defn *protobuf.IndexDefn, docs []*protobuf.Document,
+	docids []string,
+	maxSecKeySize, maxArrayKeySize uint32) (*protobuf.EvaluateIndexResponse, error) {
+
+	req := protobuf.NewEvaluateIndexRequest(defn, docs, maxSecKeySize, maxArrayKeySize)
+	req.Pool, req.Docids = proto.String(pooln), docids
+	res := &protobuf.EvaluateIndexResponse{}
+	err := client.withRetry(
+		func() error {
+			err := client.ap.Request(req, res)
+			if err != nil {
+				return err
+			} else if protoerr := res.GetErr(); protoerr != nil {
+				return fmt.Errorf(protoerr.GetError())
+			}
+			return err // nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
 // InitialRestartTimestamp will compose the initial set of timestamp
 // for a subset of vbuckets in `bucket`.
 // - return http errors for transport related failures.
@@ -5,6 +5,7 @@ package projector
 
 import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
 import c "github.com/couchbase/indexing/secondary/common"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 
 // IMPORTANT: concurrent access to be expected for Engine object.
 
@@ -63,7 +64,32 @@ func (engine *Engine) StreamEndData(
 // TransformRoute data to endpoints.
 func (engine *Engine) TransformRoute(
 	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
-	encodeBuf []byte) error {
+	encodeBuf []byte, ctx c.EvalContext) error {
 
-	return engine.evaluator.TransformRoute(vbuuid, m, data, encodeBuf)
+	return engine.evaluator.TransformRoute(vbuuid, m, data, encodeBuf, ctx)
+}
+
+// GetStatistics for this engine.
+func (engine *Engine) GetStatistics() map[string]interface{} {
+	return engine.evaluator.GetStatistics()
+}
+
+// Close the engine's evaluator, once the engine is removed from its feed.
+func (engine *Engine) Close() {
+	engine.evaluator.Close()
+}
+
+// Inspect returns engine's state, along with index instance if engine
+// is defined for an index.
+func (engine *Engine) Inspect() map[string]interface{} {
+	state := map[string]interface{}{
+		"uuid":      engine.uuid,
+		"bucket":    engine.evaluator.Bucket(),
+		"endpoints": engine.router.Endpoints(),
+		"stats":     engine.evaluator.GetStatistics(),
+	}
+	if instance, ok := engine.router.(*protobuf.IndexInst); ok {
+		state["instance"] = instance
+	}
+	return state
 }
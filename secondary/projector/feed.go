@@ -142,6 +142,7 @@ const (
 	fCmdShutdown
 	fCmdGetTopicResponse
 	fCmdGetStatistics
+	fCmdInspect
 	fCmdResetConfig
 	fCmdDeleteEndpoint
 	fCmdPing
@@ -327,6 +328,19 @@ func (feed *Feed) GetStatistics() c.Statistics {
 	return nil
 }
 
+// Inspect returns the live state of this feed, its buckets, vbuckets,
+// engines and endpoints.
+// Synchronous call.
+func (feed *Feed) Inspect() map[string]interface{} {
+	respch := make(chan []interface{}, 1)
+	cmd := []interface{}{fCmdInspect, respch}
+	resp, err := c.FailsafeOp(feed.reqch, respch, cmd, feed.finch)
+	if resp != nil && err == nil {
+		return resp[0].(map[string]interface{})
+	}
+	return nil
+}
+
 // Shutdown feed, its upstream connection with kv and downstream endpoints.
 // Synchronous call.
 func (feed *Feed) Shutdown(opaque uint16) error {
@@ -641,6 +655,10 @@ func (feed *Feed) handleCommand(msg []interface{}) (status string) {
 		respch := msg[1].(chan []interface{})
 		respch <- []interface{}{feed.getStatistics()}
 
+	case fCmdInspect:
+		respch := msg[1].(chan []interface{})
+		respch <- []interface{}{feed.inspect()}
+
 	case fCmdResetConfig:
 		config, respch := msg[1].(c.Config), msg[2].(chan []interface{})
 		feed.resetConfig(config)
@@ -1085,6 +1103,7 @@ func (feed *Feed) delInstances(
 		for uuid, engine := range engines {
 			if c.HasUint64(uuid, instanceIds) {
 				uuids = append(uuids, uuid)
+				engine.Close()
 			} else {
 				m[uuid] = engine
 			}
@@ -1178,9 +1197,54 @@ func (feed *Feed) getStatistics() c.Statistics {
 		endStats.Set(raddr, endpoint.GetStatistics())
 	}
 	stats.Set("endpoints", endStats)
+	engStats, _ := c.NewStatistics(nil)
+	for _, engines := range feed.engines {
+		for uuid, engine := range engines {
+			engStats.Set(fmt.Sprintf("%v", uuid), engine.GetStatistics())
+		}
+	}
+	stats.Set("engineStats", engStats)
 	return stats
 }
 
+func (feed *Feed) inspect() map[string]interface{} {
+	buckets := make(map[string]interface{})
+	for bucketn, kvdata := range feed.kvdata {
+		buckets[bucketn] = map[string]interface{}{
+			"kvdata":         kvdata.GetStatistics(),
+			"reqTimestamp":   feed.reqTss[bucketn],
+			"actTimestamp":   feed.actTss[bucketn],
+			"rollTimestamp":  feed.rollTss[bucketn],
+			"feederAttached": feed.feeders[bucketn] != nil,
+		}
+	}
+	engines := make(map[string]interface{})
+	for bucketn, bengines := range feed.engines {
+		m := make(map[string]interface{})
+		for uuid, engine := range bengines {
+			m[fmt.Sprintf("%v", uuid)] = engine.Inspect()
+		}
+		engines[bucketn] = m
+	}
+	endpoints := make(map[string]interface{})
+	for raddr, endpoint := range feed.endpoints {
+		endpoints[raddr] = map[string]interface{}{
+			"active": endpoint.Ping(),
+			"stats":  endpoint.GetStatistics(),
+		}
+	}
+	return map[string]interface{}{
+		"topic":        feed.topic,
+		"opaque":       feed.opaque,
+		"endpointType": feed.endpointType,
+		"staleCheck":   feed.staleCheck(),
+		"staleCount":   feed.stale,
+		"buckets":      buckets,
+		"engines":      engines,
+		"endpoints":    endpoints,
+	}
+}
+
 func (feed *Feed) resetConfig(config c.Config) {
 	if cv, ok := config["feedWaitStreamReqTimeout"]; ok {
 		feed.reqTimeout = time.Duration(cv.Int())
@@ -1222,6 +1286,10 @@ func (feed *Feed) shutdown(opaque uint16) error {
 	for _, endpoint := range feed.endpoints {
 		func() { defer recovery(); endpoint.Close() }()
 	}
+	// release engines
+	for _, engines := range feed.engines {
+		func() { defer recovery(); closeEngines(engines) }()
+	}
 	// cleanup
 	close(feed.finch)
 	logging.Infof("%v ##%x feed ... stopped\n", feed.logPrefix, feed.opaque)
@@ -1231,6 +1299,7 @@ func (feed *Feed) shutdown(opaque uint16) error {
 // shutdown upstream, data-path and remove data-structure for this bucket.
 func (feed *Feed) cleanupBucket(bucketn string, enginesOk bool) {
 	if enginesOk {
+		closeEngines(feed.engines[bucketn])
 		delete(feed.engines, bucketn) // :SideEffect:
 	}
 	delete(feed.reqTss, bucketn)  // :SideEffect:
@@ -1275,6 +1344,7 @@ func (feed *Feed) openFeeder(
 		"dataChanSize":   feed.config["dcp.dataChanSize"].Int(),
 		"numConnections": feed.config["dcp.numConnections"].Int(),
 		"latencyTick":    feed.config["dcp.latencyTick"].Int(),
+		"includeXATTRs":  feed.config["dcp.includeXATTRs"].Bool(),
 	}
 	kvaddr, err := feed.getLocalKVAddrs(pooln, bucketn, opaque)
 	if err != nil {
@@ -1459,6 +1529,7 @@ func (feed *Feed) processSubscribers(opaque uint16, req Subscriber) error {
 
 	// start fresh set of all endpoints from routers.
 	if err = feed.startEndpoints(opaque, routers); err != nil {
+		closeEvaluators(evaluators)
 		return err
 	}
 	// update feed engines.
@@ -1468,6 +1539,9 @@ func (feed *Feed) processSubscribers(opaque uint16, req Subscriber) error {
 		if !ok {
 			m = make(map[uint64]*Engine)
 		}
+		if engine, ok := m[uuid]; ok {
+			engine.Close()
+		}
 		engine := NewEngine(uuid, evaluator, routers[uuid])
 		m[uuid] = engine
 		feed.engines[bucketn] = m // :SideEffect:
@@ -1554,24 +1628,39 @@ func (feed *Feed) subscribers(
 	if err != nil {
 		fmsg := "%v ##%x malformed routers: %v\n"
 		logging.Fatalf(fmsg, feed.logPrefix, opaque, err)
+		closeEvaluators(evaluators)
 		return nil, nil, projC.ErrorInconsistentFeed
 	}
 
 	if len(evaluators) != len(routers) {
 		fmsg := "%v ##%x mismatch in evaluators/routers\n"
 		logging.Fatalf(fmsg, feed.logPrefix, opaque)
+		closeEvaluators(evaluators)
 		return nil, nil, projC.ErrorInconsistentFeed
 	}
 	fmsg := "%v ##%x uuid mismatch: %v\n"
 	for uuid := range evaluators {
 		if _, ok := routers[uuid]; ok == false {
 			logging.Fatalf(fmsg, feed.logPrefix, opaque, uuid)
+			closeEvaluators(evaluators)
 			return nil, nil, projC.ErrorInconsistentFeed
 		}
 	}
 	return evaluators, routers, nil
 }
 
+func closeEvaluators(evaluators map[uint64]c.Evaluator) {
+	for _, evaluator := range evaluators {
+		evaluator.Close()
+	}
+}
+
+func closeEngines(engines map[uint64]*Engine) {
+	for _, engine := range engines {
+		engine.Close()
+	}
+}
+
 func (feed *Feed) engineNames() []string {
 	names := make([]string, 0, len(feed.engines))
 	for uuid := range feed.engines {
@@ -1810,6 +1899,7 @@ func FeedConfigParams() []string {
 		"dcp.genChanSize",
 		"dcp.numConnections",
 		"dcp.latencyTick",
+		"dcp.includeXATTRs",
 		// dataport
 		"dataport.remoteBlock",
 		"dataport.keyChanSize",
@@ -0,0 +1,217 @@
+package projector
+
+import "sync"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "encoding/json"
+
+import c "github.com/couchbase/indexing/secondary/common"
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+
+const testTopic = "testtopic"
+const testBucket = "default"
+const testRaddr = "localhost:9999"
+
+// stubEndpoint is an always active downstream endpoint.
+type stubEndpoint struct {
+	closed bool
+}
+
+func (ep *stubEndpoint) Ping() bool                        { return true }
+func (ep *stubEndpoint) ResetConfig(config c.Config) error { return nil }
+func (ep *stubEndpoint) Send(data interface{}) error       { return nil }
+func (ep *stubEndpoint) WaitForExit() error                { return nil }
+
+func (ep *stubEndpoint) GetStatistics() map[string]interface{} {
+	return map[string]interface{}{"mutCount": 10}
+}
+
+func (ep *stubEndpoint) Close() error {
+	ep.closed = true
+	return nil
+}
+
+// stubEngine evaluates nothing and routes to a fixed set of endpoints,
+// it serves both as the evaluator and the router of an engine.
+type stubEngine struct {
+	closed bool
+}
+
+func (e *stubEngine) Bucket() string { return testBucket }
+
+func (e *stubEngine) StreamBeginData(vbno uint16, vbuuid, seqno uint64) interface{} {
+	return nil
+}
+
+func (e *stubEngine) SyncData(vbno uint16, vbuuid, seqno uint64) interface{} {
+	return nil
+}
+
+func (e *stubEngine) SnapshotData(
+	m *mc.DcpEvent, vbno uint16, vbuuid, seqno uint64) interface{} {
+
+	return nil
+}
+
+func (e *stubEngine) StreamEndData(vbno uint16, vbuuid, seqno uint64) interface{} {
+	return nil
+}
+
+func (e *stubEngine) TransformRoute(
+	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
+	encodeBuf []byte, ctx c.EvalContext) error {
+
+	return nil
+}
+
+func (e *stubEngine) GetStatistics() map[string]interface{} {
+	return map[string]interface{}{"numDocs": 20}
+}
+
+func (e *stubEngine) Close() {
+	e.closed = true
+}
+
+func (e *stubEngine) Endpoints() []string { return []string{testRaddr} }
+
+func (e *stubEngine) UpsertEndpoints(
+	m *mc.DcpEvent, partKey, key, oldKey []byte) []string {
+
+	return nil
+}
+
+func (e *stubEngine) UpsertDeletionEndpoints(
+	m *mc.DcpEvent, oldPartKey, key, oldKey []byte) []string {
+
+	return nil
+}
+
+func (e *stubEngine) DeletionEndpoints(
+	m *mc.DcpEvent, oldPartKey, oldKey []byte) []string {
+
+	return nil
+}
+
+func newTestFeed(t *testing.T) (*Feed, *stubEndpoint, *stubEngine) {
+	config := c.SystemConfig.SectionConfig("projector.", true /*trim*/)
+	feed, err := NewFeed("default", testTopic, nil, config, 0x10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, engine := &stubEndpoint{}, &stubEngine{}
+	// the feed's gen-server picks these up with the next request.
+	feed.endpoints[testRaddr] = endpoint
+	feed.engines[testBucket] = map[uint64]*Engine{
+		1: NewEngine(1, engine, engine),
+	}
+	return feed, endpoint, engine
+}
+
+func TestFeedInspect(t *testing.T) {
+	feed, endpoint, engine := newTestFeed(t)
+
+	state := feed.Inspect()
+	if state == nil {
+		t.Fatalf("expected feed state")
+	}
+	if state["topic"] != testTopic {
+		t.Errorf("expected topic %v, got %v", testTopic, state["topic"])
+	}
+	if state["staleCheck"] != "ok" {
+		t.Errorf("expected active feed, got %v", state["staleCheck"])
+	}
+
+	engines := state["engines"].(map[string]interface{})
+	estate := engines[testBucket].(map[string]interface{})["1"].(map[string]interface{})
+	if estate["bucket"] != testBucket {
+		t.Errorf("expected engine for %v, got %v", testBucket, estate["bucket"])
+	}
+	if eps := estate["endpoints"].([]string); len(eps) != 1 || eps[0] != testRaddr {
+		t.Errorf("expected engine endpoints [%v], got %v", testRaddr, eps)
+	}
+
+	endpoints := state["endpoints"].(map[string]interface{})
+	epstate := endpoints[testRaddr].(map[string]interface{})
+	if epstate["active"] != true {
+		t.Errorf("expected active endpoint, got %v", epstate["active"])
+	}
+
+	if err := feed.Shutdown(0x10); err != nil {
+		t.Fatal(err)
+	}
+	if !endpoint.closed || !engine.closed {
+		t.Errorf("expected shutdown to close endpoint and engine")
+	}
+	if feed.Inspect() != nil {
+		t.Errorf("expected no state after shutdown")
+	}
+}
+
+func TestHandleFeeds(t *testing.T) {
+	feed, _, _ := newTestFeed(t)
+	defer feed.Shutdown(0x10)
+
+	p := &Projector{
+		topics:         map[string]*Feed{testTopic: feed},
+		topicSerialize: make(map[string]*sync.Mutex),
+	}
+
+	get := func(method, path string) *httptest.ResponseRecorder {
+		r, err := http.NewRequest(method, "http://localhost"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		p.handleFeeds(w, r)
+		return w
+	}
+
+	w := get("GET", "/feeds")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %v, got %v", http.StatusOK, w.Code)
+	}
+	var topics []string
+	if err := json.Unmarshal(w.Body.Bytes(), &topics); err != nil {
+		t.Fatal(err)
+	}
+	if len(topics) != 1 || topics[0] != testTopic {
+		t.Errorf("expected topics [%v], got %v", testTopic, topics)
+	}
+
+	w = get("GET", "/feeds/"+testTopic)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %v, got %v", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected json content, got %v", ct)
+	}
+	var state struct {
+		Topic     string                            `json:"topic"`
+		Engines   map[string]map[string]interface{} `json:"engines"`
+		Endpoints map[string]struct {
+			Active bool                   `json:"active"`
+			Stats  map[string]interface{} `json:"stats"`
+		} `json:"endpoints"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Topic != testTopic {
+		t.Errorf("expected topic %v, got %v", testTopic, state.Topic)
+	}
+	if _, ok := state.Engines[testBucket]["1"]; !ok {
+		t.Errorf("expected engine 1 for %v, got %v", testBucket, state.Engines)
+	}
+	ep, ok := state.Endpoints[testRaddr]
+	if !ok || !ep.Active || ep.Stats["mutCount"] != float64(10) {
+		t.Errorf("unexpected endpoint state %v", state.Endpoints)
+	}
+
+	if w = get("GET", "/feeds/missing"); w.Code != http.StatusNotFound {
+		t.Errorf("expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+	if w = get("POST", "/feeds"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %v, got %v", http.StatusMethodNotAllowed, w.Code)
+	}
+}
@@ -11,6 +11,8 @@ import "encoding/json"
 import "runtime"
 import "runtime/pprof"
 import "runtime/debug"
+import "math/rand"
+import "sort"
 
 import ap "github.com/couchbase/indexing/secondary/adminport"
 import c "github.com/couchbase/indexing/secondary/common"
@@ -349,6 +351,88 @@ func (p *Projector) doFailoverLog(
 	return response
 }
 
+// - return ErrorMissingDefinition if request has no index definition.
+// - return couchbase SDK error if any.
+func (p *Projector) doEvaluateIndex(
+	request *protobuf.EvaluateIndexRequest,
+	opaque uint16) ap.MessageMarshaller {
+
+	response := &protobuf.EvaluateIndexResponse{}
+
+	defn := request.GetDefinition()
+	pooln, bucketn := request.GetPool(), defn.GetBucket()
+	docs, docids := request.GetDocuments(), request.GetDocids()
+
+	// log this request.
+	prefix := p.logPrefix
+	fmsg := "%v ##%x doEvaluateIndex() {%q, %q, %v docs, %v docids}\n"
+	logging.Infof(
+		fmsg, prefix, opaque, bucketn, defn.GetName(), len(docs), len(docids))
+	defer logging.Infof("%v ##%x doEvaluateIndex() returns ...\n", prefix, opaque)
+
+	sampleSize := p.config["projector.evaluateIndex.sampleSize"].Int()
+	docs, docids = sampleDocuments(docs, docids, sampleSize)
+
+	fetchErrs := make([]*protobuf.EvaluatedDocument, 0)
+	if len(docids) > 0 {
+		bucket, err := c.ConnectBucket(p.clusterAddr, pooln, bucketn)
+		if err != nil {
+			logging.Errorf("%v ##%x ConnectBucket(): %v\n", prefix, opaque, err)
+			response.Err = protobuf.NewError(err)
+			return response
+		}
+		defer bucket.Close()
+
+		for _, docid := range docids {
+			value, err := bucket.GetRaw(docid)
+			if err != nil {
+				fetchErrs = append(fetchErrs, &protobuf.EvaluatedDocument{
+					Docid: []byte(docid),
+					Error: proto.String(err.Error()),
+				})
+				continue
+			}
+			doc := &protobuf.Document{Docid: []byte(docid), Value: value}
+			docs = append(docs, doc)
+		}
+	}
+
+	encodeBufSize := p.config["projector.encodeBufSize"].Int()
+	response, err := request.Evaluate(docs, encodeBufSize)
+	if err != nil {
+		logging.Errorf("%v ##%x Evaluate(): %v\n", prefix, opaque, err)
+		return &protobuf.EvaluateIndexResponse{Err: protobuf.NewError(err)}
+	}
+	if len(fetchErrs) > 0 {
+		response.Documents = append(response.Documents, fetchErrs...)
+		nErrors := response.GetNumErrors() + uint64(len(fetchErrs))
+		response.NumErrors = proto.Uint64(nErrors)
+	}
+	return response
+}
+
+// sampleDocuments picks at random upto `n` of the documents and docids,
+// keeping them in the order they were supplied.
+func sampleDocuments(
+	docs []*protobuf.Document, docids []string,
+	n int) ([]*protobuf.Document, []string) {
+
+	if n <= 0 || len(docs)+len(docids) <= n {
+		return docs, docids
+	}
+	picks := rand.Perm(len(docs) + len(docids))[:n]
+	sort.Ints(picks)
+	sdocs, sdocids := make([]*protobuf.Document, 0), make([]string, 0)
+	for _, i := range picks {
+		if i < len(docs) {
+			sdocs = append(sdocs, docs[i])
+		} else {
+			sdocids = append(sdocids, docids[i-len(docs)])
+		}
+	}
+	return sdocs, sdocids
+}
+
 // - return ErrorInvalidKVaddrs for malformed vbuuid.
 // - return ErrorInconsistentFeed for malformed feed request.
 // - return ErrorInvalidVbucketBranch for malformed vbuuid.
@@ -646,6 +730,41 @@ func (p *Projector) handleStats(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%s", c.Statistics(stats).Lines())
 }
 
+// handle feed introspection,
+//   /feeds         list of active topics.
+//   /feeds/<topic> live state of feed for topic.
+func (p *Projector) handleFeeds(w http.ResponseWriter, r *http.Request) {
+	logging.Infof("%s Request %q %q\n", p.logPrefix, r.Method, r.URL.Path)
+
+	if r.Method != "GET" {
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var state interface{}
+	topic := strings.Trim(strings.TrimPrefix(r.URL.Path, "/feeds"), "/")
+	if topic == "" {
+		state = p.listTopics()
+	} else {
+		feed, err := p.GetFeed(topic)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		state = feed.Inspect()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		logging.Errorf("%v encoding feed state: %v\n", p.logPrefix, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	header := w.Header()
+	header["Content-Type"] = []string{"application/json"}
+	fmt.Fprintf(w, "%s", string(data))
+}
+
 // handle settings
 func (p *Projector) handleSettings(w http.ResponseWriter, r *http.Request) {
 	logging.Infof("%s Request %q %q\n", p.logPrefix, r.Method, r.URL.Path)
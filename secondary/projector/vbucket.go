@@ -14,6 +14,10 @@ type Vbucket struct {
 	vbuuid    uint64 // immutable
 	seqno     uint64
 	logPrefix string // immutable
+	// introspection
+	snapStart uint64 // snapshot window of last snapshot marker
+	snapEnd   uint64
+	lastEvent int64 // UnixNano, of last event received from DCP
 	// stats
 	sshotCount    uint64
 	mutationCount uint64
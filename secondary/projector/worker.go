@@ -26,6 +26,7 @@ import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
 import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
 import c "github.com/couchbase/indexing/secondary/common"
 import "github.com/couchbase/indexing/secondary/logging"
+import protobuf "github.com/couchbase/indexing/secondary/protobuf/projector"
 
 // VbucketWorker is immutable structure defined for each vbucket.
 type VbucketWorker struct {
@@ -48,6 +49,8 @@ type VbucketWorker struct {
 	mutChanSize int
 
 	encodeBuf []byte
+	// document parsed once and shared by all engines
+	evalCtx c.EvalContext
 }
 
 // NewVbucketWorker creates a new routine to handle this vbucket stream.
@@ -72,6 +75,7 @@ func NewVbucketWorker(
 		reqch:     make(chan []interface{}, mutChanSize),
 		finch:     make(chan bool),
 		encodeBuf: make([]byte, 0, encodeBufSize),
+		evalCtx:   protobuf.NewEvalContext(),
 	}
 	fmsg := "WRKR[%v<-%v<-%v #%v]"
 	worker.logPrefix = fmt.Sprintf(fmsg, id, bucket, feed.cluster, feed.topic)
@@ -269,6 +273,11 @@ loop:
 						"syncs":     float64(v.syncCount),
 						"snapshots": float64(v.sshotCount),
 						"mutations": float64(v.mutationCount),
+						"vbuuid":    v.vbuuid,
+						"seqno":     v.seqno,
+						"snapStart": v.snapStart,
+						"snapEnd":   v.snapEnd,
+						"lastEvent": v.lastEvent,
 					}
 				}
 				respch := msg[1].(chan []interface{})
@@ -360,6 +369,8 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 			logging.Errorf(fmsg, logPrefix, m.Opaque, vbno)
 			return v
 		}
+		v.snapStart, v.snapEnd = m.SnapstartSeq, m.SnapendSeq
+		v.lastEvent = m.Ctime
 		if data := v.makeSnapshotData(m, worker.engines); data != nil {
 			worker.broadcast2Endpoints(data)
 			v.sshotCount++
@@ -377,12 +388,15 @@ func (worker *VbucketWorker) handleEvent(m *mc.DcpEvent) *Vbucket {
 		}
 		v.mutationCount++
 		v.seqno = m.Seqno // sequence number gets updated only here
+		v.lastEvent = m.Ctime
 		// prepare a data for each endpoint.
 		dataForEndpoints := make(map[string]interface{})
 		// for each engine distribute transformations to endpoints.
 		fmsg := "%v ##%x TransformRoute: %v\n"
+		worker.evalCtx.Reset(m)
 		for _, engine := range worker.engines {
-			err := engine.TransformRoute(v.vbuuid, m, dataForEndpoints, worker.encodeBuf)
+			err := engine.TransformRoute(
+				v.vbuuid, m, dataForEndpoints, worker.encodeBuf, worker.evalCtx)
 			if err != nil {
 				logging.Errorf(fmsg, logPrefix, m.Opaque, err)
 			}
@@ -8,6 +8,10 @@ func (pl *Payload) Value() interface{} {
 		return pl.Vbmap
 	} else if pl.Vbkeys != nil {
 		return pl.Vbkeys
+	} else if pl.Handshake != nil {
+		return pl.Handshake
+	} else if pl.Ping != nil {
+		return pl.Ping
 	}
 	return nil
 }
@@ -10,6 +10,8 @@ It is generated from these files:
 
 It has these top-level messages:
 	Payload
+	Handshake
+	Ping
 	VbConnectionMap
 	VbKeyVersions
 	KeyVersions
@@ -80,6 +82,8 @@ type Payload struct {
 	// -- Following fields are mutually exclusive --
 	Vbkeys           []*VbKeyVersions `protobuf:"bytes,2,rep,name=vbkeys" json:"vbkeys,omitempty"`
 	Vbmap            *VbConnectionMap `protobuf:"bytes,3,opt,name=vbmap" json:"vbmap,omitempty"`
+	Handshake        *Handshake       `protobuf:"bytes,4,opt,name=handshake" json:"handshake,omitempty"`
+	Ping             *Ping            `protobuf:"bytes,5,opt,name=ping" json:"ping,omitempty"`
 	XXX_unrecognized []byte           `json:"-"`
 }
 
@@ -108,6 +112,64 @@ func (m *Payload) GetVbmap() *VbConnectionMap {
 	return nil
 }
 
+func (m *Payload) GetHandshake() *Handshake {
+	if m != nil {
+		return m.Handshake
+	}
+	return nil
+}
+
+func (m *Payload) GetPing() *Ping {
+	if m != nil {
+		return m.Ping
+	}
+	return nil
+}
+
+// Sent by router as the first message on a new connection. Downstream
+// replies with the protocol it speaks and the compression, if any, it
+// accepts among the ones offered by router.
+type Handshake struct {
+	Protocol         *uint32  `protobuf:"varint,1,req,name=protocol" json:"protocol,omitempty"`
+	Compressions     []uint32 `protobuf:"varint,2,rep,name=compressions" json:"compressions,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *Handshake) Reset()         { *m = Handshake{} }
+func (m *Handshake) String() string { return proto.CompactTextString(m) }
+func (*Handshake) ProtoMessage()    {}
+
+func (m *Handshake) GetProtocol() uint32 {
+	if m != nil && m.Protocol != nil {
+		return *m.Protocol
+	}
+	return 0
+}
+
+func (m *Handshake) GetCompressions() []uint32 {
+	if m != nil {
+		return m.Compressions
+	}
+	return nil
+}
+
+// Sent by router to measure round trip time, echoed back by downstream.
+type Ping struct {
+	Timestamp        *int64 `protobuf:"varint,1,req,name=timestamp" json:"timestamp,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Ping) Reset()         { *m = Ping{} }
+func (m *Ping) String() string { return proto.CompactTextString(m) }
+func (*Ping) ProtoMessage()    {}
+
+func (m *Ping) GetTimestamp() int64 {
+	if m != nil && m.Timestamp != nil {
+		return *m.Timestamp
+	}
+	return 0
+}
+
 // List of vbuckets that will be streamed via a newly opened connection.
 type VbConnectionMap struct {
 	Bucket           *string  `protobuf:"bytes,1,req,name=bucket" json:"bucket,omitempty"`
@@ -0,0 +1,176 @@
+package protobuf
+
+import "sync"
+
+import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+import qexpr "github.com/couchbase/query/expression"
+import qvalue "github.com/couchbase/query/value"
+
+// Compiled expressions are interned by their canonical string, so that
+// structurally identical expressions across index instances share the
+// same compiled expression. Entries are reference counted by the index
+// evaluators using them and removed when the last one is closed.
+var exprTable = struct {
+	sync.Mutex
+	exprs map[string]*internedExpr
+}{
+	exprs: make(map[string]*internedExpr),
+}
+
+type internedExpr struct {
+	expr qexpr.Expression
+	refs int
+}
+
+// internN1QLExpression returns the interned expression for `expr`.
+func internN1QLExpression(expr qexpr.Expression) qexpr.Expression {
+	key := expr.String()
+
+	exprTable.Lock()
+	defer exprTable.Unlock()
+
+	interned, ok := exprTable.exprs[key]
+	if !ok {
+		interned = &internedExpr{expr: expr}
+		exprTable.exprs[key] = interned
+	}
+	interned.refs++
+	return interned.expr
+}
+
+// releaseN1QLExpressions drops references to interned expressions,
+// obtained from CompileN1QLExpression.
+func releaseN1QLExpressions(cExprs []interface{}) {
+	exprTable.Lock()
+	defer exprTable.Unlock()
+
+	for _, cExpr := range cExprs {
+		expr, ok := cExpr.(qexpr.Expression)
+		if !ok || expr == nil {
+			continue
+		}
+		key := expr.String()
+		if interned, ok := exprTable.exprs[key]; ok && interned.expr == expr {
+			if interned.refs--; interned.refs <= 0 {
+				delete(exprTable.exprs, key)
+			}
+		}
+	}
+}
+
+// EvalContext implements common.EvalContext. It is shared by index
+// evaluators of a vbucket-worker transforming the same mutation. New and
+// old documents are parsed once, on first use, and results of expressions
+// evaluated for a document are cached, so an expression shared by several
+// indexes is evaluated once per document.
+//
+// EvalContext is not thread safe, each vbucket-worker has its own.
+type EvalContext struct {
+	m       *mc.DcpEvent
+	meta    map[string]interface{}
+	context qexpr.Context
+	newDoc  evalDoc
+	oldDoc  evalDoc
+}
+
+type evalDoc struct {
+	doc      []byte
+	datatype uint8
+	typed    bool // nonJSON is computed
+	nonJSON  bool // document is not JSON
+	docval   qvalue.AnnotatedValue
+	cache    map[qexpr.Expression]*evalResult
+}
+
+type evalResult struct {
+	scalar qvalue.Value
+	vector qvalue.Values
+	err    error
+}
+
+// NewEvalContext returns a context to be reset for every mutation.
+func NewEvalContext() *EvalContext {
+	return &EvalContext{
+		newDoc: evalDoc{cache: make(map[qexpr.Expression]*evalResult)},
+		oldDoc: evalDoc{cache: make(map[qexpr.Expression]*evalResult)},
+	}
+}
+
+// Reset implements common.EvalContext{} interface.
+func (ctx *EvalContext) Reset(m *mc.DcpEvent) {
+	ctx.m, ctx.meta, ctx.context = m, nil, nil
+	ctx.newDoc.reset(m.Value, m.Datatype)
+	ctx.oldDoc.reset(m.OldValue, 0)
+}
+
+// IsNonJSON returns true if the new document is not a JSON document.
+func (ctx *EvalContext) IsNonJSON() bool {
+	return ctx.newDoc.isNonJSON()
+}
+
+// Meta returns the meta dictionary of the mutation.
+func (ctx *EvalContext) Meta() map[string]interface{} {
+	if ctx.meta == nil {
+		ctx.meta = dcpEvent2Meta(ctx.m)
+		ctx.meta["type"] = "json"
+		if ctx.newDoc.isNonJSON() {
+			ctx.meta["type"] = "base64"
+		}
+	}
+	return ctx.meta
+}
+
+func (ctx *EvalContext) evalFn(doc *evalDoc) n1qlEvalFn {
+	return func(expr qexpr.Expression) (qvalue.Value, qvalue.Values, error) {
+		if res, ok := doc.cache[expr]; ok {
+			return res.scalar, res.vector, res.err
+		}
+		if doc.docval == nil {
+			doc.docval = qvalue.NewAnnotatedValue(doc.doc)
+			doc.docval.SetAttachment("meta", ctx.Meta())
+		}
+		if ctx.context == nil {
+			ctx.context = qexpr.NewIndexContext()
+		}
+		scalar, vector, err := expr.EvaluateForIndex(doc.docval, ctx.context)
+		doc.cache[expr] = &evalResult{scalar: scalar, vector: vector, err: err}
+		return scalar, vector, err
+	}
+}
+
+// newValue returns the evaluator for the new document.
+func (ctx *EvalContext) newValue() n1qlEvalFn {
+	return ctx.evalFn(&ctx.newDoc)
+}
+
+// oldValue returns the evaluator for the old document.
+func (ctx *EvalContext) oldValue() n1qlEvalFn {
+	return ctx.evalFn(&ctx.oldDoc)
+}
+
+func (doc *evalDoc) reset(value []byte, datatype uint8) {
+	doc.doc, doc.datatype, doc.docval = value, datatype, nil
+	doc.typed, doc.nonJSON = false, false
+	for expr := range doc.cache {
+		delete(doc.cache, expr)
+	}
+}
+
+// isNonJSON types the document on first use.
+func (doc *evalDoc) isNonJSON() bool {
+	if !doc.typed {
+		doc.nonJSON = len(doc.doc) > 0 && !isJSONDoc(doc.doc, doc.datatype)
+		doc.typed = true
+	}
+	return doc.nonJSON
+}
+
+// isJSONDoc uses the datatype of a document to detect JSON documents, if
+// the server did not flag it as JSON, value is typed the way N1QL does.
+func isJSONDoc(value []byte, datatype uint8) bool {
+	if datatype&mcd.DATATYPE_JSON != 0 {
+		return true
+	}
+	return qvalue.NewValue(value).Type() != qvalue.BINARY
+}
@@ -0,0 +1,125 @@
+package protobuf
+
+import "errors"
+import "fmt"
+
+import "github.com/couchbase/indexing/secondary/collatejson"
+import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+import qexpr "github.com/couchbase/query/expression"
+import "github.com/golang/protobuf/proto"
+
+// ErrorMissingDefinition
+var ErrorMissingDefinition = errors.New("protobuf.errorMissingDefinition")
+
+// Evaluate index definition of this request against `docs`, using the
+// same evaluator used by the mutation path, without creating the index.
+func (req *EvaluateIndexRequest) Evaluate(
+	docs []*Document, encodeBufSize int) (*EvaluateIndexResponse, error) {
+
+	defn := req.GetDefinition()
+	if defn == nil {
+		return nil, ErrorMissingDefinition
+	}
+	instance := &IndexInst{
+		InstId:     proto.Uint64(defn.GetDefnID()),
+		State:      IndexState_IndexInitial.Enum(),
+		Definition: defn,
+	}
+	ie, err := NewIndexEvaluator(instance, FeedVersion_watson)
+	if err != nil {
+		return nil, err
+	}
+	defer ie.Close()
+
+	maxKeySize := int(req.GetMaxSecKeySize())
+	if isArrayIndexExpression(ie.skExprs) {
+		maxKeySize = int(req.GetMaxArrayKeySize())
+	}
+
+	var nMissing, nWhereFalse, nErrors, nTooLarge uint64
+	resp := &EvaluateIndexResponse{
+		Documents: make([]*EvaluatedDocument, 0, len(docs)),
+	}
+	encodeBuf := make([]byte, 0, encodeBufSize)
+	evalCtx := NewEvalContext()
+	for _, doc := range docs {
+		edoc := ie.evaluateDocument(doc, evalCtx, encodeBuf)
+		switch {
+		case edoc.Error != nil:
+			nErrors++
+		case edoc.GetWhereFalse():
+			nWhereFalse++
+		case edoc.GetMissing():
+			nMissing++
+		case maxKeySize > 0 && len(edoc.EncodedKey) > maxKeySize:
+			edoc.TooLarge = proto.Bool(true)
+			nTooLarge++
+		}
+		resp.Documents = append(resp.Documents, edoc)
+	}
+	resp.NumMissing = proto.Uint64(nMissing)
+	resp.NumWhereFalse = proto.Uint64(nWhereFalse)
+	resp.NumErrors = proto.Uint64(nErrors)
+	resp.NumTooLarge = proto.Uint64(nTooLarge)
+	return resp, nil
+}
+
+// evaluateDocument projects `doc` as a mutation and describes the
+// secondary key it produces.
+func (ie *IndexEvaluator) evaluateDocument(
+	doc *Document, evalCtx *EvalContext,
+	encodeBuf []byte) (edoc *EvaluatedDocument) {
+
+	edoc = &EvaluatedDocument{Docid: doc.GetDocid()}
+	defer func() { // panic safe
+		if r := recover(); r != nil {
+			edoc.Error = proto.String(fmt.Sprintf("%v", r))
+		}
+	}()
+
+	m := &mc.DcpEvent{
+		Opcode: mcd.DCP_MUTATION,
+		Key:    doc.GetDocid(),
+		Value:  doc.GetValue(),
+	}
+	evalCtx.Reset(m)
+	where, pkey, key, err := ie.project(m, evalCtx, encodeBuf)
+	if err != nil {
+		edoc.Error = proto.String(err.Error())
+		return edoc
+	} else if !where {
+		edoc.WhereFalse = proto.Bool(true)
+		return edoc
+	} else if key == nil {
+		edoc.Missing = proto.Bool(true)
+		return edoc
+	}
+	edoc.PartnKey, edoc.EncodedKey = pkey, key
+	if ie.instance.GetDefinition().GetIsPrimary() { // key is docid as JSON
+		edoc.DecodedKey = proto.String(string(key))
+		return edoc
+	}
+
+	codec := collatejson.NewCodec(16)
+	text, err := codec.Decode(key, make([]byte, 0, len(key)*3+16))
+	if err != nil {
+		edoc.Error = proto.String(err.Error())
+		return edoc
+	}
+	edoc.DecodedKey = proto.String(string(text))
+	return edoc
+}
+
+// isArrayIndexExpression returns true if any of the compiled
+// expressions is an array index key.
+func isArrayIndexExpression(cExprs []interface{}) bool {
+	for _, cExpr := range cExprs {
+		if expr, ok := cExpr.(qexpr.Expression); ok {
+			if isArray, _ := expr.IsArrayIndexKey(); isArray {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package protobuf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestEvaluateIndex(t *testing.T) {
+	defn := &IndexDefn{
+		DefnID:          proto.Uint64(1),
+		Bucket:          proto.String("default"),
+		IsPrimary:       proto.Bool(false),
+		Name:            proto.String("idx"),
+		Using:           StorageType_forestdb.Enum(),
+		ExprType:        ExprType_N1QL.Enum(),
+		SecExpressions:  []string{"`name`", "`age`"},
+		WhereExpression: proto.String("`age` > 10"),
+	}
+	large := `{"name":"` + strings.Repeat("x", 5000) + `","age":20}`
+	docs := []*Document{
+		{Docid: []byte("ok"), Value: []byte(`{"name":"fred","age":20}`)},
+		{Docid: []byte("young"), Value: []byte(`{"name":"bob","age":5}`)},
+		{Docid: []byte("noname"), Value: []byte(`{"age":30}`)},
+		{Docid: []byte("large"), Value: []byte(large)},
+	}
+
+	req := NewEvaluateIndexRequest(defn, docs, 4096, 10240)
+	resp, err := req.Evaluate(docs, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(resp.GetDocuments()); n != len(docs) {
+		t.Fatalf("expected %v documents, got %v", len(docs), n)
+	}
+
+	ok := resp.GetDocuments()[0]
+	if ok.GetDecodedKey() != `["fred",20]` || len(ok.GetEncodedKey()) == 0 {
+		t.Errorf("unexpected key %v", ok.GetDecodedKey())
+	}
+	if !resp.GetDocuments()[1].GetWhereFalse() {
+		t.Errorf("expected document to be skipped by where predicate")
+	}
+	if !resp.GetDocuments()[2].GetMissing() {
+		t.Errorf("expected document to be skipped for missing key")
+	}
+	if !resp.GetDocuments()[3].GetTooLarge() {
+		t.Errorf("expected key to exceed max key size")
+	}
+
+	if resp.GetNumWhereFalse() != 1 || resp.GetNumMissing() != 1 ||
+		resp.GetNumTooLarge() != 1 || resp.GetNumErrors() != 0 {
+		t.Errorf("unexpected counts %v", resp)
+	}
+
+	// key size is not checked without limits
+	req = NewEvaluateIndexRequest(defn, docs, 0, 0)
+	if resp, err = req.Evaluate(docs, 1024*1024); err != nil {
+		t.Fatal(err)
+	} else if resp.GetNumTooLarge() != 0 {
+		t.Errorf("unexpected too large keys %v", resp.GetNumTooLarge())
+	}
+
+	if _, err := (&EvaluateIndexRequest{}).Evaluate(docs, 1024); err != ErrorMissingDefinition {
+		t.Errorf("expected %v, got %v", ErrorMissingDefinition, err)
+	}
+}
@@ -1,11 +1,13 @@
 package protobuf
 
 import "fmt"
+import "sync/atomic"
 
 import "github.com/couchbase/indexing/secondary/logging"
 import c "github.com/couchbase/indexing/secondary/common"
 import mcd "github.com/couchbase/indexing/secondary/dcp/transport"
 import mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
+import qvalue "github.com/couchbase/query/value"
 
 type Partition interface {
 	// Hosts return full list of endpoints <host:port>
@@ -93,12 +95,22 @@ func (instance *IndexInst) GetPartitionObject() Partition {
 // definition of an index instance.
 type IndexEvaluator struct {
 	skExprs  []interface{} // compiled expression
+	skPath   *jsonPathKey  // fast evaluator for plain field paths
 	pkExpr   interface{}   // compiled expression
 	whExpr   interface{}   // compiled expression
+	metaOnly bool          // expressions only reference meta()
 	instance *IndexInst
 	version  FeedVersion
+	// stats
+	nonJSONDocs int64 // atomic, non-JSON documents seen by the index
+	evalErrors  int64 // atomic, documents failed to evaluate
+	closed      int32 // atomic, interned expressions released
 }
 
+// maxEvalErrorLen bounds the error message sent downstream for documents
+// that failed to evaluate.
+const maxEvalErrorLen = 1024
+
 // NewIndexEvaluator returns a reference to a new instance
 // of IndexEvaluator.
 func NewIndexEvaluator(instance *IndexInst,
@@ -118,11 +130,13 @@ func NewIndexEvaluator(instance *IndexInst,
 		if err != nil {
 			return nil, err
 		}
+		ie.skPath = newJSONPathKey(ie.skExprs)
 		// expression to evaluate partition key
 		expr := defn.GetPartnExpression()
 		if len(expr) > 0 {
 			cExprs, err := CompileN1QLExpression([]string{expr})
 			if err != nil {
+				ie.Close()
 				return nil, err
 			} else if len(cExprs) > 0 {
 				ie.pkExpr = cExprs[0]
@@ -133,11 +147,20 @@ func NewIndexEvaluator(instance *IndexInst,
 		if len(expr) > 0 {
 			cExprs, err := CompileN1QLExpression([]string{expr})
 			if err != nil {
+				ie.Close()
 				return nil, err
 			} else if len(cExprs) > 0 {
 				ie.whExpr = cExprs[0]
 			}
 		}
+		// non-JSON documents are indexed if expressions only use meta()
+		ie.metaOnly = true
+		cExprs := append([]interface{}{ie.pkExpr, ie.whExpr}, ie.skExprs...)
+		for _, cExpr := range cExprs {
+			if cExpr != nil && !isMetaOnlyExpression(cExpr) {
+				ie.metaOnly = false
+			}
+		}
 
 	default:
 		logging.Errorf("invalid expression type %v\n", exprtype)
@@ -146,6 +169,14 @@ func NewIndexEvaluator(instance *IndexInst,
 	return ie, nil
 }
 
+// Close implements Evaluator{} interface.
+func (ie *IndexEvaluator) Close() {
+	if atomic.CompareAndSwapInt32(&ie.closed, 0, 1) {
+		releaseN1QLExpressions(ie.skExprs)
+		releaseN1QLExpressions([]interface{}{ie.pkExpr, ie.whExpr})
+	}
+}
+
 // Bucket implements Evaluator{} interface.
 func (ie *IndexEvaluator) Bucket() string {
 	return ie.instance.GetDefinition().GetBucket()
@@ -194,7 +225,7 @@ func (ie *IndexEvaluator) StreamEndData(
 // TransformRoute implement Evaluator{} interface.
 func (ie *IndexEvaluator) TransformRoute(
 	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{},
-	encodeBuf []byte) (err error) {
+	encodeBuf []byte, ctx c.EvalContext) (err error) {
 
 	defer func() { // panic safe
 		if r := recover(); r != nil {
@@ -206,28 +237,30 @@ func (ie *IndexEvaluator) TransformRoute(
 		encodeBuf = nil
 	}
 
-	var npkey /*new-partition*/, opkey /*old-partition*/, nkey, okey []byte
+	var opkey /*old-partition*/, okey []byte
 	instn := ie.instance
 
-	meta := dcpEvent2Meta(m)
-	where, err := ie.wherePredicate(m.Value, meta, encodeBuf)
-	if err != nil {
-		return err
+	// documents are parsed once and shared with other evaluators
+	// of the mutation, if a context is supplied.
+	evalCtx, ok := ctx.(*EvalContext)
+	if !ok {
+		evalCtx = NewEvalContext()
+		evalCtx.Reset(m)
 	}
 
-	if where && len(m.Value) > 0 { // project new secondary key
-		if npkey, err = ie.partitionKey(m.Value, meta, encodeBuf); err != nil {
-			return err
-		}
-		if nkey, err = ie.evaluate(m.Key, m.Value, meta, encodeBuf); err != nil {
-			return err
+	// project new secondary key
+	where, npkey /*new-partition*/, nkey, err := ie.project(m, evalCtx, encodeBuf)
+	if err != nil {
+		if m.Opcode == mcd.DCP_MUTATION {
+			ie.evalError(vbuuid, m, data, err)
 		}
+		return err
 	}
 	if len(m.OldValue) > 0 { // project old secondary key
-		if opkey, err = ie.partitionKey(m.OldValue, meta, encodeBuf); err != nil {
+		if opkey, err = ie.partitionKey(evalCtx.oldValue(), encodeBuf); err != nil {
 			return err
 		}
-		if okey, err = ie.evaluate(m.Key, m.OldValue, meta, encodeBuf); err != nil {
+		if okey, err = ie.evaluate(m.Key, m.OldValue, evalCtx.oldValue(), encodeBuf); err != nil {
 			return err
 		}
 	}
@@ -292,8 +325,71 @@ func (ie *IndexEvaluator) TransformRoute(
 	return nil
 }
 
+// project evaluates WHERE predicate, partition key and secondary key
+// for the new document of mutation `m`.
+func (ie *IndexEvaluator) project(
+	m *mc.DcpEvent, evalCtx *EvalContext,
+	encodeBuf []byte) (where bool, pkey, key []byte, err error) {
+
+	where, err = ie.wherePredicate(evalCtx.newValue(), encodeBuf)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	// non-JSON documents are indexed only by expressions on meta()
+	project := true
+	if m.Opcode == mcd.DCP_MUTATION && evalCtx.IsNonJSON() {
+		atomic.AddInt64(&ie.nonJSONDocs, 1)
+		project = ie.metaOnly
+	}
+
+	if where && project && len(m.Value) > 0 {
+		if pkey, err = ie.partitionKey(evalCtx.newValue(), encodeBuf); err != nil {
+			return where, nil, nil, err
+		}
+		if key, err = ie.evaluate(m.Key, m.Value, evalCtx.newValue(), encodeBuf); err != nil {
+			return where, pkey, nil, err
+		}
+	}
+	return where, pkey, key, nil
+}
+
+// evalError reports downstream that the document could not be indexed
+// because evaluating the index expressions failed.
+func (ie *IndexEvaluator) evalError(
+	vbuuid uint64, m *mc.DcpEvent, data map[string]interface{}, err error) {
+
+	atomic.AddInt64(&ie.evalErrors, 1)
+
+	errmsg := []byte(err.Error())
+	if len(errmsg) > maxEvalErrorLen {
+		errmsg = errmsg[:maxEvalErrorLen]
+	}
+	instn := ie.instance
+	uuid, bucket := instn.GetInstId(), ie.Bucket()
+	for _, raddr := range instn.UpsertDeletionEndpoints(m, nil, nil, nil) {
+		dkv, ok := data[raddr].(*c.DataportKeyVersions)
+		if !ok {
+			kv := c.NewKeyVersions(m.Seqno, m.Key, 4, m.Ctime)
+			kv.AddEvalError(uuid, errmsg)
+			dkv = &c.DataportKeyVersions{bucket, m.VBucket, vbuuid, kv}
+		} else {
+			dkv.Kv.AddEvalError(uuid, errmsg)
+		}
+		data[raddr] = dkv
+	}
+}
+
+// GetStatistics implement Evaluator{} interface.
+func (ie *IndexEvaluator) GetStatistics() map[string]interface{} {
+	return map[string]interface{}{
+		"nonJSONDocs": float64(atomic.LoadInt64(&ie.nonJSONDocs)),
+		"evalErrors":  float64(atomic.LoadInt64(&ie.evalErrors)),
+	}
+}
+
 func (ie *IndexEvaluator) evaluate(
-	docid, doc []byte, meta map[string]interface{}, encodeBuf []byte) ([]byte, error) {
+	docid, doc []byte, eval n1qlEvalFn, encodeBuf []byte) ([]byte, error) {
 
 	defn := ie.instance.GetDefinition()
 	if defn.GetIsPrimary() { // primary index supported !!
@@ -303,13 +399,19 @@ func (ie *IndexEvaluator) evaluate(
 	exprType := defn.GetExprType()
 	switch exprType {
 	case ExprType_N1QL:
-		return N1QLTransform(docid, doc, ie.skExprs, meta, encodeBuf)
+		if ie.skPath != nil && encodeBuf != nil {
+			key, err := ie.skPath.transform(doc, encodeBuf)
+			if err != ErrorJSONPathFallback {
+				return key, err
+			}
+		}
+		return n1qlTransform(docid, ie.skExprs, eval, encodeBuf)
 	}
 	return nil, nil
 }
 
 func (ie *IndexEvaluator) partitionKey(
-	doc []byte, meta map[string]interface{}, encodeBuf []byte) ([]byte, error) {
+	eval n1qlEvalFn, encodeBuf []byte) ([]byte, error) {
 
 	defn := ie.instance.GetDefinition()
 	if defn.GetIsPrimary() { // TODO: strategy for primary index ???
@@ -321,13 +423,13 @@ func (ie *IndexEvaluator) partitionKey(
 	exprType := defn.GetExprType()
 	switch exprType {
 	case ExprType_N1QL:
-		return N1QLTransform(nil, doc, []interface{}{ie.pkExpr}, meta, encodeBuf)
+		return n1qlTransform(nil, []interface{}{ie.pkExpr}, eval, encodeBuf)
 	}
 	return nil, nil
 }
 
 func (ie *IndexEvaluator) wherePredicate(
-	doc []byte, meta map[string]interface{}, encodeBuf []byte) (bool, error) {
+	eval n1qlEvalFn, encodeBuf []byte) (bool, error) {
 
 	// if where predicate is not supplied - always evaluate to `true`
 	if ie.whExpr == nil {
@@ -338,7 +440,7 @@ func (ie *IndexEvaluator) wherePredicate(
 	switch exprType {
 	case ExprType_N1QL:
 		// TODO: can be optimized by using a custom N1QL-evaluator.
-		out, err := N1QLTransform(nil, doc, []interface{}{ie.whExpr}, meta, encodeBuf)
+		out, err := n1qlTransform(nil, []interface{}{ie.whExpr}, eval, encodeBuf)
 		if out == nil { // missing is treated as false
 			return false, err
 		} else if err != nil { // errors are treated as false
@@ -353,13 +455,25 @@ func (ie *IndexEvaluator) wherePredicate(
 
 // helper functions
 func dcpEvent2Meta(m *mc.DcpEvent) map[string]interface{} {
-	return map[string]interface{}{
-		"id":       string(m.Key),
-		"byseqno":  m.Seqno,
-		"revseqno": m.RevSeqno,
-		"flags":    m.Flags,
-		"expiry":   m.Expiry,
-		"locktime": m.LockTime,
-		"nru":      m.Nru,
+	meta := map[string]interface{}{
+		"id":         string(m.Key),
+		"byseqno":    m.Seqno,
+		"revseqno":   m.RevSeqno,
+		"flags":      m.Flags,
+		"expiry":     m.Expiry,
+		"locktime":   m.LockTime,
+		"nru":        m.Nru,
+		"expiration": m.Expiry,
+		"cas":        m.Cas,
+		"datatype":   m.Datatype,
+	}
+	if len(m.Xattrs) > 0 {
+		// xattr values are parsed only if an expression refers to them
+		xattrs := make(map[string]interface{}, len(m.Xattrs))
+		for name, value := range m.Xattrs {
+			xattrs[name] = qvalue.NewValue(value)
+		}
+		meta["xattrs"] = xattrs
 	}
+	return meta
 }
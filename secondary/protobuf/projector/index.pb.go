@@ -71,17 +71,20 @@ const (
 	StorageType_forestdb         StorageType = 1
 	StorageType_memdb            StorageType = 2
 	StorageType_memory_optimized StorageType = 3
+	StorageType_bptree           StorageType = 4
 )
 
 var StorageType_name = map[int32]string{
 	1: "forestdb",
 	2: "memdb",
 	3: "memory_optimized",
+	4: "bptree",
 }
 var StorageType_value = map[string]int32{
 	"forestdb":         1,
 	"memdb":            2,
 	"memory_optimized": 3,
+	"bptree":           4,
 }
 
 func (x StorageType) Enum() *StorageType {
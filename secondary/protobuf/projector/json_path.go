@@ -0,0 +1,448 @@
+package protobuf
+
+import "encoding/json"
+import "errors"
+import "unicode/utf8"
+
+import "github.com/couchbase/indexing/secondary/collatejson"
+import qexpr "github.com/couchbase/query/expression"
+import qvalue "github.com/couchbase/query/value"
+
+// Secondary keys made only of plain field paths, like `a`.`b` or `c`,
+// optionally with constant array subscripts, like `phones`[0], are
+// evaluated by scanning the raw document instead of building a N1QL value
+// tree. The scan validates the whole document and decodes only the bytes
+// of the key values, which are then encoded to collatejson the same way
+// as N1QLTransform does.
+//
+// Whenever the result might differ from N1QL - invalid JSON or UTF-8,
+// duplicate fields on a path, a path crossing a value which is not an
+// object or array - the evaluation falls back to N1QL.
+
+// ErrorJSONPathFallback is returned when the document is to be
+// evaluated by N1QL.
+var ErrorJSONPathFallback = errors.New("jsonpath.fallback")
+
+const jsonPathMaxDepth = 512
+
+type jsonPathElem struct {
+	field   string
+	index   int
+	isIndex bool
+}
+
+// jsonPath is a plain field path with optional array subscripts.
+type jsonPath []jsonPathElem
+
+// compileJSONPath returns the path for a compiled plain field path
+// expression, an identifier followed by field names and constant array
+// subscripts. Case-insensitive names are left to N1QL.
+func compileJSONPath(cExpr interface{}) (jsonPath, bool) {
+	expr, ok := cExpr.(qexpr.Expression)
+	if !ok {
+		return nil, false
+	}
+
+	var path jsonPath // in reverse
+	for {
+		switch e := expr.(type) {
+		case *qexpr.Identifier:
+			if e.CaseInsensitive() {
+				return nil, false
+			}
+			path = append(path, jsonPathElem{field: e.Alias()})
+			for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+				path[i], path[j] = path[j], path[i]
+			}
+			return path, true
+
+		case *qexpr.Field:
+			name, ok := e.Children()[1].(*qexpr.FieldName)
+			if !ok || e.CaseInsensitive() {
+				return nil, false
+			}
+			path = append(path, jsonPathElem{field: name.Alias()})
+			expr = e.Children()[0]
+
+		case *qexpr.Element:
+			index, ok := constantIndex(e.Children()[1])
+			if !ok {
+				return nil, false
+			}
+			path = append(path, jsonPathElem{index: index, isIndex: true})
+			expr = e.Children()[0]
+
+		default:
+			return nil, false
+		}
+	}
+}
+
+// constantIndex returns the value of a non-negative integer constant.
+func constantIndex(expr qexpr.Expression) (int, bool) {
+	constant, ok := expr.(*qexpr.Constant)
+	if !ok || constant.Value().Type() != qvalue.NUMBER {
+		return 0, false
+	}
+	switch n := constant.Value().Actual().(type) {
+	case float64:
+		if n >= 0 && n == float64(int(n)) {
+			return int(n), true
+		}
+	case int64:
+		if n >= 0 {
+			return int(n), true
+		}
+	}
+	return 0, false
+}
+
+// pathNode is a node in the trie of paths of a secondary key.
+type pathNode struct {
+	fields  map[string]*pathNode
+	indexes map[int]*pathNode
+	keys    []int // positions in the secondary key of paths ending here
+}
+
+// jsonPathKey evaluates a secondary key made of plain field paths.
+type jsonPathKey struct {
+	root  *pathNode
+	nkeys int
+}
+
+// newJSONPathKey returns a fast evaluator for compiled secondary key
+// expressions, or nil if any of them is not a plain field path.
+func newJSONPathKey(cExprs []interface{}) *jsonPathKey {
+	if len(cExprs) == 0 {
+		return nil
+	}
+
+	root := &pathNode{}
+	for pos, cExpr := range cExprs {
+		path, ok := compileJSONPath(cExpr)
+		if !ok {
+			return nil
+		}
+		node := root
+		for _, elem := range path {
+			node = node.child(elem)
+		}
+		node.keys = append(node.keys, pos)
+	}
+	return &jsonPathKey{root: root, nkeys: len(cExprs)}
+}
+
+func (node *pathNode) child(elem jsonPathElem) *pathNode {
+	if elem.isIndex {
+		if node.indexes == nil {
+			node.indexes = make(map[int]*pathNode)
+		}
+		if _, ok := node.indexes[elem.index]; !ok {
+			node.indexes[elem.index] = &pathNode{}
+		}
+		return node.indexes[elem.index]
+	}
+	if node.fields == nil {
+		node.fields = make(map[string]*pathNode)
+	}
+	if _, ok := node.fields[elem.field]; !ok {
+		node.fields[elem.field] = &pathNode{}
+	}
+	return node.fields[elem.field]
+}
+
+// transform returns the secondary key of doc encoded as collatejson, in
+// `encodeBuf`, or ErrorJSONPathFallback if the document is to be
+// evaluated by N1QL.
+func (k *jsonPathKey) transform(doc, encodeBuf []byte) ([]byte, error) {
+	if !utf8.Valid(doc) {
+		return nil, ErrorJSONPathFallback
+	}
+
+	s := &jsonScanner{doc: doc, values: make([][]byte, k.nkeys)}
+	i := s.skipSpace(0)
+	if i >= len(doc) || doc[i] != '{' {
+		return nil, ErrorJSONPathFallback
+	}
+	i, err := s.walk(i, k.root, 0)
+	if err != nil {
+		return nil, ErrorJSONPathFallback
+	}
+	if i = s.skipSpace(i); i != len(doc) {
+		return nil, ErrorJSONPathFallback
+	}
+
+	// leading missing key is not indexed, as in N1QLTransform
+	if s.values[0] == nil {
+		return nil, nil
+	}
+
+	text := make([]byte, 0, len(doc)/4+64)
+	text = append(text, '[')
+	for pos, value := range s.values {
+		if pos > 0 {
+			text = append(text, ',')
+		}
+		if value == nil {
+			text = append(text, missingJSON...)
+		} else {
+			text = append(text, value...)
+		}
+	}
+	text = append(text, ']')
+
+	if cap(encodeBuf) < 3*len(text) || cap(encodeBuf) < collatejson.MinBufferSize {
+		return nil, ErrorJSONPathFallback
+	}
+	// MissingLiteral is encoded as a string by N1QLTransform
+	codec := collatejson.NewCodec(16)
+	codec.UseMissing(false)
+	out, err := codec.Encode(text, encodeBuf[:0])
+	if err != nil {
+		return nil, ErrorJSONPathFallback
+	}
+	return append([]byte(nil), out...), nil
+}
+
+var missingJSON = []byte(`"` + string(collatejson.MissingLiteral) + `"`)
+
+// jsonScanner validates a document and collects raw values of paths.
+type jsonScanner struct {
+	doc    []byte
+	values [][]byte
+}
+
+var errJSONSyntax = errors.New("jsonpath.syntax")
+
+func (s *jsonScanner) skipSpace(i int) int {
+	for i < len(s.doc) {
+		switch s.doc[i] {
+		case ' ', '\t', '\n', '\r':
+			i++
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// walk scans the value at i, descending into fields and elements of
+// `node`, and returns the position after the value.
+func (s *jsonScanner) walk(i int, node *pathNode, depth int) (int, error) {
+	if depth > jsonPathMaxDepth {
+		return 0, ErrorJSONPathFallback
+	}
+	if i >= len(s.doc) {
+		return 0, errJSONSyntax
+	}
+
+	start := i
+	var err error
+	switch s.doc[i] {
+	case '{':
+		i, err = s.walkObject(i, node, depth)
+	case '[':
+		i, err = s.walkArray(i, node, depth)
+	default:
+		if node != nil && (node.fields != nil || node.indexes != nil) {
+			// path crosses a scalar, leave it to N1QL
+			return 0, ErrorJSONPathFallback
+		}
+		if s.doc[i] == '"' {
+			i, _, err = s.scanString(i)
+		} else {
+			i, err = s.scanLiteral(i)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if node != nil {
+		for _, pos := range node.keys {
+			s.values[pos] = s.doc[start:i]
+		}
+	}
+	return i, nil
+}
+
+func (s *jsonScanner) walkObject(i int, node *pathNode, depth int) (int, error) {
+	if node != nil && node.indexes != nil {
+		return 0, ErrorJSONPathFallback
+	}
+
+	var seen map[*pathNode]bool
+	i = s.skipSpace(i + 1)
+	if i < len(s.doc) && s.doc[i] == '}' {
+		return i + 1, nil
+	}
+	for {
+		if i >= len(s.doc) || s.doc[i] != '"' {
+			return 0, errJSONSyntax
+		}
+		start := i
+		end, escaped, err := s.scanString(i)
+		if err != nil {
+			return 0, err
+		}
+
+		var child *pathNode
+		if node != nil && node.fields != nil {
+			name := string(s.doc[start+1 : end-1])
+			if escaped {
+				if err := json.Unmarshal(s.doc[start:end], &name); err != nil {
+					return 0, errJSONSyntax
+				}
+			}
+			if child = node.fields[name]; child != nil {
+				if seen[child] { // duplicate field
+					return 0, ErrorJSONPathFallback
+				}
+				if seen == nil {
+					seen = make(map[*pathNode]bool)
+				}
+				seen[child] = true
+			}
+		}
+
+		i = s.skipSpace(end)
+		if i >= len(s.doc) || s.doc[i] != ':' {
+			return 0, errJSONSyntax
+		}
+		if i, err = s.walk(s.skipSpace(i+1), child, depth+1); err != nil {
+			return 0, err
+		}
+
+		i = s.skipSpace(i)
+		if i >= len(s.doc) {
+			return 0, errJSONSyntax
+		} else if s.doc[i] == '}' {
+			return i + 1, nil
+		} else if s.doc[i] != ',' {
+			return 0, errJSONSyntax
+		}
+		i = s.skipSpace(i + 1)
+	}
+}
+
+func (s *jsonScanner) walkArray(i int, node *pathNode, depth int) (int, error) {
+	if node != nil && node.fields != nil {
+		return 0, ErrorJSONPathFallback
+	}
+
+	i = s.skipSpace(i + 1)
+	if i < len(s.doc) && s.doc[i] == ']' {
+		return i + 1, nil
+	}
+	for n := 0; ; n++ {
+		var child *pathNode
+		if node != nil && node.indexes != nil {
+			child = node.indexes[n]
+		}
+
+		var err error
+		if i, err = s.walk(i, child, depth+1); err != nil {
+			return 0, err
+		}
+
+		i = s.skipSpace(i)
+		if i >= len(s.doc) {
+			return 0, errJSONSyntax
+		} else if s.doc[i] == ']' {
+			return i + 1, nil
+		} else if s.doc[i] != ',' {
+			return 0, errJSONSyntax
+		}
+		i = s.skipSpace(i + 1)
+	}
+}
+
+// scanString returns the position after the string at i and whether it
+// has escape sequences.
+func (s *jsonScanner) scanString(i int) (int, bool, error) {
+	escaped := false
+	for i++; i < len(s.doc); i++ {
+		switch c := s.doc[i]; {
+		case c == '"':
+			return i + 1, escaped, nil
+		case c < 0x20:
+			return 0, false, errJSONSyntax
+		case c == '\\':
+			escaped = true
+			if i+1 >= len(s.doc) {
+				return 0, false, errJSONSyntax
+			}
+			i++
+			switch s.doc[i] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				if i+4 >= len(s.doc) {
+					return 0, false, errJSONSyntax
+				}
+				for _, h := range s.doc[i+1 : i+5] {
+					if !isHexByte(h) {
+						return 0, false, errJSONSyntax
+					}
+				}
+				i += 4
+			default:
+				return 0, false, errJSONSyntax
+			}
+		}
+	}
+	return 0, false, errJSONSyntax
+}
+
+func isHexByte(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'f') || (b >= 'A' && b <= 'F')
+}
+
+// scanLiteral scans a number, true, false or null.
+func (s *jsonScanner) scanLiteral(i int) (int, error) {
+	for _, lit := range []string{"true", "false", "null"} {
+		if len(s.doc)-i >= len(lit) && string(s.doc[i:i+len(lit)]) == lit {
+			return i + len(lit), nil
+		}
+	}
+
+	start := i
+	if i < len(s.doc) && s.doc[i] == '-' {
+		i++
+	}
+	if i >= len(s.doc) {
+		return 0, errJSONSyntax
+	}
+	if s.doc[i] == '0' {
+		i++
+	} else if s.doc[i] >= '1' && s.doc[i] <= '9' {
+		i = s.skipDigits(i)
+	} else {
+		return 0, errJSONSyntax
+	}
+	if i < len(s.doc) && s.doc[i] == '.' {
+		if i = s.skipDigits(i + 1); s.doc[i-1] == '.' {
+			return 0, errJSONSyntax
+		}
+	}
+	if i < len(s.doc) && (s.doc[i] == 'e' || s.doc[i] == 'E') {
+		i++
+		if i < len(s.doc) && (s.doc[i] == '+' || s.doc[i] == '-') {
+			i++
+		}
+		mark := i
+		if i = s.skipDigits(i); i == mark {
+			return 0, errJSONSyntax
+		}
+	}
+	if i == start {
+		return 0, errJSONSyntax
+	}
+	return i, nil
+}
+
+func (s *jsonScanner) skipDigits(i int) int {
+	for i < len(s.doc) && s.doc[i] >= '0' && s.doc[i] <= '9' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,211 @@
+package protobuf
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"encoding/json"
+	qexpr "github.com/couchbase/query/expression"
+	qparser "github.com/couchbase/query/expression/parser"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var jsonPathExprs = [][]string{
+	{"`age`"},
+	{"`city`", "`age`"},
+	{"`first-name`", "`last-name`", "`emailid`"},
+	{"type", "name"},
+	{"`members`"},
+	{"`members`[0]"},
+	{"`members`[2]", "`name`"},
+	{"`nofield`", "`age`"},
+	{"`age`", "`nofield`"},
+	{"`a`.`b`"},
+	{"`a`.`b`", "`c`[2].`d`", "`c`"},
+	{"`obbligato`.`age`", "`obbligato`.`evaporable`.`age`"},
+	{"`obbligato`.`evaporable`.`Holothuridea`[0][0].`age`"},
+}
+
+var jsonPathDocs = []string{
+	`{"a":{"b":1},"c":[1,2,{"d":"x"}]}`,
+	`  { "a" : { "b" : [ true, false, null ] } , "c" : [ ] }  `,
+	`{"a":{"b":"é\n\"q\""},"c":[0,-0.5e10,1E+2,{"d":{}}]}`,
+	`{"a":1,"a":2}`,
+	`{"a":{"b":1,"b":2}}`,
+	`{"a":null,"c":null}`,
+	`{"a":5,"c":"str"}`,
+	`{"a":{"b":"日本語"},"c":[{"d":[1,[2]]}]}`,
+	`{"a":{"b":1e400}}`,
+	`{"age":12345678901234567890}`,
+	`{"a":{"b":1}`,
+	`{"a":{"b":1}} trailing`,
+	`{"a":{"b":01}}`,
+	`[{"a":{"b":1}}]`,
+	`"string"`,
+	`not json`,
+	`{}`,
+	"{\"a\":{\"b\":\"\xff\"}}",
+}
+
+func TestCompileJSONPath(t *testing.T) {
+	valid := map[string]int{
+		"`a`":               1,
+		"a":                 1,
+		"`a`.`b`":           2,
+		"a.b.c":             3,
+		"`a.b`":             1,
+		"`a` . `b`":         2,
+		"`a``b`":            1,
+		"`members`[0]":      2,
+		"`a`[1][2].`b`":     4,
+		" `first-name` ":    1,
+		"`Holothuridea`[0]": 2,
+	}
+	for expr, n := range valid {
+		cExpr, err := qparser.Parse(expr)
+		if err != nil {
+			t.Fatalf("%v: %v", expr, err)
+		}
+		if path, ok := compileJSONPath(cExpr); !ok || len(path) != n {
+			t.Errorf("expected %v to be a path of %v elements, got %v", expr, n, path)
+		}
+	}
+
+	invalid := []string{
+		"lower(`a`)", "`a` + 1", "`a`[-1]", "`a`[1.5]", "`a`[b]", "`a`i",
+		"`a`.`b`i", "true", "NULL", "missing", "self", "meta().id", "1",
+		"ARRAY x FOR x IN `a` END", "DISTINCT ARRAY x FOR x IN a END",
+	}
+	for _, expr := range invalid {
+		cExpr, err := qparser.Parse(expr)
+		if err != nil {
+			continue
+		}
+		if path, ok := compileJSONPath(cExpr); ok {
+			t.Errorf("expected %v not to be a path, got %v", expr, path)
+		}
+	}
+}
+
+func TestReleaseN1QLExpressions(t *testing.T) {
+	exprs := []string{"`released`.`a`", "lower(`released`)"}
+	cExprs1, err := CompileN1QLExpression(exprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cExprs2, err := CompileN1QLExpression(exprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	interned := func() int {
+		exprTable.Lock()
+		defer exprTable.Unlock()
+		n := 0
+		for _, cExpr := range cExprs1 {
+			if _, ok := exprTable.exprs[cExpr.(qexpr.Expression).String()]; ok {
+				n++
+			}
+		}
+		return n
+	}
+
+	releaseN1QLExpressions(cExprs1)
+	if n := interned(); n != 2 {
+		t.Fatalf("expected expressions in use to be interned, got %v", n)
+	}
+	releaseN1QLExpressions(cExprs2)
+	if n := interned(); n != 0 {
+		t.Fatalf("expected released expressions to be removed, got %v", n)
+	}
+}
+
+// TestJSONPathDifferential checks that keys evaluated by scanning the
+// document are identical to keys evaluated by N1QL.
+func TestJSONPathDifferential(t *testing.T) {
+	docs := [][]byte{doc150, doc2000}
+	for _, doc := range jsonPathDocs {
+		docs = append(docs, []byte(doc))
+	}
+	docs = append(docs, loadTestDocs(t, usersBzip2)...)
+	docs = append(docs, loadTestDocs(t, projectsBzip2)...)
+
+	meta := make(map[string]interface{})
+	var nfast, nfallback int
+	for _, exprs := range jsonPathExprs {
+		cExprs, err := CompileN1QLExpression(exprs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := newJSONPathKey(cExprs)
+		if key == nil {
+			t.Fatalf("expected fast evaluator for %v", exprs)
+		}
+
+		for _, doc := range docs {
+			fast, err := key.transform(doc, buf)
+			if err == ErrorJSONPathFallback {
+				nfallback++
+				continue
+			} else if err != nil {
+				t.Fatalf("%v %s: %v", exprs, doc, err)
+			}
+			nfast++
+
+			ref, err := N1QLTransform([]byte("docid"), doc, cExprs, meta, buf)
+			if err != nil {
+				t.Fatalf("%v %s: N1QL error %v", exprs, doc, err)
+			}
+			if !bytes.Equal(fast, ref) {
+				t.Fatalf("%v %s: expected %v got %v", exprs, doc,
+					decodeCollateJSON(ref), decodeCollateJSON(fast))
+			}
+		}
+	}
+
+	if nfast == 0 || nfallback > len(jsonPathDocs)*len(jsonPathExprs) {
+		t.Fatalf("unexpected fast path usage: fast %v fallback %v", nfast, nfallback)
+	}
+}
+
+func TestJSONPathNotPlain(t *testing.T) {
+	cExprs, err := CompileN1QLExpression([]string{"`age`", "lower(`city`)"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := newJSONPathKey(cExprs); key != nil {
+		t.Fatalf("unexpected fast evaluator for non-path expression")
+	}
+}
+
+func loadTestDocs(t *testing.T, fname string) [][]byte {
+	f, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(bzip2.NewReader(f))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		t.Fatal(err)
+	}
+
+	docs := make([][]byte, 0, len(values))
+	for _, value := range values {
+		docs = append(docs, []byte(value))
+	}
+	return docs
+}
+
+func BenchmarkJSONPath2000(b *testing.B) {
+	cExprs, _ := CompileN1QLExpression([]string{`age`})
+	key := newJSONPathKey(cExprs)
+	for i := 0; i < b.N; i++ {
+		key.transform(doc2000, buf)
+	}
+}
@@ -7,20 +7,44 @@ import qparser "github.com/couchbase/query/expression/parser"
 import qvalue "github.com/couchbase/query/value"
 
 // CompileN1QLExpression will take expressions defined in N1QL's DDL statement
-// and compile them for evaluation.
+// and compile them for evaluation. Compiled expressions are interned and
+// shall be released with releaseN1QLExpressions once not used.
 func CompileN1QLExpression(expressions []string) ([]interface{}, error) {
 	cExprs := make([]interface{}, 0, len(expressions))
 	for _, expr := range expressions {
 		cExpr, err := qparser.Parse(expr)
 		if err != nil {
 			logging.Errorf("CompileN1QLExpression() %v: %v\n", expr, err)
+			releaseN1QLExpressions(cExprs)
 			return nil, err
 		}
-		cExprs = append(cExprs, cExpr)
+		cExprs = append(cExprs, internN1QLExpression(cExpr))
 	}
 	return cExprs, nil
 }
 
+// isMetaOnlyExpression returns true if a compiled expression references
+// no document field and only depends on meta(), such expressions can be
+// evaluated for non-JSON documents.
+func isMetaOnlyExpression(cExpr interface{}) bool {
+	expr, ok := cExpr.(qexpr.Expression)
+	if !ok {
+		return false
+	}
+	switch expr.(type) {
+	case *qexpr.Meta:
+		return true
+	case *qexpr.Identifier, *qexpr.Self:
+		return false
+	}
+	for _, child := range expr.Children() {
+		if !isMetaOnlyExpression(child) {
+			return false
+		}
+	}
+	return true
+}
+
 var missing = qvalue.NewValue(string(collatejson.MissingLiteral))
 
 // N1QLTransform will use compiled list of expression from N1QL's DDL
@@ -33,14 +57,27 @@ func N1QLTransform(
 	docid, doc []byte, cExprs []interface{},
 	meta map[string]interface{}, encodeBuf []byte) ([]byte, error) {
 
-	arrValue := make([]interface{}, 0, len(cExprs))
 	context := qexpr.NewIndexContext()
-	skip := true
 	docval := qvalue.NewAnnotatedValue(doc)
 	docval.SetAttachment("meta", meta)
+	eval := func(expr qexpr.Expression) (qvalue.Value, qvalue.Values, error) {
+		return expr.EvaluateForIndex(docval, context)
+	}
+	return n1qlTransform(docid, cExprs, eval, encodeBuf)
+}
+
+// evaluates an expression for the document being transformed.
+type n1qlEvalFn func(expr qexpr.Expression) (qvalue.Value, qvalue.Values, error)
+
+func n1qlTransform(
+	docid []byte, cExprs []interface{}, eval n1qlEvalFn,
+	encodeBuf []byte) ([]byte, error) {
+
+	arrValue := make([]interface{}, 0, len(cExprs))
+	skip := true
 	for _, cExpr := range cExprs {
 		expr := cExpr.(qexpr.Expression)
-		scalar, vector, err := expr.EvaluateForIndex(docval, context)
+		scalar, vector, err := eval(expr)
 		isArray, _ := expr.IsArrayIndexKey()
 		if isArray == false {
 			key := scalar
@@ -5,6 +5,8 @@ import (
 	"compress/bzip2"
 	"encoding/json"
 	"github.com/couchbase/indexing/secondary/collatejson"
+	mcd "github.com/couchbase/indexing/secondary/dcp/transport"
+	mc "github.com/couchbase/indexing/secondary/dcp/transport/client"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -101,6 +103,110 @@ func TestN1QLTransform2000(t *testing.T) {
 	}
 }
 
+func TestEvalContext(t *testing.T) {
+	cExprs1, err := CompileN1QLExpression([]string{`lower(city)`, `age`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cExprs2, err := CompileN1QLExpression([]string{`LOWER( city )`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cExprs1[0] != cExprs2[0] {
+		t.Fatalf("expected identical expressions to be interned")
+	}
+
+	ctx := NewEvalContext()
+	for _, doc := range [][]byte{doc150, doc2000} {
+		ctx.Reset(&mc.DcpEvent{Key: []byte("docid"), Value: doc})
+		for _, cExprs := range [][]interface{}{cExprs1, cExprs2} {
+			ref, err := N1QLTransform([]byte("docid"), doc, cExprs, ctx.Meta(), buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			secKey, err := n1qlTransform([]byte("docid"), cExprs, ctx.newValue(), buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(secKey, ref) {
+				t.Fatalf("expected %v got %v",
+					decodeCollateJSON(ref), decodeCollateJSON(secKey))
+			}
+		}
+		if len(ctx.newDoc.cache) != 2 {
+			t.Fatalf("expected 2 cached expressions, got %v", len(ctx.newDoc.cache))
+		}
+	}
+}
+
+func TestMetaOnlyExpression(t *testing.T) {
+	metaOnly := []string{
+		"meta().id", "(meta().`id`)", "meta().expiration", "substr(meta().id, 0, 4)",
+	}
+	cExprs, err := CompileN1QLExpression(metaOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cExpr := range cExprs {
+		if !isMetaOnlyExpression(cExpr) {
+			t.Errorf("expected %v to be meta only", metaOnly[i])
+		}
+	}
+
+	fields := []string{"age", "meta().id || name", "self", "lower(`city`)"}
+	cExprs, err = CompileN1QLExpression(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cExpr := range cExprs {
+		if isMetaOnlyExpression(cExpr) {
+			t.Errorf("expected %v to reference document fields", fields[i])
+		}
+	}
+}
+
+func TestNonJSONDoc(t *testing.T) {
+	ctx := NewEvalContext()
+	docs := map[string]bool{
+		`{"age":10}`:     false,
+		`[1,2]`:          false,
+		"\x00\x01binary": true,
+		"plain text":     true,
+	}
+	for doc, nonJSON := range docs {
+		ctx.Reset(&mc.DcpEvent{Key: []byte("docid"), Value: []byte(doc)})
+		if ctx.newDoc.typed {
+			t.Errorf("expected %q to be typed on first use", doc)
+		}
+		if ctx.IsNonJSON() != nonJSON {
+			t.Errorf("expected non-JSON %v for %q", nonJSON, doc)
+		}
+	}
+
+	// datatype flagged by server
+	m := &mc.DcpEvent{Key: []byte("docid"), Value: []byte(`{"age":10}`)}
+	m.Datatype = mcd.DATATYPE_JSON
+	ctx.Reset(m)
+	if ctx.IsNonJSON() {
+		t.Errorf("expected JSON document")
+	}
+
+	cExprs, err := CompileN1QLExpression([]string{"meta().id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx.Reset(&mc.DcpEvent{Key: []byte("docid"), Value: []byte("blob")})
+	secKey, err := n1qlTransform([]byte("docid"), cExprs, ctx.newValue(), buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if secKey == nil {
+		t.Errorf("expected meta().id to be indexed for non-JSON document")
+	}
+	if ctx.Meta()["type"] != "base64" {
+		t.Errorf("expected base64 type, got %v", ctx.Meta()["type"])
+	}
+}
+
 func BenchmarkCompileN1QLExpression(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		CompileN1QLExpression([]string{`age`})
@@ -123,6 +229,18 @@ func BenchmarkN1QLTransform2000(b *testing.B) {
 	}
 }
 
+func BenchmarkEvalContext2000(b *testing.B) {
+	cExprs, _ := CompileN1QLExpression([]string{`age`})
+	ctx := NewEvalContext()
+	m := &mc.DcpEvent{Key: []byte("docid"), Value: doc2000}
+	for i := 0; i < b.N; i++ {
+		ctx.Reset(m)
+		for j := 0; j < 10; j++ { // ten indexes on the same expression
+			n1qlTransform([]byte("docid"), cExprs, ctx.newValue(), buf)
+		}
+	}
+}
+
 func encodeJSON(s string) []byte {
 	codec := collatejson.NewCodec(16)
 	out, _ := codec.Encode([]byte(s), make([]byte, 0, 10000))
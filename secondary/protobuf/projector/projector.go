@@ -781,6 +781,69 @@ func (req *ShutdownTopicRequest) Decode(data []byte) (err error) {
 	return proto.Unmarshal(data, req)
 }
 
+// *************************
+// EvaluateIndexRequest
+// *************************
+
+// NewEvaluateIndexRequest creates a EvaluateIndexRequest to evaluate
+// index definition `defn` against sample documents. Keys are checked
+// against the indexer's `maxSecKeySize` and `maxArrayKeySize`.
+func NewEvaluateIndexRequest(
+	defn *IndexDefn, docs []*Document,
+	maxSecKeySize, maxArrayKeySize uint32) *EvaluateIndexRequest {
+
+	return &EvaluateIndexRequest{
+		Definition:      defn,
+		Documents:       docs,
+		MaxSecKeySize:   proto.Uint32(maxSecKeySize),
+		MaxArrayKeySize: proto.Uint32(maxArrayKeySize),
+	}
+}
+
+// Name implement MessageMarshaller{} interface
+func (req *EvaluateIndexRequest) Name() string {
+	return "evaluateIndexRequest"
+}
+
+// ContentType implement MessageMarshaller{} interface
+func (req *EvaluateIndexRequest) ContentType() string {
+	return "application/protobuf"
+}
+
+// Encode implement MessageMarshaller{} interface
+func (req *EvaluateIndexRequest) Encode() (data []byte, err error) {
+	return proto.Marshal(req)
+}
+
+// Decode implement MessageMarshaller{} interface
+func (req *EvaluateIndexRequest) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, req)
+}
+
+// *************************
+// EvaluateIndexResponse
+// *************************
+
+// Name implement MessageMarshaller{} interface
+func (resp *EvaluateIndexResponse) Name() string {
+	return "evaluateIndexResponse"
+}
+
+// ContentType implement MessageMarshaller{} interface
+func (resp *EvaluateIndexResponse) ContentType() string {
+	return "application/protobuf"
+}
+
+// Encode implement MessageMarshaller{} interface
+func (resp *EvaluateIndexResponse) Encode() (data []byte, err error) {
+	return proto.Marshal(resp)
+}
+
+// Decode implement MessageMarshaller{} interface
+func (resp *EvaluateIndexResponse) Decode(data []byte) (err error) {
+	return proto.Unmarshal(data, resp)
+}
+
 //-- local functions
 
 // TODO: add other types of engines
@@ -793,6 +856,9 @@ func getEvaluators(instances []*Instance,
 		if val := instance.GetIndexInstance(); val != nil {
 			ie, err := NewIndexEvaluator(val, version)
 			if err != nil {
+				for _, engine := range engines {
+					engine.Close()
+				}
 				return nil, err
 			}
 			engines[uuid] = ie
@@ -572,6 +572,220 @@ func (m *Instances) GetInstances() []*Instance {
 	return nil
 }
 
+// Requested by indexer / admin to evaluate an index definition against
+// sample documents, without creating the index. Documents are either
+// supplied with the request or fetched from the bucket by docids.
+// Respond back with EvaluateIndexResponse.
+type EvaluateIndexRequest struct {
+	Definition       *IndexDefn  `protobuf:"bytes,1,req,name=definition" json:"definition,omitempty"`
+	Documents        []*Document `protobuf:"bytes,2,rep,name=documents" json:"documents,omitempty"`
+	Pool             *string     `protobuf:"bytes,3,opt,name=pool" json:"pool,omitempty"`
+	Docids           []string    `protobuf:"bytes,4,rep,name=docids" json:"docids,omitempty"`
+	MaxSecKeySize    *uint32     `protobuf:"varint,5,opt,name=maxSecKeySize" json:"maxSecKeySize,omitempty"`
+	MaxArrayKeySize  *uint32     `protobuf:"varint,6,opt,name=maxArrayKeySize" json:"maxArrayKeySize,omitempty"`
+	XXX_unrecognized []byte      `json:"-"`
+}
+
+func (m *EvaluateIndexRequest) Reset()         { *m = EvaluateIndexRequest{} }
+func (m *EvaluateIndexRequest) String() string { return proto.CompactTextString(m) }
+func (*EvaluateIndexRequest) ProtoMessage()    {}
+
+func (m *EvaluateIndexRequest) GetDefinition() *IndexDefn {
+	if m != nil {
+		return m.Definition
+	}
+	return nil
+}
+
+func (m *EvaluateIndexRequest) GetDocuments() []*Document {
+	if m != nil {
+		return m.Documents
+	}
+	return nil
+}
+
+func (m *EvaluateIndexRequest) GetPool() string {
+	if m != nil && m.Pool != nil {
+		return *m.Pool
+	}
+	return ""
+}
+
+func (m *EvaluateIndexRequest) GetDocids() []string {
+	if m != nil {
+		return m.Docids
+	}
+	return nil
+}
+
+func (m *EvaluateIndexRequest) GetMaxSecKeySize() uint32 {
+	if m != nil && m.MaxSecKeySize != nil {
+		return *m.MaxSecKeySize
+	}
+	return 0
+}
+
+func (m *EvaluateIndexRequest) GetMaxArrayKeySize() uint32 {
+	if m != nil && m.MaxArrayKeySize != nil {
+		return *m.MaxArrayKeySize
+	}
+	return 0
+}
+
+type EvaluateIndexResponse struct {
+	Documents        []*EvaluatedDocument `protobuf:"bytes,1,rep,name=documents" json:"documents,omitempty"`
+	NumMissing       *uint64              `protobuf:"varint,2,opt,name=numMissing" json:"numMissing,omitempty"`
+	NumWhereFalse    *uint64              `protobuf:"varint,3,opt,name=numWhereFalse" json:"numWhereFalse,omitempty"`
+	NumErrors        *uint64              `protobuf:"varint,4,opt,name=numErrors" json:"numErrors,omitempty"`
+	NumTooLarge      *uint64              `protobuf:"varint,5,opt,name=numTooLarge" json:"numTooLarge,omitempty"`
+	Err              *Error               `protobuf:"bytes,6,opt,name=err" json:"err,omitempty"`
+	XXX_unrecognized []byte               `json:"-"`
+}
+
+func (m *EvaluateIndexResponse) Reset()         { *m = EvaluateIndexResponse{} }
+func (m *EvaluateIndexResponse) String() string { return proto.CompactTextString(m) }
+func (*EvaluateIndexResponse) ProtoMessage()    {}
+
+func (m *EvaluateIndexResponse) GetDocuments() []*EvaluatedDocument {
+	if m != nil {
+		return m.Documents
+	}
+	return nil
+}
+
+func (m *EvaluateIndexResponse) GetNumMissing() uint64 {
+	if m != nil && m.NumMissing != nil {
+		return *m.NumMissing
+	}
+	return 0
+}
+
+func (m *EvaluateIndexResponse) GetNumWhereFalse() uint64 {
+	if m != nil && m.NumWhereFalse != nil {
+		return *m.NumWhereFalse
+	}
+	return 0
+}
+
+func (m *EvaluateIndexResponse) GetNumErrors() uint64 {
+	if m != nil && m.NumErrors != nil {
+		return *m.NumErrors
+	}
+	return 0
+}
+
+func (m *EvaluateIndexResponse) GetNumTooLarge() uint64 {
+	if m != nil && m.NumTooLarge != nil {
+		return *m.NumTooLarge
+	}
+	return 0
+}
+
+func (m *EvaluateIndexResponse) GetErr() *Error {
+	if m != nil {
+		return m.Err
+	}
+	return nil
+}
+
+// Document to be evaluated.
+type Document struct {
+	Docid            []byte `protobuf:"bytes,1,req,name=docid" json:"docid,omitempty"`
+	Value            []byte `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Document) Reset()         { *m = Document{} }
+func (m *Document) String() string { return proto.CompactTextString(m) }
+func (*Document) ProtoMessage()    {}
+
+func (m *Document) GetDocid() []byte {
+	if m != nil {
+		return m.Docid
+	}
+	return nil
+}
+
+func (m *Document) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+// Result of evaluating an index definition for a document.
+type EvaluatedDocument struct {
+	Docid            []byte  `protobuf:"bytes,1,req,name=docid" json:"docid,omitempty"`
+	EncodedKey       []byte  `protobuf:"bytes,2,opt,name=encodedKey" json:"encodedKey,omitempty"`
+	DecodedKey       *string `protobuf:"bytes,3,opt,name=decodedKey" json:"decodedKey,omitempty"`
+	PartnKey         []byte  `protobuf:"bytes,4,opt,name=partnKey" json:"partnKey,omitempty"`
+	Missing          *bool   `protobuf:"varint,5,opt,name=missing" json:"missing,omitempty"`
+	WhereFalse       *bool   `protobuf:"varint,6,opt,name=whereFalse" json:"whereFalse,omitempty"`
+	TooLarge         *bool   `protobuf:"varint,7,opt,name=tooLarge" json:"tooLarge,omitempty"`
+	Error            *string `protobuf:"bytes,8,opt,name=error" json:"error,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *EvaluatedDocument) Reset()         { *m = EvaluatedDocument{} }
+func (m *EvaluatedDocument) String() string { return proto.CompactTextString(m) }
+func (*EvaluatedDocument) ProtoMessage()    {}
+
+func (m *EvaluatedDocument) GetDocid() []byte {
+	if m != nil {
+		return m.Docid
+	}
+	return nil
+}
+
+func (m *EvaluatedDocument) GetEncodedKey() []byte {
+	if m != nil {
+		return m.EncodedKey
+	}
+	return nil
+}
+
+func (m *EvaluatedDocument) GetDecodedKey() string {
+	if m != nil && m.DecodedKey != nil {
+		return *m.DecodedKey
+	}
+	return ""
+}
+
+func (m *EvaluatedDocument) GetPartnKey() []byte {
+	if m != nil {
+		return m.PartnKey
+	}
+	return nil
+}
+
+func (m *EvaluatedDocument) GetMissing() bool {
+	if m != nil && m.Missing != nil {
+		return *m.Missing
+	}
+	return false
+}
+
+func (m *EvaluatedDocument) GetWhereFalse() bool {
+	if m != nil && m.WhereFalse != nil {
+		return *m.WhereFalse
+	}
+	return false
+}
+
+func (m *EvaluatedDocument) GetTooLarge() bool {
+	if m != nil && m.TooLarge != nil {
+		return *m.TooLarge
+	}
+	return false
+}
+
+func (m *EvaluatedDocument) GetError() string {
+	if m != nil && m.Error != nil {
+		return *m.Error
+	}
+	return ""
+}
+
 func init() {
 	proto.RegisterEnum("protobuf.FeedVersion", FeedVersion_name, FeedVersion_value)
 }
@@ -204,6 +204,16 @@ func (b *cbqClient) DropIndex(defnID uint64) error {
 	return err
 }
 
+// PauseIndex implement BridgeAccessor{} interface.
+func (b *cbqClient) PauseIndex(defnID uint64) error {
+	return ErrorNotImplemented
+}
+
+// ResumeIndex implement BridgeAccessor{} interface.
+func (b *cbqClient) ResumeIndex(defnID uint64) error {
+	return ErrorNotImplemented
+}
+
 // GetScanports implement BridgeAccessor{} interface.
 func (b *cbqClient) GetScanports() (queryports []string) {
 	return []string{b.queryport}
@@ -103,6 +103,14 @@ type BridgeAccessor interface {
 	//   from deferred list.
 	DropIndex(defnID uint64) error
 
+	// PauseIndex to suspend maintenance of index specified by `defnID`,
+	// index can still be scanned at its last snapshot.
+	PauseIndex(defnID uint64) error
+
+	// ResumeIndex to restart maintenance of a paused index, index
+	// catches up with the mutations it missed while paused.
+	ResumeIndex(defnID uint64) error
+
 	// GetScanports shall return list of queryports for all indexer in
 	// the cluster.
 	GetScanports() (queryports []string)
@@ -346,6 +354,30 @@ func (c *GsiClient) DropIndex(defnID uint64) error {
 	return err
 }
 
+// PauseIndex implements BridgeAccessor{} interface.
+func (c *GsiClient) PauseIndex(defnID uint64) error {
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+	begin := time.Now()
+	err := c.bridge.PauseIndex(defnID)
+	fmsg := "PauseIndex %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, defnID, time.Since(begin), err)
+	return err
+}
+
+// ResumeIndex implements BridgeAccessor{} interface.
+func (c *GsiClient) ResumeIndex(defnID uint64) error {
+	if c.bridge == nil {
+		return ErrorClientUninitialized
+	}
+	begin := time.Now()
+	err := c.bridge.ResumeIndex(defnID)
+	fmsg := "ResumeIndex %v - elapsed(%v), err(%v)"
+	logging.Infof(fmsg, defnID, time.Since(begin), err)
+	return err
+}
+
 // LookupStatistics for a single secondary-key.
 func (c *GsiClient) LookupStatistics(
 	defnID uint64, requestId string, value common.SecondaryKey) (common.IndexStatistics, error) {
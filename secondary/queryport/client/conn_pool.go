@@ -59,7 +59,7 @@ var ConnPoolCallback func(host string, source string, start time.Time, err error
 
 func (cp *connectionPool) defaultMkConn(host string) (*connection, error) {
 	logging.Infof("%v open new connection ...\n", cp.logPrefix)
-	conn, err := net.Dial("tcp", host)
+	conn, err := transport.Dial(host)
 	if err != nil {
 		return nil, err
 	}
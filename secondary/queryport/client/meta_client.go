@@ -185,6 +185,16 @@ func (b *metadataClient) DropIndex(defnID uint64) error {
 	return err
 }
 
+// PauseIndex implements BridgeAccessor{} interface.
+func (b *metadataClient) PauseIndex(defnID uint64) error {
+	return b.mdClient.PauseIndex(common.IndexDefnId(defnID))
+}
+
+// ResumeIndex implements BridgeAccessor{} interface.
+func (b *metadataClient) ResumeIndex(defnID uint64) error {
+	return b.mdClient.ResumeIndex(common.IndexDefnId(defnID))
+}
+
 // GetScanports implements BridgeAccessor{} interface.
 func (b *metadataClient) GetScanports() (queryports []string) {
 	currmeta := (*indexTopology)(atomic.LoadPointer(&b.indexers))
@@ -118,6 +118,10 @@ func NewGSIIndexer(
 	if err != nil {
 		return nil, errors.NewError(err, "GSI config instantiation failed")
 	}
+	if err := c.SetupTLS(conf); err != nil {
+		l.Errorf("%v TLS setup failed: %v", gsi.logPrefix, err)
+		return nil, errors.NewError(err, "GSI TLS setup failed")
+	}
 	qconf := conf.SectionConfig("queryport.client.", true /*trim*/)
 	client, err := getSingletonClient(clusterURL, qconf)
 	if err != nil {
@@ -64,7 +64,7 @@ func NewServer(
 		logPrefix:      fmt.Sprintf("[Queryport %q]", laddr),
 		nConnections:   platform.NewAlignedInt64(0),
 	}
-	if s.lis, err = net.Listen("tcp", laddr); err != nil {
+	if s.lis, err = transport.Listen(laddr); err != nil {
 		logging.Errorf("%v failed starting %v !!\n", s.logPrefix, err)
 		return nil, err
 	}
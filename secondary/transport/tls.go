@@ -0,0 +1,256 @@
+// TLS for connections between nodes.
+//
+// A TLSContext carries the certificate and key presented to peers and the
+// CA bundle used to verify them. Files are checked for changes, at most once
+// every reload interval, whenever a connection is accepted or dialed, so
+// that certificates can be rotated without restarting the process. If new
+// files fail to load, previously loaded ones are used until the next check.
+//
+// With client authentication enabled, servers require and verify client
+// certificates and clients present the same certificate they serve with.
+//
+// A nil TLSContext is valid and falls back to plain TCP.
+
+package transport
+
+import "crypto/tls"
+import "crypto/x509"
+import "errors"
+import "io/ioutil"
+import "net"
+import "os"
+import "sync"
+import "time"
+
+import "github.com/couchbase/indexing/secondary/logging"
+
+// ErrorTLSCertificate when certificate or key is not configured.
+var ErrorTLSCertificate = errors.New("transport.tlsCertificate")
+
+// ErrorTLSCABundle when CA bundle does not carry any certificate.
+var ErrorTLSCABundle = errors.New("transport.tlsCABundle")
+
+// TLSContext to secure connections, refer to the package documentation.
+type TLSContext struct {
+	mu         sync.Mutex
+	certFile   string
+	keyFile    string
+	caFile     string // empty string to verify with system roots
+	clientAuth bool
+	interval   time.Duration // to check files for changes
+
+	cert    tls.Certificate
+	roots   *x509.CertPool
+	modtime time.Time // of the files last loaded
+	checked time.Time
+}
+
+// NewTLSContext loads certificate, key and CA bundle and return a context to
+// be used for listening and dialing.
+func NewTLSContext(
+	certFile, keyFile, caFile string,
+	clientAuth bool, interval time.Duration) (*TLSContext, error) {
+
+	if certFile == "" || keyFile == "" {
+		return nil, ErrorTLSCertificate
+	}
+	ctx := &TLSContext{
+		certFile:   certFile,
+		keyFile:    keyFile,
+		caFile:     caFile,
+		clientAuth: clientAuth,
+		interval:   interval,
+	}
+	if err := ctx.Reload(); err != nil {
+		return nil, err
+	}
+	logging.Infof("TLS certificate %q, CA %q, client-auth %v\n",
+		certFile, caFile, clientAuth)
+	return ctx, nil
+}
+
+// Reload certificate, key and CA bundle from disk, on error previously
+// loaded ones are retained.
+func (ctx *TLSContext) Reload() error {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	modtime, err := ctx.filesModtime()
+	if err != nil {
+		return err
+	}
+	return ctx.load(modtime)
+}
+
+// ServerConfig for accepting a new connection.
+func (ctx *TLSContext) ServerConfig() *tls.Config {
+	cert, roots := ctx.current()
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if ctx.clientAuth {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = roots
+	}
+	return config
+}
+
+// ClientConfig for dialing `serverName`, which is verified against the
+// server's certificate.
+func (ctx *TLSContext) ClientConfig(serverName string) *tls.Config {
+	cert, roots := ctx.current()
+	config := &tls.Config{
+		ServerName: serverName,
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+	if ctx.clientAuth {
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
+// Listen on `laddr`, accepted connections are secured if ctx is not nil.
+func (ctx *TLSContext) Listen(laddr string) (net.Listener, error) {
+	lis, err := net.Listen("tcp", laddr)
+	if err != nil || ctx == nil {
+		return lis, err
+	}
+	return &tlsListener{Listener: lis, ctx: ctx}, nil
+}
+
+// Dial `raddr`, connection is secured if ctx is not nil.
+func (ctx *TLSContext) Dial(raddr string) (net.Conn, error) {
+	return ctx.DialTimeout(raddr, 0)
+}
+
+// DialTimeout `raddr`, timeout applies to both connecting and TLS handshake.
+func (ctx *TLSContext) DialTimeout(
+	raddr string, timeout time.Duration) (net.Conn, error) {
+
+	if ctx == nil {
+		return net.DialTimeout("tcp", raddr, timeout)
+	}
+	host, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", raddr, ctx.ClientConfig(host))
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// current certificate and CA pool, reloaded if files have changed.
+func (ctx *TLSContext) current() (tls.Certificate, *x509.CertPool) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if time.Since(ctx.checked) >= ctx.interval {
+		ctx.checked = time.Now()
+		modtime, err := ctx.filesModtime()
+		if err != nil {
+			logging.Errorf("TLS checking certificate files: %v\n", err)
+		} else if !modtime.Equal(ctx.modtime) {
+			if err := ctx.load(modtime); err != nil {
+				logging.Errorf("TLS reloading certificate files: %v\n", err)
+			} else {
+				logging.Infof("TLS reloaded certificate %q\n", ctx.certFile)
+			}
+		}
+	}
+	return ctx.cert, ctx.roots
+}
+
+// load files, caller is expected to hold the lock.
+func (ctx *TLSContext) load(modtime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(ctx.certFile, ctx.keyFile)
+	if err != nil {
+		return err
+	}
+	var roots *x509.CertPool
+	if ctx.caFile != "" {
+		pem, err := ioutil.ReadFile(ctx.caFile)
+		if err != nil {
+			return err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return ErrorTLSCABundle
+		}
+	}
+	ctx.cert, ctx.roots, ctx.modtime = cert, roots, modtime
+	return nil
+}
+
+// latest modification time among the files.
+func (ctx *TLSContext) filesModtime() (time.Time, error) {
+	var modtime time.Time
+	for _, file := range []string{ctx.certFile, ctx.keyFile, ctx.caFile} {
+		if file == "" {
+			continue
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return modtime, err
+		}
+		if fi.ModTime().After(modtime) {
+			modtime = fi.ModTime()
+		}
+	}
+	return modtime, nil
+}
+
+type tlsListener struct {
+	net.Listener
+	ctx *TLSContext
+}
+
+// Accept a connection, TLS handshake happens on first read or write so
+// that a slow peer does not hold up the listener.
+func (lis *tlsListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, lis.ctx.ServerConfig()), nil
+}
+
+// process wide context used by dataport, queryport and adminport.
+var defaultTLS struct {
+	mu  sync.RWMutex
+	ctx *TLSContext
+}
+
+// SetTLSContext for connections made by this process hereafter, nil
+// disables TLS.
+func SetTLSContext(ctx *TLSContext) {
+	defaultTLS.mu.Lock()
+	defer defaultTLS.mu.Unlock()
+	defaultTLS.ctx = ctx
+}
+
+// GetTLSContext for this process, nil if TLS is disabled.
+func GetTLSContext() *TLSContext {
+	defaultTLS.mu.RLock()
+	defer defaultTLS.mu.RUnlock()
+	return defaultTLS.ctx
+}
+
+// Listen on `laddr` using process wide TLS context.
+func Listen(laddr string) (net.Listener, error) {
+	return GetTLSContext().Listen(laddr)
+}
+
+// Dial `raddr` using process wide TLS context.
+func Dial(raddr string) (net.Conn, error) {
+	return GetTLSContext().Dial(raddr)
+}
+
+// DialTimeout `raddr` using process wide TLS context.
+func DialTimeout(raddr string, timeout time.Duration) (net.Conn, error) {
+	return GetTLSContext().DialTimeout(raddr, timeout)
+}
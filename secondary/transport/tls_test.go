@@ -0,0 +1,212 @@
+package transport
+
+import "crypto/ecdsa"
+import "crypto/elliptic"
+import "crypto/rand"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/pem"
+import "io/ioutil"
+import "math/big"
+import "net"
+import "os"
+import "path/filepath"
+import "testing"
+import "time"
+
+func TestTLSMutualAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, cakey := makeTestCA(t, dir, "ca")
+	makeTestCert(t, dir, "node", 1, ca, cakey)
+	server := newTestTLSContext(t, dir, "node", "ca")
+	client := newTestTLSContext(t, dir, "node", "ca")
+
+	lis, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go echoPackets(lis)
+
+	conn, err := client.Dial(lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt := NewTransportPacket(1024, TransportFlag(0).SetGzip())
+	if err := pkt.Send(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	} else if payload, err := pkt.Receive(conn); err != nil {
+		t.Fatal(err)
+	} else if string(payload.([]byte)) != "hello" {
+		t.Fatalf("unexpected payload %q", payload)
+	}
+	conn.Close()
+
+	// client with a certificate from another CA is rejected.
+	other, otherkey := makeTestCA(t, dir, "otherca")
+	makeTestCert(t, dir, "othernode", 2, other, otherkey)
+	stranger := newTestTLSContext(t, dir, "othernode", "ca")
+	if conn, err = stranger.Dial(lis.Addr().String()); err == nil {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("expected handshake failure with untrusted client")
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, cakey := makeTestCA(t, dir, "ca")
+	makeTestCert(t, dir, "node", 1, ca, cakey)
+	server := newTestTLSContext(t, dir, "node", "ca")
+	client := newTestTLSContext(t, dir, "node", "ca")
+
+	lis, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go echoPackets(lis)
+
+	serial := func() int64 {
+		conn, err := client.Dial(lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		state := conn.(*tls.Conn).ConnectionState()
+		return state.PeerCertificates[0].SerialNumber.Int64()
+	}
+	if n := serial(); n != 1 {
+		t.Fatalf("unexpected serial %v", n)
+	}
+
+	// rotate certificate in place, new connections pick it up.
+	makeTestCert(t, dir, "node", 2, ca, cakey)
+	future := time.Now().Add(time.Minute)
+	for _, name := range []string{"node.pem", "node.key"} {
+		os.Chtimes(filepath.Join(dir, name), future, future)
+	}
+	if n := serial(); n != 2 {
+		t.Fatalf("expected reloaded certificate, got serial %v", n)
+	}
+
+	// broken files are ignored and the last certificate is retained.
+	ioutil.WriteFile(filepath.Join(dir, "node.key"), []byte("junk"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(filepath.Join(dir, "node.key"), future, future)
+	if n := serial(); n != 2 {
+		t.Fatalf("expected last certificate, got serial %v", n)
+	}
+}
+
+func newTestTLSContext(t *testing.T, dir, node, ca string) *TLSContext {
+	ctx, err := NewTLSContext(
+		filepath.Join(dir, node+".pem"), filepath.Join(dir, node+".key"),
+		filepath.Join(dir, ca+".pem"), true /*clientAuth*/, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
+
+func echoPackets(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			pkt := NewTransportPacket(1024, 0)
+			for {
+				payload, err := pkt.Receive(conn)
+				if err != nil {
+					return
+				} else if err = pkt.Send(conn, payload); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func makeTestCA(
+	t *testing.T, dir, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return writeTestCert(t, dir, name, tmpl, nil, nil)
+}
+
+func makeTestCert(
+	t *testing.T, dir, name string, serial int64,
+	ca *x509.Certificate, cakey *ecdsa.PrivateKey) {
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth,
+		},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	writeTestCert(t, dir, name, tmpl, ca, cakey)
+}
+
+func writeTestCert(
+	t *testing.T, dir, name string, tmpl, parent *x509.Certificate,
+	parentkey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil { // self signed
+		parent, parentkey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, parent, &key.PublicKey, parentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certpem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keypem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certpem, 0600); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), keypem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
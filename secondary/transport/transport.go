@@ -8,8 +8,13 @@
 
 package transport
 
+import "bytes"
+import "compress/gzip"
 import "errors"
+import "io"
 import "net"
+import "sync/atomic"
+import "time"
 import "github.com/couchbase/indexing/secondary/logging"
 
 // error codes
@@ -26,6 +31,9 @@ var ErrorEncoderUnknown = errors.New("transport.encoderUnknown")
 // ErrorDecoderUnknown for unknown decoder.
 var ErrorDecoderUnknown = errors.New("transport.decoderUnknown")
 
+// ErrorCompressionUnknown for unsupported compression.
+var ErrorCompressionUnknown = errors.New("transport.compressionUnknown")
+
 // packet field offset and size in bytes
 const (
 	pktLenOffset   int = 0
@@ -43,13 +51,31 @@ type transporter interface { // facilitates unit testing
 	RemoteAddr() net.Addr
 }
 
+// PacketStats account for payloads sent or received by a TransportPacket,
+// durations are in nanoseconds.
+type PacketStats struct {
+	Packets      int64 // number of payloads
+	Compressed   int64 // number of compressed payloads
+	RawBytes     int64 // payload bytes before compression
+	WireBytes    int64 // payload bytes on the wire
+	CompressTime int64 // time spent compressing or de-compressing
+	WriteTime    int64 // time spent writing payloads to the connection
+}
+
 // TransportPacket to send and receive mutation packets between router
 // and downstream client.
 type TransportPacket struct {
+	stats    PacketStats // keep it first for 64-bit alignment of atomics
 	flags    TransportFlag
 	buf      []byte
 	encoders map[byte]Encoder
 	decoders map[byte]Decoder
+	// compression, separate buffers so that a received payload can be
+	// sent again on the same packet
+	zbuf bytes.Buffer // compressed output
+	dbuf bytes.Buffer // de-compressed output
+	zw   *gzip.Writer
+	zr   *gzip.Reader
 }
 
 // Encoder callback
@@ -90,20 +116,51 @@ func (pkt *TransportPacket) SetDecoder(typ byte, callb Decoder) *TransportPacket
 	return pkt
 }
 
+// SetFlags for subsequent packets sent, typically used to switch
+// compression on a live connection.
+func (pkt *TransportPacket) SetFlags(flags TransportFlag) *TransportPacket {
+	pkt.flags = flags
+	return pkt
+}
+
+// Flags used by the last packet sent or received.
+func (pkt *TransportPacket) Flags() TransportFlag {
+	return pkt.flags
+}
+
+// Stats return a copy of packet statistics, safe to be called
+// concurrently with Send() and Receive().
+func (pkt *TransportPacket) Stats() PacketStats {
+	return PacketStats{
+		Packets:      atomic.LoadInt64(&pkt.stats.Packets),
+		Compressed:   atomic.LoadInt64(&pkt.stats.Compressed),
+		RawBytes:     atomic.LoadInt64(&pkt.stats.RawBytes),
+		WireBytes:    atomic.LoadInt64(&pkt.stats.WireBytes),
+		CompressTime: atomic.LoadInt64(&pkt.stats.CompressTime),
+		WriteTime:    atomic.LoadInt64(&pkt.stats.WriteTime),
+	}
+}
+
 // Send payload to the other end using sufficient encoding and compression.
 func (pkt *TransportPacket) Send(conn transporter, payload interface{}) (err error) {
-	var data []byte
+	var data, small []byte
 
 	// encode
 	if data, err = pkt.encode(payload); err != nil {
 		return
 	}
 	// compress
-	if data, err = pkt.compress(data); err != nil {
+	start := time.Now()
+	if small, err = pkt.compress(data); err != nil {
 		return
 	}
+	compressTime := time.Since(start)
 
-	err = Send(conn, pkt.buf, pkt.flags, data)
+	start = time.Now()
+	if err = Send(conn, pkt.buf, pkt.flags, small); err != nil {
+		return
+	}
+	pkt.account(len(data), len(small), compressTime, time.Since(start))
 	return
 }
 
@@ -129,9 +186,11 @@ func (pkt *TransportPacket) Receive(conn transporter) (payload interface{}, err
 	logging.Tracef("read %v bytes on connection %v<-%v", len(data), laddr, raddr)
 
 	// de-compression
+	start, small := time.Now(), len(data)
 	if data, err = pkt.decompress(data); err != nil {
 		return
 	}
+	pkt.account(len(data), small, time.Since(start), 0)
 	// decoding
 	if payload, err = pkt.decode(data); err != nil {
 		return
@@ -143,9 +202,9 @@ func (pkt *TransportPacket) Receive(conn transporter) (payload interface{}, err
 // valid type then return `payload` as `data`.
 func (pkt *TransportPacket) encode(payload interface{}) (data []byte, err error) {
 	typ := pkt.flags.GetEncoding()
-	if callb, ok := pkt.encoders[typ]; ok {
+	if callb, ok := pkt.encoders[typ]; ok && callb != nil {
 		return callb(payload)
-	} else if callb == nil {
+	} else if ok {
 		return payload.([]byte), nil
 	}
 	return nil, ErrorEncoderUnknown
@@ -155,32 +214,87 @@ func (pkt *TransportPacket) encode(payload interface{}) (data []byte, err error)
 // a valid type then return `data` as `payload`.
 func (pkt *TransportPacket) decode(data []byte) (payload interface{}, err error) {
 	typ := pkt.flags.GetEncoding()
-	if callb, ok := pkt.decoders[typ]; ok {
+	if callb, ok := pkt.decoders[typ]; ok && callb != nil {
 		return callb(data)
-	} else if callb == nil {
+	} else if ok {
 		return data, nil
 	}
 	return nil, ErrorDecoderUnknown
 }
 
-// compress array of bytes.
+// compress array of bytes, returned slice is valid until the next call.
 func (pkt *TransportPacket) compress(big []byte) (small []byte, err error) {
 	switch pkt.flags.GetCompression() {
 	case CompressionNone:
 		small = big
+
+	case CompressionGzip:
+		pkt.zbuf.Reset()
+		if pkt.zw == nil {
+			pkt.zw, _ = gzip.NewWriterLevel(&pkt.zbuf, gzip.BestSpeed)
+		} else {
+			pkt.zw.Reset(&pkt.zbuf)
+		}
+		if _, err = pkt.zw.Write(big); err != nil {
+			return nil, err
+		} else if err = pkt.zw.Close(); err != nil {
+			return nil, err
+		}
+		small = pkt.zbuf.Bytes()
+
+	default:
+		err = ErrorCompressionUnknown
 	}
 	return
 }
 
-// decompress array of bytes.
+// decompress array of bytes, returned slice is valid until the next call.
 func (pkt *TransportPacket) decompress(small []byte) (big []byte, err error) {
 	switch pkt.flags.GetCompression() {
 	case CompressionNone:
 		big = small
+
+	case CompressionGzip:
+		r := bytes.NewReader(small)
+		if pkt.zr == nil {
+			pkt.zr, err = gzip.NewReader(r)
+		} else {
+			err = pkt.zr.Reset(r)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// de-compressed payload is bounded by maxlen, like the ones
+		// that are not compressed.
+		pkt.dbuf.Reset()
+		maxlen := int64(len(pkt.buf))
+		n, err := pkt.dbuf.ReadFrom(io.LimitReader(pkt.zr, maxlen+1))
+		if err != nil {
+			return nil, err
+		} else if n > maxlen {
+			logging.Errorf("de-compressed payload exceeds %v bytes\n", maxlen)
+			return nil, ErrorPacketOverflow
+		}
+		big = pkt.dbuf.Bytes()
+
+	default:
+		err = ErrorCompressionUnknown
 	}
 	return
 }
 
+// account a payload of `raw` bytes carried as `wire` bytes.
+func (pkt *TransportPacket) account(raw, wire int, ctm, wtm time.Duration) {
+	atomic.AddInt64(&pkt.stats.Packets, 1)
+	if pkt.flags.GetCompression() != CompressionNone {
+		atomic.AddInt64(&pkt.stats.Compressed, 1)
+		atomic.AddInt64(&pkt.stats.CompressTime, int64(ctm))
+	}
+	atomic.AddInt64(&pkt.stats.RawBytes, int64(raw))
+	atomic.AddInt64(&pkt.stats.WireBytes, int64(wire))
+	atomic.AddInt64(&pkt.stats.WriteTime, int64(wtm))
+}
+
 // read len(buf) bytes from `conn`.
 func fullRead(conn transporter, buf []byte) error {
 	size, start := 0, 0
@@ -0,0 +1,30 @@
+package transport
+
+import "bytes"
+import "net"
+import "testing"
+
+func TestDecompressOverflow(t *testing.T) {
+	flags := TransportFlag(0).SetGzip()
+	payload := bytes.Repeat([]byte("a"), 4096)
+
+	for _, maxlen := range []int{4096, 4095} {
+		client, server := net.Pipe()
+		go func() {
+			NewTransportPacket(8192, flags).Send(client, payload)
+			client.Close()
+		}()
+
+		data, err := NewTransportPacket(maxlen, 0).Receive(server)
+		if maxlen >= len(payload) {
+			if err != nil {
+				t.Errorf("maxlen %v: unexpected error %v", maxlen, err)
+			} else if !bytes.Equal(data.([]byte), payload) {
+				t.Errorf("maxlen %v: unexpected payload", maxlen)
+			}
+		} else if err != ErrorPacketOverflow {
+			t.Errorf("maxlen %v: expected overflow, got %v", maxlen, err)
+		}
+		server.Close()
+	}
+}